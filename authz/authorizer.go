@@ -0,0 +1,265 @@
+package authz
+
+import (
+	"github.com/ruckuus/dojo1/models"
+	"strings"
+)
+
+// Error is a failed authorization check
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+func (e Error) Public() string {
+	s := strings.Replace(string(e), "authz: ", "", 1)
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+const (
+	// ErrNotFound is returned when the user has no role at all
+	// on the resource, so we don't reveal that it exists.
+	ErrNotFound Error = "authz: not found"
+	// ErrForbidden is returned when the user has a role on the
+	// resource, but not one that allows the action.
+	ErrForbidden Error = "authz: you do not have permission to do that"
+
+	ErrRoleInvalid Error = "authz: role is not valid"
+	ErrRoleTooHigh Error = "authz: you can only grant roles below your own"
+	ErrHasAccess   Error = "authz: this user already has access"
+	ErrOwnerLeave  Error = "authz: the owner can't leave the organization"
+
+	// ErrNoOrganization is returned for users without any
+	// organization, which can't happen to those who signed up
+	ErrNoOrganization Error = "authz: user is not a member of any organization"
+)
+
+// Authorizer answers authorization questions for users, based
+// on organization memberships and the grants stored in the
+// database. It also manages both, since who may change them
+// follows from the same rules.
+type Authorizer struct {
+	grants models.GrantService
+	orgs   models.OrganizationService
+}
+
+func NewAuthorizer(grants models.GrantService, orgs models.OrganizationService) *Authorizer {
+	return &Authorizer{
+		grants: grants,
+		orgs:   orgs,
+	}
+}
+
+// Role returns the role user has on res, or "" if none
+func (a *Authorizer) Role(user *models.User, res Resource) (Role, error) {
+	if user == nil {
+		return "", nil
+	}
+
+	if res.OrganizationID != 0 {
+		m, err := a.orgs.Membership(res.OrganizationID, user.ID)
+		switch err {
+		case nil:
+			return Role(m.Role), nil
+		case models.ErrNotFound:
+		default:
+			return "", err
+		}
+	} else if user.ID == res.OwnerID {
+		return RoleOwner, nil
+	}
+
+	grant, err := a.grants.ByUserResource(user.ID, res.Type, res.ID)
+	switch err {
+	case nil:
+		return Role(grant.Role), nil
+	case models.ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// Can returns nil if user may perform action on res. Otherwise
+// it returns ErrNotFound, ErrForbidden or a lookup error.
+func (a *Authorizer) Can(user *models.User, action Action, res Resource) error {
+	role, err := a.Role(user, res)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return ErrNotFound
+	}
+	if !Allows(res.Type, role, action) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// CanGive checks that user may give others role on res, e.g.
+// before inviting someone to take it.
+func (a *Authorizer) CanGive(user *models.User, res Resource, role Role) error {
+	if err := a.Can(user, ActionShare, res); err != nil {
+		return err
+	}
+	if !role.Valid() || role == RoleOwner {
+		return ErrRoleInvalid
+	}
+
+	userRole, err := a.Role(user, res)
+	if err != nil {
+		return err
+	}
+	if rank[role] >= rank[userRole] {
+		return ErrRoleTooHigh
+	}
+	return nil
+}
+
+// Grant gives grantee role on res, on behalf of granter
+func (a *Authorizer) Grant(granter *models.User, res Resource, grantee *models.User, role Role) (*models.Grant, error) {
+	if err := a.CanGive(granter, res, role); err != nil {
+		return nil, err
+	}
+
+	existing, err := a.Role(grantee, res)
+	if err != nil {
+		return nil, err
+	}
+	if existing != "" {
+		return nil, ErrHasAccess
+	}
+
+	grant := models.Grant{
+		UserID:       grantee.ID,
+		ResourceType: res.Type,
+		ResourceID:   res.ID,
+		Role:         string(role),
+	}
+	if err := a.grants.Create(&grant); err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+// Revoke removes a grant on res, on behalf of user. Users can
+// always give up their own access, otherwise the same rule as
+// for granting applies.
+func (a *Authorizer) Revoke(user *models.User, res Resource, grantID uint) error {
+	grant, err := a.grants.ByID(grantID)
+	if err != nil {
+		return err
+	}
+	if grant.ResourceType != res.Type || grant.ResourceID != res.ID {
+		return ErrNotFound
+	}
+
+	if grant.UserID != user.ID {
+		if err := a.CanGive(user, res, Role(grant.Role)); err != nil {
+			return err
+		}
+	}
+
+	return a.grants.Delete(grant.ID)
+}
+
+// Grants returns everyone granted access to res
+func (a *Authorizer) Grants(res Resource) ([]models.Grant, error) {
+	return a.grants.ByResource(res.Type, res.ID)
+}
+
+// Shared returns the IDs of the resources of resourceType that
+// user was granted access to, e.g. to list them next to the
+// ones of their organization.
+func (a *Authorizer) Shared(user *models.User, resourceType string) ([]uint, error) {
+	grants, err := a.grants.ByUserType(user.ID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0, len(grants))
+	for _, g := range grants {
+		ids = append(ids, g.ResourceID)
+	}
+	return ids, nil
+}
+
+// Forget removes every grant on res, for when it is deleted
+func (a *Authorizer) Forget(res Resource) error {
+	return a.grants.DeleteByResource(res.Type, res.ID)
+}
+
+// Organizations returns the organizations user is a member of,
+// their personal organization first.
+func (a *Authorizer) Organizations(user *models.User) ([]models.Organization, error) {
+	orgs, err := a.orgs.ByUserID(user.ID)
+	if err == nil && len(orgs) == 0 {
+		err = ErrNoOrganization
+	}
+	return orgs, err
+}
+
+// FoundPersonal creates the personal organization of user when
+// they sign up. There is only one per user, creating another
+// fails.
+func (a *Authorizer) FoundPersonal(user *models.User) (*models.Organization, error) {
+	org := models.Organization{
+		Name:     user.Name,
+		Personal: true,
+		OwnerID:  user.ID,
+	}
+	if org.Name == "" {
+		org.Name = user.Email
+	}
+	if err := a.Found(user, &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// Found creates org with user as its owner
+func (a *Authorizer) Found(user *models.User, org *models.Organization) error {
+	if err := a.orgs.Create(org); err != nil {
+		return err
+	}
+	return a.orgs.AddMember(&models.Membership{
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+		Role:           string(RoleOwner),
+	})
+}
+
+// AddMember makes member part of org with role, on behalf of user
+func (a *Authorizer) AddMember(user *models.User, org *models.Organization, member *models.User, role Role) error {
+	if err := a.CanGive(user, Organization(org), role); err != nil {
+		return err
+	}
+	return a.orgs.AddMember(&models.Membership{
+		OrganizationID: org.ID,
+		UserID:         member.ID,
+		Role:           string(role),
+	})
+}
+
+// RemoveMember removes a membership of org, on behalf of user.
+// Members can always leave, except for the owner.
+func (a *Authorizer) RemoveMember(user *models.User, org *models.Organization, membershipID uint) error {
+	m, err := a.orgs.MembershipByID(membershipID)
+	if err != nil {
+		return err
+	}
+	if m.OrganizationID != org.ID {
+		return ErrNotFound
+	}
+	if Role(m.Role) == RoleOwner {
+		return ErrOwnerLeave
+	}
+
+	if m.UserID != user.ID {
+		if err := a.CanGive(user, Organization(org), Role(m.Role)); err != nil {
+			return err
+		}
+	}
+
+	return a.orgs.RemoveMember(m.ID)
+}
@@ -0,0 +1,133 @@
+package authz
+
+import (
+	"errors"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/models/modelstest"
+	"testing"
+)
+
+func testUser(id uint) *models.User {
+	u := &models.User{}
+	u.ID = id
+	return u
+}
+
+func TestRole(t *testing.T) {
+	// User 1 is a co-owner of organization 10 and owns property
+	// 7 from before organizations. User 2 is a viewer of the
+	// organization and a property manager of property 5 in it.
+	// User 3 rents property 5 and user 4 property 7.
+	orgs := &modelstest.Organizations{Memberships: []models.Membership{
+		{OrganizationID: 10, UserID: 1, Role: string(RoleCoOwner)},
+		{OrganizationID: 10, UserID: 2, Role: string(RoleViewer)},
+	}}
+	grants := &modelstest.Grants{Grants: []models.Grant{
+		{UserID: 2, ResourceType: TypeProperty, ResourceID: 5, Role: string(RolePropertyManager)},
+		{UserID: 3, ResourceType: TypeProperty, ResourceID: 5, Role: string(RoleTenant)},
+		{UserID: 4, ResourceType: TypeProperty, ResourceID: 7, Role: string(RoleTenant)},
+		{UserID: 1, ResourceType: TypeProperty, ResourceID: 7, Role: string(RoleViewer)},
+	}}
+	a := NewAuthorizer(grants, orgs)
+
+	inOrg := Resource{Type: TypeProperty, ID: 5, OrganizationID: 10, OwnerID: 3}
+	personal := Resource{Type: TypeProperty, ID: 7, OwnerID: 1}
+	org := Resource{Type: TypeOrganization, ID: 10, OrganizationID: 10}
+
+	tests := []struct {
+		name string
+		user *models.User
+		res  Resource
+		want Role
+	}{
+		{"membership", testUser(1), inOrg, RoleCoOwner},
+		{"membership overrides grant", testUser(2), inOrg, RoleViewer},
+		{"grant without membership", testUser(3), inOrg, RoleTenant},
+		{"owner check skipped for org resources", testUser(3), Resource{Type: TypeProperty, ID: 6, OrganizationID: 10, OwnerID: 3}, ""},
+		{"owner", testUser(1), personal, RoleOwner},
+		{"owner overrides grant", testUser(1), personal, RoleOwner},
+		{"grant on personal resource", testUser(4), personal, RoleTenant},
+		{"no access", testUser(5), personal, ""},
+		{"member of the organization", testUser(2), org, RoleViewer},
+		{"not a member of the organization", testUser(3), org, ""},
+		{"signed out", nil, inOrg, ""},
+	}
+	for _, tc := range tests {
+		got, err := a.Role(tc.user, tc.res)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: Role() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRoleLookupErrors(t *testing.T) {
+	boom := errors.New("boom")
+	res := Resource{Type: TypeProperty, ID: 5, OrganizationID: 10}
+
+	a := NewAuthorizer(&modelstest.Grants{}, &modelstest.Organizations{Err: boom})
+	if _, err := a.Role(testUser(1), res); err != boom {
+		t.Errorf("membership lookup failed: err = %v, want %v", err, boom)
+	}
+
+	a = NewAuthorizer(&modelstest.Grants{Err: boom}, &modelstest.Organizations{})
+	if _, err := a.Role(testUser(1), res); err != boom {
+		t.Errorf("grant lookup failed: err = %v, want %v", err, boom)
+	}
+}
+
+func TestCan(t *testing.T) {
+	orgs := &modelstest.Organizations{Memberships: []models.Membership{
+		{OrganizationID: 10, UserID: 1, Role: string(RolePropertyManager)},
+	}}
+	a := NewAuthorizer(&modelstest.Grants{}, orgs)
+	res := Resource{Type: TypeProperty, ID: 5, OrganizationID: 10}
+
+	tests := []struct {
+		user   uint
+		action Action
+		want   error
+	}{
+		{1, ActionEdit, nil},
+		{1, ActionShare, ErrForbidden},
+		{2, ActionView, ErrNotFound},
+	}
+	for _, tc := range tests {
+		if err := a.Can(testUser(tc.user), tc.action, res); err != tc.want {
+			t.Errorf("user %d %s: Can() = %v, want %v", tc.user, tc.action, err, tc.want)
+		}
+	}
+}
+
+func TestCanGive(t *testing.T) {
+	orgs := &modelstest.Organizations{Memberships: []models.Membership{
+		{OrganizationID: 10, UserID: 1, Role: string(RoleOwner)},
+		{OrganizationID: 10, UserID: 2, Role: string(RoleCoOwner)},
+		{OrganizationID: 10, UserID: 3, Role: string(RolePropertyManager)},
+	}}
+	a := NewAuthorizer(&modelstest.Grants{}, orgs)
+	res := Resource{Type: TypeProperty, ID: 5, OrganizationID: 10}
+
+	tests := []struct {
+		user uint
+		role Role
+		want error
+	}{
+		{1, RoleCoOwner, nil},
+		{1, RoleTenant, nil},
+		{1, RoleOwner, ErrRoleInvalid},
+		{1, "landlord", ErrRoleInvalid},
+		{2, RolePropertyManager, nil},
+		{2, RoleCoOwner, ErrRoleTooHigh},
+		{3, RoleViewer, ErrForbidden},
+		{4, RoleViewer, ErrNotFound},
+	}
+	for _, tc := range tests {
+		if err := a.CanGive(testUser(tc.user), res, tc.role); err != tc.want {
+			t.Errorf("user %d giving %q: CanGive() = %v, want %v", tc.user, tc.role, err, tc.want)
+		}
+	}
+}
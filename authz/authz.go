@@ -0,0 +1,140 @@
+// Package authz decides who may do what with the resources
+// users own. Controllers ask an Authorizer instead of comparing
+// user IDs themselves, so the rules live in one place.
+package authz
+
+import (
+	"github.com/ruckuus/dojo1/models"
+)
+
+// Role is what a user is to a resource
+type Role string
+
+const (
+	// RoleOwner is the user who created the resource. It is
+	// never granted, it comes from the resource itself.
+	RoleOwner           Role = "owner"
+	RoleCoOwner         Role = "co-owner"
+	RolePropertyManager Role = "property manager"
+	RoleTenant          Role = "tenant"
+	RoleViewer          Role = "viewer"
+)
+
+// Roles lists the roles that can be granted, most powerful first
+var Roles = []Role{
+	RoleCoOwner,
+	RolePropertyManager,
+	RoleTenant,
+	RoleViewer,
+}
+
+// MemberRoles lists the roles members of an organization can be
+// given, most powerful first. Tenants are never members, they
+// are granted access to the property they rent.
+var MemberRoles = []Role{
+	RoleCoOwner,
+	RolePropertyManager,
+	RoleViewer,
+}
+
+// rank orders roles, a user can only grant roles below their own
+var rank = map[Role]int{
+	RoleOwner:           5,
+	RoleCoOwner:         4,
+	RolePropertyManager: 3,
+	RoleTenant:          2,
+	RoleViewer:          1,
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	_, ok := rank[r]
+	return ok
+}
+
+// Action is something a user wants to do with a resource
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionView   Action = "view"
+	ActionEdit   Action = "edit"
+	ActionDelete Action = "delete"
+	// ActionShare is granting and revoking access for others
+	ActionShare Action = "share"
+)
+
+// Resource types
+const (
+	TypeOrganization = "organization"
+	TypeProperty     = "property"
+	TypeGallery      = "gallery"
+)
+
+// policies lists, per resource type and action, the roles
+// allowed to perform it. Anything not listed is denied.
+var policies = map[string]map[Action][]Role{
+	TypeOrganization: {
+		ActionView:   {RoleOwner, RoleCoOwner, RolePropertyManager, RoleViewer},
+		ActionEdit:   {RoleOwner, RoleCoOwner},
+		ActionDelete: {RoleOwner},
+		ActionShare:  {RoleOwner, RoleCoOwner},
+	},
+	TypeProperty: {
+		ActionCreate: {RoleOwner, RoleCoOwner, RolePropertyManager},
+		ActionView:   {RoleOwner, RoleCoOwner, RolePropertyManager, RoleTenant, RoleViewer},
+		ActionEdit:   {RoleOwner, RoleCoOwner, RolePropertyManager},
+		ActionDelete: {RoleOwner},
+		ActionShare:  {RoleOwner, RoleCoOwner},
+	},
+	TypeGallery: {
+		ActionCreate: {RoleOwner, RoleCoOwner, RolePropertyManager},
+		ActionView:   {RoleOwner, RoleCoOwner, RolePropertyManager, RoleTenant, RoleViewer},
+		ActionEdit:   {RoleOwner, RoleCoOwner},
+		ActionDelete: {RoleOwner},
+		ActionShare:  {RoleOwner, RoleCoOwner},
+	},
+}
+
+// Resource identifies what is being accessed. Members of the
+// owning organization have their member role on it, others
+// need a grant. OwnerID is the user who created the resource,
+// it only matters for resources from before organizations.
+type Resource struct {
+	Type           string
+	ID             uint
+	OrganizationID uint
+	OwnerID        uint
+}
+
+// Organization returns the Resource for org
+func Organization(org *models.Organization) Resource {
+	return Resource{Type: TypeOrganization, ID: org.ID, OrganizationID: org.ID}
+}
+
+// Property returns the Resource for p
+func Property(p *models.Property) Resource {
+	return Resource{Type: TypeProperty, ID: p.ID, OrganizationID: p.OrganizationID, OwnerID: p.UserID}
+}
+
+// Gallery returns the Resource for g
+func Gallery(g *models.Gallery) Resource {
+	return Resource{Type: TypeGallery, ID: g.ID, OrganizationID: g.OrganizationID, OwnerID: g.UserID}
+}
+
+// In returns a Resource of resourceType that is yet to be
+// created in org, to check ActionCreate.
+func In(resourceType string, org *models.Organization) Resource {
+	return Resource{Type: resourceType, OrganizationID: org.ID}
+}
+
+// Allows reports whether role may perform action on resources
+// of type resourceType.
+func Allows(resourceType string, role Role, action Action) bool {
+	for _, r := range policies[resourceType][action] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package authz
+
+import "testing"
+
+func TestAllows(t *testing.T) {
+	const (
+		c = ActionCreate
+		v = ActionView
+		e = ActionEdit
+		d = ActionDelete
+		s = ActionShare
+	)
+	actions := []Action{c, v, e, d, s}
+	roles := []Role{RoleOwner, RoleCoOwner, RolePropertyManager, RoleTenant, RoleViewer, "", "landlord"}
+
+	// allowed lists, per resource type and role, every action
+	// the role may take. The rest must be denied.
+	allowed := map[string]map[Role][]Action{
+		TypeOrganization: {
+			RoleOwner:           {v, e, d, s},
+			RoleCoOwner:         {v, e, s},
+			RolePropertyManager: {v},
+			RoleViewer:          {v},
+		},
+		TypeProperty: {
+			RoleOwner:           {c, v, e, d, s},
+			RoleCoOwner:         {c, v, e, s},
+			RolePropertyManager: {c, v, e},
+			RoleTenant:          {v},
+			RoleViewer:          {v},
+		},
+		TypeGallery: {
+			RoleOwner:           {c, v, e, d, s},
+			RoleCoOwner:         {c, v, e, s},
+			RolePropertyManager: {c, v},
+			RoleTenant:          {v},
+			RoleViewer:          {v},
+		},
+		"lease": {},
+	}
+
+	for resourceType, byRole := range allowed {
+		for _, role := range roles {
+			for _, action := range actions {
+				want := false
+				for _, a := range byRole[role] {
+					want = want || a == action
+				}
+				if got := Allows(resourceType, role, action); got != want {
+					t.Errorf("Allows(%q, %q, %q) = %t, want %t", resourceType, role, action, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRoleValid(t *testing.T) {
+	for _, r := range append(Roles, RoleOwner) {
+		if !r.Valid() {
+			t.Errorf("%q is not valid", r)
+		}
+	}
+	for _, r := range []Role{"", "admin", "Owner"} {
+		if r.Valid() {
+			t.Errorf("%q is valid", r)
+		}
+	}
+}
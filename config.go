@@ -3,26 +3,106 @@ package main
 import (
 	json2 "encoding/json"
 	"fmt"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/oidc"
+	"golang.org/x/crypto/bcrypt"
 	"os"
 )
 
 type Config struct {
 	Port           int            `json:"port"`
 	Env            string         `json:"env"`
+	BaseURL        string         `json:"base_url"`
+	SenderName     string         `json:"sender_name"`
+	SenderEmail    string         `json:"sender_email"`
+	InboundDomain  string         `json:"inbound_domain"`
 	HMACKey        string         `json:"hmac_key"`
 	Pepper         string         `json:"pepper"`
 	Database       PostgresConfig `json:"database"`
 	Mailgun        MailgunConfig  `json:"mailgun"`
+	MailerType     string         `json:"mailer_type"`
+	SMTP           SMTPConfig     `json:"smtp"`
+	OutboxPath     string         `json:"outbox_path"`
 	RootPath       string         `json:"root_path"`
 	AWSConfig      AWSConfig      `json:"aws_config"`
 	StorageType    string         `json:"storage_type"`
 	ImageCDNDomain string         `json:"image_cdn_domain"`
+	OIDCProviders  []oidc.Config  `json:"oidc_providers"`
+	Password       PasswordConfig `json:"password"`
+
+	// TrustedProxy is the address of the reverse proxy in front
+	// of the app, X-Real-IP is only believed when it comes from
+	// there. Leave it empty when clients connect directly.
+	TrustedProxy string `json:"trusted_proxy"`
+}
+
+// PasswordConfig is the password policy, zero values get the
+// defaults of models.NewPasswordPolicy. BreachedList is the path
+// to a local breached password list, see models.BreachedList.
+type PasswordConfig struct {
+	MinLength    int    `json:"min_length"`
+	MaxLength    int    `json:"max_length"`
+	BcryptCost   int    `json:"bcrypt_cost"`
+	BreachedList string `json:"breached_list"`
+}
+
+// Policy builds the password policy users are held to
+func (c PasswordConfig) Policy() (*models.PasswordPolicy, error) {
+	// bcrypt quietly uses its default for lower costs and fails
+	// every hash for higher ones
+	if c.BcryptCost != 0 && (c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost) {
+		return nil, fmt.Errorf("bcrypt_cost must be between %d and %d, not %d", bcrypt.MinCost, bcrypt.MaxCost, c.BcryptCost)
+	}
+
+	rules := []models.PasswordRule{models.NoPersonalInfo}
+	if c.BreachedList != "" {
+		list, err := models.OpenBreachedList(c.BreachedList)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, list)
+	}
+	return models.NewPasswordPolicy(c.MinLength, c.MaxLength, c.BcryptCost, rules...), nil
 }
 
+// MailgunConfig is the Mailgun account emails are sent with.
+// WebhookSigningKey checks the requests Mailgun posts to us.
 type MailgunConfig struct {
-	APIKey       string `json:"api_key"`
-	PublicAPIKey string `json:"public_api_key"`
-	Domain       string `json:"domain"`
+	APIKey            string `json:"api_key"`
+	PublicAPIKey      string `json:"public_api_key"`
+	Domain            string `json:"domain"`
+	WebhookSigningKey string `json:"webhook_signing_key"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	StartTLS bool   `json:"starttls"`
+}
+
+// Mailer returns how emails are sent: "mailgun", the default
+// for configs predating the setting, "smtp" or "outbox", which
+// saves them to OutboxPath for development.
+func (c Config) Mailer() (email.Mailer, error) {
+	switch c.MailerType {
+	case "", "mailgun":
+		return email.NewMailgun(c.Mailgun.Domain, c.Mailgun.APIKey), nil
+	case "smtp":
+		return email.NewSMTP(email.SMTPConfig{
+			Host:     c.SMTP.Host,
+			Port:     c.SMTP.Port,
+			Username: c.SMTP.Username,
+			Password: c.SMTP.Password,
+			StartTLS: c.SMTP.StartTLS,
+		}), nil
+	case "outbox":
+		return email.NewOutbox(c.OutboxPath), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer type %q", c.MailerType)
+	}
 }
 
 func (c Config) IsProd() bool {
@@ -31,14 +111,20 @@ func (c Config) IsProd() bool {
 
 func DefaultConfig() Config {
 	return Config{
-		Port:        3000,
-		Env:         "dev",
-		HMACKey:     "SuperSecret2019!$",
-		Pepper:      "HALUSINOGEN2019$$",
-		Database:    DefaultPostgresConfig(),
-		RootPath:    "./",
-		AWSConfig:   DefaultAWSConfig(),
-		StorageType: "filesystem",
+		Port:          3000,
+		Env:           "dev",
+		BaseURL:       "http://localhost:3000",
+		SenderName:    "Tataruma",
+		SenderEmail:   "hello@tataruma.com",
+		InboundDomain: "localhost",
+		HMACKey:       "SuperSecret2019!$",
+		Pepper:        "HALUSINOGEN2019$$",
+		Database:      DefaultPostgresConfig(),
+		RootPath:      "./",
+		AWSConfig:     DefaultAWSConfig(),
+		StorageType:   "filesystem",
+		MailerType:    "outbox",
+		OutboxPath:    "./outbox",
 	}
 }
 
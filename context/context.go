@@ -5,7 +5,16 @@ import (
 	"github.com/ruckuus/dojo1/models"
 )
 
-const userKey = "user"
+const (
+	userKey    = "user"
+	sessionKey = "session"
+	tokenKey   = "api_token"
+	orgKey     = "organization"
+	orgsKey    = "organizations"
+	leaseKey   = "lease"
+	adminKey   = "impersonator"
+	unreadKey  = "unread"
+)
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
 	return context.WithValue(ctx, userKey, user)
@@ -19,3 +28,110 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithSession stores the session the current user signed in with
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session of the current request, or nil
+func Session(ctx context.Context) *models.Session {
+	if tmp := ctx.Value(sessionKey); tmp != nil {
+		if session, ok := tmp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// WithAPIToken stores the API token the request was authenticated with
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// APIToken returns the API token of the current request, or nil
+// if the request came from a browser session.
+func APIToken(ctx context.Context) *models.APIToken {
+	if tmp := ctx.Value(tokenKey); tmp != nil {
+		if token, ok := tmp.(*models.APIToken); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// WithOrganization stores the organization the user works in
+func WithOrganization(ctx context.Context, org *models.Organization) context.Context {
+	return context.WithValue(ctx, orgKey, org)
+}
+
+// Organization returns the organization the user works in, or nil
+func Organization(ctx context.Context) *models.Organization {
+	if tmp := ctx.Value(orgKey); tmp != nil {
+		if org, ok := tmp.(*models.Organization); ok {
+			return org
+		}
+	}
+	return nil
+}
+
+// WithOrganizations stores the organizations the user is a member of
+func WithOrganizations(ctx context.Context, orgs []models.Organization) context.Context {
+	return context.WithValue(ctx, orgsKey, orgs)
+}
+
+// Organizations returns the organizations the user is a member of
+func Organizations(ctx context.Context) []models.Organization {
+	if tmp := ctx.Value(orgsKey); tmp != nil {
+		if orgs, ok := tmp.([]models.Organization); ok {
+			return orgs
+		}
+	}
+	return nil
+}
+
+// WithLease stores the lease of the tenant using the portal
+func WithLease(ctx context.Context, lease *models.Lease) context.Context {
+	return context.WithValue(ctx, leaseKey, lease)
+}
+
+// Lease returns the lease of the tenant using the portal, or nil
+func Lease(ctx context.Context) *models.Lease {
+	if tmp := ctx.Value(leaseKey); tmp != nil {
+		if lease, ok := tmp.(*models.Lease); ok {
+			return lease
+		}
+	}
+	return nil
+}
+
+// WithImpersonator stores the operator acting as the current user
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, adminKey, admin)
+}
+
+// Impersonator returns the operator acting as the current user,
+// or nil when the user signed in themselves.
+func Impersonator(ctx context.Context) *models.User {
+	if tmp := ctx.Value(adminKey); tmp != nil {
+		if admin, ok := tmp.(*models.User); ok {
+			return admin
+		}
+	}
+	return nil
+}
+
+// WithUnread stores how many notifications the user hasn't read
+func WithUnread(ctx context.Context, count int) context.Context {
+	return context.WithValue(ctx, unreadKey, count)
+}
+
+// Unread returns how many notifications the user hasn't read
+func Unread(ctx context.Context) int {
+	if tmp := ctx.Value(unreadKey); tmp != nil {
+		if count, ok := tmp.(int); ok {
+			return count
+		}
+	}
+	return 0
+}
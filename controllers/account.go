@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/middleware"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChangePasswordForm is used to change the password from the profile
+type ChangePasswordForm struct {
+	Current  string `schema:"current_password"`
+	Password string `schema:"password"`
+}
+
+// ChangeEmailForm is used to change the email address, the
+// password is asked again since the address can reset it.
+type ChangeEmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+// DeleteAccountForm confirms the deletion with the password
+type DeleteAccountForm struct {
+	Password string `schema:"password"`
+}
+
+// ChangePassword sets a new password and signs out every other device
+//
+// POST /profile/password
+func (u *Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var form ChangePasswordForm
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.us.ChangePassword(user, form.Current, form.Password); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	// Whoever knew the old password should not stay signed in
+	if sessions, err := u.ss.ByUserID(user.ID); err == nil {
+		current := context.Session(r.Context())
+		for _, s := range sessions {
+			if current == nil || s.ID != current.ID {
+				u.ss.Delete(s.ID)
+			}
+		}
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your password has been changed, other devices have been signed out.",
+	})
+}
+
+// ChangeEmail sends a verification link to the new address and
+// lets the current one know. The address changes once the link
+// is followed, see Verify.
+//
+// POST /profile/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var form ChangeEmailForm
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.confirmPassword(r, user, form.Password); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	newEmail := strings.TrimSpace(form.Email)
+	err := u.services.Transaction(func(tx *models.Services) error {
+		token, err := tx.User.InitiateEmailChange(user, form.Email)
+		if err != nil {
+			return err
+		}
+		emailer := queued(u.emailer, tx).In(user.Locale)
+		if err := emailer.Verify(user.Name, newEmail, token); err != nil {
+			return err
+		}
+		return emailer.EmailChanging(user.Name, user.Email, newEmail)
+	})
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We sent a link to " + newEmail + ", your email address changes once you follow it.",
+	})
+}
+
+// DeleteAccount deletes the account of the user. It can be
+// restored during the cooling-off period, after which the files
+// of the user are purged.
+//
+// POST /profile/delete
+func (u *Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var form DeleteAccountForm
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.confirmPassword(r, user, form.Password); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	err := u.services.Transaction(func(tx *models.Services) error {
+		if err := tx.User.Delete(user.ID); err != nil {
+			return err
+		}
+		if err := tx.Session.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+		purgeOn := time.Now().Add(models.AccountCoolingOff)
+		return queued(u.emailer, tx).In(user.Locale).AccountDeleted(user.Name, user.Email, purgeOn)
+	})
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     middleware.SessionCookie,
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+
+	views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your account has been deleted. We sent you a link to restore it in case you change your mind.",
+	})
+}
+
+// confirmPassword checks the password of a signed in user
+// before a sensitive change. It is throttled like the login
+// form, so a session can't be used to guess the password.
+func (u *Users) confirmPassword(r *http.Request, user *models.User, password string) error {
+	ip := clientIP(r)
+	if err := u.lts.Check(user.Email, ip); err != nil {
+		return err
+	}
+
+	_, err := u.us.As(actor(r)).Authenticate(user.Email, password)
+	if err == models.ErrCredentialsInvalid {
+		u.loginFailed(user.Email, ip)
+		return models.ErrPasswordInvalid
+	}
+	if err != nil {
+		return err
+	}
+	u.lts.Success(user.Email)
+	return nil
+}
+
+// ShowRestore renders the form to restore a deleted account
+//
+// GET /restore
+func (u *Users) ShowRestore(w http.ResponseWriter, r *http.Request) {
+	var form LoginForm
+	parseURLParams(r, &form)
+	u.RestoreView.Render(w, r, &form)
+}
+
+// Restore brings back a deleted account and signs the user in
+//
+// POST /restore
+func (u *Users) Restore(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form LoginForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.RestoreView.Render(w, r, vd)
+		return
+	}
+
+	ip := clientIP(r)
+	if err := u.lts.Check(form.Email, ip); err != nil {
+		vd.SetAlert(err)
+		u.RestoreView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.Restore(form.Email, form.Password)
+	if err != nil {
+		if err == models.ErrCredentialsInvalid {
+			u.loginFailed(form.Email, ip)
+		}
+		vd.SetAlert(err)
+		u.RestoreView.Render(w, r, vd)
+		return
+	}
+
+	u.completeLogin(w, r, user)
+}
@@ -0,0 +1,421 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// searchLimit is how many users a search lists at most
+const searchLimit = 50
+
+// outboxLimit is how many emails the outbox page lists at most
+const outboxLimit = 100
+
+const (
+	errImpersonateAdmin publicError = "Other admins can't be impersonated."
+	errDisableSelf      publicError = "You can't disable your own account."
+)
+
+// Admin is the operator console. Every handler runs behind
+// middleware.RequireAdmin, except StopImpersonating which is
+// used while acting as a regular user.
+type Admin struct {
+	IndexView  *views.View
+	UserView   *views.View
+	OutboxView *views.View
+	users      *Users
+	us         models.UserService
+	ss         models.SessionService
+	ims        models.ImageService
+	as         models.AuditService
+	obs        models.OutboxService
+	sps        models.SuppressionService
+}
+
+// AdminSearchForm is used to look users up by name or email
+type AdminSearchForm struct {
+	Query string `schema:"q"`
+}
+
+// adminIndexData is what the console home page renders
+type adminIndexData struct {
+	Query string
+	Users []models.User
+}
+
+// AdminOutboxForm filters the outbox page by status
+type AdminOutboxForm struct {
+	Status string `schema:"status"`
+}
+
+// adminOutboxData is what the outbox page renders
+type adminOutboxData struct {
+	Status       string
+	Statuses     []string
+	Messages     []models.OutboxMessage
+	Suppressions []models.Suppression
+}
+
+// adminUserData is what the console renders about a user
+type adminUserData struct {
+	*models.User
+	Sessions   []models.Session
+	Images     int
+	ImageBytes int64
+	Events     []models.AuditEvent
+}
+
+// Storage is the space taken by the images of the user
+func (d *adminUserData) Storage() string {
+	const unit = 1024
+	if d.ImageBytes < unit {
+		return fmt.Sprintf("%d B", d.ImageBytes)
+	}
+	size, exp := float64(d.ImageBytes)/unit, 0
+	for size >= unit && exp < 3 {
+		size /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", size, "KMGT"[exp])
+}
+
+// NewAdmin uses users to sign operators back in and to send
+// verification emails.
+func NewAdmin(services *models.Services, users *Users) *Admin {
+	return &Admin{
+		IndexView:  views.NewView("bootstrap", "admin/index"),
+		UserView:   views.NewView("bootstrap", "admin/user"),
+		OutboxView: views.NewView("bootstrap", "admin/outbox"),
+		users:      users,
+		us:         services.User,
+		ss:         services.Session,
+		ims:        services.Image,
+		as:         services.Audit,
+		obs:        services.Outbox,
+		sps:        services.Suppression,
+	}
+}
+
+// Index searches users by name or email
+//
+// GET /admin
+func (a *Admin) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	var form AdminSearchForm
+	parseURLParams(r, &form)
+	data := adminIndexData{Query: form.Query}
+	vd.Yield = &data
+
+	users, err := a.us.Search(form.Query, searchLimit)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	data.Users = users
+
+	a.IndexView.Render(w, r, vd)
+}
+
+// userByID looks up the user in the URL
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.us.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// ShowUser renders a user with their sessions, storage usage
+// and recent security events
+//
+// GET /admin/users/:id
+func (a *Admin) ShowUser(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	data := adminUserData{User: user}
+	vd.Yield = &data
+
+	data.Sessions, err = a.ss.ByUserID(user.ID)
+	if err == nil {
+		data.Images, data.ImageBytes, err = a.ims.UsageByUserID(user.ID)
+	}
+	if err == nil {
+		data.Events, err = a.as.ByTarget(models.AuditUser, user.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	a.UserView.Render(w, r, vd)
+}
+
+// Impersonate signs the operator in as the user, to see what
+// they see. The session of the operator is replaced by a short
+// one, see StopImpersonating.
+//
+// POST /admin/users/:id/impersonate
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if user.Admin {
+		redirectError(w, r, showURL, errImpersonateAdmin)
+		return
+	}
+
+	admin := context.User(r.Context())
+	session := models.Session{
+		UserID:         user.ID,
+		ImpersonatorID: admin.ID,
+		UserAgent:      r.UserAgent(),
+		IP:             clientIP(r),
+		ExpiresAt:      time.Now().Add(models.ImpersonationDuration),
+	}
+	if err := a.ss.Create(&session); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+	if err := a.as.Record(actor(r), models.AuditImpersonationStarted, models.AuditUser, user.ID); err != nil {
+		a.ss.Delete(session.ID)
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	if current := context.Session(r.Context()); current != nil {
+		a.ss.Delete(current.ID)
+	}
+	setSessionCookie(w, &session)
+
+	views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: "You are now acting as " + user.Name + ".",
+	})
+}
+
+// StopImpersonating signs the operator back in as themselves
+//
+// POST /admin/impersonation/stop
+func (a *Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	admin := context.Impersonator(r.Context())
+	session := context.Session(r.Context())
+	if admin == nil || session == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	a.ss.Delete(session.ID)
+	a.as.Record(models.Actor{UserID: admin.ID, IP: clientIP(r)},
+		models.AuditImpersonationFinished, models.AuditUser, session.UserID)
+
+	if err := a.users.signIn(w, r, admin); err != nil {
+		redirectError(w, r, "/login", err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", session.UserID), http.StatusFound)
+}
+
+// ForcePasswordReset makes the user choose a new password, e.g.
+// when their account may be compromised. Every device is
+// signed out.
+//
+// POST /admin/users/:id/reset
+func (a *Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	err = a.users.services.Transaction(func(tx *models.Services) error {
+		token, err := tx.User.As(actor(r)).ForcePasswordReset(user)
+		if err != nil {
+			return err
+		}
+		if err := tx.Session.DeleteByUserID(user.ID); err != nil {
+			return err
+		}
+		return queued(a.users.emailer, tx).In(user.Locale).ResetPw(user.Email, token)
+	})
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The password has been reset, we sent " + user.Email + " a link to choose a new one.",
+	})
+}
+
+// Disable keeps the user from signing in and signs out every device
+//
+// POST /admin/users/:id/disable
+func (a *Admin) Disable(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if user.ID == context.User(r.Context()).ID {
+		redirectError(w, r, showURL, errDisableSelf)
+		return
+	}
+
+	err = a.us.As(actor(r)).Disable(user)
+	if err == nil {
+		err = a.ss.DeleteByUserID(user.ID)
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Account disabled.",
+	})
+}
+
+// Enable lets a disabled user sign in again
+//
+// POST /admin/users/:id/enable
+func (a *Admin) Enable(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if err := a.us.As(actor(r)).Enable(user); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Account enabled.",
+	})
+}
+
+// ResendVerification emails the user a fresh verification link
+//
+// POST /admin/users/:id/verify/resend
+func (a *Admin) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	if err := a.users.sendVerification(user); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We sent " + user.Email + " a new verification link.",
+	})
+}
+
+// Outbox lists the latest emails and whether they were sent
+//
+// GET /admin/outbox?status=
+func (a *Admin) Outbox(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	var form AdminOutboxForm
+	parseURLParams(r, &form)
+	data := adminOutboxData{
+		Status:   form.Status,
+		Statuses: []string{models.OutboxQueued, models.OutboxSent, models.OutboxDead, models.OutboxSuppressed},
+	}
+	vd.Yield = &data
+
+	var err error
+	data.Messages, err = a.obs.Recent(form.Status, outboxLimit)
+	if err == nil {
+		data.Suppressions, err = a.sps.Recent(outboxLimit)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	a.OutboxView.Render(w, r, vd)
+}
+
+// RetryEmail queues a dead email again
+//
+// POST /admin/outbox/:id/retry
+func (a *Admin) RetryEmail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	err = a.obs.Retry(uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	default:
+		redirectError(w, r, "/admin/outbox", err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/admin/outbox", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The email has been queued again.",
+	})
+}
+
+// Unsuppress lets emails be sent to a suppressed address again,
+// e.g. once its owner fixed their mailbox
+//
+// POST /admin/suppressions/:id/delete
+func (a *Admin) Unsuppress(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Suppression not found", http.StatusNotFound)
+		return
+	}
+
+	if err := a.sps.Delete(uint(id)); err != nil {
+		redirectError(w, r, "/admin/outbox", err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/admin/outbox", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Emails will be sent to the address again.",
+	})
+}
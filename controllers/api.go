@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/openapi"
+	"github.com/ruckuus/dojo1/views"
+	"github.com/ruckuus/dojo1/webhook"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultPageSize and maxPageSize bound the limit parameter
+	// of the API lists
+	defaultPageSize = 25
+	maxPageSize     = 100
+
+	// maxAPIBody is the largest JSON body the API reads
+	maxAPIBody = 1 << 20
+)
+
+const (
+	errBadCursor publicError = "Cursor is not valid"
+	errBadLimit  publicError = "Limit must be a number between 1 and 100"
+	errBadBody   publicError = "Request body is not valid JSON"
+)
+
+// API serves /api/v1, the JSON API scripts use instead of the
+// HTML pages. It goes through the same services, so the same
+// validation and authorization apply.
+type API struct {
+	ps    models.PropertyService
+	gs    models.GalleryService
+	is    models.ImageService
+	az    *authz.Authorizer
+	hooks *webhook.Dispatcher
+
+	// spec is the OpenAPI document of the API, see apiSpec
+	spec *openapi.Document
+}
+
+// apiList is the body of the responses listing things. A page
+// ends the list when NextCursor is empty, else it is passed as
+// the cursor parameter to get the next page.
+type apiList struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// apiPage is the page of a list asked for
+type apiPage struct {
+	After uint
+	Limit int
+}
+
+func NewAPI(services *models.Services, az *authz.Authorizer, hooks *webhook.Dispatcher, baseURL string) *API {
+	return &API{
+		ps:    services.Property,
+		gs:    services.Gallery,
+		is:    services.Image,
+		az:    az,
+		hooks: hooks,
+		spec:  apiSpec(baseURL),
+	}
+}
+
+// page reads the cursor and limit parameters of r
+func page(r *http.Request) (apiPage, error) {
+	p := apiPage{Limit: defaultPageSize}
+	query := r.URL.Query()
+
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return p, errBadLimit
+		}
+		p.Limit = limit
+	}
+
+	if s := query.Get("cursor"); s != "" {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return p, errBadCursor
+		}
+		after, err := strconv.ParseUint(string(b), 10, 64)
+		if err != nil {
+			return p, errBadCursor
+		}
+		p.After = uint(after)
+	}
+	return p, nil
+}
+
+// nextCursor returns the cursor of the page after the one
+// ending with lastID, when the page was full
+func (p apiPage) nextCursor(n int, lastID uint) string {
+	if n < p.Limit {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(lastID), 10)))
+}
+
+// decodeJSON reads the JSON body of r into dst
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return errBadBody
+	}
+	return nil
+}
+
+// apiID reads the ID named key from the URL of r
+func apiID(r *http.Request, key string) (uint, error) {
+	id, err := strconv.Atoi(mux.Vars(r)[key])
+	if err != nil || id <= 0 {
+		return 0, models.ErrNotFound
+	}
+	return uint(id), nil
+}
+
+// renderAPIError writes the response for err, what names the
+// thing that was not found, e.g. "Property". Errors written for
+// the user, validation ones among them, are shown as is.
+func renderAPIError(w http.ResponseWriter, err error, what string) {
+	switch err {
+	case models.ErrNotFound, authz.ErrNotFound:
+		views.RenderJSONError(w, http.StatusNotFound, what+" not found")
+		return
+	case authz.ErrForbidden:
+		views.RenderJSONError(w, http.StatusForbidden, authz.ErrForbidden.Public())
+		return
+	case errBadCursor, errBadLimit, errBadBody:
+		views.RenderJSONError(w, http.StatusBadRequest, err.(views.PublicError).Public())
+		return
+	}
+
+	if pe, ok := err.(views.PublicError); ok {
+		views.RenderJSONError(w, http.StatusUnprocessableEntity, pe.Public())
+		return
+	}
+	log.Println(err)
+	views.RenderJSONError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+// apiTime is how times are written by the API
+func apiTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,300 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+)
+
+const errNoImages publicError = "Send the images in the images field of a multipart form"
+
+// apiGallery is a gallery as the API shows it
+type apiGallery struct {
+	ID             uint   `json:"id"`
+	OrganizationID uint   `json:"organization_id"`
+	Title          string `json:"title"`
+	CreatedAt      string `json:"created_at" format:"date-time"`
+	UpdatedAt      string `json:"updated_at" format:"date-time"`
+}
+
+// apiGalleryInput is the body of the requests creating or
+// updating a gallery
+type apiGalleryInput struct {
+	Title *string `json:"title"`
+}
+
+// apiImage is an image of a gallery as the API shows it
+type apiImage struct {
+	ID        uint   `json:"id"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at" format:"date-time"`
+}
+
+func newAPIGallery(g *models.Gallery) *apiGallery {
+	return &apiGallery{
+		ID:             g.ID,
+		OrganizationID: g.OrganizationID,
+		Title:          g.Title,
+		CreatedAt:      apiTime(g.CreatedAt),
+		UpdatedAt:      apiTime(g.UpdatedAt),
+	}
+}
+
+func newAPIImage(i *models.Image) *apiImage {
+	return &apiImage{
+		ID:        i.ID,
+		Filename:  i.Filename,
+		URL:       i.Path(),
+		Size:      i.Size,
+		CreatedAt: apiTime(i.CreatedAt),
+	}
+}
+
+// ListGalleries lists the galleries of the organization of the
+// token
+//
+// GET /api/v1/galleries
+func (a *API) ListGalleries(w http.ResponseWriter, r *http.Request) {
+	pg, err := page(r)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	org := context.Organization(r.Context())
+	galleries, err := a.gs.Page(org.ID, pg.After, pg.Limit)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	data := make([]*apiGallery, 0, len(galleries))
+	var lastID uint
+	for i := range galleries {
+		data = append(data, newAPIGallery(&galleries[i]))
+		lastID = galleries[i].ID
+	}
+	views.RenderJSON(w, http.StatusOK, &apiList{
+		Data:       data,
+		NextCursor: pg.nextCursor(len(galleries), lastID),
+	})
+}
+
+// CreateGallery creates a gallery in the organization of the
+// token
+//
+// POST /api/v1/galleries
+func (a *API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	org := context.Organization(r.Context())
+	if err := a.az.Can(user, authz.ActionCreate, authz.In(authz.TypeGallery, org)); err != nil {
+		renderAPIError(w, err, "Organization")
+		return
+	}
+
+	var in apiGalleryInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	gallery := models.Gallery{
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+	}
+	if in.Title != nil {
+		gallery.Title = *in.Title
+	}
+	if err := a.gs.As(actor(r)).Create(&gallery); err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+	views.RenderJSON(w, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// ShowGallery GET /api/v1/galleries/:id
+func (a *API) ShowGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionView)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// UpdateGallery PATCH /api/v1/galleries/:id
+func (a *API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionEdit)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	var in apiGalleryInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	if in.Title != nil {
+		gallery.Title = *in.Title
+	}
+	if err := a.gs.As(actor(r)).Update(gallery); err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// DeleteGallery DELETE /api/v1/galleries/:id
+func (a *API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionDelete)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	err = a.gs.As(actor(r)).Delete(gallery.ID)
+	if err == nil {
+		err = a.az.Forget(authz.Gallery(gallery))
+	}
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListImages GET /api/v1/galleries/:id/images
+func (a *API) ListImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionView)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+	pg, err := page(r)
+	if err != nil {
+		renderAPIError(w, err, "Image")
+		return
+	}
+
+	images, err := a.is.Page(models.GalleryImageKey, gallery.ID, pg.After, pg.Limit)
+	if err != nil {
+		renderAPIError(w, err, "Image")
+		return
+	}
+
+	data := make([]*apiImage, 0, len(images))
+	var lastID uint
+	for i := range images {
+		data = append(data, newAPIImage(&images[i]))
+		lastID = images[i].ID
+	}
+	views.RenderJSON(w, http.StatusOK, &apiList{
+		Data:       data,
+		NextCursor: pg.nextCursor(len(images), lastID),
+	})
+}
+
+// UploadImages adds the images posted in the images field of a
+// multipart form to the gallery
+//
+// POST /api/v1/galleries/:id/images
+func (a *API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionEdit)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil || len(r.MultipartForm.File["images"]) == 0 {
+		renderAPIError(w, errNoImages, "Image")
+		return
+	}
+
+	act := actor(r)
+	data := []*apiImage{}
+	for _, f := range r.MultipartForm.File["images"] {
+		file, err := f.Open()
+		if err != nil {
+			renderAPIError(w, err, "Image")
+			return
+		}
+		image := models.Image{
+			ExternalType: models.GalleryImageKey,
+			ExternalID:   gallery.ID,
+			Filename:     f.Filename,
+			UserID:       act.UserID,
+		}
+		err = a.is.As(act).Create(&image, file)
+		file.Close()
+		if err != nil {
+			renderAPIError(w, err, "Image")
+			return
+		}
+		data = append(data, newAPIImage(&image))
+	}
+	views.RenderJSON(w, http.StatusCreated, &apiList{Data: data})
+}
+
+// DeleteImage DELETE /api/v1/galleries/:id/images/:filename
+func (a *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, authz.ActionEdit)
+	if err != nil {
+		renderAPIError(w, err, "Gallery")
+		return
+	}
+
+	// Only images of the gallery are looked for in the store
+	images, err := a.is.ByExternalTypeAndID(models.GalleryImageKey, gallery.ID)
+	if err != nil {
+		renderAPIError(w, err, "Image")
+		return
+	}
+	filename := mux.Vars(r)["filename"]
+	var found *models.Image
+	for i := range images {
+		if images[i].Filename == filename {
+			found = &images[i]
+			break
+		}
+	}
+	if found == nil {
+		renderAPIError(w, models.ErrNotFound, "Image")
+		return
+	}
+
+	err = a.is.As(actor(r)).Delete(&models.Image{
+		ExternalType: models.GalleryImageKey,
+		ExternalID:   gallery.ID,
+		Filename:     found.Filename,
+	})
+	if err != nil {
+		renderAPIError(w, err, "Image")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gallery returns the gallery in the URL of r, if the user may
+// take action on it
+func (a *API) gallery(r *http.Request, action authz.Action) (*models.Gallery, error) {
+	id, err := apiID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	gallery, err := a.gs.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if err := a.az.Can(user, action, authz.Gallery(gallery)); err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"log"
+	"net/http"
+)
+
+// apiProperty is a property as the API shows it
+type apiProperty struct {
+	ID             uint   `json:"id"`
+	OrganizationID uint   `json:"organization_id"`
+	Name           string `json:"name"`
+	Address        string `json:"address"`
+	PostalCode     string `json:"postal_code"`
+	CreatedAt      string `json:"created_at" format:"date-time"`
+	UpdatedAt      string `json:"updated_at" format:"date-time"`
+}
+
+// apiPropertyInput is the body of the requests creating or
+// updating a property. Fields left out are not changed by
+// updates.
+type apiPropertyInput struct {
+	Name       *string `json:"name"`
+	Address    *string `json:"address"`
+	PostalCode *string `json:"postal_code"`
+}
+
+func newAPIProperty(p *models.Property) *apiProperty {
+	return &apiProperty{
+		ID:             p.ID,
+		OrganizationID: p.OrganizationID,
+		Name:           p.Name,
+		Address:        p.Address,
+		PostalCode:     p.PostalCode,
+		CreatedAt:      apiTime(p.CreatedAt),
+		UpdatedAt:      apiTime(p.UpdatedAt),
+	}
+}
+
+// apply sets the fields of p given in the input
+func (in *apiPropertyInput) apply(p *models.Property) {
+	if in.Name != nil {
+		p.Name = *in.Name
+	}
+	if in.Address != nil {
+		p.Address = *in.Address
+	}
+	if in.PostalCode != nil {
+		p.PostalCode = *in.PostalCode
+	}
+}
+
+// ListProperties lists the properties of the organization of the
+// token, and those shared with its user
+//
+// GET /api/v1/properties
+func (a *API) ListProperties(w http.ResponseWriter, r *http.Request) {
+	pg, err := page(r)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	user := context.User(r.Context())
+	org := context.Organization(r.Context())
+	shared, err := a.az.Shared(user, authz.TypeProperty)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+	properties, err := a.ps.Page(org.ID, shared, pg.After, pg.Limit)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	data := make([]*apiProperty, 0, len(properties))
+	var lastID uint
+	for i := range properties {
+		data = append(data, newAPIProperty(&properties[i]))
+		lastID = properties[i].ID
+	}
+	views.RenderJSON(w, http.StatusOK, &apiList{
+		Data:       data,
+		NextCursor: pg.nextCursor(len(properties), lastID),
+	})
+}
+
+// CreateProperty creates a property in the organization of the
+// token
+//
+// POST /api/v1/properties
+func (a *API) CreateProperty(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	org := context.Organization(r.Context())
+	if err := a.az.Can(user, authz.ActionCreate, authz.In(authz.TypeProperty, org)); err != nil {
+		renderAPIError(w, err, "Organization")
+		return
+	}
+
+	var in apiPropertyInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	property := models.Property{
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+	}
+	in.apply(&property)
+	if err := a.ps.As(actor(r)).Create(&property); err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+	if err := a.hooks.Emit(org.ID, models.EventPropertyCreated, newAPIProperty(&property)); err != nil {
+		log.Println(err)
+	}
+	views.RenderJSON(w, http.StatusCreated, newAPIProperty(&property))
+}
+
+// ShowProperty GET /api/v1/properties/:id
+func (a *API) ShowProperty(w http.ResponseWriter, r *http.Request) {
+	property, err := a.property(r, authz.ActionView)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIProperty(property))
+}
+
+// UpdateProperty PATCH /api/v1/properties/:id
+func (a *API) UpdateProperty(w http.ResponseWriter, r *http.Request) {
+	property, err := a.property(r, authz.ActionEdit)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	var in apiPropertyInput
+	if err := decodeJSON(w, r, &in); err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	in.apply(property)
+	if err := a.ps.As(actor(r)).Update(property); err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+	if err := a.hooks.Emit(property.OrganizationID, models.EventPropertyUpdated, newAPIProperty(property)); err != nil {
+		log.Println(err)
+	}
+	views.RenderJSON(w, http.StatusOK, newAPIProperty(property))
+}
+
+// DeleteProperty DELETE /api/v1/properties/:id
+func (a *API) DeleteProperty(w http.ResponseWriter, r *http.Request) {
+	property, err := a.property(r, authz.ActionDelete)
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+
+	err = a.ps.As(actor(r)).Delete(property.ID)
+	if err == nil {
+		err = a.az.Forget(authz.Property(property))
+	}
+	if err != nil {
+		renderAPIError(w, err, "Property")
+		return
+	}
+	if err := a.hooks.Emit(property.OrganizationID, models.EventPropertyDeleted, newAPIProperty(property)); err != nil {
+		log.Println(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// property returns the property in the URL of r, if the user
+// may take action on it
+func (a *API) property(r *http.Request, action authz.Action) (*models.Property, error) {
+	id, err := apiID(r, "id")
+	if err != nil {
+		return nil, err
+	}
+	property, err := a.ps.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if err := a.az.Can(user, action, authz.Property(property)); err != nil {
+		return nil, err
+	}
+	return property, nil
+}
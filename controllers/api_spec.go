@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/openapi"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// apiSpec describes the routes of the API as main.go sets them
+// up, keep the two in step. Bodies are described by the types
+// the handlers encode and decode, they follow on their own.
+func apiSpec(baseURL string) *openapi.Document {
+	doc := openapi.New(openapi.Info{
+		Title:       "Tataruma API",
+		Description: "Properties, galleries and their images. Requests are made with a personal API token, created on the profile page, and need the scope named by each operation.",
+		Version:     "1",
+	})
+	doc.Servers = []openapi.Server{{URL: baseURL}}
+	doc.Components.SecuritySchemes["apiToken"] = &openapi.SecurityScheme{
+		Type:   "http",
+		Scheme: "bearer",
+	}
+	doc.Security = []openapi.SecurityRequirement{{"apiToken": {}}}
+
+	errorBody := doc.Define("Error", views.ErrorBody{})
+	property := doc.Define("Property", apiProperty{})
+	propertyInput := doc.Define("PropertyInput", apiPropertyInput{})
+	gallery := doc.Define("Gallery", apiGallery{})
+	galleryInput := doc.Define("GalleryInput", apiGalleryInput{})
+	image := doc.Define("Image", apiImage{})
+
+	minLimit, maxLimit := 1, maxPageSize
+	pageParams := []openapi.Parameter{
+		{
+			Name:        "cursor",
+			In:          "query",
+			Description: "The next_cursor of the previous page",
+			Schema:      &openapi.Schema{Type: "string"},
+		},
+		{
+			Name:        "limit",
+			In:          "query",
+			Description: "How many items a page has at most, " + strconv.Itoa(defaultPageSize) + " by default",
+			Schema:      &openapi.Schema{Type: "integer", Minimum: &minLimit, Maximum: &maxLimit},
+		},
+	}
+	idParam := openapi.Parameter{Name: "id", In: "path", Required: true, Schema: &openapi.Schema{Type: "integer", Format: "int64"}}
+	filenameParam := openapi.Parameter{Name: "filename", In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}
+	idempotencyParam := openapi.Parameter{
+		Name:        "Idempotency-Key",
+		In:          "header",
+		Description: "Retries with the key within 24 hours get the response of the first request back",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+
+	// op describes an operation answering status with body, or
+	// with no body when it is nil, and failing with errs as
+	// well as the errors every operation may fail with
+	op := func(id, summary, scope string, status int, body *openapi.Schema, errs ...int) *openapi.Operation {
+		o := &openapi.Operation{
+			OperationID: id,
+			Summary:     summary,
+			Description: "Needs the " + scope + " scope.",
+			Responses:   map[string]openapi.Response{},
+		}
+		ok := openapi.Response{Description: http.StatusText(status)}
+		if body != nil {
+			ok.Content = openapi.JSON(body)
+		}
+		o.Responses[strconv.Itoa(status)] = ok
+
+		errs = append(errs, http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError)
+		for _, code := range errs {
+			o.Responses[strconv.Itoa(code)] = openapi.Response{
+				Description: http.StatusText(code),
+				Content:     openapi.JSON(errorBody),
+			}
+		}
+		return o
+	}
+	// idempotent adds the Idempotency-Key header to o
+	idempotent := func(o *openapi.Operation) *openapi.Operation {
+		o.Parameters = append(o.Parameters, idempotencyParam)
+		o.Responses[strconv.Itoa(http.StatusConflict)] = openapi.Response{
+			Description: "A request with the idempotency key is still in progress",
+			Content:     openapi.JSON(errorBody),
+		}
+		return o
+	}
+	jsonBody := func(schema *openapi.Schema) *openapi.RequestBody {
+		return &openapi.RequestBody{Required: true, Content: openapi.JSON(schema)}
+	}
+
+	o := op("listProperties", "List the properties of the organization of the token, and those shared with its user",
+		models.ScopePropertiesRead, http.StatusOK, apiListSchema(property), http.StatusBadRequest)
+	o.Parameters = pageParams
+	doc.Add("GET", "/api/v1/properties", o)
+
+	o = idempotent(op("createProperty", "Create a property in the organization of the token",
+		models.ScopePropertiesWrite, http.StatusCreated, property,
+		http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity))
+	o.RequestBody = jsonBody(propertyInput)
+	doc.Add("POST", "/api/v1/properties", o)
+
+	o = op("getProperty", "Get a property",
+		models.ScopePropertiesRead, http.StatusOK, property, http.StatusNotFound)
+	o.Parameters = []openapi.Parameter{idParam}
+	doc.Add("GET", "/api/v1/properties/{id}", o)
+
+	o = idempotent(op("updateProperty", "Update the fields of a property given in the body",
+		models.ScopePropertiesWrite, http.StatusOK, property,
+		http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity))
+	o.Parameters = append([]openapi.Parameter{idParam}, o.Parameters...)
+	o.RequestBody = jsonBody(propertyInput)
+	doc.Add("PATCH", "/api/v1/properties/{id}", o)
+
+	o = op("deleteProperty", "Delete a property",
+		models.ScopePropertiesWrite, http.StatusNoContent, nil, http.StatusNotFound)
+	o.Parameters = []openapi.Parameter{idParam}
+	doc.Add("DELETE", "/api/v1/properties/{id}", o)
+
+	o = op("listGalleries", "List the galleries of the organization of the token",
+		models.ScopeGalleriesRead, http.StatusOK, apiListSchema(gallery), http.StatusBadRequest)
+	o.Parameters = pageParams
+	doc.Add("GET", "/api/v1/galleries", o)
+
+	o = idempotent(op("createGallery", "Create a gallery in the organization of the token",
+		models.ScopeGalleriesWrite, http.StatusCreated, gallery,
+		http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity))
+	o.RequestBody = jsonBody(galleryInput)
+	doc.Add("POST", "/api/v1/galleries", o)
+
+	o = op("getGallery", "Get a gallery",
+		models.ScopeGalleriesRead, http.StatusOK, gallery, http.StatusNotFound)
+	o.Parameters = []openapi.Parameter{idParam}
+	doc.Add("GET", "/api/v1/galleries/{id}", o)
+
+	o = idempotent(op("updateGallery", "Update the fields of a gallery given in the body",
+		models.ScopeGalleriesWrite, http.StatusOK, gallery,
+		http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity))
+	o.Parameters = append([]openapi.Parameter{idParam}, o.Parameters...)
+	o.RequestBody = jsonBody(galleryInput)
+	doc.Add("PATCH", "/api/v1/galleries/{id}", o)
+
+	o = op("deleteGallery", "Delete a gallery",
+		models.ScopeGalleriesWrite, http.StatusNoContent, nil, http.StatusNotFound)
+	o.Parameters = []openapi.Parameter{idParam}
+	doc.Add("DELETE", "/api/v1/galleries/{id}", o)
+
+	o = op("listImages", "List the images of a gallery",
+		models.ScopeGalleriesRead, http.StatusOK, apiListSchema(image),
+		http.StatusBadRequest, http.StatusNotFound)
+	o.Parameters = append([]openapi.Parameter{idParam}, pageParams...)
+	doc.Add("GET", "/api/v1/galleries/{id}/images", o)
+
+	o = idempotent(op("uploadImages", "Add images to a gallery",
+		models.ScopeGalleriesWrite, http.StatusCreated, apiListSchema(image),
+		http.StatusNotFound, http.StatusUnprocessableEntity))
+	o.Parameters = append([]openapi.Parameter{idParam}, o.Parameters...)
+	o.RequestBody = &openapi.RequestBody{
+		Required: true,
+		Content: map[string]openapi.MediaType{
+			"multipart/form-data": {Schema: &openapi.Schema{
+				Type: "object",
+				Properties: map[string]*openapi.Schema{
+					"images": {Type: "array", Items: &openapi.Schema{Type: "string", Format: "binary"}},
+				},
+				Required: []string{"images"},
+			}},
+		},
+	}
+	doc.Add("POST", "/api/v1/galleries/{id}/images", o)
+
+	o = op("deleteImage", "Delete an image of a gallery",
+		models.ScopeGalleriesWrite, http.StatusNoContent, nil, http.StatusNotFound)
+	o.Parameters = []openapi.Parameter{idParam, filenameParam}
+	doc.Add("DELETE", "/api/v1/galleries/{id}/images/{filename}", o)
+
+	return doc
+}
+
+// apiListSchema describes an apiList of item
+func apiListSchema(item *openapi.Schema) *openapi.Schema {
+	s := openapi.SchemaOf(reflect.TypeOf(apiList{}))
+	s.Properties["data"] = &openapi.Schema{Type: "array", Items: item}
+	return s
+}
+
+// Spec serves the OpenAPI document of the API, for client
+// generators. It needs no token.
+//
+// GET /api/openapi.json
+func (a *API) Spec(w http.ResponseWriter, r *http.Request) {
+	views.RenderJSON(w, http.StatusOK, a.spec)
+}
@@ -0,0 +1,520 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/models/modelstest"
+	"github.com/ruckuus/dojo1/openapi"
+	"github.com/ruckuus/dojo1/webhook"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The responses of the API handlers, checked against the
+// OpenAPI document served at /api/openapi.json. The services
+// are kept in memory.
+
+type memProperties struct {
+	models.PropertyService
+	properties map[uint]*models.Property
+}
+
+func (mp *memProperties) As(models.Actor) models.PropertyService { return mp }
+
+func (mp *memProperties) ByID(id uint) (*models.Property, error) {
+	if p, ok := mp.properties[id]; ok {
+		copy := *p
+		return &copy, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (mp *memProperties) Page(orgID uint, shared []uint, after uint, limit int) ([]models.Property, error) {
+	var page []models.Property
+	for _, p := range mp.properties {
+		if p.ID > after && p.OrganizationID == orgID {
+			page = append(page, *p)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page, nil
+}
+
+func (mp *memProperties) Create(p *models.Property) error {
+	if p.Name == "" {
+		return models.ErrPropertyNameRequired
+	}
+	p.ID = uint(len(mp.properties) + 100)
+	p.CreatedAt, p.UpdatedAt = time.Now(), time.Now()
+	copy := *p
+	mp.properties[p.ID] = &copy
+	return nil
+}
+
+func (mp *memProperties) Update(p *models.Property) error {
+	if p.Name == "" {
+		return models.ErrPropertyNameRequired
+	}
+	copy := *p
+	mp.properties[p.ID] = &copy
+	return nil
+}
+
+func (mp *memProperties) Delete(id uint) error {
+	delete(mp.properties, id)
+	return nil
+}
+
+type memGalleries struct {
+	models.GalleryService
+	galleries map[uint]*models.Gallery
+}
+
+func (mg *memGalleries) As(models.Actor) models.GalleryService { return mg }
+
+func (mg *memGalleries) ByID(id uint) (*models.Gallery, error) {
+	if g, ok := mg.galleries[id]; ok {
+		copy := *g
+		return &copy, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (mg *memGalleries) Page(orgID uint, after uint, limit int) ([]models.Gallery, error) {
+	var page []models.Gallery
+	for _, g := range mg.galleries {
+		if g.ID > after && g.OrganizationID == orgID {
+			page = append(page, *g)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page, nil
+}
+
+func (mg *memGalleries) Create(g *models.Gallery) error {
+	if g.Title == "" {
+		return models.ErrTitleRequired
+	}
+	g.ID = uint(len(mg.galleries) + 100)
+	g.CreatedAt, g.UpdatedAt = time.Now(), time.Now()
+	copy := *g
+	mg.galleries[g.ID] = &copy
+	return nil
+}
+
+func (mg *memGalleries) Update(g *models.Gallery) error {
+	if g.Title == "" {
+		return models.ErrTitleRequired
+	}
+	copy := *g
+	mg.galleries[g.ID] = &copy
+	return nil
+}
+
+func (mg *memGalleries) Delete(id uint) error {
+	delete(mg.galleries, id)
+	return nil
+}
+
+type memImages struct {
+	models.ImageService
+	images []models.Image
+}
+
+func (mi *memImages) As(models.Actor) models.ImageService { return mi }
+
+func (mi *memImages) Create(i *models.Image, r io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	i.ID = uint(len(mi.images) + 1)
+	i.Size = n
+	i.Location = fmt.Sprintf("images.tataruma.test/images/%s/%d/%s", i.ExternalType, i.ExternalID, i.Filename)
+	i.CreatedAt = time.Now()
+	mi.images = append(mi.images, *i)
+	return nil
+}
+
+func (mi *memImages) ByExternalTypeAndID(externalType string, externalID uint) ([]models.Image, error) {
+	return mi.Page(externalType, externalID, 0, len(mi.images))
+}
+
+func (mi *memImages) Page(externalType string, externalID uint, after uint, limit int) ([]models.Image, error) {
+	var page []models.Image
+	for _, i := range mi.images {
+		if i.ExternalType == externalType && i.ExternalID == externalID && i.ID > after && len(page) < limit {
+			page = append(page, i)
+		}
+	}
+	return page, nil
+}
+
+func (mi *memImages) Delete(image *models.Image) error {
+	for n, i := range mi.images {
+		if i.ExternalType == image.ExternalType && i.ExternalID == image.ExternalID && i.Filename == image.Filename {
+			mi.images = append(mi.images[:n], mi.images[n+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+type memWebhooks struct {
+	models.WebhookEndpointService
+}
+
+func (memWebhooks) Subscribed(orgID uint, event string) ([]models.WebhookEndpoint, error) {
+	return nil, nil
+}
+
+type apiTest struct {
+	*testApp
+	spec *openapi.Document
+}
+
+func newAPITest(t *testing.T) *apiTest {
+	t.Helper()
+	now := time.Now()
+	properties := &memProperties{properties: map[uint]*models.Property{
+		1: {OrganizationID: 1, UserID: 1, Name: "Kost Melati", Address: "Jl. Melati 1", PostalCode: "12345"},
+		2: {OrganizationID: 2, UserID: 2, Name: "Kost Mawar", Address: "Jl. Mawar 2", PostalCode: "54321"},
+	}}
+	for id, p := range properties.properties {
+		p.ID, p.CreatedAt, p.UpdatedAt = id, now, now
+	}
+	galleries := &memGalleries{galleries: map[uint]*models.Gallery{
+		1: {OrganizationID: 1, UserID: 1, Title: "Rooms"},
+	}}
+	galleries.galleries[1].ID = 1
+	images := &memImages{images: []models.Image{{
+		ExternalType: models.GalleryImageKey,
+		ExternalID:   1,
+		Filename:     "room.jpg",
+		Location:     "images.tataruma.test/images/galleries/1/room.jpg",
+		Size:         3,
+	}}}
+	images.images[0].ID = 1
+
+	services := &models.Services{
+		Property: properties,
+		Gallery:  galleries,
+		Image:    images,
+		Webhook:  memWebhooks{},
+	}
+	// The user of the tests owns organization 1 and views
+	// organization 2
+	az := authz.NewAuthorizer(&modelstest.Grants{}, &modelstest.Organizations{Memberships: []models.Membership{
+		{OrganizationID: 1, UserID: 1, Role: string(authz.RoleOwner)},
+		{OrganizationID: 2, UserID: 1, Role: string(authz.RoleViewer)},
+	}})
+	api := NewAPI(services, az, webhook.NewDispatcher(services), "https://tataruma.test")
+
+	at := &apiTest{testApp: newTestApp(t)}
+	at.user = &models.User{Name: "Jon", Email: "jon@example.com"}
+	at.user.ID = 1
+	at.org = &models.Organization{Name: "Jon"}
+	at.org.ID = 1
+
+	// As main.go routes them
+	r := at.router
+	r.HandleFunc("/api/openapi.json", api.Spec).Methods("GET")
+	r.HandleFunc("/api/v1/properties", api.ListProperties).Methods("GET")
+	r.HandleFunc("/api/v1/properties", api.CreateProperty).Methods("POST")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", api.ShowProperty).Methods("GET")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", api.UpdateProperty).Methods("PATCH")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", api.DeleteProperty).Methods("DELETE")
+	r.HandleFunc("/api/v1/galleries", api.ListGalleries).Methods("GET")
+	r.HandleFunc("/api/v1/galleries", api.CreateGallery).Methods("POST")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", api.ShowGallery).Methods("GET")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", api.UpdateGallery).Methods("PATCH")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", api.DeleteGallery).Methods("DELETE")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images", api.ListImages).Methods("GET")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images", api.UploadImages).Methods("POST")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images/{filename}", api.DeleteImage).Methods("DELETE")
+
+	w := at.serve(httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json answered %d", w.Code)
+	}
+	// The document as clients read it, not as it is built
+	if err := json.Unmarshal(w.Body.Bytes(), &at.spec); err != nil {
+		t.Fatal(err)
+	}
+	return at
+}
+
+// check validates the response w to the operation of method
+// on path against the document
+func (at *apiTest) check(method, path string, w *httptest.ResponseRecorder) {
+	at.t.Helper()
+	op := at.spec.Paths[path][strings.ToLower(method)]
+	if op == nil {
+		at.t.Errorf("%s %s is not in the document", method, path)
+		return
+	}
+	resp, ok := op.Responses[strconv.Itoa(w.Code)]
+	if !ok {
+		at.t.Errorf("%s %s answered %d, which is not in the document: %s", method, path, w.Code, w.Body)
+		return
+	}
+	if resp.Content == nil {
+		if w.Body.Len() != 0 {
+			at.t.Errorf("%s %s answered %d with a body, the document has none: %s", method, path, w.Code, w.Body)
+		}
+		return
+	}
+
+	media, ok := resp.Content["application/json"]
+	if !ok || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		at.t.Errorf("%s %s answered %d with %q", method, path, w.Code, w.Header().Get("Content-Type"))
+		return
+	}
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		at.t.Errorf("%s %s answered %d with no JSON: %v", method, path, w.Code, err)
+		return
+	}
+	for _, err := range validate(at.spec, media.Schema, body, "body") {
+		at.t.Errorf("%s %s answered %d: %s", method, path, w.Code, err)
+	}
+}
+
+// validate returns how v fails to match schema, at the JSON
+// path where. Object properties the schema doesn't describe are
+// reported as well, a handler sending them has drifted from the
+// document.
+func validate(doc *openapi.Document, schema *openapi.Schema, v interface{}, where string) []string {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		ref, ok := doc.Components.Schemas[name]
+		if !ok {
+			return []string{where + ": unknown reference " + schema.Ref}
+		}
+		return validate(doc, ref, v, where)
+	}
+	if v == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return []string{where + ": null, but not nullable"}
+	}
+
+	var errs []string
+	mismatch := func() []string {
+		return []string{fmt.Sprintf("%s: %v is not of type %s", where, v, schema.Type)}
+	}
+	switch schema.Type {
+	case "":
+		// Anything goes
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, where+": "+name+" is required")
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := schema.Properties[name]
+			if !ok {
+				if schema.Properties != nil {
+					errs = append(errs, where+": "+name+" is not documented")
+				}
+				continue
+			}
+			errs = append(errs, validate(doc, prop, obj[name], where+"."+name)...)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for i, item := range items {
+			errs = append(errs, validate(doc, schema.Items, item, fmt.Sprintf("%s[%d]", where, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a date-time", where, s))
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != math.Trunc(n) {
+			return mismatch()
+		}
+		if schema.Minimum != nil && n < float64(*schema.Minimum) {
+			errs = append(errs, fmt.Sprintf("%s: %v is below %d", where, n, *schema.Minimum))
+		}
+		if schema.Maximum != nil && n > float64(*schema.Maximum) {
+			errs = append(errs, fmt.Sprintf("%s: %v is above %d", where, n, *schema.Maximum))
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	default:
+		errs = append(errs, where+": unknown type "+schema.Type)
+	}
+	return errs
+}
+
+func jsonRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func imagesRequest(target string, filenames ...string) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range filenames {
+		fw, err := mw.CreateFormFile("images", name)
+		if err != nil {
+			panic(err)
+		}
+		fw.Write([]byte("jpg"))
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", target, &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestAPIResponsesMatchSpec(t *testing.T) {
+	at := newAPITest(t)
+
+	tests := []struct {
+		name   string
+		path   string
+		req    *http.Request
+		status int
+	}{
+		{"list properties", "/api/v1/properties",
+			httptest.NewRequest("GET", "/api/v1/properties", nil), http.StatusOK},
+		{"list properties, full page", "/api/v1/properties",
+			httptest.NewRequest("GET", "/api/v1/properties?limit=1", nil), http.StatusOK},
+		{"list properties, bad limit", "/api/v1/properties",
+			httptest.NewRequest("GET", "/api/v1/properties?limit=1000", nil), http.StatusBadRequest},
+		{"create property", "/api/v1/properties",
+			jsonRequest("POST", "/api/v1/properties", `{"name":"Kost Anggrek","address":"Jl. Anggrek 3","postal_code":"11111"}`), http.StatusCreated},
+		{"create property, bad body", "/api/v1/properties",
+			jsonRequest("POST", "/api/v1/properties", `{"rooms":3}`), http.StatusBadRequest},
+		{"create property, no name", "/api/v1/properties",
+			jsonRequest("POST", "/api/v1/properties", `{"address":"Jl. Anggrek 3"}`), http.StatusUnprocessableEntity},
+		{"get property", "/api/v1/properties/{id}",
+			httptest.NewRequest("GET", "/api/v1/properties/1", nil), http.StatusOK},
+		{"get property, missing", "/api/v1/properties/{id}",
+			httptest.NewRequest("GET", "/api/v1/properties/99", nil), http.StatusNotFound},
+		{"update property", "/api/v1/properties/{id}",
+			jsonRequest("PATCH", "/api/v1/properties/1", `{"postal_code":"12346"}`), http.StatusOK},
+		{"update property, viewer", "/api/v1/properties/{id}",
+			jsonRequest("PATCH", "/api/v1/properties/2", `{"name":"Mine"}`), http.StatusForbidden},
+		{"delete property", "/api/v1/properties/{id}",
+			httptest.NewRequest("DELETE", "/api/v1/properties/1", nil), http.StatusNoContent},
+		{"list galleries", "/api/v1/galleries",
+			httptest.NewRequest("GET", "/api/v1/galleries", nil), http.StatusOK},
+		{"list galleries, bad cursor", "/api/v1/galleries",
+			httptest.NewRequest("GET", "/api/v1/galleries?cursor=%21", nil), http.StatusBadRequest},
+		{"create gallery", "/api/v1/galleries",
+			jsonRequest("POST", "/api/v1/galleries", `{"title":"Garden"}`), http.StatusCreated},
+		{"create gallery, no title", "/api/v1/galleries",
+			jsonRequest("POST", "/api/v1/galleries", `{}`), http.StatusUnprocessableEntity},
+		{"get gallery", "/api/v1/galleries/{id}",
+			httptest.NewRequest("GET", "/api/v1/galleries/1", nil), http.StatusOK},
+		{"update gallery", "/api/v1/galleries/{id}",
+			jsonRequest("PATCH", "/api/v1/galleries/1", `{"title":"Bedrooms"}`), http.StatusOK},
+		{"update gallery, missing", "/api/v1/galleries/{id}",
+			jsonRequest("PATCH", "/api/v1/galleries/99", `{"title":"Bedrooms"}`), http.StatusNotFound},
+		{"list images", "/api/v1/galleries/{id}/images",
+			httptest.NewRequest("GET", "/api/v1/galleries/1/images", nil), http.StatusOK},
+		{"upload images", "/api/v1/galleries/{id}/images",
+			imagesRequest("/api/v1/galleries/1/images", "bath.jpg", "kitchen.jpg"), http.StatusCreated},
+		{"upload no images", "/api/v1/galleries/{id}/images",
+			imagesRequest("/api/v1/galleries/1/images"), http.StatusUnprocessableEntity},
+		{"delete image", "/api/v1/galleries/{id}/images/{filename}",
+			httptest.NewRequest("DELETE", "/api/v1/galleries/1/images/room.jpg", nil), http.StatusNoContent},
+		{"delete image, missing", "/api/v1/galleries/{id}/images/{filename}",
+			httptest.NewRequest("DELETE", "/api/v1/galleries/1/images/room.jpg", nil), http.StatusNotFound},
+		{"delete gallery", "/api/v1/galleries/{id}",
+			httptest.NewRequest("DELETE", "/api/v1/galleries/1", nil), http.StatusNoContent},
+	}
+
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		w := at.serve(tt.req)
+		if w.Code != tt.status {
+			t.Errorf("%s: answered %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		at.check(tt.req.Method, tt.path, w)
+		covered[tt.req.Method+" "+tt.path] = true
+	}
+
+	// Every operation documented is tried
+	for path, item := range at.spec.Paths {
+		for method := range item {
+			if !covered[strings.ToUpper(method)+" "+path] {
+				t.Errorf("%s %s is not tested", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestValidateFindsDrift(t *testing.T) {
+	doc := apiSpec("https://tataruma.test")
+	property := openapi.Ref("Property")
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing field", `{"id":1,"organization_id":1,"name":"a","address":"b","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"}`},
+		{"undocumented field", `{"id":1,"organization_id":1,"name":"a","address":"b","postal_code":"c","rooms":3,"created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"}`},
+		{"wrong type", `{"id":"1","organization_id":1,"name":"a","address":"b","postal_code":"c","created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-01T00:00:00Z"}`},
+		{"bad date-time", `{"id":1,"organization_id":1,"name":"a","address":"b","postal_code":"c","created_at":"yesterday","updated_at":"2024-01-01T00:00:00Z"}`},
+		{"null", `null`},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.body), &v); err != nil {
+			t.Fatal(err)
+		}
+		if errs := validate(doc, property, v, "body"); len(errs) == 0 {
+			t.Errorf("%s: validate() found nothing wrong", tt.name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type APITokenForm struct {
+	Name   string   `schema:"name"`
+	Scopes []string `schema:"scopes"`
+	// ExpiresIn is the lifetime in days, 0 for no expiry
+	ExpiresIn int `schema:"expires_in"`
+}
+
+// CreateAPIToken creates a personal API token and shows it
+// to the user. This is the only time the token is shown.
+//
+// POST /profile/tokens
+func (u *Users) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form APITokenForm
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	apiToken := models.APIToken{
+		UserID:         user.ID,
+		OrganizationID: context.Organization(r.Context()).ID,
+		Name:           form.Name,
+		Scopes:         strings.Join(form.Scopes, " "),
+	}
+	if form.ExpiresIn > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresIn)
+		apiToken.ExpiresAt = &expiresAt
+	}
+
+	if err := u.ats.Create(&apiToken); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	vd.SetSuccessMessage("Your API token has been created.")
+	vd.Yield = &apiToken
+	u.APITokenView.Render(w, r, vd)
+}
+
+// RevokeAPIToken deletes a token, scripts using it stop working
+// right away.
+//
+// POST /profile/tokens/:id/delete
+func (u *Users) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	apiToken, err := u.ats.ByID(uint(id))
+	if err != nil || apiToken.UserID != user.ID {
+		http.Error(w, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	if err := u.ats.Delete(apiToken.ID); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "API token \"" + apiToken.Name + "\" revoked.",
+	})
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testApp serves requests to the handlers routed on router,
+// signed in as user in org when they are set. The middleware
+// of main.go is left out.
+type testApp struct {
+	t      *testing.T
+	router *mux.Router
+	user   *models.User
+	org    *models.Organization
+}
+
+func newTestApp(t *testing.T) *testApp {
+	views.TemplateDir = "../views/"
+	views.LayoutDir = views.TemplateDir + "layouts/"
+	return &testApp{t: t, router: mux.NewRouter()}
+}
+
+func (ta *testApp) serve(r *http.Request) *httptest.ResponseRecorder {
+	ctx := r.Context()
+	if ta.user != nil {
+		ctx = context.WithUser(ctx, ta.user)
+	}
+	if ta.org != nil {
+		ctx = context.WithOrganization(ctx, ta.org)
+	}
+	w := httptest.NewRecorder()
+	ta.router.ServeHTTP(w, r.WithContext(ctx))
+	return w
+}
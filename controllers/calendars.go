@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/ical"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// rentPast and rentAhead bound the rent due dates of feeds,
+	// around today
+	rentPast  = -1
+	rentAhead = 12
+)
+
+// Calendars serves the iCalendar feeds of lease dates. Calendar
+// apps fetch them without a session, the token in the URL is
+// what lets them in, so access is checked again on every fetch.
+type Calendars struct {
+	FeedView *views.View
+	cfs      models.CalendarFeedService
+	us       models.UserService
+	os       models.OrganizationService
+	ps       models.PropertyService
+	ls       models.LeaseService
+	az       *authz.Authorizer
+	baseURL  string
+}
+
+// calendarFeedData is what the page showing a new feed renders
+type calendarFeedData struct {
+	Property  *models.Property
+	URL       string
+	WebcalURL string
+}
+
+// calendarFeedEntry is a feed as listed on the profile page
+type calendarFeedEntry struct {
+	*models.CalendarFeed
+	PropertyName string
+}
+
+func NewCalendars(services *models.Services, az *authz.Authorizer, baseURL string) *Calendars {
+	return &Calendars{
+		FeedView: views.NewView("bootstrap", "calendars/feed"),
+		cfs:      services.CalendarFeed,
+		us:       services.User,
+		os:       services.Organization,
+		ps:       services.Property,
+		ls:       services.Lease,
+		az:       az,
+		baseURL:  baseURL,
+	}
+}
+
+// Create makes a feed of every property the user can see, and
+// of the leases they rent under
+//
+// POST /profile/calendars
+func (c *Calendars) Create(w http.ResponseWriter, r *http.Request) {
+	c.create(w, r, nil)
+}
+
+// CreateForProperty makes a feed of one property
+//
+// POST /properties/:id/calendar
+func (c *Calendars) CreateForProperty(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	property, err := c.ps.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Property not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user := context.User(r.Context())
+	if !authorized(w, c.az.Can(user, authz.ActionView, authz.Property(property)), "Property") {
+		return
+	}
+	c.create(w, r, property)
+}
+
+func (c *Calendars) create(w http.ResponseWriter, r *http.Request, property *models.Property) {
+	var vd views.Data
+	user := context.User(r.Context())
+
+	feed := models.CalendarFeed{UserID: user.ID}
+	if property != nil {
+		feed.PropertyID = property.ID
+	}
+	if err := c.cfs.Create(&feed); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	feedURL := fmt.Sprintf("%s/calendars/%s.ics", c.baseURL, feed.Token)
+	webcalURL := feedURL
+	if u, err := url.Parse(feedURL); err == nil {
+		u.Scheme = "webcal"
+		webcalURL = u.String()
+	}
+
+	vd.SetSuccessMessage("Your calendar feed has been created.")
+	vd.Yield = &calendarFeedData{
+		Property:  property,
+		URL:       feedURL,
+		WebcalURL: webcalURL,
+	}
+	c.FeedView.Render(w, r, vd)
+}
+
+// Revoke deletes a feed, calendar apps subscribed to it get
+// nothing more
+//
+// POST /profile/calendars/:id/delete
+func (c *Calendars) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	feed, err := c.cfs.ByID(uint(id))
+	if err != nil || feed.UserID != user.ID {
+		http.Error(w, "Calendar feed not found", http.StatusNotFound)
+		return
+	}
+
+	if err := c.cfs.Delete(feed.ID); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Calendar feed revoked.",
+	})
+}
+
+// Feed writes the calendar of a feed
+//
+// GET /calendars/:token.ics
+func (c *Calendars) Feed(w http.ResponseWriter, r *http.Request) {
+	feed, err := c.cfs.ByToken(mux.Vars(r)["token"])
+	var user *models.User
+	if err == nil {
+		user, err = c.us.ByID(feed.UserID)
+	}
+	if err == nil && user.Disabled() {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Calendar not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	cal, err := c.calendar(user, feed)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Calendar not found", http.StatusNotFound)
+		default:
+			log.Printf("calendar feed %d: %v", feed.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := cal.Write(w); err != nil {
+		log.Printf("calendar feed %d: %v", feed.ID, err)
+	}
+}
+
+// calendar builds the calendar of feed. ErrNotFound is returned
+// when the user lost access to the property of the feed.
+func (c *Calendars) calendar(user *models.User, feed *models.CalendarFeed) (*ical.Calendar, error) {
+	cal := &ical.Calendar{Name: "Tataruma"}
+
+	var properties []models.Property
+	if feed.PropertyID != 0 {
+		property, err := c.ps.ByID(feed.PropertyID)
+		if err != nil {
+			return nil, err
+		}
+		if c.az.Can(user, authz.ActionView, authz.Property(property)) != nil {
+			return nil, models.ErrNotFound
+		}
+		cal.Name = "Tataruma: " + property.Name
+		properties = append(properties, *property)
+	} else {
+		var err error
+		properties, err = c.properties(user)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tenants := map[uint]string{}
+	covered := map[uint]bool{}
+	for i := range properties {
+		p := &properties[i]
+		covered[p.ID] = true
+		leases, err := c.ls.ByPropertyID(p.ID)
+		if err != nil {
+			return nil, err
+		}
+		for j := range leases {
+			tenant, ok := tenants[leases[j].TenantID]
+			if !ok {
+				if u, err := c.us.ByID(leases[j].TenantID); err == nil {
+					tenant = u.Name
+				}
+				tenants[leases[j].TenantID] = tenant
+			}
+			name := p.Name
+			if tenant != "" {
+				name += " (" + tenant + ")"
+			}
+			c.leaseEvents(cal, &leases[j], name, fmt.Sprintf("/leases/%d", leases[j].ID))
+		}
+	}
+
+	// The leases the user rents under, on the feed of everything
+	if feed.PropertyID == 0 {
+		leases, err := c.ls.ByTenantID(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range leases {
+			if covered[leases[i].PropertyID] {
+				continue
+			}
+			property, err := c.ps.ByID(leases[i].PropertyID)
+			if err != nil {
+				return nil, err
+			}
+			c.leaseEvents(cal, &leases[i], property.Name, "/portal")
+		}
+	}
+	return cal, nil
+}
+
+// properties returns the properties of the organizations of
+// user, and those shared with them
+func (c *Calendars) properties(user *models.User) ([]models.Property, error) {
+	var properties []models.Property
+	seen := map[uint]bool{}
+	add := func(found []models.Property) {
+		for _, p := range found {
+			if !seen[p.ID] {
+				seen[p.ID] = true
+				properties = append(properties, p)
+			}
+		}
+	}
+
+	orgs, err := c.os.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, org := range orgs {
+		found, err := c.ps.ByOrganizationID(org.ID)
+		if err != nil {
+			return nil, err
+		}
+		add(found)
+	}
+
+	ids, err := c.az.Shared(user, authz.TypeProperty)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := c.ps.ByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	add(shared)
+	return properties, nil
+}
+
+// leaseEvents adds the start and end of the lease to cal, and
+// the days rent is due on from a month ago to a year ahead.
+// name says what the lease is of, path leads to it in the app.
+func (c *Calendars) leaseEvents(cal *ical.Calendar, l *models.Lease, name, path string) {
+	host := "tataruma"
+	if u, err := url.Parse(c.baseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	uid := func(what string) string {
+		return fmt.Sprintf("lease-%d-%s@%s", l.ID, what, host)
+	}
+	link := c.baseURL + path
+
+	cal.Events = append(cal.Events, ical.Event{
+		UID:     uid("start"),
+		Date:    l.StartsOn,
+		Summary: "Lease starts: " + name,
+		URL:     link,
+	})
+	if l.EndsOn != nil {
+		cal.Events = append(cal.Events, ical.Event{
+			UID:     uid("end"),
+			Date:    *l.EndsOn,
+			Summary: "Lease ends: " + name,
+			URL:     link,
+		})
+	}
+
+	if l.Rent <= 0 {
+		return
+	}
+	now := time.Now()
+	from, until := now.AddDate(0, rentPast, 0), now.AddDate(0, rentAhead, 0)
+	if from.Before(l.StartsOn) {
+		from = l.StartsOn
+	}
+	for due := l.RentDueOn(from); due.Before(until) && l.Active(due); due = l.RentDueOn(due.AddDate(0, 0, 1)) {
+		cal.Events = append(cal.Events, ical.Event{
+			UID:     uid("rent-" + due.Format("20060102")),
+			Date:    due,
+			Summary: "Rent of " + l.Rent.String() + " due: " + name,
+			URL:     link,
+		})
+	}
+}
+
+// calendarFeeds returns the feeds of the user with the name of
+// their property, for the profile page
+func calendarFeeds(cfs models.CalendarFeedService, ps models.PropertyService, userID uint) ([]calendarFeedEntry, error) {
+	feeds, err := cfs.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]calendarFeedEntry, 0, len(feeds))
+	for i := range feeds {
+		entry := calendarFeedEntry{CalendarFeed: &feeds[i]}
+		if feeds[i].PropertyID != 0 {
+			property, err := ps.ByID(feeds[i].PropertyID)
+			switch err {
+			case nil:
+				entry.PropertyName = property.Name
+			case models.ErrNotFound:
+				entry.PropertyName = "Deleted property"
+			default:
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/models"
+	"log"
+	"net/http"
+)
+
+// Deliveries records what the mail provider tells us became of
+// the emails we sent, and suppresses the addresses that bounced
+// for good or complained so they get no more emails.
+type Deliveries struct {
+	obs     models.OutboxService
+	sps     models.SuppressionService
+	mailgun *inbound.Mailgun
+}
+
+func NewDeliveries(services *models.Services, mailgun *inbound.Mailgun) *Deliveries {
+	return &Deliveries{
+		obs:     services.Outbox,
+		sps:     services.Suppression,
+		mailgun: mailgun,
+	}
+}
+
+// Mailgun receives the delivered, failed and complained events
+// of Mailgun. Mailgun retries on errors but not after 406 Not
+// Acceptable, which events that aren't Mailgun's get.
+//
+// POST /webhooks/mailgun/events
+func (d *Deliveries) Mailgun(w http.ResponseWriter, r *http.Request) {
+	e, err := d.mailgun.ParseEvent(r)
+	if err != nil {
+		log.Printf("delivery event rejected: %v", err)
+		http.Error(w, "Not acceptable", http.StatusNotAcceptable)
+		return
+	}
+
+	if err := d.record(e); err != nil {
+		log.Printf("delivery event for %s: %v", e.MessageID, err)
+		d.mailgun.Forget(e.Token)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (d *Deliveries) record(e *inbound.Event) error {
+	var status, reason string
+	switch e.Type {
+	case inbound.EventDelivered:
+		status = models.DeliveryDelivered
+	case inbound.EventBounced:
+		status, reason = models.DeliveryBounced, models.SuppressBounced
+	case inbound.EventComplained:
+		status, reason = models.DeliveryComplained, models.SuppressComplained
+	default:
+		return nil
+	}
+
+	if reason != "" {
+		err := d.sps.Create(&models.Suppression{
+			Email:  e.Recipient,
+			Reason: reason,
+			Detail: e.Detail,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Messages sent long ago are removed, and emails sent
+	// before the outbox have no key
+	_, err := d.obs.RecordDelivery(e.MessageID, status, e.Detail)
+	switch err {
+	case models.ErrNotFound, models.ErrIdempotencyKeyRequired:
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/models/modelstest"
+	"testing"
+)
+
+type memSuppressions struct {
+	models.SuppressionService
+	created []models.Suppression
+}
+
+func (ms *memSuppressions) Create(s *models.Suppression) error {
+	ms.created = append(ms.created, *s)
+	return nil
+}
+
+func TestDeliveriesRecord(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     inbound.Event
+		suppress  string
+		delivery  string
+		messageID string
+	}{
+		{"delivered", inbound.Event{Type: inbound.EventDelivered}, "", models.DeliveryDelivered, "abc123"},
+		{"failed for now", inbound.Event{}, "", "", "abc123"},
+		{"bounced", inbound.Event{Type: inbound.EventBounced}, models.SuppressBounced, models.DeliveryBounced, "abc123"},
+		{"complained", inbound.Event{Type: inbound.EventComplained}, models.SuppressComplained, models.DeliveryComplained, "abc123"},
+		{"bounced, sent before the outbox", inbound.Event{Type: inbound.EventBounced}, models.SuppressBounced, "", ""},
+		{"delivered, pruned from the outbox", inbound.Event{Type: inbound.EventDelivered}, "", "", "gone"},
+	}
+	for _, tt := range tests {
+		sps := &memSuppressions{}
+		obs := &modelstest.Outbox{Messages: []models.OutboxMessage{{IdempotencyKey: "abc123"}}}
+		d := &Deliveries{obs: obs, sps: sps}
+
+		e := tt.event
+		e.Recipient, e.MessageID, e.Detail = "jon@example.com", tt.messageID, "550 no such user"
+		if err := d.record(&e); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		switch {
+		case tt.suppress == "" && len(sps.created) != 0:
+			t.Errorf("%s: suppressed %+v", tt.name, sps.created)
+		case tt.suppress != "" && len(sps.created) != 1:
+			t.Errorf("%s: %d suppressions, want 1", tt.name, len(sps.created))
+		case tt.suppress != "":
+			s := sps.created[0]
+			if s.Email != e.Recipient || s.Reason != tt.suppress || s.Detail != e.Detail {
+				t.Errorf("%s: suppression = %+v, want %s for %s", tt.name, s, tt.suppress, e.Recipient)
+			}
+		}
+
+		if m := obs.Messages[0]; m.DeliveryStatus != tt.delivery {
+			t.Errorf("%s: delivery status = %q, want %q", tt.name, m.DeliveryStatus, tt.delivery)
+		}
+	}
+}
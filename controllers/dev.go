@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+)
+
+// Dev holds pages that only exist in development
+type Dev struct {
+	EmailsView *views.View
+	emailer    *email.Client
+}
+
+func NewDev(emailer *email.Client) *Dev {
+	return &Dev{
+		EmailsView: views.NewView("bootstrap", "dev/emails"),
+		emailer:    emailer,
+	}
+}
+
+type devEmailsData struct {
+	Locales []string
+	Names   []string
+}
+
+// GET /dev/emails
+func (d *Dev) Emails(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = &devEmailsData{
+		Locales: d.emailer.Locales(),
+		Names:   email.PreviewNames(),
+	}
+	d.EmailsView.Render(w, r, vd)
+}
+
+// GET /dev/emails/{locale}/{name}?format=text
+func (d *Dev) PreviewEmail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	msg, err := d.emailer.Preview(vars["locale"], vars["name"])
+	if err == email.ErrUnknownEmail {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("From: " + msg.From + "\nTo: " + msg.To + "\nSubject: " + msg.Subject + "\n\n" + msg.Text))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(msg.HTML))
+}
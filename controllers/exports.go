@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"io"
+	"log"
+	"net/http"
+)
+
+// ExportForm carries the token of the emailed download link
+type ExportForm struct {
+	Token string `schema:"token"`
+}
+
+// RequestExport queues an export of the data of the user, it is
+// built by package export which emails the link once ready.
+//
+// POST /profile/export
+func (u *Users) RequestExport(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if _, err := u.es.Request(user.ID); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We are preparing your data, you will get an email with the download link shortly.",
+	})
+}
+
+// DownloadExport sends the ZIP of an export. The link only
+// works for the user it was made for, so a forwarded email
+// doesn't hand out their data.
+//
+// GET /exports/download?token=
+func (u *Users) DownloadExport(w http.ResponseWriter, r *http.Request) {
+	var form ExportForm
+	if err := parseURLParams(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	export, err := u.es.Download(form.Token)
+	if err == nil && export.UserID != user.ID {
+		err = models.ErrTokenInvalid
+	}
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	f, err := u.store.Open(export.Path)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	filename := fmt.Sprintf("tataruma-%s.zip", export.CreatedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	io.Copy(w, f)
+}
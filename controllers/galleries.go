@@ -3,6 +3,7 @@ package controllers
 import (
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
 	"github.com/ruckuus/dojo1/context"
 	"github.com/ruckuus/dojo1/models"
 	"github.com/ruckuus/dojo1/views"
@@ -18,6 +19,7 @@ type Galleries struct {
 	gs        models.GalleryService
 	r         *mux.Router
 	is        models.ImageService
+	az        *authz.Authorizer
 }
 
 type GalleryForm struct {
@@ -31,10 +33,9 @@ const (
 	DeleteGallery   = "delete_gallery"
 	IndexGalleries  = "index_galleries"
 	maxMultipartMem = 1 << 20 // 1 MB
-	GalleryImageKey = "galleries"
 )
 
-func NewGalleries(services models.GalleryService, r *mux.Router, is models.ImageService) *Galleries {
+func NewGalleries(services models.GalleryService, r *mux.Router, is models.ImageService, az *authz.Authorizer) *Galleries {
 	return &Galleries{
 		NewView:   views.NewView("bootstrap", "galleries/new"),
 		ShowView:  views.NewView("bootstrap", "galleries/show"),
@@ -43,6 +44,7 @@ func NewGalleries(services models.GalleryService, r *mux.Router, is models.Image
 		gs:        services,
 		r:         r,
 		is:        is,
+		az:        az,
 	}
 }
 
@@ -55,6 +57,10 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	var form GalleryForm
 
 	user := context.User(r.Context())
+	org := context.Organization(r.Context())
+	if !authorized(w, g.az.Can(user, authz.ActionCreate, authz.In(authz.TypeGallery, org)), "Organization") {
+		return
+	}
 
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
@@ -63,11 +69,12 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery := models.Gallery{
-		UserID: user.ID,
-		Title:  form.Title,
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+		Title:          form.Title,
 	}
 
-	if err := g.gs.Create(&gallery); err != nil {
+	if err := g.gs.As(actor(r)).Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.NewView.Render(w, r, vd)
 		return
@@ -101,6 +108,7 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
 		return nil, err
 	}
 
@@ -114,7 +122,7 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		}
 		return nil, err
 	}
-	images, err := g.is.ByExternalTypeAndID(GalleryImageKey, gallery.ID)
+	images, err := g.is.ByExternalTypeAndID(models.GalleryImageKey, gallery.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return nil, err
@@ -132,10 +140,8 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find the user
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "You do not have permission to access this gallery.", http.StatusForbidden)
+	if !authorized(w, g.az.Can(user, authz.ActionEdit, authz.Gallery(gallery)), "Gallery") {
 		return
 	}
 
@@ -147,13 +153,11 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
-		http.Error(w, "Error updating gallery", http.StatusBadRequest)
 		return
 	}
 
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Error updating gallery, user mismatch", http.StatusForbidden)
+	if !authorized(w, g.az.Can(user, authz.ActionEdit, authz.Gallery(gallery)), "Gallery") {
 		return
 	}
 
@@ -169,7 +173,7 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 	gallery.Title = form.Title
 
-	err = g.gs.Update(gallery)
+	err = g.gs.As(actor(r)).Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
@@ -183,20 +187,20 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
-
 	if err != nil {
-		http.Error(w, "Error deleting gallery", http.StatusBadRequest)
 		return
 	}
 
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Error deleting gallery, user mismatch", http.StatusForbidden)
+	if !authorized(w, g.az.Can(user, authz.ActionDelete, authz.Gallery(gallery)), "Gallery") {
 		return
 	}
 
 	var vd views.Data
-	err = g.gs.Delete(gallery.ID)
+	err = g.gs.As(actor(r)).Delete(gallery.ID)
+	if err == nil {
+		err = g.az.Forget(authz.Gallery(gallery))
+	}
 
 	if err != nil {
 		vd.SetAlert(err)
@@ -215,8 +219,8 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
-	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	org := context.Organization(r.Context())
+	galleries, err := g.gs.ByOrganizationID(org.ID)
 	if err != nil {
 		vd.SetAlert(err)
 		g.IndexView.Render(w, r, vd)
@@ -235,8 +239,7 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !authorized(w, g.az.Can(user, authz.ActionEdit, authz.Gallery(gallery)), "Gallery") {
 		return
 	}
 
@@ -258,12 +261,13 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		defer file.Close()
 
 		image := models.Image{
-			ExternalType: GalleryImageKey,
+			ExternalType: models.GalleryImageKey,
 			ExternalID:   gallery.ID,
 			Filename:     f.Filename,
+			UserID:       user.ID,
 		}
 
-		err = g.is.Create(&image, file)
+		err = g.is.As(actor(r)).Create(&image, file)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -285,17 +289,15 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := context.User(r.Context())
-
-	if user.ID != gallery.UserID {
-		http.Error(w, "You don't have permission to delete this image.", http.StatusForbidden)
+	if !authorized(w, g.az.Can(user, authz.ActionEdit, authz.Gallery(gallery)), "Gallery") {
 		return
 	}
 
 	// Get filename from the path
 	filename := mux.Vars(r)["filename"]
 
-	err = g.is.Delete(&models.Image{
-		ExternalType: GalleryImageKey,
+	err = g.is.As(actor(r)).Delete(&models.Image{
+		ExternalType: models.GalleryImageKey,
 		ExternalID:   gallery.ID,
 		Filename:     filename,
 	})
@@ -2,6 +2,14 @@ package controllers
 
 import (
 	"github.com/gorilla/schema"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/mailqueue"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 )
@@ -38,3 +46,98 @@ func parseURLParams(r *http.Request, dst interface{}) error {
 
 	return parseValues(r.Form, dst)
 }
+
+// clientIP returns the address of the client making the request.
+// Behind our proxy this is the address it reported, see
+// middleware.RealIP, never a header the client sent.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// actor is who the request is made by, for the audit log
+func actor(r *http.Request) models.Actor {
+	a := models.Actor{IP: clientIP(r)}
+	if user := context.User(r.Context()); user != nil {
+		a.UserID = user.ID
+	}
+	return a
+}
+
+// requestLocale is the language of the browser making the
+// request, out of those emails are written in
+func requestLocale(r *http.Request, emailer *email.Client) string {
+	return emailer.MatchLocale(r.Header.Get("Accept-Language"))
+}
+
+// queued returns emailer queueing its emails in the outbox of
+// tx, so they are only sent once tx is committed.
+func queued(emailer *email.Client, tx *models.Services) *email.Client {
+	return emailer.Via(mailqueue.NewMailer(tx.Outbox))
+}
+
+// publicError is an error whose message is written for the
+// user, so views show it as is.
+type publicError string
+
+func (e publicError) Error() string {
+	return string(e)
+}
+
+func (e publicError) Public() string {
+	return string(e)
+}
+
+// authorized writes the response for a failed authorization
+// check of what, e.g. "Property". It reports whether the
+// handler may go on.
+func authorized(w http.ResponseWriter, err error, what string) bool {
+	switch err {
+	case nil:
+		return true
+	case authz.ErrNotFound:
+		http.Error(w, what+" not found", http.StatusNotFound)
+	case authz.ErrForbidden:
+		http.Error(w, authz.ErrForbidden.Public()+".", http.StatusForbidden)
+	default:
+		log.Println(err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// redirectError sends the user to url with err shown as an alert
+func redirectError(w http.ResponseWriter, r *http.Request, url string, err error) {
+	var vd views.Data
+	vd.SetAlert(err)
+	views.RedirectAlert(w, r, url, http.StatusFound, *vd.Alert)
+}
+
+// saveUploads stores the files posted in field of a multipart
+// form as images of externalType and externalID, e.g. the
+// photos of a ticket.
+func saveUploads(is models.ImageService, r *http.Request, field, externalType string, externalID uint) error {
+	for _, f := range r.MultipartForm.File[field] {
+		file, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		a := actor(r)
+		image := models.Image{
+			ExternalType: externalType,
+			ExternalID:   externalID,
+			Filename:     f.Filename,
+			UserID:       a.UserID,
+		}
+		err = is.As(a).Create(&image, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
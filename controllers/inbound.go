@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/notify"
+	"github.com/ruckuus/dojo1/webhook"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// maxInboundSize is the largest email accepted, attachments
+// included
+const maxInboundSize = 25 << 20
+
+// Inbound turns the emails users send us into tickets and
+// ticket comments. Replies to ticket emails go to the address
+// of the ticket, see inbound.Addresses, and new tickets are
+// opened at the tickets address.
+type Inbound struct {
+	services  *models.Services
+	us        models.UserService
+	ls        models.LeaseService
+	ps        models.PropertyService
+	ts        models.TicketService
+	az        *authz.Authorizer
+	notifier  *notify.Notifier
+	hooks     *webhook.Dispatcher
+	addresses *inbound.Addresses
+	mailgun   *inbound.Mailgun
+}
+
+func NewInbound(services *models.Services, az *authz.Authorizer, notifier *notify.Notifier, hooks *webhook.Dispatcher, addresses *inbound.Addresses, mailgun *inbound.Mailgun) *Inbound {
+	return &Inbound{
+		services:  services,
+		us:        services.User,
+		ls:        services.Lease,
+		ps:        services.Property,
+		ts:        services.Ticket,
+		az:        az,
+		notifier:  notifier,
+		hooks:     hooks,
+		addresses: addresses,
+		mailgun:   mailgun,
+	}
+}
+
+// Mailgun receives the emails forwarded by a Mailgun route.
+// Mailgun retries on errors, but not after 406 Not Acceptable,
+// which is what rejected emails get.
+//
+// POST /webhooks/mailgun/inbound
+func (in *Inbound) Mailgun(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxInboundSize)
+	msg, err := in.mailgun.Parse(r)
+	if err != nil {
+		in.reject(w, msg, err)
+		return
+	}
+	in.deliver(w, r, msg)
+}
+
+// Raw receives an email in the RFC 5322 format, as saved by the
+// outbox mailer. It is there to try inbound email locally, and
+// is only routed outside of production.
+//
+// POST /webhooks/inbound/raw
+func (in *Inbound) Raw(w http.ResponseWriter, r *http.Request) {
+	msg, err := inbound.ParseRaw(http.MaxBytesReader(w, r.Body, maxInboundSize))
+	if err != nil {
+		in.reject(w, msg, err)
+		return
+	}
+	in.deliver(w, r, msg)
+}
+
+// deliver adds msg to the ticket it replies to, or opens a
+// ticket with it
+func (in *Inbound) deliver(w http.ResponseWriter, r *http.Request, msg *inbound.Message) {
+	user, err := in.us.ByEmail(msg.From)
+	if err == nil && user.Disabled() {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		in.reject(w, msg, err)
+		return
+	}
+
+	ticketID, err := in.addresses.Match(msg.Recipients)
+	if err != nil {
+		in.reject(w, msg, err)
+		return
+	}
+
+	a := models.Actor{UserID: user.ID, IP: clientIP(r)}
+	if ticketID == 0 {
+		err = in.openTicket(a, user, msg)
+	} else {
+		err = in.comment(a, user, ticketID, msg)
+	}
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	case models.ErrNotFound, models.ErrTitleRequired, models.ErrCommentBodyRequired:
+		in.reject(w, msg, err)
+	default:
+		log.Printf("inbound email from %s: %v", msg.From, err)
+		// Nothing was kept of it, let Mailgun try again
+		if msg.Token != "" {
+			in.mailgun.Forget(msg.Token)
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// openTicket opens a ticket under the current lease of user,
+// the subject of msg is its title. The ticket and attachments
+// are saved at once, so a retried email doesn't leave another.
+func (in *Inbound) openTicket(a models.Actor, user *models.User, msg *inbound.Message) error {
+	lease, err := in.ls.Current(user.ID)
+	if err != nil {
+		return err
+	}
+
+	ticket := models.Ticket{
+		PropertyID:  lease.PropertyID,
+		LeaseID:     lease.ID,
+		OpenedByID:  user.ID,
+		Title:       msg.Subject,
+		Description: msg.Text,
+	}
+	err = in.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Ticket.Create(&ticket); err != nil {
+			return err
+		}
+		return saveAttachments(tx.Image, a, msg, models.TicketPhotoKey, ticket.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	notifyTicketOpened(in.ps, in.notifier, in.hooks, in.addresses, &ticket)
+	return nil
+}
+
+// comment adds msg to the ticket as a comment of user, who must
+// be its tenant or allowed to edit its property. Like tickets,
+// the comment and attachments are saved at once.
+func (in *Inbound) comment(a models.Actor, user *models.User, ticketID uint, msg *inbound.Message) error {
+	if msg.Text == "" && len(msg.Attachments) == 0 {
+		return models.ErrCommentBodyRequired
+	}
+
+	ticket, err := in.ts.ByID(ticketID)
+	if err != nil {
+		return err
+	}
+	lease, err := in.ls.ByID(ticket.LeaseID)
+	if err != nil {
+		return err
+	}
+	property, err := in.ps.ByID(ticket.PropertyID)
+	if err != nil {
+		return err
+	}
+
+	byTenant := user.ID == ticket.OpenedByID || user.ID == lease.TenantID
+	if !byTenant && in.az.Can(user, authz.ActionEdit, authz.Property(property)) != nil {
+		// Only those on the ticket have its address
+		return models.ErrNotFound
+	}
+
+	comment := models.TicketComment{
+		TicketID: ticket.ID,
+		AuthorID: user.ID,
+		Body:     msg.Text,
+		Source:   models.CommentSourceEmail,
+	}
+	err = in.services.Transaction(func(tx *models.Services) error {
+		if err := tx.TicketComment.Create(&comment); err != nil {
+			return err
+		}
+		return saveAttachments(tx.Image, a, msg, models.TicketCommentKey, comment.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The other side of the ticket hears about the comment
+	n := models.Notification{
+		Event:   models.NotifyTicketUpdated,
+		Key:     fmt.Sprintf("ticket:%d:comment:%d", ticket.ID, comment.ID),
+		Title:   user.Name + " commented on ticket \"" + ticket.Title + "\"",
+		Body:    comment.Body,
+		ReplyTo: in.addresses.Ticket(ticket.ID),
+	}
+	if byTenant {
+		n.UserID = property.UserID
+		n.URL = fmt.Sprintf("/properties/%d", property.ID)
+	} else {
+		n.UserID = ticket.OpenedByID
+		n.URL = fmt.Sprintf("/portal/tickets/%d", ticket.ID)
+	}
+	if err := in.notifier.Notify(&n); err != nil {
+		log.Println(err)
+	}
+	if err := in.hooks.Emit(property.OrganizationID, models.EventTicketUpdated, newAPITicket(ticket)); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// saveAttachments stores the attachments of msg as images of
+// the ticket or comment, uploaded by a
+func saveAttachments(ims models.ImageService, a models.Actor, msg *inbound.Message, externalType string, externalID uint) error {
+	for _, att := range msg.Attachments {
+		// The name is the sender's, keep it from leaving the
+		// directory of the ticket
+		filename := filepath.Base(strings.TrimSpace(att.Filename))
+		switch filename {
+		case ".", "..", string(filepath.Separator):
+			continue
+		}
+		image := models.Image{
+			ExternalType: externalType,
+			ExternalID:   externalID,
+			Filename:     filename,
+			UserID:       a.UserID,
+		}
+		if err := ims.As(a).Create(&image, bytes.NewReader(att.Content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject refuses an email for good. Why is only logged, the
+// sender may be anyone.
+func (in *Inbound) reject(w http.ResponseWriter, msg *inbound.Message, err error) {
+	from := "unknown sender"
+	if msg != nil {
+		from = msg.From
+	}
+	log.Printf("inbound email from %s rejected: %v", from, err)
+	http.Error(w, "Not acceptable", http.StatusNotAcceptable)
+}
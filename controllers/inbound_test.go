@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/models"
+	"testing"
+)
+
+func TestSaveAttachmentsKeepsNamesInPlace(t *testing.T) {
+	msg := &inbound.Message{Attachments: []inbound.Attachment{
+		{Filename: "leak.jpg"},
+		{Filename: "../../etc/passwd"},
+		{Filename: ".."},
+		{Filename: "photos/.."},
+		{Filename: ""},
+		{Filename: "  "},
+		{Filename: "/"},
+		{Filename: "."},
+	}}
+	images := &memImages{}
+	if err := saveAttachments(images, models.Actor{UserID: 1}, msg, models.TicketPhotoKey, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, i := range images.images {
+		names = append(names, i.Filename)
+		if i.ExternalType != models.TicketPhotoKey || i.ExternalID != 7 || i.UserID != 1 {
+			t.Errorf("image %+v saved for the wrong ticket or user", i)
+		}
+	}
+	if len(names) != 2 || names[0] != "leak.jpg" || names[1] != "passwd" {
+		t.Errorf("saved %q, want [leak.jpg passwd]", names)
+	}
+}
@@ -0,0 +1,337 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const errInvitationGone publicError = "This invitation is no longer valid, please ask for a new one."
+
+// Invitations lets users invite people by email to take a role
+// on their properties, whether or not they have an account yet.
+type Invitations struct {
+	AcceptView *views.View
+	services   *models.Services
+	is         models.InvitationService
+	ps         models.PropertyService
+	us         models.UserService
+	az         *authz.Authorizer
+	emailer    *email.Client
+}
+
+// InvitationForm is used to invite someone to a property
+type InvitationForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+type AcceptInvitationForm struct {
+	Token string `schema:"token"`
+}
+
+// invitationData is what the accept page renders
+type invitationData struct {
+	Token     string
+	Email     string
+	Role      string
+	What      string
+	InvitedBy string
+	SignedIn  bool
+	SignupURL string
+}
+
+func NewInvitations(services *models.Services, az *authz.Authorizer, emailer *email.Client) *Invitations {
+	return &Invitations{
+		AcceptView: views.NewView("bootstrap", "invitations/accept"),
+		services:   services,
+		is:         services.Invitation,
+		ps:         services.Property,
+		us:         services.User,
+		az:         az,
+		emailer:    emailer,
+	}
+}
+
+// Create invites someone to the property and emails them
+//
+// POST /properties/:id/invitations
+func (i *Invitations) Create(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	property, err := i.ps.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Property not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	var form InvitationForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = i.az.CanGive(user, authz.Property(property), authz.Role(form.Role))
+	switch err {
+	case nil:
+	case authz.ErrNotFound, authz.ErrForbidden:
+		authorized(w, err, "Property")
+		return
+	default:
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	inv := models.Invitation{
+		ResourceType: authz.TypeProperty,
+		ResourceID:   property.ID,
+		Email:        form.Email,
+		Role:         form.Role,
+		InvitedByID:  user.ID,
+	}
+	err = i.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Invitation.Create(&inv); err != nil {
+			return err
+		}
+		return queued(i.emailer, tx).In(user.Locale).Invite(inv.Email, user.Name, property.Name, inv.Role, inv.Token)
+	})
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "An invitation has been sent to " + inv.Email + ".",
+	})
+}
+
+// invitationByID looks up the invitation in the URL along with
+// its property, and checks the user may manage it.
+func (i *Invitations) invitationByID(w http.ResponseWriter, r *http.Request) (*models.Invitation, *models.Property, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return nil, nil, err
+	}
+
+	inv, err := i.is.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+
+	property, err := i.property(inv)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+
+	user := context.User(r.Context())
+	err = i.az.CanGive(user, authz.Property(property), authz.Role(inv.Role))
+	if !authorized(w, err, "Invitation") {
+		return nil, nil, err
+	}
+	return inv, property, nil
+}
+
+// property returns the property inv is for
+func (i *Invitations) property(inv *models.Invitation) (*models.Property, error) {
+	if inv.ResourceType != authz.TypeProperty {
+		return nil, models.ErrNotFound
+	}
+	return i.ps.ByID(inv.ResourceID)
+}
+
+// Resend issues a new token for the invitation and emails it
+// again, which also restarts its expiry.
+//
+// POST /invitations/:id/resend
+func (i *Invitations) Resend(w http.ResponseWriter, r *http.Request) {
+	inv, property, err := i.invitationByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	user := context.User(r.Context())
+	err = i.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Invitation.Renew(inv); err != nil {
+			return err
+		}
+		return queued(i.emailer, tx).In(user.Locale).Invite(inv.Email, user.Name, property.Name, inv.Role, inv.Token)
+	})
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The invitation has been sent again to " + inv.Email + ".",
+	})
+}
+
+// Delete revokes the invitation
+//
+// POST /invitations/:id/delete
+func (i *Invitations) Delete(w http.ResponseWriter, r *http.Request) {
+	inv, property, err := i.invitationByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	if err := i.is.Delete(inv.ID); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The invitation for " + inv.Email + " has been revoked.",
+	})
+}
+
+// Show renders the invitation from the email. Visitors are
+// offered to sign up or to sign in first.
+//
+// GET /invitations/accept?token=
+func (i *Invitations) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AcceptInvitationForm
+	parseURLParams(r, &form)
+
+	inv, property, err := i.pending(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		i.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	data := invitationData{
+		Token:    form.Token,
+		Email:    inv.Email,
+		Role:     inv.Role,
+		What:     property.Name,
+		SignedIn: context.User(r.Context()) != nil,
+	}
+	if inviter, err := i.us.ByID(inv.InvitedByID); err == nil {
+		data.InvitedBy = inviter.Name
+	}
+
+	v := url.Values{}
+	v.Set("email", inv.Email)
+	v.Set("invite", form.Token)
+	data.SignupURL = "/signup?" + v.Encode()
+
+	vd.Yield = &data
+	i.AcceptView.Render(w, r, vd)
+}
+
+// Accept gives the signed in user the role they were invited
+// to, on behalf of whoever invited them.
+//
+// POST /invitations/accept
+func (i *Invitations) Accept(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AcceptInvitationForm
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		i.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	inv, property, err := i.pending(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		i.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	inviter, err := i.us.ByID(inv.InvitedByID)
+	if err != nil {
+		vd.SetAlert(errInvitationGone)
+		i.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	// The grant is made as the inviter, so it fails if they lost
+	// the right to give this role since they sent the invitation.
+	user := context.User(r.Context())
+	_, err = i.az.Grant(inviter, authz.Property(property), user, authz.Role(inv.Role))
+	switch err {
+	case nil, authz.ErrHasAccess:
+	case authz.ErrNotFound, authz.ErrForbidden, authz.ErrRoleTooHigh:
+		vd.SetAlert(errInvitationGone)
+		i.AcceptView.Render(w, r, vd)
+		return
+	default:
+		vd.SetAlert(err)
+		i.AcceptView.Render(w, r, vd)
+		return
+	}
+
+	// Following the link proves the user owns the invited address
+	if !user.Verified() && strings.EqualFold(user.Email, inv.Email) {
+		now := time.Now()
+		user.VerifiedAt = &now
+		i.us.Update(user)
+	}
+
+	i.is.Delete(inv.ID)
+
+	views.RedirectAlert(w, r, fmt.Sprintf("/properties/%d", property.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "You are now " + inv.Role + " of " + property.Name + ".",
+	})
+}
+
+// pending returns the invitation for token and its property, if
+// it can still be accepted.
+func (i *Invitations) pending(token string) (*models.Invitation, *models.Property, error) {
+	inv, err := i.is.Pending(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	property, err := i.property(inv)
+	if err == models.ErrNotFound {
+		// The property was deleted, the invitation goes with it
+		i.is.Delete(inv.ID)
+		return nil, nil, errInvitationGone
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return inv, property, nil
+}
@@ -0,0 +1,322 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"github.com/ruckuus/dojo1/webhook"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateFormat is how dates are entered in forms
+const dateFormat = "2006-01-02"
+
+const errDateInvalid publicError = "Dates must look like 2020-01-31."
+
+// Leases lets whoever manages a property rent it out, keep the
+// ledger of each lease and share documents with the tenant.
+type Leases struct {
+	ShowView *views.View
+	ls       models.LeaseService
+	les      models.LedgerService
+	ps       models.PropertyService
+	us       models.UserService
+	is       models.ImageService
+	az       *authz.Authorizer
+	hooks    *webhook.Dispatcher
+}
+
+// LeaseForm is used to rent a property to an existing user
+type LeaseForm struct {
+	Email    string `schema:"email"`
+	StartsOn string `schema:"starts_on"`
+	EndsOn   string `schema:"ends_on"`
+	Rent     string `schema:"rent"`
+}
+
+// LedgerEntryForm is used to post a charge or a payment
+type LedgerEntryForm struct {
+	PostedOn    string `schema:"posted_on"`
+	Description string `schema:"description"`
+	Amount      string `schema:"amount"`
+	Payment     bool   `schema:"payment"`
+}
+
+// leaseData is what the lease page renders
+type leaseData struct {
+	*models.Lease
+	Property   *models.Property
+	TenantName string
+	Balance    models.Money
+	Entries    []models.LedgerEntry
+	Documents  []models.Image
+}
+
+func NewLeases(services *models.Services, az *authz.Authorizer, hooks *webhook.Dispatcher) *Leases {
+	return &Leases{
+		ShowView: views.NewView("bootstrap", "leases/show"),
+		ls:       services.Lease,
+		les:      services.Ledger,
+		ps:       services.Property,
+		us:       services.User,
+		is:       services.Image,
+		az:       az,
+		hooks:    hooks,
+	}
+}
+
+// parseDate reads an optional date entered in a form
+func parseDate(s string) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(dateFormat, s)
+	if err != nil {
+		return nil, errDateInvalid
+	}
+	return &t, nil
+}
+
+// Create rents the property out
+//
+// POST /properties/:id/leases
+func (l *Leases) Create(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
+		return
+	}
+	property, err := l.ps.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Property not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user := context.User(r.Context())
+	if !authorized(w, l.az.Can(user, authz.ActionEdit, authz.Property(property)), "Property") {
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	var form LeaseForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	tenant, err := l.us.ByEmail(form.Email)
+	if err == models.ErrNotFound {
+		err = errNoSuchUser
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	lease := models.Lease{
+		PropertyID: property.ID,
+		TenantID:   tenant.ID,
+	}
+	startsOn, err := parseDate(form.StartsOn)
+	if err == nil && startsOn != nil {
+		lease.StartsOn = *startsOn
+	}
+	if err == nil {
+		lease.EndsOn, err = parseDate(form.EndsOn)
+	}
+	if err == nil && form.Rent != "" {
+		lease.Rent, err = models.ParseMoney(form.Rent)
+	}
+	if err == nil {
+		err = l.ls.Create(&lease)
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+	if err := l.hooks.Emit(property.OrganizationID, models.EventLeaseCreated, newAPILease(&lease)); err != nil {
+		log.Println(err)
+	}
+
+	views.RedirectAlert(w, r, fmt.Sprintf("/leases/%d", lease.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The property is now rented to " + tenant.Name + ".",
+	})
+}
+
+// leaseByID looks up the lease in the URL along with its
+// property, and checks the user may manage the property.
+func (l *Leases) leaseByID(w http.ResponseWriter, r *http.Request) (*models.Lease, *models.Property, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return nil, nil, err
+	}
+
+	lease, err := l.ls.ByID(uint(id))
+	var property *models.Property
+	if err == nil {
+		property, err = l.ps.ByID(lease.PropertyID)
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Lease not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+
+	user := context.User(r.Context())
+	err = l.az.Can(user, authz.ActionEdit, authz.Property(property))
+	if !authorized(w, err, "Lease") {
+		return nil, nil, err
+	}
+	return lease, property, nil
+}
+
+// Show renders the lease with its ledger and documents
+//
+// GET /leases/:id
+func (l *Leases) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	lease, property, err := l.leaseByID(w, r)
+	if err != nil {
+		return
+	}
+
+	data := leaseData{
+		Lease:    lease,
+		Property: property,
+	}
+	vd.Yield = &data
+	if tenant, err := l.us.ByID(lease.TenantID); err == nil {
+		data.TenantName = tenant.Name
+	}
+
+	data.Balance, err = l.les.Balance(lease.ID)
+	if err == nil {
+		data.Entries, err = l.les.ByLeaseID(lease.ID)
+	}
+	if err == nil {
+		data.Documents, err = l.is.ByExternalTypeAndID(models.LeaseDocumentKey, lease.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	l.ShowView.Render(w, r, vd)
+}
+
+// Delete removes the lease, the tenant loses access to the portal
+//
+// POST /leases/:id/delete
+func (l *Leases) Delete(w http.ResponseWriter, r *http.Request) {
+	lease, property, err := l.leaseByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := l.ls.Delete(lease.ID); err != nil {
+		redirectError(w, r, fmt.Sprintf("/leases/%d", lease.ID), err)
+		return
+	}
+	if err := l.hooks.Emit(property.OrganizationID, models.EventLeaseDeleted, newAPILease(lease)); err != nil {
+		log.Println(err)
+	}
+
+	views.RedirectAlert(w, r, fmt.Sprintf("/properties/%d", property.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Lease deleted.",
+	})
+}
+
+// CreateEntry posts a charge or a payment on the lease
+//
+// POST /leases/:id/entries
+func (l *Leases) CreateEntry(w http.ResponseWriter, r *http.Request) {
+	lease, property, err := l.leaseByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/leases/%d", lease.ID)
+
+	var form LedgerEntryForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	entry := models.LedgerEntry{
+		LeaseID:     lease.ID,
+		Description: form.Description,
+	}
+	postedOn, err := parseDate(form.PostedOn)
+	if err == nil && postedOn != nil {
+		entry.PostedOn = *postedOn
+	}
+	if err == nil {
+		entry.Amount, err = models.ParseMoney(form.Amount)
+	}
+	if err == nil {
+		if form.Payment {
+			entry.Amount = -entry.Amount
+		}
+		err = l.les.Create(&entry)
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+	if entry.Amount < 0 {
+		err := l.hooks.Emit(property.OrganizationID, models.EventPaymentCreated, newAPIPayment(&entry, property.ID))
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Ledger entry posted.",
+	})
+}
+
+// UploadDocument shares documents with the tenant
+//
+// POST /leases/:id/documents
+func (l *Leases) UploadDocument(w http.ResponseWriter, r *http.Request) {
+	lease, _, err := l.leaseByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/leases/%d", lease.ID)
+
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+	if err := saveUploads(l.is, r, "documents", models.LeaseDocumentKey, lease.ID); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Documents shared with the tenant.",
+	})
+}
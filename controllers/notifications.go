@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strconv"
+)
+
+// inboxLimit is how many notifications the inbox lists at most
+const inboxLimit = 100
+
+// Notifications is the in-app inbox, notifications are sent by
+// package notify.
+type Notifications struct {
+	InboxView *views.View
+	ns        models.NotificationService
+}
+
+// notificationChannel is the channel picked for an event, as
+// the profile page lists it
+type notificationChannel struct {
+	models.NotificationEvent
+	Current string
+}
+
+func NewNotifications(services *models.Services) *Notifications {
+	return &Notifications{
+		InboxView: views.NewView("bootstrap", "notifications/index"),
+		ns:        services.Notification,
+	}
+}
+
+// GET /notifications
+func (n *Notifications) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+
+	notifications, err := n.ns.ByUserID(user.ID, inboxLimit)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = notifications
+	n.InboxView.Render(w, r, vd)
+}
+
+// Read marks the notification as read and follows its link
+//
+// POST /notifications/:id/read
+func (n *Notifications) Read(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	notification, err := n.ns.MarkRead(user.ID, uint(id))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	default:
+		redirectError(w, r, "/notifications", err)
+		return
+	}
+
+	url := notification.URL
+	if url == "" {
+		url = "/notifications"
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// POST /notifications/read
+func (n *Notifications) ReadAll(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := n.ns.MarkAllRead(user.ID); err != nil {
+		redirectError(w, r, "/notifications", err)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusFound)
+}
+
+// UpdateChannels saves how the user wants to be notified of
+// each event. The form has a "channel_<event>" field per event.
+//
+// POST /profile/notifications
+func (n *Notifications) UpdateChannels(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	channels := map[string]string{}
+	for _, e := range models.NotificationEvents {
+		if channel := r.PostForm.Get("channel_" + e.Name); channel != "" {
+			channels[e.Name] = channel
+		}
+	}
+
+	user := context.User(r.Context())
+	if err := n.ns.SetChannels(user.ID, channels); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your notification settings have been saved.",
+	})
+}
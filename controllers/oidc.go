@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/oidc"
+	"github.com/ruckuus/dojo1/rand"
+	"github.com/ruckuus/dojo1/views"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// flowCookie keeps the state, nonce and PKCE verifier while the
+// user is away at the provider.
+const flowCookie = "oidc_flow"
+
+const (
+	errFlowInvalid    publicError = "Your sign in request is invalid or has expired, please try again."
+	errAccountDeleted publicError = "This account has been deleted. You can restore it with your email address and password."
+)
+
+// OIDC handles signing in with, and linking of, accounts at
+// external OpenID Connect providers.
+type OIDC struct {
+	users     *Users
+	is        models.IdentityService
+	providers map[string]*oidc.Provider
+	hmac      hash.HMAC
+}
+
+// oidcFlow is what we keep in the flow cookie
+type oidcFlow struct {
+	oidc.Flow
+	Provider string    `json:"provider"`
+	LinkUser uint      `json:"link_user,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NewOIDC returns the OIDC controller. The providers are also
+// made available to the login and profile pages of users.
+func NewOIDC(users *Users, is models.IdentityService, providers []*oidc.Provider, hmacKey string) *OIDC {
+	o := OIDC{
+		users:     users,
+		is:        is,
+		providers: map[string]*oidc.Provider{},
+		hmac:      hash.NewHMAC(hmacKey),
+	}
+	for _, p := range providers {
+		o.providers[p.Name] = p
+	}
+	users.providers = providers
+	return &o
+}
+
+// Login sends the user to the provider to sign in
+//
+// GET /auth/:provider/login
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	o.start(w, r, 0)
+}
+
+// Link sends the signed in user to the provider, to link the
+// account there with their profile.
+//
+// POST /auth/:provider/link
+func (o *OIDC) Link(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	o.start(w, r, user.ID)
+}
+
+func (o *OIDC) start(w http.ResponseWriter, r *http.Request, linkUser uint) {
+	provider, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := oidc.NewFlow()
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(f)
+	if err != nil {
+		log.Println(err)
+		o.fail(w, r, linkUser, publicError(provider.DisplayName+" is not available right now."))
+		return
+	}
+
+	flow := oidcFlow{
+		Flow:     *f,
+		Provider: provider.Name,
+		LinkUser: linkUser,
+		Expires:  time.Now().Add(10 * time.Minute),
+	}
+	if err := o.setFlow(w, &flow); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back to
+//
+// GET /auth/:provider/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := o.providers[mux.Vars(r)["provider"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	flow, err := o.flow(r)
+	o.clearFlow(w)
+	if err != nil || flow.Provider != provider.Name || r.FormValue("state") != flow.State {
+		o.fail(w, r, 0, errFlowInvalid)
+		return
+	}
+
+	if errCode := r.FormValue("error"); errCode != "" {
+		o.fail(w, r, flow.LinkUser, publicError(provider.DisplayName+" did not sign you in ("+errCode+")."))
+		return
+	}
+
+	claims, err := provider.Exchange(&flow.Flow, r.FormValue("code"))
+	if err != nil {
+		log.Println(err)
+		o.fail(w, r, flow.LinkUser, publicError("We could not verify your "+provider.DisplayName+" account."))
+		return
+	}
+
+	if flow.LinkUser != 0 {
+		o.link(w, r, flow, provider, claims)
+		return
+	}
+
+	identity, err := o.is.ByProviderSubject(provider.Name, claims.Subject)
+	switch err {
+	case nil:
+		o.login(w, r, identity, provider, claims)
+	case models.ErrNotFound:
+		o.signup(w, r, provider, claims)
+	default:
+		o.fail(w, r, 0, err)
+	}
+}
+
+// login signs in the user identity is linked to. An identity
+// whose user was purged is left over from before identities
+// were purged along with their user, it is treated as not
+// linked.
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request, identity *models.Identity, provider *oidc.Provider, claims *oidc.Claims) {
+	user, err := o.users.us.ByID(identity.UserID)
+	if err == models.ErrNotFound {
+		_, err = o.users.us.DeletedByID(identity.UserID)
+		switch err {
+		case nil:
+			err = errAccountDeleted
+		case models.ErrNotFound:
+			if err := o.is.Delete(identity.ID); err != nil {
+				o.fail(w, r, 0, err)
+				return
+			}
+			o.signup(w, r, provider, claims)
+			return
+		}
+	}
+	if err != nil {
+		o.fail(w, r, 0, err)
+		return
+	}
+	o.users.completeLogin(w, r, user)
+}
+
+// link adds the provider account to the user that started the flow
+func (o *OIDC) link(w http.ResponseWriter, r *http.Request, flow *oidcFlow, provider *oidc.Provider, claims *oidc.Claims) {
+	user := context.User(r.Context())
+	if user == nil || user.ID != flow.LinkUser {
+		o.fail(w, r, 0, errFlowInvalid)
+		return
+	}
+
+	identity := models.Identity{
+		UserID:   user.ID,
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	if err := o.is.Create(&identity); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your " + provider.DisplayName + " account is now linked.",
+	})
+}
+
+// signup creates a user for a provider account we haven't seen
+// before. We never link to an existing user by email here, that
+// would hand the account to whoever controls the address at the
+// provider; the owner has to link from their profile instead.
+func (o *OIDC) signup(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, claims *oidc.Claims) {
+	if claims.Email == "" {
+		o.fail(w, r, 0, publicError(provider.DisplayName+" did not share your email address with us."))
+		return
+	}
+
+	_, err := o.users.us.ByEmail(claims.Email)
+	switch err {
+	case models.ErrNotFound:
+	case nil:
+		o.fail(w, r, 0, publicError("An account with this email address already exists. "+
+			"Please sign in with your password and link "+provider.DisplayName+" from your profile."))
+		return
+	default:
+		o.fail(w, r, 0, err)
+		return
+	}
+
+	// The user signs in through the provider, but the account
+	// needs a password. Nobody knows this one, it can be set
+	// with the forgot password flow.
+	password, err := rand.String(32)
+	if err != nil {
+		o.fail(w, r, 0, err)
+		return
+	}
+
+	user := models.User{
+		Name:     claims.Name,
+		Email:    claims.Email,
+		Password: password,
+		Locale:   requestLocale(r, o.users.emailer),
+	}
+	if claims.EmailVerified {
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+	err = o.users.services.Transaction(func(tx *models.Services) error {
+		if err := tx.User.Create(&user); err != nil {
+			return err
+		}
+		if _, err := authz.NewAuthorizer(tx.Grant, tx.Organization).FoundPersonal(&user); err != nil {
+			return err
+		}
+		identity := models.Identity{
+			UserID:   user.ID,
+			Provider: provider.Name,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		}
+		if err := tx.Identity.Create(&identity); err != nil {
+			return err
+		}
+		err := queued(o.users.emailer, tx).In(user.Locale).Welcome(user.Name, user.Email)
+		if err != nil || user.Verified() {
+			return err
+		}
+		return o.users.queueVerification(tx, &user)
+	})
+	if err != nil {
+		o.fail(w, r, 0, err)
+		return
+	}
+
+	o.users.completeLogin(w, r, &user)
+}
+
+// Unlink removes a linked provider account from the profile
+//
+// POST /identities/:id/delete
+func (o *OIDC) Unlink(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := context.User(r.Context())
+	identity, err := o.is.ByID(uint(id))
+	if err != nil || identity.UserID != user.ID {
+		http.Error(w, "Linked account not found", http.StatusNotFound)
+		return
+	}
+
+	if err := o.is.Delete(identity.ID); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "The account has been unlinked.",
+	})
+}
+
+// fail sends the user back to where the flow started
+func (o *OIDC) fail(w http.ResponseWriter, r *http.Request, linkUser uint, err error) {
+	if linkUser != 0 {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	vd.SetAlert(err)
+	o.users.renderLogin(w, r, vd)
+}
+
+// setFlow stores the flow in a cookie, signed so it can't be
+// forged or altered on the way.
+func (o *OIDC) setFlow(w http.ResponseWriter, flow *oidcFlow) error {
+	b, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     flowCookie,
+		Value:    payload + "." + o.hmac.Hash(payload),
+		Path:     "/auth",
+		Expires:  flow.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (o *OIDC) flow(r *http.Request) (*oidcFlow, error) {
+	cookie, err := r.Cookie(flowCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(o.hmac.Hash(parts[0])), []byte(parts[1])) != 1 {
+		return nil, errFlowInvalid
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errFlowInvalid
+	}
+
+	var flow oidcFlow
+	if err := json.Unmarshal(b, &flow); err != nil {
+		return nil, errFlowInvalid
+	}
+	if time.Now().After(flow.Expires) {
+		return nil, errFlowInvalid
+	}
+	return &flow, nil
+}
+
+func (o *OIDC) clearFlow(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     flowCookie,
+		Value:    "",
+		Path:     "/auth",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+}
@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/middleware"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/oidc"
+	"github.com/ruckuus/dojo1/oidc/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// The login and link flows of the OIDC controller, run against
+// an oidctest.MockIdP with the services they use kept in memory.
+
+type memUsers struct {
+	models.UserService
+	users   map[uint]*models.User
+	deleted map[uint]*models.User
+}
+
+func (mu *memUsers) ByID(id uint) (*models.User, error) {
+	if u, ok := mu.users[id]; ok {
+		return u, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+func (mu *memUsers) DeletedByID(id uint) (*models.User, error) {
+	if u, ok := mu.deleted[id]; ok {
+		return u, nil
+	}
+	return nil, models.ErrNotFound
+}
+
+type memSessions struct {
+	models.SessionService
+	created []models.Session
+}
+
+func (ms *memSessions) Create(s *models.Session) error {
+	s.ID = uint(len(ms.created) + 1)
+	s.Token = "session-token"
+	ms.created = append(ms.created, *s)
+	return nil
+}
+
+type memThrottle struct {
+	models.LoginThrottleService
+}
+
+func (memThrottle) Success(email string) error { return nil }
+
+type memIdentities struct {
+	models.IdentityService
+	identities []models.Identity
+}
+
+func (mi *memIdentities) ByProviderSubject(provider, subject string) (*models.Identity, error) {
+	for i := range mi.identities {
+		if mi.identities[i].Provider == provider && mi.identities[i].Subject == subject {
+			return &mi.identities[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (mi *memIdentities) Create(identity *models.Identity) error {
+	if _, err := mi.ByProviderSubject(identity.Provider, identity.Subject); err == nil {
+		return models.ErrIdentityTaken
+	}
+	identity.ID = uint(len(mi.identities) + 1)
+	mi.identities = append(mi.identities, *identity)
+	return nil
+}
+
+func (mi *memIdentities) Delete(id uint) error {
+	for i := range mi.identities {
+		if mi.identities[i].ID == id {
+			mi.identities = append(mi.identities[:i], mi.identities[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+type flowTest struct {
+	*testApp
+	idp        *oidctest.MockIdP
+	users      *memUsers
+	sessions   *memSessions
+	identities *memIdentities
+}
+
+func newFlowTest(t *testing.T) *flowTest {
+	t.Helper()
+	idp, err := oidctest.NewMockIdP("test-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	ft := &flowTest{
+		testApp: newTestApp(t),
+		idp:     idp,
+		users: &memUsers{users: map[uint]*models.User{
+			1: {Name: "Jon", Email: "jon@example.com"},
+		}},
+		sessions:   &memSessions{},
+		identities: &memIdentities{},
+	}
+	ft.users.users[1].ID = 1
+
+	services := &models.Services{
+		User:     ft.users,
+		Session:  ft.sessions,
+		Throttle: memThrottle{},
+		Identity: ft.identities,
+	}
+	provider := oidc.NewProvider(oidc.Config{
+		Name:        "mock",
+		Issuer:      srv.URL,
+		ClientID:    "test-client",
+		RedirectURL: "https://tataruma.test/auth/mock/callback",
+	}, srv.Client())
+	oidcC := NewOIDC(NewUsers(services, nil), ft.identities, []*oidc.Provider{provider}, "test-hmac-key")
+
+	ft.router.HandleFunc("/auth/{provider}/login", oidcC.Login).Methods("GET")
+	ft.router.HandleFunc("/auth/{provider}/link", oidcC.Link).Methods("POST")
+	ft.router.HandleFunc("/auth/{provider}/callback", oidcC.Callback).Methods("GET")
+	return ft
+}
+
+// do serves a request to the app, with the cookies given.
+// The signed in user of the requests is ft.user, if any.
+func (ft *flowTest) do(method, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	return ft.serve(r)
+}
+
+// start begins a flow at path, and returns the callback URL
+// the provider sends the user back to along with the cookies
+// set meanwhile
+func (ft *flowTest) start(method, path string) (string, []*http.Cookie) {
+	ft.t.Helper()
+	w := ft.do(method, path, nil)
+	if w.Code != http.StatusFound {
+		ft.t.Fatalf("%s %s answered %d", method, path, w.Code)
+	}
+	cookies := w.Result().Cookies()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		ft.t.Fatalf("provider answered %d", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		ft.t.Fatal(err)
+	}
+	return callback.RequestURI(), cookies
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == middleware.SessionCookie && c.Value != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLoginWithLinkedIdentity(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.identities.identities = []models.Identity{
+		{UserID: 1, Provider: "mock", Subject: ft.idp.Subject},
+	}
+
+	callback, cookies := ft.start("GET", "/auth/mock/login")
+	w := ft.do("GET", callback, cookies)
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+		t.Fatalf("callback answered %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if sessionCookie(w) == nil {
+		t.Error("no session cookie was set")
+	}
+	if len(ft.sessions.created) != 1 || ft.sessions.created[0].UserID != 1 {
+		t.Errorf("sessions = %+v, want one for user 1", ft.sessions.created)
+	}
+}
+
+func TestCallbackRejectsOtherState(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.identities.identities = []models.Identity{
+		{UserID: 1, Provider: "mock", Subject: ft.idp.Subject},
+	}
+
+	callback, cookies := ft.start("GET", "/auth/mock/login")
+	u, _ := url.Parse(callback)
+	q := u.Query()
+	q.Set("state", "forged")
+	u.RawQuery = q.Encode()
+	w := ft.do("GET", u.RequestURI(), cookies)
+
+	if sessionCookie(w) != nil || len(ft.sessions.created) != 0 {
+		t.Error("signed in with a forged state")
+	}
+}
+
+func TestCallbackWithoutFlowCookie(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.identities.identities = []models.Identity{
+		{UserID: 1, Provider: "mock", Subject: ft.idp.Subject},
+	}
+
+	// A code handed to another browser must not sign this one in
+	callback, _ := ft.start("GET", "/auth/mock/login")
+	w := ft.do("GET", callback, nil)
+
+	if sessionCookie(w) != nil || len(ft.sessions.created) != 0 {
+		t.Error("signed in without the flow cookie")
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.user = ft.users.users[1]
+
+	callback, cookies := ft.start("POST", "/auth/mock/link")
+	w := ft.do("GET", callback, cookies)
+
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/profile" {
+		t.Fatalf("callback answered %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	identity, err := ft.identities.ByProviderSubject("mock", ft.idp.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != 1 || identity.Email != ft.idp.Email {
+		t.Errorf("identity = %+v", identity)
+	}
+	if len(ft.sessions.created) != 0 {
+		t.Error("linking must not start another session")
+	}
+}
+
+func TestLinkNeedsTheUserThatStartedIt(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.user = ft.users.users[1]
+	callback, cookies := ft.start("POST", "/auth/mock/link")
+
+	// The flow cookie ends up in a browser signed in as another
+	ft.user = &models.User{Name: "Eve", Email: "eve@example.com"}
+	ft.user.ID = 2
+	ft.do("GET", callback, cookies)
+
+	if len(ft.identities.identities) != 0 {
+		t.Errorf("identities = %+v, want none", ft.identities.identities)
+	}
+}
+
+func TestLoginOfDeletedUser(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.users.deleted = map[uint]*models.User{2: {Email: "gone@example.com"}}
+	ft.identities.identities = []models.Identity{
+		{Model: gorm.Model{ID: 1}, UserID: 2, Provider: "mock", Subject: ft.idp.Subject},
+	}
+
+	callback, cookies := ft.start("GET", "/auth/mock/login")
+	w := ft.do("GET", callback, cookies)
+
+	if sessionCookie(w) != nil || len(ft.sessions.created) != 0 {
+		t.Error("signed in as a deleted user")
+	}
+	if len(ft.identities.identities) != 1 {
+		t.Error("the identity of a user that can be restored must stay")
+	}
+}
+
+func TestLoginOfPurgedUser(t *testing.T) {
+	ft := newFlowTest(t)
+	ft.identities.identities = []models.Identity{
+		{Model: gorm.Model{ID: 1}, UserID: 2, Provider: "mock", Subject: ft.idp.Subject},
+	}
+	// Stops the sign up that follows before it needs a database
+	ft.idp.Email = ""
+
+	callback, cookies := ft.start("GET", "/auth/mock/login")
+	w := ft.do("GET", callback, cookies)
+
+	if sessionCookie(w) != nil || len(ft.sessions.created) != 0 {
+		t.Error("signed in as a purged user")
+	}
+	if len(ft.identities.identities) != 0 {
+		t.Errorf("identities = %+v, want the left over one removed", ft.identities.identities)
+	}
+}
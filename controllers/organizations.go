@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strconv"
+)
+
+// Organizations lets users create organizations, manage their
+// members and switch between them.
+type Organizations struct {
+	IndexView *views.View
+	ShowView  *views.View
+	os        models.OrganizationService
+	us        models.UserService
+	ss        models.SessionService
+	az        *authz.Authorizer
+}
+
+type OrganizationForm struct {
+	Name string `schema:"name"`
+}
+
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+type SwitchOrganizationForm struct {
+	OrganizationID uint `schema:"organization_id"`
+}
+
+// organizationData is what the organization page renders
+type organizationData struct {
+	*models.Organization
+	Role      authz.Role
+	CanEdit   bool
+	CanShare  bool
+	Members   []memberEntry
+	Roles     []authz.Role
+	CurrentID uint
+}
+
+// memberEntry is a membership along with who the member is
+type memberEntry struct {
+	models.Membership
+	Name  string
+	Email string
+}
+
+func NewOrganizations(services *models.Services, az *authz.Authorizer) *Organizations {
+	return &Organizations{
+		IndexView: views.NewView("bootstrap", "organizations/index"),
+		ShowView:  views.NewView("bootstrap", "organizations/show"),
+		os:        services.Organization,
+		us:        services.User,
+		ss:        services.Session,
+		az:        az,
+	}
+}
+
+// Index lists the organizations of the user
+//
+// GET /organizations
+func (o *Organizations) Index(w http.ResponseWriter, r *http.Request) {
+	o.IndexView.Render(w, r, context.Organizations(r.Context()))
+}
+
+// Create founds a new organization and switches to it
+//
+// POST /organizations
+func (o *Organizations) Create(w http.ResponseWriter, r *http.Request) {
+	var form OrganizationForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, "/organizations", err)
+		return
+	}
+
+	user := context.User(r.Context())
+	org := models.Organization{Name: form.Name}
+	if err := o.az.Found(user, &org); err != nil {
+		redirectError(w, r, "/organizations", err)
+		return
+	}
+	o.switchTo(r, &org)
+
+	views.RedirectAlert(w, r, fmt.Sprintf("/organizations/%d", org.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: org.Name + " has been created.",
+	})
+}
+
+// organizationByID looks up the organization in the URL and
+// checks the user may perform action on it.
+func (o *Organizations) organizationByID(w http.ResponseWriter, r *http.Request, action authz.Action) (*models.Organization, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	org, err := o.os.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Organization not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	err = o.az.Can(user, action, authz.Organization(org))
+	if !authorized(w, err, "Organization") {
+		return nil, err
+	}
+	return org, nil
+}
+
+// Show renders the organization with its members
+//
+// GET /organizations/:id
+func (o *Organizations) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	org, err := o.organizationByID(w, r, authz.ActionView)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	res := authz.Organization(org)
+	role, err := o.az.Role(user, res)
+	if err != nil {
+		vd.SetAlert(err)
+		o.ShowView.Render(w, r, vd)
+		return
+	}
+
+	data := organizationData{
+		Organization: org,
+		Role:         role,
+		CanEdit:      authz.Allows(res.Type, role, authz.ActionEdit),
+		CanShare:     authz.Allows(res.Type, role, authz.ActionShare),
+		Roles:        authz.MemberRoles,
+		CurrentID:    user.ID,
+	}
+	vd.Yield = &data
+
+	members, err := o.os.Members(org.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		o.ShowView.Render(w, r, vd)
+		return
+	}
+	for _, m := range members {
+		entry := memberEntry{Membership: m}
+		if u, err := o.us.ByID(m.UserID); err == nil {
+			entry.Name = u.Name
+			entry.Email = u.Email
+		}
+		data.Members = append(data.Members, entry)
+	}
+
+	o.ShowView.Render(w, r, vd)
+}
+
+// Update renames the organization
+//
+// POST /organizations/:id/update
+func (o *Organizations) Update(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, authz.ActionEdit)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d", org.ID)
+
+	var form OrganizationForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	org.Name = form.Name
+	if err := o.os.Update(org); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Organization updated successfully.",
+	})
+}
+
+// AddMember adds an existing user to the organization
+//
+// POST /organizations/:id/members
+func (o *Organizations) AddMember(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, authz.ActionShare)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d", org.ID)
+
+	var form MemberForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	member, err := o.us.ByEmail(form.Email)
+	if err == models.ErrNotFound {
+		err = errNoSuchUser
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := o.az.AddMember(user, org, member, authz.Role(form.Role)); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: member.Name + " is now a member of " + org.Name + ".",
+	})
+}
+
+// RemoveMember removes a member, or lets users leave
+//
+// POST /organizations/:id/members/:member/delete
+func (o *Organizations) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	org, err := o.organizationByID(w, r, authz.ActionView)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d", org.ID)
+
+	memberID, err := strconv.Atoi(mux.Vars(r)["member"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = o.az.RemoveMember(user, org, uint(memberID))
+	switch err {
+	case nil:
+	case models.ErrNotFound, authz.ErrNotFound:
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	default:
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	// Users who left can't see the organization anymore
+	if err := o.az.Can(user, authz.ActionView, authz.Organization(org)); err != nil {
+		showURL = "/organizations"
+	}
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Member removed.",
+	})
+}
+
+// Switch changes the organization the user works in on this device
+//
+// POST /organizations/switch
+func (o *Organizations) Switch(w http.ResponseWriter, r *http.Request) {
+	var form SwitchOrganizationForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, "/organizations", err)
+		return
+	}
+
+	for _, org := range context.Organizations(r.Context()) {
+		if org.ID == form.OrganizationID {
+			o.switchTo(r, &org)
+			http.Redirect(w, r, "/properties", http.StatusFound)
+			return
+		}
+	}
+	http.Error(w, "Organization not found", http.StatusNotFound)
+}
+
+// switchTo remembers org in the session of the request
+func (o *Organizations) switchTo(r *http.Request, org *models.Organization) {
+	session := context.Session(r.Context())
+	if session == nil {
+		return
+	}
+	session.OrganizationID = org.ID
+	o.ss.Update(session)
+}
@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/notify"
+	"github.com/ruckuus/dojo1/views"
+	"github.com/ruckuus/dojo1/webhook"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Portal is the tenant self-service portal. Every handler runs
+// behind middleware.RequireTenant and only looks up what belongs
+// to the lease it put in the context.
+type Portal struct {
+	HomeView    *views.View
+	TicketsView *views.View
+	TicketView  *views.View
+	us          models.UserService
+	ps          models.PropertyService
+	les         models.LedgerService
+	ts          models.TicketService
+	tcs         models.TicketCommentService
+	is          models.ImageService
+	notifier    *notify.Notifier
+	hooks       *webhook.Dispatcher
+	addresses   *inbound.Addresses
+}
+
+// TicketForm is used by tenants to open a maintenance ticket
+type TicketForm struct {
+	Title       string `schema:"title"`
+	Description string `schema:"description"`
+}
+
+// portalData is what the portal home page renders
+type portalData struct {
+	Lease     *models.Lease
+	Property  *models.Property
+	Balance   models.Money
+	Entries   []models.LedgerEntry
+	Documents []models.Image
+	Tickets   []models.Ticket
+}
+
+// ticketData is a ticket along with its photos and comments
+type ticketData struct {
+	*models.Ticket
+	Photos   []models.Image
+	Comments []commentData
+}
+
+// commentData is a ticket comment with the name of its author
+// and its attachments
+type commentData struct {
+	*models.TicketComment
+	AuthorName  string
+	Attachments []models.Image
+}
+
+func NewPortal(services *models.Services, notifier *notify.Notifier, hooks *webhook.Dispatcher, addresses *inbound.Addresses) *Portal {
+	return &Portal{
+		HomeView:    views.NewView("portal", "portal/home"),
+		TicketsView: views.NewView("portal", "portal/tickets"),
+		TicketView:  views.NewView("portal", "portal/ticket"),
+		us:          services.User,
+		ps:          services.Property,
+		les:         services.Ledger,
+		ts:          services.Ticket,
+		tcs:         services.TicketComment,
+		is:          services.Image,
+		notifier:    notifier,
+		hooks:       hooks,
+		addresses:   addresses,
+	}
+}
+
+// Home shows the tenant their lease, balance and documents
+//
+// GET /portal
+func (p *Portal) Home(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	lease := context.Lease(r.Context())
+	data := portalData{Lease: lease}
+	vd.Yield = &data
+
+	var err error
+	data.Property, err = p.ps.ByID(lease.PropertyID)
+	if err == nil {
+		data.Balance, err = p.les.Balance(lease.ID)
+	}
+	if err == nil {
+		data.Entries, err = p.les.ByLeaseID(lease.ID)
+	}
+	if err == nil {
+		data.Documents, err = p.is.ByExternalTypeAndID(models.LeaseDocumentKey, lease.ID)
+	}
+	if err == nil {
+		data.Tickets, err = p.ts.ByLeaseID(lease.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	p.HomeView.Render(w, r, vd)
+}
+
+// Tickets lists the tickets of the lease, with a form to open one
+//
+// GET /portal/tickets
+func (p *Portal) Tickets(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	lease := context.Lease(r.Context())
+	tickets, err := p.ts.ByLeaseID(lease.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = tickets
+
+	p.TicketsView.Render(w, r, vd)
+}
+
+// CreateTicket opens a maintenance ticket, with optional photos
+//
+// POST /portal/tickets
+func (p *Portal) CreateTicket(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		redirectError(w, r, "/portal/tickets", err)
+		return
+	}
+
+	var form TicketForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, "/portal/tickets", err)
+		return
+	}
+
+	lease := context.Lease(r.Context())
+	user := context.User(r.Context())
+	ticket := models.Ticket{
+		PropertyID:  lease.PropertyID,
+		LeaseID:     lease.ID,
+		OpenedByID:  user.ID,
+		Title:       form.Title,
+		Description: form.Description,
+	}
+	if err := p.ts.Create(&ticket); err != nil {
+		redirectError(w, r, "/portal/tickets", err)
+		return
+	}
+
+	showURL := fmt.Sprintf("/portal/tickets/%d", ticket.ID)
+	if err := saveUploads(p.is, r, "photos", models.TicketPhotoKey, ticket.ID); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	notifyTicketOpened(p.ps, p.notifier, p.hooks, p.addresses, &ticket)
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your ticket has been opened, we'll keep you posted.",
+	})
+}
+
+// ShowTicket shows a ticket of the lease with its photos
+//
+// GET /portal/tickets/:id
+func (p *Portal) ShowTicket(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+
+	// Tickets of other leases don't exist as far as tenants know
+	lease := context.Lease(r.Context())
+	ticket, err := p.ts.ByID(uint(id))
+	if err == nil && ticket.LeaseID != lease.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Ticket not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	data := ticketData{Ticket: ticket}
+	vd.Yield = &data
+	data.Photos, err = p.is.ByExternalTypeAndID(models.TicketPhotoKey, ticket.ID)
+	if err == nil {
+		data.Comments, err = ticketComments(p.tcs, p.us, p.is, ticket.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	p.TicketView.Render(w, r, vd)
+}
+
+// notifyTicketOpened tells the owner of the property, and the
+// webhooks of its organization, about a new ticket. The ticket
+// is open either way, the owner still sees it on the property
+// page.
+func notifyTicketOpened(ps models.PropertyService, notifier *notify.Notifier, hooks *webhook.Dispatcher, addresses *inbound.Addresses, ticket *models.Ticket) {
+	property, err := ps.ByID(ticket.PropertyID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = notifier.Notify(&models.Notification{
+		UserID:  property.UserID,
+		Event:   models.NotifyTicketUpdated,
+		Key:     fmt.Sprintf("ticket:%d:opened", ticket.ID),
+		Title:   "New ticket \"" + ticket.Title + "\"",
+		Body:    property.Name,
+		URL:     fmt.Sprintf("/properties/%d", property.ID),
+		ReplyTo: addresses.Ticket(ticket.ID),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if err := hooks.Emit(property.OrganizationID, models.EventTicketOpened, newAPITicket(ticket)); err != nil {
+		log.Println(err)
+	}
+}
+
+// ticketComments returns the comments of a ticket, oldest first
+func ticketComments(tcs models.TicketCommentService, us models.UserService, is models.ImageService, ticketID uint) ([]commentData, error) {
+	comments, err := tcs.ByTicketID(ticketID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[uint]string{}
+	entries := make([]commentData, 0, len(comments))
+	for i := range comments {
+		c := commentData{TicketComment: &comments[i]}
+		name, ok := names[c.AuthorID]
+		if !ok {
+			// Authors may have deleted their account since
+			if author, err := us.ByID(c.AuthorID); err == nil {
+				name = author.Name
+			}
+			names[c.AuthorID] = name
+		}
+		c.AuthorName = name
+		c.Attachments, err = is.ByExternalTypeAndID(models.TicketCommentKey, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, c)
+	}
+	return entries, nil
+}
@@ -3,9 +3,14 @@ package controllers
 import (
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
 	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/inbound"
 	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/notify"
 	"github.com/ruckuus/dojo1/views"
+	"github.com/ruckuus/dojo1/webhook"
+	"log"
 	"net/http"
 	"strconv"
 )
@@ -14,15 +19,30 @@ const (
 	IndexProperties = "index_properties"
 )
 
+const errNoSuchUser publicError = "There is no account with this email address."
+
 // Properties defines the Properties controller
 // It ties its models and views in one place
 type Properties struct {
-	NewView   *views.View
-	IndexView *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	ps        models.PropertyService
-	r         *mux.Router
+	NewView      *views.View
+	IndexView    *views.View
+	ShowView     *views.View
+	EditView     *views.View
+	ActivityView *views.View
+	ps           models.PropertyService
+	us           models.UserService
+	is           models.InvitationService
+	ls           models.LeaseService
+	les          models.LedgerService
+	ts           models.TicketService
+	tcs          models.TicketCommentService
+	ims          models.ImageService
+	as           models.AuditService
+	notifier     *notify.Notifier
+	hooks        *webhook.Dispatcher
+	addresses    *inbound.Addresses
+	az           *authz.Authorizer
+	r            *mux.Router
 }
 
 // PropertyForm defines schema for form input
@@ -32,17 +52,83 @@ type PropertyForm struct {
 	PostalCode string `schema:"postal_code"`
 }
 
+// AccessForm is used to grant a user a role on a property
+type AccessForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// propertyData is what the property page renders
+type propertyData struct {
+	*models.Property
+	Role     authz.Role
+	CanEdit  bool
+	CanShare bool
+	Access   []accessEntry
+	Roles    []authz.Role
+
+	Invitations []models.Invitation
+
+	Leases         []leaseEntry
+	Tickets        []ticketData
+	TicketStatuses []string
+}
+
+// leaseEntry is a lease along with its tenant and balance
+type leaseEntry struct {
+	models.Lease
+	TenantName string
+	Balance    models.Money
+}
+
+// TicketStatusForm is used to move a ticket along
+type TicketStatusForm struct {
+	Status string `schema:"status"`
+}
+
+// activityEntry is an audit event along with who made it
+type activityEntry struct {
+	models.AuditEvent
+	ActorName string
+}
+
+// activityData is what the activity page renders
+type activityData struct {
+	*models.Property
+	Events []activityEntry
+}
+
+// accessEntry is a grant along with who it was granted to
+type accessEntry struct {
+	models.Grant
+	Name  string
+	Email string
+}
+
 // NewProperties returns new Properties object,
 // it instantiates all the necessary elements to
 // be used by every controller methods
-func NewProperties(services models.PropertyService, r *mux.Router) *Properties {
+func NewProperties(services *models.Services, az *authz.Authorizer, r *mux.Router, notifier *notify.Notifier, hooks *webhook.Dispatcher, addresses *inbound.Addresses) *Properties {
 	return &Properties{
-		NewView:   views.NewView("bootstrap", "properties/new"),
-		IndexView: views.NewView("bootstrap", "properties/index"),
-		ShowView:  views.NewView("bootstrap", "properties/show"),
-		EditView:  views.NewView("bootstrap", "properties/edit"),
-		ps:        services,
-		r:         r,
+		NewView:      views.NewView("bootstrap", "properties/new"),
+		IndexView:    views.NewView("bootstrap", "properties/index"),
+		ShowView:     views.NewView("bootstrap", "properties/show"),
+		EditView:     views.NewView("bootstrap", "properties/edit"),
+		ActivityView: views.NewView("bootstrap", "properties/activity"),
+		ps:           services.Property,
+		us:           services.User,
+		is:           services.Invitation,
+		ls:           services.Lease,
+		les:          services.Ledger,
+		ts:           services.Ticket,
+		tcs:          services.TicketComment,
+		ims:          services.Image,
+		as:           services.Audit,
+		notifier:     notifier,
+		hooks:        hooks,
+		addresses:    addresses,
+		az:           az,
+		r:            r,
 	}
 }
 
@@ -57,6 +143,10 @@ func (p *Properties) Create(w http.ResponseWriter, r *http.Request) {
 	var form PropertyForm
 
 	user := context.User(r.Context())
+	org := context.Organization(r.Context())
+	if !authorized(w, p.az.Can(user, authz.ActionCreate, authz.In(authz.TypeProperty, org)), "Organization") {
+		return
+	}
 
 	if err := parseForm(r, &form); err != nil {
 		vd.SetAlert(err)
@@ -65,17 +155,21 @@ func (p *Properties) Create(w http.ResponseWriter, r *http.Request) {
 	}
 
 	property := models.Property{
-		UserID:     user.ID,
-		Name:       form.Name,
-		Address:    form.Address,
-		PostalCode: form.PostalCode,
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+		Name:           form.Name,
+		Address:        form.Address,
+		PostalCode:     form.PostalCode,
 	}
 
-	if err := p.ps.Create(&property); err != nil {
+	if err := p.ps.As(actor(r)).Create(&property); err != nil {
 		vd.SetAlert(err)
 		p.NewView.Render(w, r, vd)
 		return
 	}
+	if err := p.hooks.Emit(org.ID, models.EventPropertyCreated, newAPIProperty(&property)); err != nil {
+		log.Println(err)
+	}
 
 	views.RedirectAlert(w, r, fmt.Sprintf("/properties/%d", property.ID), http.StatusFound, views.Alert{
 		Level:   views.AlertLvlSuccess,
@@ -87,24 +181,47 @@ func (p *Properties) Index(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 
 	user := context.User(r.Context())
-	properties, err := p.ps.ByUserID(user.ID)
+	org := context.Organization(r.Context())
+	properties, err := p.ps.ByOrganizationID(org.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		p.IndexView.Render(w, r, vd)
+		return
+	}
+
+	// Properties of other organizations the user was given access to
+	ids, err := p.az.Shared(user, authz.TypeProperty)
+	if err != nil {
+		vd.SetAlert(err)
+		p.IndexView.Render(w, r, vd)
+		return
+	}
+	shared, err := p.ps.ByIDs(ids)
 	if err != nil {
 		vd.SetAlert(err)
 		p.IndexView.Render(w, r, vd)
 		return
 	}
+	for _, property := range shared {
+		if property.OrganizationID != org.ID {
+			properties = append(properties, property)
+		}
+	}
+
 	vd.Yield = properties
 	p.IndexView.Render(w, r, vd)
 }
 
-// propertyByID helper to fetch property by id
-func (p *Properties) propertyByID(w http.ResponseWriter, r *http.Request) (*models.Property, error) {
+// propertyByID fetches the property of the request and checks
+// that the user may take action on it
+func (p *Properties) propertyByID(w http.ResponseWriter, r *http.Request, action authz.Action) (*models.Property, error) {
 	vars := mux.Vars(r)
 
 	paramID := vars["id"]
 
 	id, err := strconv.Atoi(paramID)
 	if err != nil {
+		http.Error(w, "Property not found", http.StatusNotFound)
 		return nil, err
 	}
 
@@ -118,6 +235,12 @@ func (p *Properties) propertyByID(w http.ResponseWriter, r *http.Request) (*mode
 		}
 		return nil, err
 	}
+
+	user := context.User(r.Context())
+	err = p.az.Can(user, action, authz.Property(property))
+	if !authorized(w, err, "Property") {
+		return nil, err
+	}
 	return property, nil
 }
 
@@ -125,27 +248,123 @@ func (p *Properties) propertyByID(w http.ResponseWriter, r *http.Request) (*mode
 func (p *Properties) Show(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 
-	property, err := p.propertyByID(w, r)
+	property, err := p.propertyByID(w, r, authz.ActionView)
 	if err != nil {
 		return
 	}
-	vd.Yield = property
+
+	user := context.User(r.Context())
+	res := authz.Property(property)
+
+	role, err := p.az.Role(user, res)
+	if err != nil {
+		vd.SetAlert(err)
+		p.ShowView.Render(w, r, vd)
+		return
+	}
+
+	data := propertyData{
+		Property:       property,
+		Role:           role,
+		CanEdit:        authz.Allows(res.Type, role, authz.ActionEdit),
+		CanShare:       authz.Allows(res.Type, role, authz.ActionShare),
+		Roles:          authz.Roles,
+		TicketStatuses: models.TicketStatuses,
+	}
+	vd.Yield = &data
+
+	if data.CanEdit {
+		data.Leases, err = p.leases(property)
+		if err == nil {
+			data.Tickets, err = p.tickets(property)
+		}
+		if err != nil {
+			vd.SetAlert(err)
+		}
+	}
+
+	if data.CanShare {
+		data.Access, err = p.access(res)
+		if err == nil {
+			data.Invitations, err = p.is.ByResource(res.Type, res.ID)
+		}
+		if err != nil {
+			vd.SetAlert(err)
+		}
+	}
+
 	p.ShowView.Render(w, r, vd)
 }
 
-// Edit handles GET /properties/:id/edit
-func (p *Properties) Edit(w http.ResponseWriter, r *http.Request) {
-	var vd views.Data
+// access returns who was granted access to res
+func (p *Properties) access(res authz.Resource) ([]accessEntry, error) {
+	grants, err := p.az.Grants(res)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]accessEntry, 0, len(grants))
+	for _, g := range grants {
+		entry := accessEntry{Grant: g}
+		if u, err := p.us.ByID(g.UserID); err == nil {
+			entry.Name = u.Name
+			entry.Email = u.Email
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
 
-	property, err := p.propertyByID(w, r)
+// leases returns the leases of property with their balance
+func (p *Properties) leases(property *models.Property) ([]leaseEntry, error) {
+	leases, err := p.ls.ByPropertyID(property.ID)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	user := context.User(r.Context())
+	entries := make([]leaseEntry, 0, len(leases))
+	for _, l := range leases {
+		entry := leaseEntry{Lease: l}
+		if u, err := p.us.ByID(l.TenantID); err == nil {
+			entry.TenantName = u.Name
+		}
+		entry.Balance, err = p.les.Balance(l.ID)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// tickets returns the tickets of property with their photos
+func (p *Properties) tickets(property *models.Property) ([]ticketData, error) {
+	tickets, err := p.ts.ByPropertyID(property.ID)
+	if err != nil {
+		return nil, err
+	}
 
-	if property.UserID != user.ID {
-		http.Error(w, "Error updating property, user mismatch", http.StatusForbidden)
+	entries := make([]ticketData, 0, len(tickets))
+	for i := range tickets {
+		entry := ticketData{Ticket: &tickets[i]}
+		entry.Photos, err = p.ims.ByExternalTypeAndID(models.TicketPhotoKey, tickets[i].ID)
+		if err == nil {
+			entry.Comments, err = ticketComments(p.tcs, p.us, p.ims, tickets[i].ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Edit handles GET /properties/:id/edit
+func (p *Properties) Edit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	property, err := p.propertyByID(w, r, authz.ActionEdit)
+	if err != nil {
 		return
 	}
 
@@ -154,18 +373,50 @@ func (p *Properties) Edit(w http.ResponseWriter, r *http.Request) {
 	p.EditView.Render(w, r, vd)
 }
 
-// Update handles POST /properties/:id/update
-func (p *Properties) Update(w http.ResponseWriter, r *http.Request) {
-	property, err := p.propertyByID(w, r)
+// Activity lists who changed the property and when, for owners
+//
+// GET /properties/:id/activity
+func (p *Properties) Activity(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	property, err := p.propertyByID(w, r, authz.ActionShare)
 	if err != nil {
-		http.Error(w, "error updating property", http.StatusBadRequest)
 		return
 	}
 
-	user := context.User(r.Context())
+	data := activityData{Property: property}
+	vd.Yield = &data
+
+	events, err := p.as.ByTarget(models.AuditProperty, property.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		p.ActivityView.Render(w, r, vd)
+		return
+	}
+
+	names := map[uint]string{}
+	for _, e := range events {
+		entry := activityEntry{AuditEvent: e}
+		if e.ActorID != 0 {
+			name, ok := names[e.ActorID]
+			if !ok {
+				if actor, err := p.us.ByID(e.ActorID); err == nil {
+					name = actor.Name
+				}
+				names[e.ActorID] = name
+			}
+			entry.ActorName = name
+		}
+		data.Events = append(data.Events, entry)
+	}
 
-	if property.UserID != user.ID {
-		http.Error(w, "error updating property, user mismatch", http.StatusForbidden)
+	p.ActivityView.Render(w, r, vd)
+}
+
+// Update handles POST /properties/:id/update
+func (p *Properties) Update(w http.ResponseWriter, r *http.Request) {
+	property, err := p.propertyByID(w, r, authz.ActionEdit)
+	if err != nil {
 		return
 	}
 
@@ -183,12 +434,15 @@ func (p *Properties) Update(w http.ResponseWriter, r *http.Request) {
 	property.Address = form.Address
 	property.PostalCode = form.PostalCode
 
-	err = p.ps.Update(property)
+	err = p.ps.As(actor(r)).Update(property)
 	if err != nil {
 		vd.SetAlert(err)
 		p.EditView.Render(w, r, vd)
 		return
 	}
+	if err := p.hooks.Emit(property.OrganizationID, models.EventPropertyUpdated, newAPIProperty(property)); err != nil {
+		log.Println(err)
+	}
 
 	views.RedirectAlert(w, r, fmt.Sprintf("/properties/%d", property.ID), http.StatusFound, views.Alert{
 		Level:   views.AlertLvlSuccess,
@@ -198,20 +452,16 @@ func (p *Properties) Update(w http.ResponseWriter, r *http.Request) {
 
 // Delete handles POST /properties/:id/delete
 func (p *Properties) Delete(w http.ResponseWriter, r *http.Request) {
-	property, err := p.propertyByID(w, r)
+	property, err := p.propertyByID(w, r, authz.ActionDelete)
 	if err != nil {
-		http.Error(w, "Error deleting property", http.StatusBadRequest)
-		return
-	}
-
-	user := context.User(r.Context())
-	if property.UserID != user.ID {
-		http.Error(w, "Error deleting property, user mismatch", http.StatusForbidden)
 		return
 	}
 
 	var vd views.Data
-	err = p.ps.Delete(property.ID)
+	err = p.ps.As(actor(r)).Delete(property.ID)
+	if err == nil {
+		err = p.az.Forget(authz.Property(property))
+	}
 
 	if err != nil {
 		vd.SetAlert(err)
@@ -219,6 +469,9 @@ func (p *Properties) Delete(w http.ResponseWriter, r *http.Request) {
 		p.EditView.Render(w, r, vd)
 		return
 	}
+	if err := p.hooks.Emit(property.OrganizationID, models.EventPropertyDeleted, newAPIProperty(property)); err != nil {
+		log.Println(err)
+	}
 
 	// FIXME: alert is not shown in /properties page
 	views.RedirectAlert(w, r, "/properties", http.StatusFound, views.Alert{
@@ -226,3 +479,153 @@ func (p *Properties) Delete(w http.ResponseWriter, r *http.Request) {
 		Message: "Successfully deleted property.",
 	})
 }
+
+// GrantAccess gives another user a role on the property
+//
+// POST /properties/:id/access
+func (p *Properties) GrantAccess(w http.ResponseWriter, r *http.Request) {
+	property, err := p.propertyByID(w, r, authz.ActionShare)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	var form AccessForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	// The role is checked before looking up the grantee, so only
+	// users who may share the property learn who has an account
+	user := context.User(r.Context())
+	res := authz.Property(property)
+	if err := p.az.CanGive(user, res, authz.Role(form.Role)); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	grantee, err := p.us.ByEmail(form.Email)
+	if err == models.ErrNotFound {
+		err = errNoSuchUser
+	}
+	if err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	if _, err := p.az.Grant(user, res, grantee, authz.Role(form.Role)); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: grantee.Name + " is now " + form.Role + " of this property.",
+	})
+}
+
+// RevokeAccess removes a grant from the property
+//
+// POST /properties/:id/access/:grant/delete
+func (p *Properties) RevokeAccess(w http.ResponseWriter, r *http.Request) {
+	property, err := p.propertyByID(w, r, authz.ActionView)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	grantID, err := strconv.Atoi(mux.Vars(r)["grant"])
+	if err != nil {
+		http.Error(w, "Access not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	err = p.az.Revoke(user, authz.Property(property), uint(grantID))
+	switch err {
+	case nil:
+	case models.ErrNotFound:
+		http.Error(w, "Access not found", http.StatusNotFound)
+		return
+	case authz.ErrNotFound, authz.ErrForbidden:
+		authorized(w, err, "Property")
+		return
+	default:
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	// Users giving up their own access can't see the property anymore
+	if err := p.az.Can(user, authz.ActionView, authz.Property(property)); err != nil {
+		showURL = "/properties"
+	}
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Access revoked.",
+	})
+}
+
+// UpdateTicket changes the status of a ticket of the property
+//
+// POST /properties/:id/tickets/:ticket/update
+func (p *Properties) UpdateTicket(w http.ResponseWriter, r *http.Request) {
+	property, err := p.propertyByID(w, r, authz.ActionEdit)
+	if err != nil {
+		return
+	}
+
+	showURL := fmt.Sprintf("/properties/%d", property.ID)
+
+	ticketID, err := strconv.Atoi(mux.Vars(r)["ticket"])
+	if err != nil {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
+	ticket, err := p.ts.ByID(uint(ticketID))
+	if err == nil && ticket.PropertyID != property.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Ticket not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var form TicketStatusForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	ticket.Status = form.Status
+	if err := p.ts.Update(ticket); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	err = p.notifier.Notify(&models.Notification{
+		UserID:  ticket.OpenedByID,
+		Event:   models.NotifyTicketUpdated,
+		Key:     fmt.Sprintf("ticket:%d:%s:%d", ticket.ID, ticket.Status, ticket.UpdatedAt.Unix()),
+		Title:   "Ticket \"" + ticket.Title + "\" is now " + ticket.Status,
+		Body:    property.Name,
+		URL:     fmt.Sprintf("/portal/tickets/%d", ticket.ID),
+		ReplyTo: p.addresses.Ticket(ticket.ID),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if err := p.hooks.Emit(property.OrganizationID, models.EventTicketUpdated, newAPITicket(ticket)); err != nil {
+		log.Println(err)
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Ticket \"" + ticket.Title + "\" is now " + ticket.Status + ".",
+	})
+}
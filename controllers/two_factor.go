@@ -0,0 +1,271 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/qr"
+	"github.com/ruckuus/dojo1/views"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// challengeCookie holds the login challenge token between
+// the password step and the two-factor step of the login.
+const challengeCookie = "login_challenge"
+
+// qrScale is how many pixels wide the modules of the QR code of
+// the enrollment page are
+const qrScale = 5
+
+// TwoFactorForm is used by every form asking for a code
+type TwoFactorForm struct {
+	Secret string `schema:"secret"`
+	Code   string `schema:"code"`
+}
+
+// twoFactorSetupData is rendered by the enrollment page. QRCode
+// is the provisioning URI as a PNG image, in a data URL.
+type twoFactorSetupData struct {
+	Secret string
+	QRCode template.URL
+}
+
+// newTwoFactorSetupData returns the enrollment page of user
+// for secret. The QR code is drawn here, the page showing the
+// secret loads no script.
+func (u *Users) newTwoFactorSetupData(user *models.User, secret string) (*twoFactorSetupData, error) {
+	code, err := qr.Encode(u.tfs.ProvisioningURI(user, secret))
+	if err != nil {
+		return nil, err
+	}
+	img, err := code.PNG(qrScale)
+	if err != nil {
+		return nil, err
+	}
+	return &twoFactorSetupData{
+		Secret: secret,
+		QRCode: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(img)),
+	}, nil
+}
+
+// beginTwoFactor is called once the password was accepted for
+// a user with 2FA enabled, instead of signing them in.
+func (u *Users) beginTwoFactor(w http.ResponseWriter, user *models.User) error {
+	token, err := u.tfs.BeginChallenge(user)
+	if err != nil {
+		return err
+	}
+
+	cookie := http.Cookie{
+		Name:     challengeCookie,
+		Value:    token,
+		Path:     "/login",
+		Expires:  time.Now().Add(5 * time.Minute),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+	return nil
+}
+
+// GET /login/2fa
+func (u *Users) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(challengeCookie); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	u.TwoFactorView.Render(w, r, nil)
+}
+
+// POST /login/2fa
+func (u *Users) CompleteTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	cookie, err := r.Cookie(challengeCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	pending, err := u.tfs.ChallengeUser(cookie.Value)
+	if err != nil {
+		u.clearChallenge(w)
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	// wrong codes count like wrong passwords, otherwise a leaked
+	// password would allow guessing codes without limit
+	ip := clientIP(r)
+	if err := u.lts.Check(pending.Email, ip); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.tfs.CompleteChallenge(cookie.Value, form.Code)
+	switch err {
+	case nil:
+	case models.ErrTwoFactorCodeInvalid:
+		u.loginFailed(pending.Email, ip)
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	default:
+		// the challenge itself is gone, start over
+		u.clearChallenge(w)
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	u.lts.Success(user.Email)
+	u.clearChallenge(w)
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func (u *Users) clearChallenge(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    "",
+		Path:     "/login",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+}
+
+// GET /profile/2fa
+func (u *Users) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+
+	secret, err := u.tfs.NewSecret(user)
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	data, err := u.newTwoFactorSetupData(user, secret)
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+	vd.Yield = data
+	u.TwoFactorSetupView.Render(w, r, vd)
+}
+
+// POST /profile/2fa
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorSetupView.Render(w, r, vd)
+		return
+	}
+
+	codes, err := u.tfs.Enable(user, form.Secret, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		// keep the same secret, the user already scanned it
+		data, qrErr := u.newTwoFactorSetupData(user, form.Secret)
+		if qrErr != nil {
+			redirectProfileError(w, r, qrErr)
+			return
+		}
+		vd.Yield = data
+		u.TwoFactorSetupView.Render(w, r, vd)
+		return
+	}
+
+	vd.SetSuccessMessage("Two-factor authentication is now enabled.")
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// POST /profile/2fa/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	err := u.checkCode(r, user, func() error {
+		return u.tfs.Disable(user, form.Code)
+	})
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-factor authentication has been disabled.",
+	})
+}
+
+// POST /profile/2fa/recovery
+func (u *Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	user := context.User(r.Context())
+
+	if err := parseForm(r, &form); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	var codes []string
+	err := u.checkCode(r, user, func() (err error) {
+		codes, err = u.tfs.RegenerateRecoveryCodes(user, form.Code)
+		return err
+	})
+	if err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	vd.SetSuccessMessage("New recovery codes have been generated, the old ones no longer work.")
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// checkCode runs check, which verifies a two-factor code of
+// user. Wrong codes count like wrong passwords, as at login,
+// so a session in the wrong hands can't guess its way to
+// turning two-factor authentication off.
+func (u *Users) checkCode(r *http.Request, user *models.User, check func() error) error {
+	ip := clientIP(r)
+	if err := u.lts.Check(user.Email, ip); err != nil {
+		return err
+	}
+
+	err := check()
+	switch err {
+	case nil:
+		u.lts.Success(user.Email)
+	case models.ErrTwoFactorCodeInvalid:
+		u.loginFailed(user.Email, ip)
+	}
+	return err
+}
@@ -2,29 +2,57 @@ package controllers
 
 import (
 	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
 	"github.com/ruckuus/dojo1/context"
 	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/middleware"
 	"github.com/ruckuus/dojo1/models"
-	"github.com/ruckuus/dojo1/rand"
+	"github.com/ruckuus/dojo1/oidc"
+	"github.com/ruckuus/dojo1/store"
 	"github.com/ruckuus/dojo1/views"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	ProfileView  *views.View
-	us           models.UserService
-	emailer      *email.Client
+	NewView            *views.View
+	LoginView          *views.View
+	TwoFactorView      *views.View
+	TwoFactorSetupView *views.View
+	RecoveryCodesView  *views.View
+	APITokenView       *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	ProfileView        *views.View
+	RestoreView        *views.View
+	services           *models.Services
+	us                 models.UserService
+	ss                 models.SessionService
+	tfs                models.TwoFactorService
+	lts                models.LoginThrottleService
+	is                 models.IdentityService
+	ats                models.APITokenService
+	cfs                models.CalendarFeedService
+	es                 models.ExportService
+	ns                 models.NotificationService
+	store              store.StoreProvider
+	emailer            *email.Client
+
+	// providers are the OpenID Connect providers offered on the
+	// login and profile pages, see NewOIDC
+	providers []*oidc.Provider
 }
 
 type SignupForm struct {
 	Name     string `schema:"name"`
 	Email    string `schema:"email"`
 	Password string `schema:"password"`
+	// Invite is the token of the invitation the user signed up
+	// from, it is accepted once the account exists.
+	Invite string `schema:"invite"`
 }
 
 type LoginForm struct {
@@ -32,21 +60,61 @@ type LoginForm struct {
 	Password string `schema:"password"`
 }
 
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
 type ResetPwForm struct {
 	Email    string `schema:"email"`
 	Token    string `schema:"token"`
 	Password string `schema:"password"`
 }
 
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+// loginData is what the login page renders
+type loginData struct {
+	Providers []*oidc.Provider
+}
+
+// profileData is what the profile page renders
+type profileData struct {
+	User             *models.User
+	Sessions         []models.Session
+	CurrentSessionID uint
+	Identities       []models.Identity
+	Providers        []*oidc.Provider
+	APITokens        []models.APIToken
+	CalendarFeeds    []calendarFeedEntry
+	Scopes           []string
+	Exports          []models.Export
+	Notifications    []notificationChannel
+}
+
+// NewUsers takes all services since the account pages touch
+// most of what a user owns.
+func NewUsers(services *models.Services, emailer *email.Client) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
-		ProfileView:  views.NewView("bootstrap", "users/profile"),
-		us:           us,
-		emailer:      emailer,
+		NewView:            views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		TwoFactorSetupView: views.NewView("bootstrap", "users/two_factor_setup"),
+		RecoveryCodesView:  views.NewView("bootstrap", "users/recovery_codes"),
+		APITokenView:       views.NewView("bootstrap", "users/api_token"),
+		ForgotPwView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:        views.NewView("bootstrap", "users/reset_pw"),
+		ProfileView:        views.NewView("bootstrap", "users/profile"),
+		RestoreView:        views.NewView("bootstrap", "users/restore"),
+		services:           services,
+		us:                 services.User,
+		ss:                 services.Session,
+		tfs:                services.TwoFactor,
+		lts:                services.Throttle,
+		is:                 services.Identity,
+		ats:                services.APIToken,
+		cfs:                services.CalendarFeed,
+		es:                 services.Export,
+		ns:                 services.Notification,
+		store:              services.Store,
+		emailer:            emailer,
 	}
 }
 
@@ -81,20 +149,39 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		Name:     p.Name,
 		Email:    p.Email,
 		Password: p.Password,
+		Locale:   requestLocale(r, u.emailer),
 	}
 
-	if err = u.us.Create(&user); err != nil {
+	err = u.services.Transaction(func(tx *models.Services) error {
+		if err := tx.User.Create(&user); err != nil {
+			return err
+		}
+		if _, err := authz.NewAuthorizer(tx.Grant, tx.Organization).FoundPersonal(&user); err != nil {
+			return err
+		}
+		err := queued(u.emailer, tx).In(user.Locale).Welcome(user.Name, user.Email)
+		if err != nil {
+			return err
+		}
+		return u.queueVerification(tx, &user)
+	})
+	if err != nil {
 		vd.SetAlert(err)
 		u.NewView.Render(w, r, vd)
 		return
 	}
 
-	u.emailer.Welcome(user.Name, user.Email)
-	err = u.signIn(w, &user)
+	err = u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
+	if p.Invite != "" {
+		v := url.Values{}
+		v.Set("token", p.Invite)
+		http.Redirect(w, r, "/invitations/accept?"+v.Encode(), http.StatusFound)
+		return
+	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
@@ -109,63 +196,122 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	foundUser, err := u.us.Authenticate(form.Email, form.Password)
+	ip := clientIP(r)
+	if err := u.lts.Check(form.Email, ip); err != nil {
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	foundUser, err := u.us.As(actor(r)).Authenticate(form.Email, form.Password)
 
 	if err != nil {
-		switch err {
-		case models.ErrNotFound:
-			vd.Alert = &views.Alert{
-				Level:   views.AlertLvlError,
-				Message: "No such user with that email address.",
-			}
-		case models.ErrPasswordInvalid:
-			vd.Alert = &views.Alert{
-				Level:   views.AlertLvlError,
-				Message: "Password is incorrect.",
-			}
-		default:
+		if err == models.ErrCredentialsInvalid {
+			u.loginFailed(form.Email, ip)
+		}
+		vd.SetAlert(err)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	u.completeLogin(w, r, foundUser)
+}
+
+// ShowLogin renders the login form
+//
+// GET /login
+func (u *Users) ShowLogin(w http.ResponseWriter, r *http.Request) {
+	u.renderLogin(w, r, views.Data{})
+}
+
+func (u *Users) renderLogin(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	vd.Yield = &loginData{
+		Providers: u.providers,
+	}
+	u.LoginView.Render(w, r, vd)
+}
+
+// completeLogin is called once the first factor was accepted,
+// be it a password or an external identity. Users with 2FA go
+// on to the code prompt, everybody else gets a session.
+func (u *Users) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	var vd views.Data
+
+	// Sign ins that don't go through Authenticate, e.g. OpenID
+	if user.Disabled() {
+		vd.SetAlert(models.ErrAccountDisabled)
+		u.renderLogin(w, r, vd)
+		return
+	}
+
+	if user.TwoFactorEnabled() {
+		if err := u.beginTwoFactor(w, user); err != nil {
 			vd.SetAlert(err)
+			u.renderLogin(w, r, vd)
+			return
 		}
-		u.LoginView.Render(w, r, vd)
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
 		return
 	}
 
-	err = u.signIn(w, foundUser)
-	if err != nil {
+	u.lts.Success(user.Email)
+	if err := u.signIn(w, r, user); err != nil {
 		vd.SetAlert(err)
-		u.LoginView.Render(w, r, vd)
+		u.renderLogin(w, r, vd)
 		return
 	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// loginFailed records a failed attempt, and lets the owner of
+// the account know if it got locked because of it.
+func (u *Users) loginFailed(email, ip string) {
+	lockedUntil, err := u.lts.Failure(email, ip)
+	if err != nil || lockedUntil.IsZero() {
+		return
+	}
 
+	user, err := u.us.ByEmail(email)
+	if err != nil {
+		return
+	}
+	u.emailer.In(user.Locale).AccountLocked(user.Name, user.Email, lockedUntil)
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
-		}
+// signIn creates a new session for the device making the request
+// and hands its token to the browser.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
 	}
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+
+	setSessionCookie(w, &session)
+	return nil
+}
+
+// setSessionCookie hands the token of session to the browser
+func setSessionCookie(w http.ResponseWriter, session *models.Session) {
 	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
+		Name:     middleware.SessionCookie,
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 	}
 
 	http.SetCookie(w, &cookie)
-	return nil
 }
 
+// Logout only ends the session of the current device,
+// the user stays signed in everywhere else.
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	cookie := http.Cookie{
-		Name:     "remember_token",
+		Name:     middleware.SessionCookie,
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
@@ -173,32 +319,191 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 
 	http.SetCookie(w, &cookie)
 
-	user := context.User(r.Context())
-
-	token, _ := rand.RememberToken()
-	user.Remember = token
-
-	u.us.Update(user)
+	if session := context.Session(r.Context()); session != nil {
+		u.ss.Delete(session.ID)
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, _ := r.Cookie("remember_token")
-	user, err := u.us.ByRemember(cookie.Value)
+	cookie, err := r.Cookie(middleware.SessionCookie)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
-	fmt.Fprintf(w, "Found user: %+v", user)
+	session, err := u.ss.Active(cookie.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Found session: %+v", session)
 }
 
+// GET /profile
 func (u *Users) Profile(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	user := context.User(r.Context())
-	vd.Yield = user
+
+	data := profileData{
+		User:      user,
+		Providers: u.providers,
+		Scopes:    models.Scopes,
+	}
+	if session := context.Session(r.Context()); session != nil {
+		data.CurrentSessionID = session.ID
+	}
+	vd.Yield = &data
+
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	data.Sessions = sessions
+
+	identities, err := u.is.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	data.Identities = identities
+
+	apiTokens, err := u.ats.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	data.APITokens = apiTokens
+
+	feeds, err := calendarFeeds(u.cfs, u.services.Property, user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	data.CalendarFeeds = feeds
+
+	exports, err := u.es.ByUserID(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	data.Exports = exports
+
+	channels, err := u.ns.Channels(user.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ProfileView.Render(w, r, vd)
+		return
+	}
+	for _, e := range models.NotificationEvents {
+		data.Notifications = append(data.Notifications, notificationChannel{
+			NotificationEvent: e,
+			Current:           channels[e.Name],
+		})
+	}
+
 	u.ProfileView.Render(w, r, vd)
 }
 
+// sendVerification emails a fresh verification link to user
+func (u *Users) sendVerification(user *models.User) error {
+	return u.services.Transaction(func(tx *models.Services) error {
+		return u.queueVerification(tx, user)
+	})
+}
+
+// queueVerification is sendVerification within tx
+func (u *Users) queueVerification(tx *models.Services, user *models.User) error {
+	token, err := tx.User.InitiateVerification(user)
+	if err != nil {
+		return err
+	}
+	return queued(u.emailer, tx).In(user.Locale).Verify(user.Name, user.Email, token)
+}
+
+// Verify confirms the email address from the link we sent
+//
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var form VerifyForm
+	parseURLParams(r, &form)
+
+	_, err := u.us.CompleteVerification(form.Token)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		views.RedirectAlert(w, r, "/", http.StatusFound, *vd.Alert)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thank you, your email address has been verified.",
+	})
+}
+
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.Verified() {
+		http.Redirect(w, r, "/profile", http.StatusFound)
+		return
+	}
+
+	if err := u.sendVerification(user); err != nil {
+		redirectProfileError(w, r, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We have sent you a new verification link.",
+	})
+}
+
+// redirectProfileError sends the user back to their
+// profile page with err shown as an alert.
+func redirectProfileError(w http.ResponseWriter, r *http.Request, err error) {
+	redirectError(w, r, "/profile", err)
+}
+
+// RevokeSession signs out a single device of the current user
+//
+// POST /sessions/:id/delete
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	session, err := u.ss.ByID(uint(id))
+	if err != nil || session.UserID != user.ID {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if err := u.ss.Delete(session.ID); err != nil {
+		views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlError,
+			Message: views.AlertMsgGeneric,
+		})
+		return
+	}
+
+	views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Session revoked.",
+	})
+}
+
 // POST /forgot
 func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
@@ -210,28 +515,34 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := u.us.InitiateReset(form.Email)
+	// Unknown addresses get the same answer as known ones,
+	// this page must not tell who has an account.
+	sent := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If we find the provided email, a confirmation link will be sent to that email address.",
+	}
 
-	if err != nil {
-		vd.SetAlert(err)
-		u.ForgotPwView.Render(w, r, vd)
+	// We don't look the user up here, so write in the language
+	// of the browser asking.
+	emailer := u.emailer.In(requestLocale(r, u.emailer))
+	err := u.services.Transaction(func(tx *models.Services) error {
+		token, err := tx.User.InitiateReset(form.Email)
+		if err != nil {
+			return err
+		}
+		return queued(emailer, tx).ResetPw(form.Email, token)
+	})
+	if err == models.ErrEmailNotFound {
+		views.RedirectAlert(w, r, "/reset", http.StatusFound, sent)
 		return
 	}
-
-	//fmt.Println("Token for: ", form.Email, " : ", token)
-
-	err = u.emailer.ResetPw(form.Email, token)
-
 	if err != nil {
 		vd.SetAlert(err)
 		u.ForgotPwView.Render(w, r, vd)
 		return
 	}
 
-	views.RedirectAlert(w, r, "/reset", http.StatusFound, views.Alert{
-		Level:   views.AlertLvlSuccess,
-		Message: "If we find the provided email, a confirmation link will be sent to that email address.",
-	})
+	views.RedirectAlert(w, r, "/reset", http.StatusFound, sent)
 }
 
 // GET /reset
@@ -257,14 +568,33 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.us.CompleteReset(form.Token, form.Password)
+	user, err := u.us.As(actor(r)).CompleteReset(form.Token, form.Password)
 	if err != nil {
 		vd.SetAlert(err)
 		u.ResetPwView.Render(w, r, vd)
 		return
 	}
 
-	u.signIn(w, user)
+	// A password reset ends every existing session, whoever
+	// knew the old password should not stay signed in.
+	u.ss.DeleteByUserID(user.ID)
+
+	// Knowing the reset token is not enough to get around the
+	// second factor.
+	if user.TwoFactorEnabled() {
+		if err := u.beginTwoFactor(w, user); err != nil {
+			vd.SetAlert(err)
+			u.ResetPwView.Render(w, r, vd)
+			return
+		}
+		views.RedirectAlert(w, r, "/login/2fa", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlSuccess,
+			Message: "Your password has been reset. Please enter your two-factor code to sign in.",
+		})
+		return
+	}
+
+	u.signIn(w, r, user)
 	views.RedirectAlert(w, r, "/properties", http.StatusFound, views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: "Your password has been reset and you have been logged in.",
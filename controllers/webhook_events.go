@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"github.com/ruckuus/dojo1/models"
+)
+
+// apiLease is a lease as webhook events show it. Amounts are in
+// cents.
+type apiLease struct {
+	ID         uint    `json:"id"`
+	PropertyID uint    `json:"property_id"`
+	TenantID   uint    `json:"tenant_id"`
+	StartsOn   string  `json:"starts_on" format:"date"`
+	EndsOn     *string `json:"ends_on" format:"date"`
+	RentCents  int64   `json:"rent_cents"`
+	CreatedAt  string  `json:"created_at" format:"date-time"`
+}
+
+// apiPayment is a payment posted on the ledger of a lease, as
+// webhook events show it. The amount paid is positive.
+type apiPayment struct {
+	ID          uint   `json:"id"`
+	LeaseID     uint   `json:"lease_id"`
+	PropertyID  uint   `json:"property_id"`
+	PostedOn    string `json:"posted_on" format:"date"`
+	Description string `json:"description"`
+	AmountCents int64  `json:"amount_cents"`
+	CreatedAt   string `json:"created_at" format:"date-time"`
+}
+
+// apiTicket is a ticket as webhook events show it
+type apiTicket struct {
+	ID          uint   `json:"id"`
+	PropertyID  uint   `json:"property_id"`
+	LeaseID     uint   `json:"lease_id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	CreatedAt   string `json:"created_at" format:"date-time"`
+	UpdatedAt   string `json:"updated_at" format:"date-time"`
+}
+
+func newAPILease(l *models.Lease) *apiLease {
+	lease := &apiLease{
+		ID:         l.ID,
+		PropertyID: l.PropertyID,
+		TenantID:   l.TenantID,
+		StartsOn:   l.StartsOn.Format(dateFormat),
+		RentCents:  int64(l.Rent),
+		CreatedAt:  apiTime(l.CreatedAt),
+	}
+	if l.EndsOn != nil {
+		endsOn := l.EndsOn.Format(dateFormat)
+		lease.EndsOn = &endsOn
+	}
+	return lease
+}
+
+func newAPIPayment(e *models.LedgerEntry, propertyID uint) *apiPayment {
+	return &apiPayment{
+		ID:          e.ID,
+		LeaseID:     e.LeaseID,
+		PropertyID:  propertyID,
+		PostedOn:    e.PostedOn.Format(dateFormat),
+		Description: e.Description,
+		AmountCents: -int64(e.Amount),
+		CreatedAt:   apiTime(e.CreatedAt),
+	}
+}
+
+func newAPITicket(t *models.Ticket) *apiTicket {
+	return &apiTicket{
+		ID:          t.ID,
+		PropertyID:  t.PropertyID,
+		LeaseID:     t.LeaseID,
+		Title:       t.Title,
+		Description: t.Description,
+		Status:      t.Status,
+		CreatedAt:   apiTime(t.CreatedAt),
+		UpdatedAt:   apiTime(t.UpdatedAt),
+	}
+}
@@ -0,0 +1,318 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// deliveryLogSize is how many deliveries the endpoint page lists
+const deliveryLogSize = 50
+
+// Webhooks lets the owners of an organization post its events
+// to their own services, see package webhook. The pages live
+// under the organization, not under /webhooks/ which is for the
+// webhooks other services post to us.
+type Webhooks struct {
+	IndexView *views.View
+	ShowView  *views.View
+	os        models.OrganizationService
+	wes       models.WebhookEndpointService
+	wds       models.WebhookDeliveryService
+	az        *authz.Authorizer
+}
+
+type WebhookEndpointForm struct {
+	URL    string   `schema:"url"`
+	Events []string `schema:"events"`
+}
+
+// webhooksData is what the webhooks page renders
+type webhooksData struct {
+	Organization *models.Organization
+	Endpoints    []models.WebhookEndpoint
+	Events       []string
+}
+
+// webhookData is what the endpoint page renders
+type webhookData struct {
+	Organization *models.Organization
+	Endpoint     *models.WebhookEndpoint
+	Events       []string
+	Deliveries   []models.WebhookDelivery
+}
+
+func NewWebhooks(services *models.Services, az *authz.Authorizer) *Webhooks {
+	return &Webhooks{
+		IndexView: views.NewView("bootstrap", "webhooks/index"),
+		ShowView:  views.NewView("bootstrap", "webhooks/show"),
+		os:        services.Organization,
+		wes:       services.Webhook,
+		wds:       services.Delivery,
+		az:        az,
+	}
+}
+
+// organizationByID looks up the organization in the URL and
+// checks the user may manage its webhooks
+func (wh *Webhooks) organizationByID(w http.ResponseWriter, r *http.Request) (*models.Organization, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, err
+	}
+
+	org, err := wh.os.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Organization not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	err = wh.az.Can(user, authz.ActionEdit, authz.Organization(org))
+	if !authorized(w, err, "Organization") {
+		return nil, err
+	}
+	return org, nil
+}
+
+// endpointByID looks up the endpoint in the URL along with its
+// organization
+func (wh *Webhooks) endpointByID(w http.ResponseWriter, r *http.Request) (*models.Organization, *models.WebhookEndpoint, error) {
+	org, err := wh.organizationByID(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["endpoint"])
+	if err != nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, nil, err
+	}
+	endpoint, err := wh.wes.ByID(uint(id))
+	if err == nil && endpoint.OrganizationID != org.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return nil, nil, err
+	}
+	return org, endpoint, nil
+}
+
+// Index lists the webhook endpoints of the organization
+//
+// GET /organizations/:id/webhooks
+func (wh *Webhooks) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	org, err := wh.organizationByID(w, r)
+	if err != nil {
+		return
+	}
+
+	data := webhooksData{
+		Organization: org,
+		Events:       models.WebhookEvents,
+	}
+	vd.Yield = &data
+	data.Endpoints, err = wh.wes.ByOrganizationID(org.ID)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	wh.IndexView.Render(w, r, vd)
+}
+
+// Create adds a webhook endpoint to the organization
+//
+// POST /organizations/:id/webhooks
+func (wh *Webhooks) Create(w http.ResponseWriter, r *http.Request) {
+	org, err := wh.organizationByID(w, r)
+	if err != nil {
+		return
+	}
+	indexURL := fmt.Sprintf("/organizations/%d/webhooks", org.ID)
+
+	var form WebhookEndpointForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, indexURL, err)
+		return
+	}
+
+	endpoint := models.WebhookEndpoint{
+		OrganizationID: org.ID,
+		UserID:         context.User(r.Context()).ID,
+		URL:            form.URL,
+		Events:         strings.Join(form.Events, " "),
+	}
+	if err := wh.wes.Create(&endpoint); err != nil {
+		redirectError(w, r, indexURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, fmt.Sprintf("%s/%d", indexURL, endpoint.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Webhook created, use its signing secret to check the requests come from us.",
+	})
+}
+
+// Show renders the endpoint with its secret and delivery log
+//
+// GET /organizations/:id/webhooks/:endpoint
+func (wh *Webhooks) Show(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+
+	org, endpoint, err := wh.endpointByID(w, r)
+	if err != nil {
+		return
+	}
+
+	data := webhookData{
+		Organization: org,
+		Endpoint:     endpoint,
+		Events:       models.WebhookEvents,
+	}
+	vd.Yield = &data
+	data.Deliveries, err = wh.wds.ByEndpointID(endpoint.ID, deliveryLogSize)
+	if err != nil {
+		vd.SetAlert(err)
+	}
+
+	wh.ShowView.Render(w, r, vd)
+}
+
+// Update changes the URL and events of the endpoint
+//
+// POST /organizations/:id/webhooks/:endpoint/update
+func (wh *Webhooks) Update(w http.ResponseWriter, r *http.Request) {
+	org, endpoint, err := wh.endpointByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d/webhooks/%d", org.ID, endpoint.ID)
+
+	var form WebhookEndpointForm
+	if err := parseForm(r, &form); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	endpoint.URL = form.URL
+	endpoint.Events = strings.Join(form.Events, " ")
+	if err := wh.wes.Update(endpoint); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Webhook updated.",
+	})
+}
+
+// Enable posts events to an endpoint disabled after failing too
+// often again. The deliveries queued meanwhile go out first.
+//
+// POST /organizations/:id/webhooks/:endpoint/enable
+func (wh *Webhooks) Enable(w http.ResponseWriter, r *http.Request) {
+	org, endpoint, err := wh.endpointByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d/webhooks/%d", org.ID, endpoint.ID)
+
+	if err := wh.wes.Enable(endpoint); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Webhook enabled.",
+	})
+}
+
+// Delete removes the endpoint along with its delivery log
+//
+// POST /organizations/:id/webhooks/:endpoint/delete
+func (wh *Webhooks) Delete(w http.ResponseWriter, r *http.Request) {
+	org, endpoint, err := wh.endpointByID(w, r)
+	if err != nil {
+		return
+	}
+
+	err = wh.wds.DeleteByEndpointID(endpoint.ID)
+	if err == nil {
+		err = wh.wes.Delete(endpoint.ID)
+	}
+	if err != nil {
+		redirectError(w, r, fmt.Sprintf("/organizations/%d/webhooks/%d", org.ID, endpoint.ID), err)
+		return
+	}
+
+	views.RedirectAlert(w, r, fmt.Sprintf("/organizations/%d/webhooks", org.ID), http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Webhook deleted.",
+	})
+}
+
+// Replay posts a delivery again, with the same event ID
+//
+// POST /organizations/:id/webhooks/:endpoint/deliveries/:delivery/replay
+func (wh *Webhooks) Replay(w http.ResponseWriter, r *http.Request) {
+	org, endpoint, err := wh.endpointByID(w, r)
+	if err != nil {
+		return
+	}
+	showURL := fmt.Sprintf("/organizations/%d/webhooks/%d", org.ID, endpoint.ID)
+
+	id, err := strconv.Atoi(mux.Vars(r)["delivery"])
+	if err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	delivery, err := wh.wds.ByID(uint(id))
+	if err == nil && delivery.EndpointID != endpoint.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if _, err := wh.wds.Redeliver(delivery.ID); err != nil {
+		redirectError(w, r, showURL, err)
+		return
+	}
+
+	message := "The " + delivery.Event + " event will be posted again shortly."
+	if endpoint.Disabled() {
+		message = "The " + delivery.Event + " event will be posted again once the webhook is enabled."
+	}
+	views.RedirectAlert(w, r, showURL, http.StatusFound, views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: message,
+	})
+}
@@ -0,0 +1,306 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Paths of the pages emails link to, under the base URL
+const (
+	resetPath   = "/reset"
+	verifyPath  = "/verify"
+	forgotPath  = "/forgot"
+	invitePath  = "/invitations/accept"
+	restorePath = "/restore"
+	exportPath  = "/exports/download"
+)
+
+// ErrUnknownEmail is returned when previewing an email that
+// does not exist
+var ErrUnknownEmail = errors.New("email: unknown email")
+
+// ResetData is the Yield of the password reset email
+type ResetData struct {
+	URL   string
+	Token string
+}
+
+// VerifyData is the Yield of the email address verification
+type VerifyData struct {
+	URL string
+}
+
+// LockedData is the Yield of the account locked email
+type LockedData struct {
+	Until     time.Time
+	ForgotURL string
+}
+
+// InviteData is the Yield of invitations, What is e.g. the name
+// of a property.
+type InviteData struct {
+	FromName string
+	What     string
+	Role     string
+	URL      string
+}
+
+// ChangingData is the Yield of the email sent to the old
+// address of a user changing it
+type ChangingData struct {
+	NewEmail  string
+	ForgotURL string
+}
+
+// DeletedData is the Yield of the account deleted email
+type DeletedData struct {
+	PurgeOn    time.Time
+	RestoreURL string
+}
+
+// ExportData is the Yield of the data export email
+type ExportData struct {
+	URL       string
+	ExpiresAt time.Time
+}
+
+// NotificationData is the Yield of a notification email, and
+// one of the notifications of a digest. Replies to the email go
+// to ReplyTo when it is set, digests ignore it.
+type NotificationData struct {
+	Title   string
+	Body    string
+	URL     string
+	ReplyTo string
+}
+
+// DigestData is the Yield of the daily digest of notifications
+type DigestData struct {
+	Notifications []NotificationData
+}
+
+// Client writes the emails we send and hands them to a Mailer,
+// see WithMailgun, WithSMTP and WithOutbox.
+type Client struct {
+	from       string
+	senderName string
+	baseURL    string
+	locale     string
+	mailer     Mailer
+	templates  templates
+}
+
+type ClientConfig func(*Client)
+
+func NewClient(opts ...ClientConfig) *Client {
+	client := Client{
+		from:       "no-reply@tataruma.com",
+		senderName: "Tataruma",
+		baseURL:    "http://localhost:3000",
+		locale:     DefaultLocale,
+	}
+
+	for _, opt := range opts {
+		opt(&client)
+	}
+
+	tpls, err := loadTemplates(TemplateDir)
+	if err != nil {
+		panic(err)
+	}
+	client.templates = tpls
+
+	return &client
+}
+
+// In returns a copy of the client writing emails in locale,
+// e.g. the User.Locale of the recipient.
+func (c *Client) In(locale string) *Client {
+	client := *c
+	client.locale = locale
+	return &client
+}
+
+// Via returns a copy of the client handing its emails to
+// mailer, e.g. one queueing them in a transaction.
+func (c *Client) Via(mailer Mailer) *Client {
+	client := *c
+	client.mailer = mailer
+	return &client
+}
+
+// WithMailer sends the emails through mailer
+func WithMailer(mailer Mailer) ClientConfig {
+	return func(client *Client) {
+		client.mailer = mailer
+	}
+}
+
+func WithMailgun(domain, apiKey string) ClientConfig {
+	return WithMailer(NewMailgun(domain, apiKey))
+}
+
+func WithSMTP(cfg SMTPConfig) ClientConfig {
+	return WithMailer(NewSMTP(cfg))
+}
+
+func WithOutbox(dir string) ClientConfig {
+	return WithMailer(NewOutbox(dir))
+}
+
+// WithSender sets the sender of the emails, which are also
+// signed with name.
+func WithSender(name, email string) ClientConfig {
+	return func(client *Client) {
+		client.from = buildEmail(name, email)
+		client.senderName = name
+	}
+}
+
+// WithBaseURL sets where the links in the emails lead, e.g.
+// "https://www.tataruma.com".
+func WithBaseURL(baseURL string) ClientConfig {
+	return func(client *Client) {
+		client.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+func (c *Client) Welcome(toName, toEmail string) error {
+	return c.sendTemplate(emailWelcome, toName, toEmail, nil)
+}
+
+func (c *Client) ResetPw(toEmail, token string) error {
+	return c.sendTemplate(emailReset, "", toEmail, ResetData{
+		URL:   c.tokenURL(resetPath, token),
+		Token: token,
+	})
+}
+
+func (c *Client) Verify(toName, toEmail, token string) error {
+	return c.sendTemplate(emailVerify, toName, toEmail, VerifyData{
+		URL: c.tokenURL(verifyPath, token),
+	})
+}
+
+func (c *Client) AccountLocked(toName, toEmail string, until time.Time) error {
+	return c.sendTemplate(emailLocked, toName, toEmail, LockedData{
+		Until:     until,
+		ForgotURL: c.baseURL + forgotPath,
+	})
+}
+
+// EmailChanging lets the current address of a user know that
+// it is about to be replaced by newEmail.
+func (c *Client) EmailChanging(toName, toEmail, newEmail string) error {
+	return c.sendTemplate(emailChanging, toName, toEmail, ChangingData{
+		NewEmail:  newEmail,
+		ForgotURL: c.baseURL + forgotPath,
+	})
+}
+
+// AccountDeleted confirms the deletion of an account, which can
+// be restored until purgeOn.
+func (c *Client) AccountDeleted(toName, toEmail string, purgeOn time.Time) error {
+	return c.sendTemplate(emailDeleted, toName, toEmail, DeletedData{
+		PurgeOn:    purgeOn,
+		RestoreURL: c.baseURL + restorePath,
+	})
+}
+
+// ExportReady sends the link to download an export of the
+// data of the user, which works until expiresAt.
+func (c *Client) ExportReady(toName, toEmail, token string, expiresAt time.Time) error {
+	return c.sendTemplate(emailExport, toName, toEmail, ExportData{
+		URL:       c.tokenURL(exportPath, token),
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Invite sends an invitation to take role on what, e.g. the
+// name of a property, on behalf of fromName.
+func (c *Client) Invite(toEmail, fromName, what, role, token string) error {
+	return c.sendTemplate(emailInvite, "", toEmail, InviteData{
+		FromName: fromName,
+		What:     what,
+		Role:     role,
+		URL:      c.tokenURL(invitePath, token),
+	})
+}
+
+// Notification emails one notification. Its URL may be a path,
+// which is made to lead to the app.
+func (c *Client) Notification(toName, toEmail string, n NotificationData) error {
+	n.URL = c.link(n.URL)
+	msg := &Message{To: buildEmail(toName, toEmail), ReplyTo: n.ReplyTo}
+	if err := c.render(msg, emailNotify, toName, n); err != nil {
+		return err
+	}
+	return c.send(msg)
+}
+
+// Digest emails the notifications of the day at once
+func (c *Client) Digest(toName, toEmail string, notifications []NotificationData) error {
+	data := DigestData{}
+	for _, n := range notifications {
+		n.URL = c.link(n.URL)
+		data.Notifications = append(data.Notifications, n)
+	}
+	return c.sendTemplate(emailDigest, toName, toEmail, data)
+}
+
+// sendTemplate renders the email name in the locale of the
+// client and sends it
+func (c *Client) sendTemplate(name, toName, toEmail string, yield interface{}) error {
+	msg := &Message{To: buildEmail(toName, toEmail)}
+	if err := c.render(msg, name, toName, yield); err != nil {
+		return err
+	}
+	return c.send(msg)
+}
+
+func (c *Client) render(msg *Message, name, toName string, yield interface{}) error {
+	tpl, err := c.templates.lookup(c.locale, name)
+	if err != nil {
+		return err
+	}
+	return tpl.render(msg, &Data{
+		ToName:  toName,
+		Sender:  c.senderName,
+		BaseURL: c.baseURL,
+		Yield:   yield,
+	})
+}
+
+// link makes paths lead to the app, other URLs are kept
+func (c *Client) link(url string) string {
+	if strings.HasPrefix(url, "/") {
+		return c.baseURL + url
+	}
+	return url
+}
+
+// tokenURL links to path under the base URL with a token
+func (c *Client) tokenURL(path, token string) string {
+	v := url.Values{}
+	v.Set("token", token)
+	return c.baseURL + path + "?" + v.Encode()
+}
+
+// send fills in the sender and hands msg to the mailer
+func (c *Client) send(msg *Message) error {
+	if c.mailer == nil {
+		return ErrNoMailer
+	}
+	msg.From = c.from
+	return c.mailer.Send(msg)
+}
+
+func buildEmail(name, email string) string {
+	if name == "" {
+		return email
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
@@ -0,0 +1,117 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNoMailer is returned when sending with a Client that was
+// given no Mailer
+var ErrNoMailer = errors.New("email: no mailer configured")
+
+// Mailer delivers messages, see NewMailgun, NewSMTP and NewOutbox
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// Message is an email with a plain text and an HTML version.
+// From and To are addresses such as "Name <name@example.com>".
+// ID is optional, it makes the Message-ID of every attempt at
+// sending the message the same, so it is delivered once.
+// ReplyTo is optional too, replies go to From without it.
+type Message struct {
+	ID      string
+	From    string
+	To      string
+	ReplyTo string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Bytes returns the message in the RFC 5322 format, as sent
+// over SMTP and saved by the outbox.
+func (m *Message) Bytes() ([]byte, error) {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	headers := []struct{ key, value string }{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", m.messageID()},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + body.Boundary()},
+	}
+	if m.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(m.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, struct{ key, value string }{"Reply-To", replyTo.String()})
+	}
+	var head bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&head, "%s: %s\r\n", h.key, h.value)
+	}
+	head.WriteString("\r\n")
+
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	}
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return append(head.Bytes(), buf.Bytes()...), nil
+}
+
+// messageID returns the Message-ID header, built from ID under
+// the domain of the sender when it is set.
+func (m *Message) messageID() string {
+	if from, err := mail.ParseAddress(m.From); err == nil && m.ID != "" {
+		domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+		return fmt.Sprintf("<%s@%s>", m.ID, domain)
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), hostname)
+}
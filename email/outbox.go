@@ -0,0 +1,41 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// outboxMailer saves messages as .eml files in a maildir instead
+// of sending them, for development. Files are written to tmp/
+// and moved to new/ once complete, so readers never see half a
+// message.
+type outboxMailer struct {
+	dir string
+}
+
+func NewOutbox(dir string) Mailer {
+	return &outboxMailer{dir: dir}
+}
+
+func (om *outboxMailer) Send(msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(om.dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	name := fmt.Sprintf("%d.%d.eml", time.Now().UnixNano(), os.Getpid())
+	tmp := filepath.Join(om.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(om.dir, "new", name))
+}
@@ -0,0 +1,79 @@
+package email
+
+import (
+	"sort"
+	"time"
+)
+
+// previews make up the data to render each email with, for
+// looking at them during development.
+var previews = map[string]func(c *Client) interface{}{
+	emailWelcome: func(c *Client) interface{} { return nil },
+	emailReset: func(c *Client) interface{} {
+		return ResetData{URL: c.tokenURL(resetPath, "preview-token"), Token: "preview-token"}
+	},
+	emailVerify: func(c *Client) interface{} {
+		return VerifyData{URL: c.tokenURL(verifyPath, "preview-token")}
+	},
+	emailLocked: func(c *Client) interface{} {
+		return LockedData{Until: time.Now().Add(15 * time.Minute), ForgotURL: c.baseURL + forgotPath}
+	},
+	emailInvite: func(c *Client) interface{} {
+		return InviteData{
+			FromName: "Jane Doe",
+			What:     "Jalan Kenanga 12",
+			Role:     "manager",
+			URL:      c.tokenURL(invitePath, "preview-token"),
+		}
+	},
+	emailChanging: func(c *Client) interface{} {
+		return ChangingData{NewEmail: "new@example.com", ForgotURL: c.baseURL + forgotPath}
+	},
+	emailDeleted: func(c *Client) interface{} {
+		return DeletedData{PurgeOn: time.Now().Add(30 * 24 * time.Hour), RestoreURL: c.baseURL + restorePath}
+	},
+	emailNotify: func(c *Client) interface{} {
+		return NotificationData{
+			Title: "Ticket \"Leaking tap\" is now in progress",
+			Body:  "Jalan Kenanga 12",
+			URL:   c.link("/portal/tickets/1"),
+		}
+	},
+	emailDigest: func(c *Client) interface{} {
+		return DigestData{Notifications: []NotificationData{
+			{Title: "Rent of 1500.00 is due on 01 Nov 2026", Body: "Jalan Kenanga 12", URL: c.link("/portal")},
+			{Title: "New ticket \"Leaking tap\"", Body: "Jalan Kenanga 12", URL: c.link("/properties/1")},
+		}}
+	},
+	emailExport: func(c *Client) interface{} {
+		return ExportData{URL: c.tokenURL(exportPath, "preview-token"), ExpiresAt: time.Now().Add(7 * 24 * time.Hour)}
+	},
+}
+
+// PreviewNames returns the names of the emails Preview renders
+func PreviewNames() []string {
+	var names []string
+	for name := range previews {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Preview renders the email name in locale with made up data,
+// without sending it.
+func (c *Client) Preview(locale, name string) (*Message, error) {
+	sample, ok := previews[name]
+	if !ok {
+		return nil, ErrUnknownEmail
+	}
+
+	msg := &Message{
+		From: c.from,
+		To:   buildEmail("Jane Doe", "jane@example.com"),
+	}
+	if err := c.In(locale).render(msg, name, "Jane Doe", sample(c)); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,103 @@
+package email
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+const (
+	// smtpDialTimeout is how long connecting to the server may take
+	smtpDialTimeout = 10 * time.Second
+
+	// smtpTimeout is how long a whole message may take to send,
+	// so a server that stops answering doesn't hold up the queue
+	smtpTimeout = time.Minute
+)
+
+// SMTPConfig is how to reach an SMTP server. Username is left
+// empty for servers that don't require authentication.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// StartTLS upgrades the connection before authenticating,
+	// it is required when a password is sent.
+	StartTLS bool
+}
+
+// smtpMailer sends through an SMTP server
+type smtpMailer struct {
+	cfg SMTPConfig
+}
+
+func NewSMTP(cfg SMTPConfig) Mailer {
+	return &smtpMailer{cfg: cfg}
+}
+
+func (sm *smtpMailer) Send(msg *Message) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return err
+	}
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(sm.cfg.Host, strconv.Itoa(sm.cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, smtpDialTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, sm.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if sm.cfg.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: sm.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if sm.cfg.Username != "" {
+		// PlainAuth refuses to send the password in the clear
+		// unless the server is on localhost.
+		auth := smtp.PlainAuth("", sm.cfg.Username, sm.cfg.Password, sm.cfg.Host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,158 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+var (
+	// TemplateDir holds a directory per locale, each with a
+	// layout.txt and layout.html, and a .txt and .html file per
+	// email. The .txt file also defines the "subject".
+	TemplateDir = "email/templates/"
+
+	// DefaultLocale is used for unknown locales, and for emails
+	// missing from a locale.
+	DefaultLocale = "en"
+)
+
+const (
+	emailWelcome  = "welcome"
+	emailReset    = "reset"
+	emailVerify   = "verify"
+	emailLocked   = "locked"
+	emailInvite   = "invite"
+	emailChanging = "changing"
+	emailDeleted  = "deleted"
+	emailExport   = "export"
+	emailNotify   = "notification"
+	emailDigest   = "digest"
+)
+
+// Data is what every email template is executed with. Yield
+// holds the fields of the email itself, e.g. ResetData.
+type Data struct {
+	// ToName is the name of the recipient, it is empty when we
+	// only know their address.
+	ToName  string
+	Sender  string
+	BaseURL string
+	Yield   interface{}
+}
+
+// emailTemplate is one email in one locale
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// templates holds the emails of each locale, by name
+type templates map[string]map[string]*emailTemplate
+
+func loadTemplates(dir string) (templates, error) {
+	dirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tpls := templates{}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		locale := d.Name()
+		localeDir := filepath.Join(dir, locale)
+		files, err := filepath.Glob(filepath.Join(localeDir, "*.txt"))
+		if err != nil {
+			return nil, err
+		}
+
+		tpls[locale] = map[string]*emailTemplate{}
+		for _, f := range files {
+			name := strings.TrimSuffix(filepath.Base(f), ".txt")
+			if name == "layout" {
+				continue
+			}
+			text, err := texttemplate.ParseFiles(
+				filepath.Join(localeDir, "layout.txt"), f)
+			if err != nil {
+				return nil, err
+			}
+			html, err := htmltemplate.ParseFiles(
+				filepath.Join(localeDir, "layout.html"),
+				filepath.Join(localeDir, name+".html"))
+			if err != nil {
+				return nil, err
+			}
+			tpls[locale][name] = &emailTemplate{text: text, html: html}
+		}
+	}
+
+	if _, ok := tpls[DefaultLocale]; !ok {
+		return nil, fmt.Errorf("email: no templates for the default locale %q in %s", DefaultLocale, dir)
+	}
+	return tpls, nil
+}
+
+// lookup returns the email name in locale, falling back to the
+// default locale.
+func (t templates) lookup(locale, name string) (*emailTemplate, error) {
+	if tpl, ok := t[locale][name]; ok {
+		return tpl, nil
+	}
+	if tpl, ok := t[DefaultLocale][name]; ok {
+		return tpl, nil
+	}
+	return nil, fmt.Errorf("email: no template %q", name)
+}
+
+// render fills in the subject and both bodies of msg
+func (et *emailTemplate) render(msg *Message, data *Data) error {
+	var buf bytes.Buffer
+	if err := et.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := et.text.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return err
+	}
+	msg.Text = buf.String()
+
+	buf.Reset()
+	if err := et.html.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return err
+	}
+	msg.HTML = buf.String()
+	return nil
+}
+
+// Locales returns the locales there are templates for
+func (c *Client) Locales() []string {
+	var locales []string
+	for locale := range c.templates {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// MatchLocale picks the best locale we have for an
+// Accept-Language header, or the default one.
+func (c *Client) MatchLocale(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		tag = strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := c.templates[tag]; ok {
+			return tag
+		}
+	}
+	return DefaultLocale
+}
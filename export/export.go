@@ -0,0 +1,409 @@
+// Package export builds the ZIP files users download to take
+// their data with them. Exports are requested from the profile
+// page and built here in the background, one at a time.
+package export
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/mailqueue"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/rand"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// pollInterval is how often pending exports are looked for
+const pollInterval = time.Minute
+
+// Exporter builds pending exports and emails their download
+// link, and removes them once they expired.
+type Exporter struct {
+	services *models.Services
+	emailer  *email.Client
+}
+
+func NewExporter(services *models.Services, emailer *email.Client) *Exporter {
+	return &Exporter{
+		services: services,
+		emailer:  emailer,
+	}
+}
+
+// Run works through the exports forever, it is meant to be
+// started in its own goroutine.
+func (ex *Exporter) Run() {
+	for {
+		ex.buildPending()
+		ex.removeExpired()
+		time.Sleep(pollInterval)
+	}
+}
+
+func (ex *Exporter) buildPending() {
+	exports, err := ex.services.Export.Pending()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range exports {
+		e := &exports[i]
+		if err := ex.build(e); err != nil {
+			log.Printf("export %d: %v", e.ID, err)
+			e.Status = models.ExportFailed
+			ex.services.Export.Update(e)
+		}
+	}
+}
+
+func (ex *Exporter) build(e *models.Export) error {
+	user, err := ex.services.User.ByID(e.UserID)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	w := writer{zip: zw, services: ex.services}
+	if err := w.writeAll(user); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// The name can't be guessed, the file is only ever handed
+	// out by the download handler.
+	name, err := rand.String(32)
+	if err != nil {
+		return err
+	}
+	dir := path.Join("exports", fmt.Sprint(user.ID))
+	stored, err := ex.services.Store.Store(dir, name+".zip", tmp)
+	if err != nil {
+		return err
+	}
+
+	return ex.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Export.Ready(e, stored); err != nil {
+			return err
+		}
+		emailer := ex.emailer.Via(mailqueue.NewMailer(tx.Outbox))
+		return emailer.In(user.Locale).ExportReady(user.Name, user.Email, e.Token, *e.ExpiresAt)
+	})
+}
+
+func (ex *Exporter) removeExpired() {
+	exports, err := ex.services.Export.ExpiredBefore(time.Now())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, e := range exports {
+		if err := ex.services.Store.Delete(e.Path); err != nil {
+			log.Printf("export %d: %v", e.ID, err)
+			continue
+		}
+		ex.services.Export.Delete(e.ID)
+	}
+}
+
+// writer puts the data of a user in a ZIP: a JSON manifest per
+// kind of data, and the stored files under files/.
+type writer struct {
+	zip      *zip.Writer
+	services *models.Services
+}
+
+func (w *writer) writeAll(user *models.User) error {
+	if err := w.writeProfile(user); err != nil {
+		return err
+	}
+
+	// What the user owns: their personal organization, and
+	// what they created in the others.
+	orgs, err := w.services.Organization.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	var properties []property
+	var galleries []gallery
+	for _, org := range orgs {
+		ps, err := w.services.Property.ByOrganizationID(org.ID)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			if !org.Personal && p.UserID != user.ID {
+				continue
+			}
+			entry, err := w.property(p)
+			if err != nil {
+				return err
+			}
+			properties = append(properties, entry)
+		}
+
+		gs, err := w.services.Gallery.ByOrganizationID(org.ID)
+		if err != nil {
+			return err
+		}
+		for _, g := range gs {
+			if !org.Personal && g.UserID != user.ID {
+				continue
+			}
+			images, err := w.files(models.GalleryImageKey, g.ID)
+			if err != nil {
+				return err
+			}
+			galleries = append(galleries, gallery{Gallery: g, Files: images})
+		}
+	}
+	if err := w.writeJSON("properties.json", properties); err != nil {
+		return err
+	}
+	if err := w.writeJSON("galleries.json", galleries); err != nil {
+		return err
+	}
+
+	// What the user rents
+	leases, err := w.services.Lease.ByTenantID(user.ID)
+	if err != nil {
+		return err
+	}
+	rented := make([]lease, 0, len(leases))
+	for _, l := range leases {
+		entry, err := w.lease(l)
+		if err != nil {
+			return err
+		}
+		rented = append(rented, entry)
+	}
+	return w.writeJSON("leases.json", rented)
+}
+
+// profile leaves out password hashes and other secrets
+type profile struct {
+	ID               uint
+	Name             string
+	Email            string
+	CreatedAt        time.Time
+	VerifiedAt       *time.Time
+	TwoFactorEnabled bool
+	Identities       []identity
+	APITokens        []apiToken
+	Organizations    []organization
+}
+
+type identity struct {
+	Provider  string
+	Email     string
+	CreatedAt time.Time
+}
+
+type apiToken struct {
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+}
+
+type organization struct {
+	ID   uint
+	Name string
+	Role string
+}
+
+type property struct {
+	models.Property
+	Leases  []lease
+	Tickets []ticket
+}
+
+type gallery struct {
+	models.Gallery
+	Files []string
+}
+
+type lease struct {
+	models.Lease
+	Ledger    []models.LedgerEntry
+	Documents []string
+	Tickets   []ticket
+}
+
+type ticket struct {
+	models.Ticket
+	Photos []string
+}
+
+func (w *writer) writeProfile(user *models.User) error {
+	p := profile{
+		ID:               user.ID,
+		Name:             user.Name,
+		Email:            user.Email,
+		CreatedAt:        user.CreatedAt,
+		VerifiedAt:       user.VerifiedAt,
+		TwoFactorEnabled: user.TwoFactorEnabled(),
+	}
+
+	identities, err := w.services.Identity.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, i := range identities {
+		p.Identities = append(p.Identities, identity{
+			Provider:  i.Provider,
+			Email:     i.Email,
+			CreatedAt: i.CreatedAt,
+		})
+	}
+
+	tokens, err := w.services.APIToken.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		p.APITokens = append(p.APITokens, apiToken{
+			Name:       t.Name,
+			Scopes:     t.ScopeList(),
+			CreatedAt:  t.CreatedAt,
+			ExpiresAt:  t.ExpiresAt,
+			LastUsedAt: t.LastUsedAt,
+		})
+	}
+
+	orgs, err := w.services.Organization.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		entry := organization{ID: org.ID, Name: org.Name}
+		if m, err := w.services.Organization.Membership(org.ID, user.ID); err == nil {
+			entry.Role = m.Role
+		}
+		p.Organizations = append(p.Organizations, entry)
+	}
+
+	return w.writeJSON("profile.json", p)
+}
+
+func (w *writer) property(p models.Property) (property, error) {
+	entry := property{Property: p}
+
+	leases, err := w.services.Lease.ByPropertyID(p.ID)
+	if err != nil {
+		return entry, err
+	}
+	for _, l := range leases {
+		le, err := w.lease(l)
+		if err != nil {
+			return entry, err
+		}
+		// Tickets are listed once, with the property
+		le.Tickets = nil
+		entry.Leases = append(entry.Leases, le)
+	}
+
+	tickets, err := w.services.Ticket.ByPropertyID(p.ID)
+	if err != nil {
+		return entry, err
+	}
+	entry.Tickets, err = w.tickets(tickets)
+	return entry, err
+}
+
+func (w *writer) lease(l models.Lease) (lease, error) {
+	entry := lease{Lease: l}
+
+	var err error
+	entry.Ledger, err = w.services.Ledger.ByLeaseID(l.ID)
+	if err != nil {
+		return entry, err
+	}
+	entry.Documents, err = w.files(models.LeaseDocumentKey, l.ID)
+	if err != nil {
+		return entry, err
+	}
+
+	tickets, err := w.services.Ticket.ByLeaseID(l.ID)
+	if err != nil {
+		return entry, err
+	}
+	entry.Tickets, err = w.tickets(tickets)
+	return entry, err
+}
+
+func (w *writer) tickets(tickets []models.Ticket) ([]ticket, error) {
+	entries := make([]ticket, 0, len(tickets))
+	for _, t := range tickets {
+		photos, err := w.files(models.TicketPhotoKey, t.ID)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ticket{Ticket: t, Photos: photos})
+	}
+	return entries, nil
+}
+
+// files copies the stored images of externalType and externalID
+// into the ZIP and returns their path in it.
+func (w *writer) files(externalType string, externalID uint) ([]string, error) {
+	images, err := w.services.Image.ByExternalTypeAndID(externalType, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(images))
+	for _, image := range images {
+		name := path.Join("files", image.RelativePath())
+		if err := w.copyFile(name, image.RelativePath()); err != nil {
+			return nil, err
+		}
+		paths = append(paths, name)
+	}
+	return paths, nil
+}
+
+func (w *writer) copyFile(name, storedPath string) error {
+	r, err := w.services.Store.Open(storedPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := w.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (w *writer) writeJSON(name string, v interface{}) error {
+	f, err := w.zip.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,113 @@
+// Package ical writes calendars in the iCalendar format of
+// RFC 5545, for calendar apps to subscribe to.
+package ical
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// prodID names the program that wrote the calendar
+	prodID = "-//Tataruma//Tataruma//EN"
+
+	// lineLength is how long lines may be, in octets, before
+	// they are folded
+	lineLength = 75
+
+	dateFormat     = "20060102"
+	dateTimeFormat = "20060102T150405Z"
+)
+
+// Calendar is a named list of events
+type Calendar struct {
+	Name   string
+	Events []Event
+}
+
+// Event is an all-day event. UID must be unique across every
+// calendar and stay the same when the event changes, so apps
+// update their copy rather than add another.
+type Event struct {
+	UID         string
+	Date        time.Time
+	Summary     string
+	Description string
+	URL         string
+}
+
+// Write writes the calendar to w
+func (c *Calendar) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	stamp := time.Now().UTC().Format(dateTimeFormat)
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:" + prodID,
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+		"X-WR-CALNAME:" + escape(c.Name),
+	}
+	for _, e := range c.Events {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+escape(e.UID),
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+e.Date.Format(dateFormat),
+			"DTEND;VALUE=DATE:"+e.Date.AddDate(0, 0, 1).Format(dateFormat),
+			"SUMMARY:"+escape(e.Summary),
+		)
+		if e.Description != "" {
+			lines = append(lines, "DESCRIPTION:"+escape(e.Description))
+		}
+		if e.URL != "" {
+			lines = append(lines, "URL:"+e.URL)
+		}
+		lines = append(lines, "TRANSP:TRANSPARENT", "END:VEVENT")
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		if _, err := bw.WriteString(fold(line)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+var escaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\;`,
+	",", `\,`,
+	"\r\n", `\n`,
+	"\n", `\n`,
+	"\r", `\n`,
+)
+
+// escape escapes the characters of text values
+func escape(text string) string {
+	return escaper.Replace(text)
+}
+
+// fold ends a content line with CRLF, breaking it up into lines
+// of lineLength octets or less, without splitting characters.
+// Continuation lines start with a space.
+func fold(line string) string {
+	var b bytes.Buffer
+	length := 0
+	for _, r := range line {
+		size := len(string(r))
+		if length+size > lineLength {
+			b.WriteString("\r\n ")
+			length = 1
+		}
+		b.WriteRune(r)
+		length += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,120 @@
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Rent due", "Rent due"},
+		{"Rent; Flat 2, Main St.", `Rent\; Flat 2\, Main St.`},
+		{`C:\rent`, `C:\\rent`},
+		{"first\nsecond", `first\nsecond`},
+		{"first\r\nsecond", `first\nsecond`},
+		{"first\rsecond", `first\nsecond`},
+		{"a,b;c\\\n", `a\,b\;c\\\n`},
+		{"Miete fällig", "Miete fällig"},
+	}
+	for _, tt := range tests {
+		if got := escape(tt.text); got != tt.want {
+			t.Errorf("escape(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"short", "SUMMARY:Rent due", "SUMMARY:Rent due\r\n"},
+		{"exactly 75 octets", strings.Repeat("a", 75), strings.Repeat("a", 75) + "\r\n"},
+		{"76 octets", strings.Repeat("a", 76), strings.Repeat("a", 75) + "\r\n a\r\n"},
+		{"continuation lines hold 74", strings.Repeat("a", 75+74+1),
+			strings.Repeat("a", 75) + "\r\n " + strings.Repeat("a", 74) + "\r\n a\r\n"},
+		// ü is two octets, the 75th octet would be half of one
+		{"two octet character at the end", strings.Repeat("a", 74) + "ü",
+			strings.Repeat("a", 74) + "\r\n ü\r\n"},
+		{"empty", "", "\r\n"},
+	}
+	for _, tt := range tests {
+		if got := fold(tt.line); got != tt.want {
+			t.Errorf("%s: fold() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFoldMultiByte(t *testing.T) {
+	// Two, three and four octet characters, 12 octets a repeat
+	// once escaped, far over 75 octets
+	line := "SUMMARY:" + escape(strings.Repeat("ü€😀, ", 12))
+	folded := fold(line)
+
+	if !strings.HasSuffix(folded, "\r\n") {
+		t.Fatalf("%q does not end with CRLF", folded)
+	}
+	lines := strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n")
+	if len(lines) < 2 {
+		t.Fatalf("%d octets were not folded", len(line))
+	}
+
+	var unfolded string
+	for i, l := range lines {
+		if len(l) > lineLength {
+			t.Errorf("line %d is %d octets", i, len(l))
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("line %d splits a character: %q", i, l)
+		}
+		if i > 0 {
+			if !strings.HasPrefix(l, " ") {
+				t.Errorf("line %d does not start with a space: %q", i, l)
+			}
+			l = l[1:]
+		}
+		unfolded += l
+	}
+	if unfolded != line {
+		t.Errorf("unfolded to %q, want %q", unfolded, line)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	c := Calendar{
+		Name: "Flat 2, Main St.",
+		Events: []Event{{
+			UID:     "lease-7-rent-2026-03@tataruma.test",
+			Date:    time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			Summary: "Rent due; Flat 2",
+		}},
+	}
+	var buf bytes.Buffer
+	if err := c.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"X-WR-CALNAME:Flat 2\\, Main St.\r\n",
+		"DTSTART;VALUE=DATE:20260301\r\n",
+		"DTEND;VALUE=DATE:20260302\r\n",
+		"SUMMARY:Rent due\\; Flat 2\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("calendar has no %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(strings.Replace(out, "\r\n", "", -1), "\n") {
+		t.Error("calendar has lines not ending with CRLF")
+	}
+}
@@ -0,0 +1,104 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownRecipient = errors.New("inbound: the message is not for an address of ours")
+	ErrInvalidSignature = errors.New("inbound: the signature is not valid")
+	ErrReplayed         = errors.New("inbound: the signature was already used")
+)
+
+const (
+	// ticketPrefix starts the local part of ticket reply addresses
+	ticketPrefix = "ticket+"
+
+	// newTicketLocal is the local part of the address tickets
+	// are opened at
+	newTicketLocal = "tickets"
+
+	// signatureLength is how many hex digits of the HMAC the
+	// reply addresses carry
+	signatureLength = 20
+)
+
+// Addresses builds and recognizes the addresses under domain
+// users write to: one per ticket to reply to it, signed so they
+// can't be guessed, and one to open tickets.
+type Addresses struct {
+	domain string
+	key    []byte
+}
+
+// NewAddresses returns the addresses under domain, signed with
+// key. An empty domain disables inbound email, Ticket and
+// NewTicket then return empty addresses.
+func NewAddresses(domain, key string) *Addresses {
+	return &Addresses{
+		domain: strings.ToLower(domain),
+		key:    []byte(key),
+	}
+}
+
+// Ticket returns the address replies to the ticket go to
+func (a *Addresses) Ticket(ticketID uint) string {
+	if a.domain == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%d-%s@%s", ticketPrefix, ticketID, a.sign(ticketID), a.domain)
+}
+
+// NewTicket returns the address tickets are opened at
+func (a *Addresses) NewTicket() string {
+	if a.domain == "" {
+		return ""
+	}
+	return newTicketLocal + "@" + a.domain
+}
+
+// Match finds the first of recipients that is an address of
+// ours. It returns the ID of the ticket replied to, or 0 for
+// the address tickets are opened at.
+func (a *Addresses) Match(recipients []string) (uint, error) {
+	for _, r := range recipients {
+		r = strings.ToLower(r)
+		at := strings.LastIndex(r, "@")
+		if a.domain == "" || at < 0 || r[at+1:] != a.domain {
+			continue
+		}
+
+		local := r[:at]
+		if local == newTicketLocal {
+			return 0, nil
+		}
+		if !strings.HasPrefix(local, ticketPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(local, ticketPrefix), "-", 2)
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || id == 0 || len(parts) != 2 {
+			return 0, ErrInvalidSignature
+		}
+		if !hmac.Equal([]byte(parts[1]), []byte(a.sign(uint(id)))) {
+			return 0, ErrInvalidSignature
+		}
+		return uint(id), nil
+	}
+	return 0, ErrUnknownRecipient
+}
+
+// sign returns the signature of a ticket address. It is hex
+// rather than the base64 of package hash, as mail servers may
+// change the case of addresses.
+func (a *Addresses) sign(ticketID uint) string {
+	h := hmac.New(sha256.New, a.key)
+	fmt.Fprintf(h, "ticket:%d", ticketID)
+	return hex.EncodeToString(h.Sum(nil))[:signatureLength]
+}
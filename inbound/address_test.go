@@ -0,0 +1,57 @@
+package inbound
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddressesMatch(t *testing.T) {
+	a := NewAddresses("In.Tataruma.test", "secret")
+	reply := a.Ticket(42)
+	forged := strings.Replace(reply, "ticket+42-", "ticket+43-", 1)
+
+	tests := []struct {
+		name       string
+		recipients []string
+		wantID     uint
+		wantErr    error
+	}{
+		{"reply", []string{reply}, 42, nil},
+		{"reply in another case", []string{strings.ToUpper(reply)}, 42, nil},
+		{"new ticket", []string{"tickets@in.tataruma.test"}, 0, nil},
+		{"ours after others", []string{"jon@example.com", "other@in.tataruma.test", reply}, 42, nil},
+		{"first of ours wins", []string{"tickets@in.tataruma.test", reply}, 0, nil},
+		{"signature of another ticket", []string{forged}, 0, ErrInvalidSignature},
+		{"no signature", []string{"ticket+42@in.tataruma.test"}, 0, ErrInvalidSignature},
+		{"ticket zero", []string{"ticket+0-" + a.sign(0) + "@in.tataruma.test"}, 0, ErrInvalidSignature},
+		{"not a number", []string{"ticket+x-abc@in.tataruma.test"}, 0, ErrInvalidSignature},
+		{"other domain", []string{strings.Replace(reply, "in.tataruma.test", "tataruma.test", 1)}, 0, ErrUnknownRecipient},
+		{"subdomain", []string{"tickets@evil.in.tataruma.test"}, 0, ErrUnknownRecipient},
+		{"other local part", []string{"support@in.tataruma.test"}, 0, ErrUnknownRecipient},
+		{"not an address", []string{"tickets"}, 0, ErrUnknownRecipient},
+		{"no recipients", nil, 0, ErrUnknownRecipient},
+	}
+	for _, tt := range tests {
+		id, err := a.Match(tt.recipients)
+		if id != tt.wantID || err != tt.wantErr {
+			t.Errorf("%s: Match(%q) = %d, %v, want %d, %v", tt.name, tt.recipients, id, err, tt.wantID, tt.wantErr)
+		}
+	}
+}
+
+func TestAddressesOtherKey(t *testing.T) {
+	reply := NewAddresses("in.tataruma.test", "secret").Ticket(42)
+	if _, err := NewAddresses("in.tataruma.test", "other").Match([]string{reply}); err != ErrInvalidSignature {
+		t.Errorf("address signed with another key: err = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestAddressesDisabled(t *testing.T) {
+	a := NewAddresses("", "secret")
+	if a.Ticket(42) != "" || a.NewTicket() != "" {
+		t.Errorf("addresses without a domain: %q, %q", a.Ticket(42), a.NewTicket())
+	}
+	if _, err := a.Match([]string{"tickets@"}); err != ErrUnknownRecipient {
+		t.Errorf("Match() = %v, want %v", err, ErrUnknownRecipient)
+	}
+}
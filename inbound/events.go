@@ -0,0 +1,100 @@
+package inbound
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxEventSize is the largest delivery event accepted
+const maxEventSize = 1 << 20
+
+// What became of an email we sent, as told by the mail provider
+const (
+	EventDelivered  = "delivered"
+	EventBounced    = "bounced"
+	EventComplained = "complained"
+)
+
+// Event is the delivery event of an email we sent. Type is one
+// of the Event constants, or empty for events we don't track,
+// e.g. opens. MessageID is the local part of the Message-ID of
+// the email, which is its idempotency key, see package
+// mailqueue. Only bounces for good are reported, not those
+// retrying may get past. Token is the one Mailgun signed the
+// event with, see Mailgun.Forget.
+type Event struct {
+	Type      string
+	Recipient string
+	MessageID string
+	Detail    string
+	Token     string
+}
+
+// mailgunEvent is the body of the Mailgun webhooks
+type mailgunEvent struct {
+	Signature struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	} `json:"signature"`
+	EventData struct {
+		Event     string `json:"event"`
+		Severity  string `json:"severity"`
+		Recipient string `json:"recipient"`
+		Reason    string `json:"reason"`
+		Message   struct {
+			Headers struct {
+				MessageID string `json:"message-id"`
+			} `json:"headers"`
+		} `json:"message"`
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+	} `json:"event-data"`
+}
+
+// ParseEvent verifies and reads the delivery event posted in r.
+// Temporary failures have no Type, Mailgun keeps trying then.
+func (mg *Mailgun) ParseEvent(r *http.Request) (*Event, error) {
+	var body mailgunEvent
+	err := json.NewDecoder(io.LimitReader(r.Body, maxEventSize)).Decode(&body)
+	if err != nil {
+		return nil, ErrBadPayload
+	}
+	sig := body.Signature
+	if err := mg.Verify(sig.Timestamp, sig.Token, sig.Signature); err != nil {
+		return nil, err
+	}
+
+	data := body.EventData
+	e := &Event{
+		Recipient: strings.ToLower(data.Recipient),
+		MessageID: strings.Trim(data.Message.Headers.MessageID, "<>"),
+		Token:     sig.Token,
+	}
+	if at := strings.LastIndex(e.MessageID, "@"); at >= 0 {
+		e.MessageID = e.MessageID[:at]
+	}
+
+	switch data.Event {
+	case "delivered":
+		e.Type = EventDelivered
+	case "failed":
+		if data.Severity == "permanent" {
+			e.Type = EventBounced
+		}
+	case "complained":
+		e.Type = EventComplained
+	}
+
+	status := data.DeliveryStatus
+	e.Detail = strings.TrimSpace(status.Description + " " + status.Message)
+	if e.Detail == "" {
+		e.Detail = data.Reason
+	}
+	return e, nil
+}
@@ -0,0 +1,105 @@
+package inbound
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recordedEvent returns the Mailgun payload in testdata/name,
+// signed again with key as if it was just sent
+func recordedEvent(t *testing.T, key, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	sig := payload["signature"].(map[string]interface{})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig["timestamp"] = timestamp
+	sig["signature"] = sign(key, timestamp, sig["token"].(string))
+
+	b, err = json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		file string
+		want Event
+	}{
+		{"delivered.json", Event{
+			Type:      EventDelivered,
+			Recipient: "jon@example.com",
+			MessageID: "8f3c0b1e2a7d4c5e9b6a1f0d2c3e4b5a",
+			Detail:    "OK",
+			Token:     "9e1ac5f1d5d4cc2fb0ec3bdf12b6f4b5a1c8e0c6c3f6e2a4b9",
+		}},
+		{"failed-temporary.json", Event{
+			Recipient: "ann@example.org",
+			MessageID: "0a1b2c3d4e5f60718293a4b5c6d7e8f9",
+			Detail:    "4.2.2 The email account that you tried to reach is over quota.",
+			Token:     "1c4d0f7a9b2e8d6c5a3f1e0b9d8c7a6f5e4d3c2b1a0f9e8d7c",
+		}},
+		{"failed-permanent.json", Event{
+			Type:      EventBounced,
+			Recipient: "gone@example.net",
+			MessageID: "f9e8d7c6b5a4938271605f4e3d2c1b0a",
+			Detail:    "5.1.1 The email account that you tried to reach does not exist.",
+			Token:     "5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b",
+		}},
+		{"complained.json", Event{
+			Type:      EventComplained,
+			Recipient: "annoyed@example.com",
+			MessageID: "1234abcd5678ef901234abcd5678ef90",
+			Token:     "c0ffee1234567890abcdef1234567890abcdef1234567890ab",
+		}},
+	}
+	for _, tt := range tests {
+		mg := NewMailgun("signing-key")
+		r := httptest.NewRequest("POST", "/webhooks/mailgun/events", bytes.NewReader(recordedEvent(t, "signing-key", tt.file)))
+		e, err := mg.ParseEvent(r)
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if *e != tt.want {
+			t.Errorf("%s: ParseEvent() = %+v, want %+v", tt.file, *e, tt.want)
+		}
+	}
+}
+
+func TestParseEventRejects(t *testing.T) {
+	mg := NewMailgun("signing-key")
+	body := recordedEvent(t, "other-key", "failed-permanent.json")
+	r := httptest.NewRequest("POST", "/webhooks/mailgun/events", bytes.NewReader(body))
+	if _, err := mg.ParseEvent(r); err != ErrInvalidSignature {
+		t.Errorf("signed with another key: err = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	body = recordedEvent(t, "signing-key", "failed-permanent.json")
+	for i, want := range []error{nil, ErrReplayed} {
+		r = httptest.NewRequest("POST", "/webhooks/mailgun/events", bytes.NewReader(body))
+		if _, err := mg.ParseEvent(r); err != want {
+			t.Errorf("delivery %d: err = %v, want %v", i+1, err, want)
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/webhooks/mailgun/events", bytes.NewReader([]byte("event=delivered")))
+	if _, err := mg.ParseEvent(r); err != ErrBadPayload {
+		t.Errorf("form body: err = %v, want %v", err, ErrBadPayload)
+	}
+}
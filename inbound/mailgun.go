@@ -0,0 +1,179 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMemory is how much of a posted message is kept in
+	// memory, the rest goes to temporary files
+	maxMemory = 10 << 20
+
+	// maxAge is how old a webhook signature may be, older ones
+	// are taken for replays
+	maxAge = 15 * time.Minute
+)
+
+// Mailgun reads the messages posted by Mailgun routes set to
+// forward to us. Their signature is checked with the webhook
+// signing key of the account.
+type Mailgun struct {
+	signingKey string
+
+	// seen has the tokens of the webhooks received within
+	// maxAge, and when they may be forgotten
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewMailgun(signingKey string) *Mailgun {
+	return &Mailgun{
+		signingKey: signingKey,
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// Verify checks the signature Mailgun posts along with its
+// webhooks, of both the routes and the delivery events. A
+// signature is only good once, ErrReplayed is returned for the
+// tokens already verified until Forget is called with them.
+// They are kept in memory, so replays to other instances of the
+// app are only caught by maxAge.
+func (mg *Mailgun) Verify(timestamp, token, signature string) error {
+	if mg.signingKey == "" {
+		return ErrInvalidSignature
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxAge || age < -maxAge {
+		return ErrInvalidSignature
+	}
+
+	h := hmac.New(sha256.New, []byte(mg.signingKey))
+	fmt.Fprint(h, timestamp+token)
+	expected := hex.EncodeToString(h.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrInvalidSignature
+	}
+
+	now := time.Now()
+	mg.mu.Lock()
+	defer mg.mu.Unlock()
+	for t, until := range mg.seen {
+		if now.After(until) {
+			delete(mg.seen, t)
+		}
+	}
+	if _, ok := mg.seen[token]; ok {
+		return ErrReplayed
+	}
+	// The timestamp is refused after maxAge, either way
+	mg.seen[token] = time.Unix(ts, 0).Add(maxAge)
+	return nil
+}
+
+// Forget lets the webhook signed with token be verified again.
+// Call it when a webhook failed and Mailgun is to retry it.
+func (mg *Mailgun) Forget(token string) {
+	mg.mu.Lock()
+	delete(mg.seen, token)
+	mg.mu.Unlock()
+}
+
+// Parse verifies and reads the message posted in r
+func (mg *Mailgun) Parse(r *http.Request) (*Message, error) {
+	if err := r.ParseMultipartForm(maxMemory); err != nil && err != http.ErrNotMultipart {
+		return nil, ErrBadPayload
+	}
+	err := mg.Verify(r.FormValue("timestamp"), r.FormValue("token"), r.FormValue("signature"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !senderVerified(r.FormValue("message-headers")) {
+		return nil, ErrUnverifiedSender
+	}
+
+	from, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		return nil, ErrNoSender
+	}
+	msg := &Message{
+		From:    strings.ToLower(from.Address),
+		Subject: r.FormValue("subject"),
+		Token:   r.FormValue("token"),
+	}
+	for _, recipient := range strings.Split(r.FormValue("recipient"), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			msg.Recipients = append(msg.Recipients, strings.ToLower(recipient))
+		}
+	}
+
+	// Mailgun strips the quoted message itself when it can
+	msg.Text = r.FormValue("stripped-text")
+	if msg.Text == "" {
+		msg.Text = r.FormValue("body-plain")
+	}
+	msg.Text = StripReply(msg.Text)
+
+	if r.MultipartForm == nil {
+		return msg, nil
+	}
+	count, _ := strconv.Atoi(r.FormValue("attachment-count"))
+	for i := 1; i <= count; i++ {
+		files := r.MultipartForm.File[fmt.Sprintf("attachment-%d", i)]
+		if len(files) == 0 {
+			continue
+		}
+		f, err := files[0].Open()
+		if err != nil {
+			return nil, ErrBadPayload
+		}
+		content, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, ErrBadPayload
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Filename:    files[0].Filename,
+			ContentType: files[0].Header.Get("Content-Type"),
+			Content:     content,
+		})
+	}
+	return msg, nil
+}
+
+// senderVerified reports whether the message passed the SPF or
+// DKIM check of Mailgun, going by the headers it added. Anyone
+// can put our users in the From header otherwise.
+func senderVerified(messageHeaders string) bool {
+	var headers [][]string
+	if err := json.Unmarshal([]byte(messageHeaders), &headers); err != nil {
+		return false
+	}
+	for _, h := range headers {
+		if len(h) != 2 {
+			continue
+		}
+		switch strings.ToLower(h[0]) {
+		case "x-mailgun-spf", "x-mailgun-dkim-check-result":
+			if strings.EqualFold(h[1], "pass") {
+				return true
+			}
+		}
+	}
+	return false
+}
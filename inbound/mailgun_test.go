@@ -0,0 +1,72 @@
+package inbound
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(key, timestamp, token string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(timestamp + token))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	mg := NewMailgun("signing-key")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-maxAge-time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		token     string
+		signature string
+		want      error
+	}{
+		{"signed", now, "token-1", sign("signing-key", now, "token-1"), nil},
+		{"other key", now, "token-2", sign("other-key", now, "token-2"), ErrInvalidSignature},
+		{"too old", old, "token-3", sign("signing-key", old, "token-3"), ErrInvalidSignature},
+		{"bad timestamp", "soon", "token-4", sign("signing-key", "soon", "token-4"), ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		if err := mg.Verify(tt.timestamp, tt.token, tt.signature); err != tt.want {
+			t.Errorf("%s: Verify() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyRefusesReplays(t *testing.T) {
+	mg := NewMailgun("signing-key")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sign("signing-key", now, "token")
+
+	if err := mg.Verify(now, "token", signature); err != nil {
+		t.Fatal(err)
+	}
+	if err := mg.Verify(now, "token", signature); err != ErrReplayed {
+		t.Errorf("second Verify() error = %v, want %v", err, ErrReplayed)
+	}
+
+	// A webhook that failed is retried with the same signature
+	mg.Forget("token")
+	if err := mg.Verify(now, "token", signature); err != nil {
+		t.Errorf("Verify() after Forget() error = %v", err)
+	}
+}
+
+func TestVerifyForgetsExpiredTokens(t *testing.T) {
+	mg := NewMailgun("signing-key")
+	mg.seen["expired"] = time.Now().Add(-time.Second)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if err := mg.Verify(now, "token", sign("signing-key", now, "token")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mg.seen["expired"]; ok {
+		t.Error("the expired token is still kept")
+	}
+}
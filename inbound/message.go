@@ -0,0 +1,176 @@
+// Package inbound reads what comes back to us by email: the
+// emails users send us, either as raw RFC 5322 messages or as
+// posted by the Mailgun routes webhook, and the delivery events
+// of the emails we send. It also signs the addresses users
+// reply to.
+package inbound
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrNoSender         = errors.New("inbound: the message has no valid sender")
+	ErrUnverifiedSender = errors.New("inbound: the sender of the message could not be verified")
+	ErrNoMessage        = errors.New("inbound: the message is empty")
+	ErrBadPayload       = errors.New("inbound: the message could not be read")
+)
+
+// maxDepth is how deep multipart messages are looked into
+const maxDepth = 5
+
+// Attachment is a file sent along with a message
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// Message is an email we received. From and Recipients are bare
+// addresses, Text is the plain text body without the quoted
+// message it replies to. Token is the one Mailgun signed the
+// message with, see Mailgun.Forget, raw messages have none.
+type Message struct {
+	From        string
+	Recipients  []string
+	Subject     string
+	Text        string
+	Attachments []Attachment
+	Token       string
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+// ParseRaw reads a message in the RFC 5322 format
+func ParseRaw(r io.Reader) (*Message, error) {
+	m, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, ErrNoMessage
+	}
+
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	from, err := parser.Parse(m.Header.Get("From"))
+	if err != nil {
+		return nil, ErrNoSender
+	}
+
+	msg := &Message{From: strings.ToLower(from.Address)}
+	for _, field := range []string{"To", "Cc"} {
+		list, err := parser.ParseList(m.Header.Get(field))
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			msg.Recipients = append(msg.Recipients, strings.ToLower(addr.Address))
+		}
+	}
+	if subject, err := wordDecoder.DecodeHeader(m.Header.Get("Subject")); err == nil {
+		msg.Subject = subject
+	}
+
+	header := map[string][]string(m.Header)
+	if err := msg.readPart(header, m.Body, 0); err != nil {
+		return nil, err
+	}
+	msg.Text = StripReply(msg.Text)
+	return msg, nil
+}
+
+// readPart reads the text and attachments of a part, and of the
+// parts it is made of.
+func (msg *Message) readPart(header map[string][]string, body io.Reader, depth int) error {
+	get := func(key string) string {
+		if values := header[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return ErrBadPayload
+			}
+			if err := msg.readPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return ErrBadPayload
+	}
+
+	filename := ""
+	if _, dparams, err := mime.ParseMediaType(get("Content-Disposition")); err == nil {
+		filename = dparams["filename"]
+	}
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	// The first plain text part is the body, the HTML version
+	// of it is left out.
+	if filename == "" && mediaType == "text/plain" && msg.Text == "" {
+		msg.Text = string(content)
+		return nil
+	}
+	if filename == "" {
+		return nil
+	}
+	msg.Attachments = append(msg.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Content:     content,
+	})
+	return nil
+}
+
+var replyHeader = regexp.MustCompile(`^(On .*wrote:|-+ ?Original Message ?-+)$`)
+
+// StripReply cuts the quoted message off a reply, from the
+// first quoted line or "On ... wrote:" line down.
+func StripReply(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	var kept bytes.Buffer
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") || replyHeader.MatchString(trimmed) {
+			break
+		}
+		kept.WriteString(line)
+		kept.WriteString("\n")
+	}
+	return strings.TrimSpace(kept.String())
+}
@@ -0,0 +1,149 @@
+package inbound
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// crlf turns the lines of a test message into one with CRLF
+// line endings, like it arrives
+func crlf(lines ...string) string {
+	return strings.Join(lines, "\r\n")
+}
+
+func TestParseRaw(t *testing.T) {
+	raw := crlf(
+		`From: "Jon Doe" <Jon@Example.com>`,
+		`To: Tataruma <ticket+7-abc@in.tataruma.test>, other@example.com`,
+		`Cc: =?utf-8?q?J=C3=BCrgen?= <jurgen@example.com>`,
+		`Subject: =?utf-8?q?Heizung_kaputt_=E2=80=93_bitte_helfen?=`,
+		`MIME-Version: 1.0`,
+		`Content-Type: multipart/mixed; boundary="outer"`,
+		``,
+		`--outer`,
+		`Content-Type: multipart/alternative; boundary="inner"`,
+		``,
+		`--inner`,
+		`Content-Type: text/plain; charset=utf-8`,
+		`Content-Transfer-Encoding: quoted-printable`,
+		``,
+		`The heating is broken =E2=80=93 again.`,
+		``,
+		`On Mon, 2 Mar 2026 at 10:00, Tataruma wrote:`,
+		`> Your ticket was opened`,
+		`--inner`,
+		`Content-Type: text/html; charset=utf-8`,
+		``,
+		`<p>The heating is broken</p>`,
+		`--inner--`,
+		`--outer`,
+		`Content-Type: image/jpeg; name="ignored.jpg"`,
+		`Content-Disposition: attachment; filename="radiator.jpg"`,
+		`Content-Transfer-Encoding: base64`,
+		``,
+		`/9j/4AAQ`,
+		`--outer`,
+		`Content-Type: application/pdf; name="invoice.pdf"`,
+		``,
+		`%PDF`,
+		`--outer--`,
+		``,
+	)
+
+	msg, err := ParseRaw(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.From != "jon@example.com" {
+		t.Errorf("From = %q", msg.From)
+	}
+	wantRecipients := []string{"ticket+7-abc@in.tataruma.test", "other@example.com", "jurgen@example.com"}
+	if !reflect.DeepEqual(msg.Recipients, wantRecipients) {
+		t.Errorf("Recipients = %q, want %q", msg.Recipients, wantRecipients)
+	}
+	if msg.Subject != "Heizung kaputt – bitte helfen" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if msg.Text != "The heating is broken – again." {
+		t.Errorf("Text = %q", msg.Text)
+	}
+	if msg.Token != "" {
+		t.Errorf("Token = %q, raw messages have none", msg.Token)
+	}
+
+	if len(msg.Attachments) != 2 {
+		t.Fatalf("%d attachments, want 2", len(msg.Attachments))
+	}
+	photo, pdf := msg.Attachments[0], msg.Attachments[1]
+	if photo.Filename != "radiator.jpg" || photo.ContentType != "image/jpeg" || string(photo.Content) != "\xff\xd8\xff\xe0\x00\x10" {
+		t.Errorf("first attachment = %q %q %q", photo.Filename, photo.ContentType, photo.Content)
+	}
+	if pdf.Filename != "invoice.pdf" || string(pdf.Content) != "%PDF" {
+		t.Errorf("second attachment = %q %q", pdf.Filename, pdf.Content)
+	}
+}
+
+func TestParseRawPlainText(t *testing.T) {
+	raw := crlf(
+		`From: jon@example.com`,
+		`To: tickets@in.tataruma.test`,
+		`Subject: Leaking tap`,
+		``,
+		`The tap in the kitchen leaks.`,
+	)
+	msg, err := ParseRaw(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Text != "The tap in the kitchen leaks." || len(msg.Attachments) != 0 {
+		t.Errorf("Text = %q with %d attachments", msg.Text, len(msg.Attachments))
+	}
+}
+
+func TestParseRawErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want error
+	}{
+		{"empty", "", ErrNoMessage},
+		{"no sender", crlf("To: tickets@in.tataruma.test", "", "Hi"), ErrNoSender},
+		{"bad sender", crlf("From: not an address", "", "Hi"), ErrNoSender},
+		{"broken base64", crlf(
+			"From: jon@example.com",
+			"Content-Transfer-Encoding: base64",
+			"",
+			"!!!!",
+		), ErrBadPayload},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRaw(strings.NewReader(tt.raw)); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestStripReply(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"no quote", "Thanks, fixed.", "Thanks, fixed."},
+		{"quoted lines", "Thanks!\n\n> Your ticket was updated\n> by the manager", "Thanks!"},
+		{"indented quote", "Thanks!\n   > quoted", "Thanks!"},
+		{"gmail header", "Done.\n\nOn Mon, 2 Mar 2026 at 10:00, Tataruma <t@in.tataruma.test> wrote:\n> old", "Done."},
+		{"outlook header", "Done.\r\n-----Original Message-----\r\nFrom: Tataruma", "Done."},
+		{"crlf kept as lines", "First line\r\nSecond line\r\n", "First line\nSecond line"},
+		{"wrote in a sentence", "I wrote: it still leaks", "I wrote: it still leaks"},
+		{"only a quote", "> old", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := StripReply(tt.text); got != tt.want {
+			t.Errorf("%s: StripReply(%q) = %q, want %q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
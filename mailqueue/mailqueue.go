@@ -0,0 +1,154 @@
+// Package mailqueue sends emails through the outbox table, so a
+// request never fails, nor loses an email, because the mail
+// provider is down. Emails are queued by the Mailer of this
+// package, usually within the transaction of the change they
+// are about, and sent in the background by a Worker.
+package mailqueue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/rand"
+	"log"
+	"net/mail"
+	"time"
+)
+
+const (
+	// pollInterval is how often due messages are looked for
+	pollInterval = 10 * time.Second
+
+	// batchSize is how many messages are sent per poll
+	batchSize = 50
+
+	// keepDone is how long messages that were sent, or given up
+	// on, are listed before they are removed
+	keepDone = 30 * 24 * time.Hour
+
+	// keyBytes is how many random bytes the idempotency keys of
+	// messages without an ID have
+	keyBytes = 16
+)
+
+// queueMailer queues messages instead of sending them
+type queueMailer struct {
+	outbox models.OutboxService
+}
+
+// NewMailer returns a Mailer queueing messages in outbox. Give
+// it the outbox of a transaction to queue them along with the
+// rest of it, see models.Services.Transaction.
+func NewMailer(outbox models.OutboxService) email.Mailer {
+	return &queueMailer{outbox: outbox}
+}
+
+// Send queues msg. Every message is sent, even when two look
+// the same, e.g. two reminders in a row. Callers that may queue
+// the same email again, such as a retried request, set its ID:
+// the idempotency key is then a hash of the ID and the content,
+// so it is sent once.
+func (qm *queueMailer) Send(msg *email.Message) error {
+	var key string
+	if msg.ID != "" {
+		sum := sha256.Sum256([]byte(msg.ID + "\n" + msg.To + "\n" + msg.Subject + "\n" + msg.Text))
+		key = hex.EncodeToString(sum[:])
+	} else {
+		b, err := rand.Bytes(keyBytes)
+		if err != nil {
+			return err
+		}
+		key = hex.EncodeToString(b)
+	}
+
+	return qm.outbox.Enqueue(&models.OutboxMessage{
+		IdempotencyKey: key,
+		From:           msg.From,
+		To:             msg.To,
+		ReplyTo:        msg.ReplyTo,
+		Subject:        msg.Subject,
+		Text:           msg.Text,
+		HTML:           msg.HTML,
+	})
+}
+
+// Worker sends the queued messages through a Mailer, except to
+// suppressed addresses. Only one worker may run at a time.
+type Worker struct {
+	outbox       models.OutboxService
+	suppressions models.SuppressionService
+	mailer       email.Mailer
+}
+
+func NewWorker(outbox models.OutboxService, suppressions models.SuppressionService, mailer email.Mailer) *Worker {
+	return &Worker{
+		outbox:       outbox,
+		suppressions: suppressions,
+		mailer:       mailer,
+	}
+}
+
+// Run sends messages forever, it is meant to be started in its
+// own goroutine.
+func (w *Worker) Run() {
+	for {
+		w.sendDue()
+		if err := w.outbox.DeleteDoneBefore(time.Now().Add(-keepDone)); err != nil {
+			log.Println(err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (w *Worker) sendDue() {
+	messages, err := w.outbox.Due(time.Now(), batchSize)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range messages {
+		if err := w.send(&messages[i]); err != nil {
+			log.Printf("outbox message %d: %v", messages[i].ID, err)
+		}
+	}
+}
+
+// send sends m, or gives up on it when its recipient is
+// suppressed
+func (w *Worker) send(m *models.OutboxMessage) error {
+	suppressed, err := w.suppressed(m)
+	if err == nil && suppressed {
+		return w.outbox.Suppressed(m)
+	}
+
+	// The key is sent as the Message-ID, so a message sent
+	// again after we failed to mark it sent is recognized as
+	// the same one.
+	if err == nil {
+		err = w.mailer.Send(&email.Message{
+			ID:      m.IdempotencyKey,
+			From:    m.From,
+			To:      m.To,
+			ReplyTo: m.ReplyTo,
+			Subject: m.Subject,
+			Text:    m.Text,
+			HTML:    m.HTML,
+		})
+	}
+	if err != nil {
+		log.Printf("outbox message %d: %v", m.ID, err)
+		return w.outbox.Failed(m, err)
+	}
+	return w.outbox.Sent(m)
+}
+
+// suppressed reports whether the recipient of m is suppressed
+func (w *Worker) suppressed(m *models.OutboxMessage) (bool, error) {
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return false, err
+	}
+	return w.suppressions.Suppressed(to.Address)
+}
@@ -0,0 +1,50 @@
+package mailqueue
+
+import (
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/models/modelstest"
+	"testing"
+)
+
+// queuedKeys returns the idempotency keys of the queued messages
+func queuedKeys(outbox *modelstest.Outbox) []string {
+	var keys []string
+	for _, m := range outbox.Messages {
+		keys = append(keys, m.IdempotencyKey)
+	}
+	return keys
+}
+
+func TestSendQueuesLookalikesTwice(t *testing.T) {
+	outbox := &modelstest.Outbox{}
+	mailer := NewMailer(outbox)
+
+	for i := 0; i < 2; i++ {
+		msg := email.Message{To: "jon@example.com", Subject: "Rent is due", Text: "Rent is due"}
+		if err := mailer.Send(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := queuedKeys(outbox); len(keys) != 2 || keys[0] == keys[1] {
+		t.Errorf("keys = %q, want two different ones", keys)
+	}
+}
+
+func TestSendWithIDQueuesOnce(t *testing.T) {
+	outbox := &modelstest.Outbox{}
+	mailer := NewMailer(outbox)
+
+	for _, id := range []string{"req-1", "req-1", "req-2"} {
+		msg := email.Message{ID: id, To: "jon@example.com", Subject: "Welcome", Text: "Hi"}
+		if err := mailer.Send(&msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := queuedKeys(outbox)
+	if keys[0] != keys[1] {
+		t.Error("a message queued again with its ID got another key")
+	}
+	if keys[0] == keys[2] {
+		t.Error("messages with different IDs got the same key")
+	}
+}
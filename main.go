@@ -7,13 +7,21 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"github.com/ruckuus/dojo1/authz"
 	"github.com/ruckuus/dojo1/controllers"
 	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/export"
+	"github.com/ruckuus/dojo1/inbound"
+	"github.com/ruckuus/dojo1/mailqueue"
 	"github.com/ruckuus/dojo1/middleware"
 	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/notify"
+	"github.com/ruckuus/dojo1/oidc"
 	"github.com/ruckuus/dojo1/rand"
+	"github.com/ruckuus/dojo1/webhook"
 	"log"
 	"net/http"
+	"time"
 )
 
 func main() {
@@ -26,10 +34,30 @@ func main() {
 		Region: aws.String(config.AWSConfig.Region),
 	}))
 
+	passwordPolicy, err := config.Password.Policy()
+	if err != nil {
+		panic(err)
+	}
+
+	mailer, err := config.Mailer()
+	if err != nil {
+		panic(err)
+	}
+
 	services, err := models.NewServices(
 		models.WithGorm(config.Database.Dialect(), config.Database.ConnectionInfo()),
 		models.WithLogMode(!config.IsProd()),
-		models.WithUser(config.Pepper, config.HMACKey),
+		models.WithUser(config.Pepper, config.HMACKey, passwordPolicy),
+		models.WithSession(config.HMACKey),
+		models.WithTwoFactor("Tataruma", config.HMACKey),
+		models.WithLoginThrottle(),
+		models.WithIdentity(),
+		models.WithAPIToken(config.HMACKey),
+		models.WithCalendarFeed(config.HMACKey),
+		models.WithIdempotency(),
+		models.WithGrant(),
+		models.WithOrganization(),
+		models.WithInvitation(config.HMACKey),
 		models.WithAWSSession(sess),
 		models.WithS3Bucket(config.AWSConfig.Bucket),
 		models.WithS3Store(),
@@ -37,30 +65,95 @@ func main() {
 		models.WithImageCDNDomain(config.ImageCDNDomain),
 		models.WithImage(),
 		models.WithProperty(),
-	)
-
-	mailConfig := config.Mailgun
-	emailer := email.NewClient(
-		email.WithSender("Dwi from Tataruma", "hello@tataruma.com"),
-		email.WithMailgun(mailConfig.Domain, mailConfig.APIKey),
+		models.WithLease(),
+		models.WithLedger(),
+		models.WithTicket(),
+		models.WithTicketComment(),
+		models.WithExport(config.HMACKey),
+		models.WithAudit(),
+		models.WithOutbox(),
+		models.WithSuppression(),
+		models.WithNotification(),
+		models.WithWebhookEndpoint(),
+		models.WithWebhookDelivery(),
 	)
 
 	if err != nil {
 		panic(err)
 	}
 
+	// Emails are queued in the outbox and sent by the worker
+	emailer := email.NewClient(
+		email.WithSender(config.SenderName, config.SenderEmail),
+		email.WithBaseURL(config.BaseURL),
+		email.WithMailer(mailqueue.NewMailer(services.Outbox)),
+	)
+
 	defer services.Close()
 	services.AutoMigrate()
+	go purgeDeletedUsers(services)
+	go mailqueue.NewWorker(services.Outbox, services.Suppression, mailer).Run()
+	go export.NewExporter(services, emailer).Run()
+	notifier := notify.NewNotifier(services, emailer)
+
+	// Replies to ticket emails come back to the ticket
+	addresses := inbound.NewAddresses(config.InboundDomain, config.HMACKey)
+	go notifier.Run()
+
+	// Events are queued for the webhooks of organizations and
+	// posted by the worker
+	hooks := webhook.NewDispatcher(services)
+	go webhook.NewWorker(services.Webhook, services.Delivery).Run()
 
 	r := mux.NewRouter()
 
+	authorizer := authz.NewAuthorizer(services.Grant, services.Organization)
+
 	// Middlewares
 
 	// User middleware
 	userMw := middleware.User{
-		UserService: services.User,
+		UserService:    services.User,
+		SessionService: services.Session,
 	}
 	requireUserMw := middleware.RequireUser{}
+	requireVerifiedMw := middleware.RequireVerified{}
+	requireAdminMw := middleware.RequireAdmin{}
+	requireTenantMw := middleware.RequireTenant{
+		LeaseService: services.Lease,
+	}
+
+	// API token middleware, for scripts. Routes scripts may use
+	// are guarded by a scope instead of requireUserMw.
+	apiTokenMw := middleware.APIToken{
+		UserService:     services.User,
+		APITokenService: services.APIToken,
+	}
+	readPropertiesMw := middleware.RequireScope{Scope: models.ScopePropertiesRead}
+	writePropertiesMw := middleware.RequireScope{Scope: models.ScopePropertiesWrite}
+	readGalleriesMw := middleware.RequireScope{Scope: models.ScopeGalleriesRead}
+	writeGalleriesMw := middleware.RequireScope{Scope: models.ScopeGalleriesWrite}
+
+	// JSON API middleware, the API only takes API tokens. Retries
+	// of requests sent with an Idempotency-Key get the response
+	// of the first one.
+	apiReadPropertiesMw := middleware.RequireAPIToken{Scope: models.ScopePropertiesRead}
+	apiWritePropertiesMw := middleware.RequireAPIToken{Scope: models.ScopePropertiesWrite}
+	apiReadGalleriesMw := middleware.RequireAPIToken{Scope: models.ScopeGalleriesRead}
+	apiWriteGalleriesMw := middleware.RequireAPIToken{Scope: models.ScopeGalleriesWrite}
+	idempotencyMw := middleware.Idempotency{
+		IdempotencyService: services.Idempotency,
+	}
+
+	// Organization middleware, picks the organization the user works in
+	orgMw := middleware.Organization{
+		Authorizer: authorizer,
+	}
+
+	// Notifications middleware, counts unread ones for the navbar
+	notificationsMw := middleware.Notifications{
+		NotificationService: services.Notification,
+	}
 
 	// CSRF Middleware
 	csrfKey, err := rand.Bytes(32)
@@ -70,14 +163,39 @@ func main() {
 
 	csrfMw := csrf.Protect(csrfKey, csrf.Secure(config.IsProd()))
 
+	// Real IP middleware, reads the client address our proxy reports
+	realIPMw := middleware.RealIP{TrustedProxy: config.TrustedProxy}
+
+	// Webhooks middleware, lets other services post past CSRF
+	webhooksMw := middleware.Webhooks{Prefix: "/webhooks/"}
+
 	// Controllers
-	userC := controllers.NewUsers(services.User, emailer)
+	userC := controllers.NewUsers(services, emailer)
+	// A provider that stops answering must not hold up sign ins
+	idpClient := &http.Client{Timeout: 10 * time.Second}
+	var providers []*oidc.Provider
+	for _, cfg := range config.OIDCProviders {
+		providers = append(providers, oidc.NewProvider(cfg, idpClient))
+	}
+	oidcC := controllers.NewOIDC(userC, services.Identity, providers, config.HMACKey)
 	staticC := controllers.NewStatic()
-	galleriesC := controllers.NewGalleries(services.Gallery, r, services.Image)
-	propertiesC := controllers.NewProperties(services.Property, r)
+	orgC := controllers.NewOrganizations(services, authorizer)
+	webhooksC := controllers.NewWebhooks(services, authorizer)
+	galleriesC := controllers.NewGalleries(services.Gallery, r, services.Image, authorizer)
+	propertiesC := controllers.NewProperties(services, authorizer, r, notifier, hooks, addresses)
+	leasesC := controllers.NewLeases(services, authorizer, hooks)
+	calendarsC := controllers.NewCalendars(services, authorizer, config.BaseURL)
+	apiC := controllers.NewAPI(services, authorizer, hooks, config.BaseURL)
+	portalC := controllers.NewPortal(services, notifier, hooks, addresses)
+	notificationsC := controllers.NewNotifications(services)
+	invitationC := controllers.NewInvitations(services, authorizer, emailer)
+	adminC := controllers.NewAdmin(services, userC)
+	mailgunHooks := inbound.NewMailgun(config.Mailgun.WebhookSigningKey)
+	inboundC := controllers.NewInbound(services, authorizer, notifier, hooks, addresses, mailgunHooks)
+	deliveriesC := controllers.NewDeliveries(services, mailgunHooks)
 
 	newGallery := requireUserMw.Apply(galleriesC.NewView)
-	createGallery := requireUserMw.ApplyFn(galleriesC.Create)
+	createGallery := writeGalleriesMw.ApplyFn(galleriesC.Create)
 
 	// Static router
 
@@ -89,15 +207,66 @@ func main() {
 
 	r.HandleFunc("/signup", userC.New).Methods("GET")
 	r.HandleFunc("/signup", userC.Create).Methods("POST")
-	r.Handle("/login", userC.LoginView).Methods("GET")
+	r.HandleFunc("/login", userC.ShowLogin).Methods("GET")
 	r.HandleFunc("/login", userC.Login).Methods("POST")
+	r.HandleFunc("/login/2fa", userC.TwoFactorLogin).Methods("GET")
+	r.HandleFunc("/login/2fa", userC.CompleteTwoFactorLogin).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFn(userC.Logout)).Methods("POST")
 	r.HandleFunc("/cookietest", userC.CookieTest).Methods("GET")
 	r.Handle("/forgot", userC.ForgotPwView).Methods("GET")
 	r.HandleFunc("/forgot", userC.InitiateReset).Methods("POST")
 	r.HandleFunc("/reset", userC.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", userC.CompleteReset).Methods("POST")
-	r.HandleFunc("/profile", userC.Profile).Methods("GET")
+	r.HandleFunc("/verify", userC.Verify).Methods("GET")
+	r.HandleFunc("/verify/resend", requireUserMw.ApplyFn(userC.ResendVerification)).Methods("POST")
+	r.HandleFunc("/profile", requireUserMw.ApplyFn(userC.Profile)).Methods("GET")
+	r.HandleFunc("/profile/password", requireUserMw.ApplyFn(userC.ChangePassword)).Methods("POST")
+	r.HandleFunc("/profile/email", requireUserMw.ApplyFn(userC.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/profile/delete", requireUserMw.ApplyFn(userC.DeleteAccount)).Methods("POST")
+	r.HandleFunc("/profile/export", requireUserMw.ApplyFn(userC.RequestExport)).Methods("POST")
+	r.HandleFunc("/exports/download", requireUserMw.ApplyFn(userC.DownloadExport)).Methods("GET")
+	r.HandleFunc("/restore", userC.ShowRestore).Methods("GET")
+	r.HandleFunc("/restore", userC.Restore).Methods("POST")
+	r.HandleFunc("/profile/2fa", requireUserMw.ApplyFn(userC.TwoFactorSetup)).Methods("GET")
+	r.HandleFunc("/profile/2fa", requireUserMw.ApplyFn(userC.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/profile/2fa/disable", requireUserMw.ApplyFn(userC.DisableTwoFactor)).Methods("POST")
+	r.HandleFunc("/profile/2fa/recovery", requireUserMw.ApplyFn(userC.RegenerateRecoveryCodes)).Methods("POST")
+	r.HandleFunc("/sessions/{id:[0-9]+}/delete", requireUserMw.ApplyFn(userC.RevokeSession)).Methods("POST")
+	r.HandleFunc("/profile/tokens", requireUserMw.ApplyFn(userC.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/profile/tokens/{id:[0-9]+}/delete", requireUserMw.ApplyFn(userC.RevokeAPIToken)).Methods("POST")
+
+	// OpenID Connect router
+	r.HandleFunc("/auth/{provider}/login", oidcC.Login).Methods("GET")
+	r.HandleFunc("/auth/{provider}/link", requireUserMw.ApplyFn(oidcC.Link)).Methods("POST")
+	r.HandleFunc("/auth/{provider}/callback", oidcC.Callback).Methods("GET")
+	r.HandleFunc("/identities/{id:[0-9]+}/delete", requireUserMw.ApplyFn(oidcC.Unlink)).Methods("POST")
+
+	// Organization router
+	r.HandleFunc("/organizations", requireUserMw.ApplyFn(orgC.Index)).Methods("GET")
+	r.HandleFunc("/organizations", requireUserMw.ApplyFn(orgC.Create)).Methods("POST")
+	r.HandleFunc("/organizations/switch", requireUserMw.ApplyFn(orgC.Switch)).Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}", requireUserMw.ApplyFn(orgC.Show)).Methods("GET")
+	r.HandleFunc("/organizations/{id:[0-9]+}/update", requireUserMw.ApplyFn(orgC.Update)).Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/members", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(orgC.AddMember))).
+		Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/members/{member:[0-9]+}/delete", requireUserMw.ApplyFn(orgC.RemoveMember)).
+		Methods("POST")
+
+	// Outgoing webhook router, kept out of /webhooks/ so CSRF
+	// protection applies
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks", requireUserMw.ApplyFn(webhooksC.Index)).Methods("GET")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(webhooksC.Create))).
+		Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks/{endpoint:[0-9]+}", requireUserMw.ApplyFn(webhooksC.Show)).
+		Methods("GET")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks/{endpoint:[0-9]+}/update", requireUserMw.ApplyFn(webhooksC.Update)).
+		Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks/{endpoint:[0-9]+}/enable", requireUserMw.ApplyFn(webhooksC.Enable)).
+		Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks/{endpoint:[0-9]+}/delete", requireUserMw.ApplyFn(webhooksC.Delete)).
+		Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/webhooks/{endpoint:[0-9]+}/deliveries/{delivery:[0-9]+}/replay",
+		requireUserMw.ApplyFn(webhooksC.Replay)).Methods("POST")
 
 	// Gallery router
 	r.Handle("/galleries/new", newGallery).Methods("GET")
@@ -105,25 +274,25 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesC.Show).
 		Methods("GET").
 		Name(controllers.ShowGallery)
-	r.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesC.Index)).
+	r.HandleFunc("/galleries", readGalleriesMw.ApplyFn(galleriesC.Index)).
 		Methods("GET").
 		Name(controllers.IndexGalleries)
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesC.Edit)).
 		Methods("GET").
 		Name(controllers.EditGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesC.Update)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/update", writeGalleriesMw.ApplyFn(galleriesC.Update)).
 		Methods("POST").
 		Name(controllers.UpdateGallery)
-	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesC.Delete)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/delete", writeGalleriesMw.ApplyFn(galleriesC.Delete)).
 		Methods("POST").
 		Name(controllers.DeleteGallery)
 
 	// Image Upload
-	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesC.ImageUpload)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/images", writeGalleriesMw.ApplyFn(galleriesC.ImageUpload)).
 		Methods("POST")
 
 	// Image Delete
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesC.ImageDelete)).
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", writeGalleriesMw.ApplyFn(galleriesC.ImageDelete)).
 		Methods("POST")
 
 	// Image routes
@@ -139,20 +308,108 @@ func main() {
 	// Properties router
 	r.HandleFunc("/properties/new", requireUserMw.ApplyFn(propertiesC.New)).
 		Methods("GET")
-	r.HandleFunc("/properties", requireUserMw.ApplyFn(propertiesC.Create)).
+	r.HandleFunc("/properties", writePropertiesMw.ApplyFn(propertiesC.Create)).
 		Methods("POST")
-	r.HandleFunc("/properties", requireUserMw.ApplyFn(propertiesC.Index)).
+	r.HandleFunc("/properties", readPropertiesMw.ApplyFn(propertiesC.Index)).
 		Methods("GET").Name(controllers.IndexProperties)
-	r.HandleFunc("/properties/{id:[0-9]+}", requireUserMw.ApplyFn(propertiesC.Show)).
+	r.HandleFunc("/properties/{id:[0-9]+}", readPropertiesMw.ApplyFn(propertiesC.Show)).
 		Methods("GET")
 	r.HandleFunc("/properties/{id:[0-9]+}/edit", requireUserMw.ApplyFn(propertiesC.Edit)).
 		Methods("GET")
+	r.HandleFunc("/properties/{id:[0-9]+}/activity", requireUserMw.ApplyFn(propertiesC.Activity)).
+		Methods("GET")
 
-	r.HandleFunc("/properties/{id:[0-9]+}/update", requireUserMw.ApplyFn(propertiesC.Update)).
+	r.HandleFunc("/properties/{id:[0-9]+}/update", writePropertiesMw.ApplyFn(propertiesC.Update)).
+		Methods("POST")
+	r.HandleFunc("/properties/{id:[0-9]+}/delete", writePropertiesMw.ApplyFn(propertiesC.Delete)).
 		Methods("POST")
-	r.HandleFunc("/properties/{id:[0-9]+}/delete", requireUserMw.ApplyFn(propertiesC.Delete)).
+	r.HandleFunc("/properties/{id:[0-9]+}/access", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(propertiesC.GrantAccess))).
+		Methods("POST")
+	r.HandleFunc("/properties/{id:[0-9]+}/access/{grant:[0-9]+}/delete", requireUserMw.ApplyFn(propertiesC.RevokeAccess)).
+		Methods("POST")
+	r.HandleFunc("/properties/{id:[0-9]+}/tickets/{ticket:[0-9]+}/update", requireUserMw.ApplyFn(propertiesC.UpdateTicket)).
 		Methods("POST")
 
 	// End of properties router
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), csrfMw(userMw.Apply(r))))
+
+	// Invitation router, sending invitations on the user's behalf
+	// needs a verified email address
+	r.HandleFunc("/properties/{id:[0-9]+}/invitations", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(invitationC.Create))).
+		Methods("POST")
+	r.HandleFunc("/invitations/{id:[0-9]+}/resend", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(invitationC.Resend))).
+		Methods("POST")
+	r.HandleFunc("/invitations/{id:[0-9]+}/delete", requireUserMw.ApplyFn(invitationC.Delete)).
+		Methods("POST")
+	r.HandleFunc("/invitations/accept", invitationC.Show).Methods("GET")
+	r.HandleFunc("/invitations/accept", requireUserMw.ApplyFn(invitationC.Accept)).Methods("POST")
+
+	// Lease router
+	r.HandleFunc("/properties/{id:[0-9]+}/leases", requireUserMw.ApplyFn(requireVerifiedMw.ApplyFn(leasesC.Create))).
+		Methods("POST")
+	r.HandleFunc("/leases/{id:[0-9]+}", requireUserMw.ApplyFn(leasesC.Show)).Methods("GET")
+	r.HandleFunc("/leases/{id:[0-9]+}/delete", requireUserMw.ApplyFn(leasesC.Delete)).Methods("POST")
+	r.HandleFunc("/leases/{id:[0-9]+}/entries", requireUserMw.ApplyFn(leasesC.CreateEntry)).Methods("POST")
+	r.HandleFunc("/leases/{id:[0-9]+}/documents", requireUserMw.ApplyFn(leasesC.UploadDocument)).Methods("POST")
+
+	// Calendar router, feeds are fetched by calendar apps which
+	// have no session, their token is in the URL
+	r.HandleFunc("/calendars/{token}.ics", calendarsC.Feed).Methods("GET")
+	r.HandleFunc("/profile/calendars", requireUserMw.ApplyFn(calendarsC.Create)).Methods("POST")
+	r.HandleFunc("/profile/calendars/{id:[0-9]+}/delete", requireUserMw.ApplyFn(calendarsC.Revoke)).Methods("POST")
+	r.HandleFunc("/properties/{id:[0-9]+}/calendar", requireUserMw.ApplyFn(calendarsC.CreateForProperty)).Methods("POST")
+
+	// JSON API router, the document describing it is public
+	r.HandleFunc("/api/openapi.json", apiC.Spec).Methods("GET")
+	r.HandleFunc("/api/v1/properties", apiReadPropertiesMw.ApplyFn(apiC.ListProperties)).Methods("GET")
+	r.HandleFunc("/api/v1/properties", apiWritePropertiesMw.ApplyFn(idempotencyMw.ApplyFn(apiC.CreateProperty))).Methods("POST")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", apiReadPropertiesMw.ApplyFn(apiC.ShowProperty)).Methods("GET")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", apiWritePropertiesMw.ApplyFn(idempotencyMw.ApplyFn(apiC.UpdateProperty))).Methods("PATCH")
+	r.HandleFunc("/api/v1/properties/{id:[0-9]+}", apiWritePropertiesMw.ApplyFn(apiC.DeleteProperty)).Methods("DELETE")
+	r.HandleFunc("/api/v1/galleries", apiReadGalleriesMw.ApplyFn(apiC.ListGalleries)).Methods("GET")
+	r.HandleFunc("/api/v1/galleries", apiWriteGalleriesMw.ApplyFn(idempotencyMw.ApplyFn(apiC.CreateGallery))).Methods("POST")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", apiReadGalleriesMw.ApplyFn(apiC.ShowGallery)).Methods("GET")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", apiWriteGalleriesMw.ApplyFn(idempotencyMw.ApplyFn(apiC.UpdateGallery))).Methods("PATCH")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}", apiWriteGalleriesMw.ApplyFn(apiC.DeleteGallery)).Methods("DELETE")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images", apiReadGalleriesMw.ApplyFn(apiC.ListImages)).Methods("GET")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images", apiWriteGalleriesMw.ApplyFn(idempotencyMw.ApplyFn(apiC.UploadImages))).Methods("POST")
+	r.HandleFunc("/api/v1/galleries/{id:[0-9]+}/images/{filename}", apiWriteGalleriesMw.ApplyFn(apiC.DeleteImage)).Methods("DELETE")
+
+	// Tenant portal router
+	r.HandleFunc("/portal", requireUserMw.ApplyFn(requireTenantMw.ApplyFn(portalC.Home))).Methods("GET")
+	r.HandleFunc("/portal/tickets", requireUserMw.ApplyFn(requireTenantMw.ApplyFn(portalC.Tickets))).Methods("GET")
+	r.HandleFunc("/portal/tickets", requireUserMw.ApplyFn(requireTenantMw.ApplyFn(portalC.CreateTicket))).Methods("POST")
+	r.HandleFunc("/portal/tickets/{id:[0-9]+}", requireUserMw.ApplyFn(requireTenantMw.ApplyFn(portalC.ShowTicket))).Methods("GET")
+
+	// Notifications router
+	r.HandleFunc("/notifications", requireUserMw.ApplyFn(notificationsC.Index)).Methods("GET")
+	r.HandleFunc("/notifications/read", requireUserMw.ApplyFn(notificationsC.ReadAll)).Methods("POST")
+	r.HandleFunc("/notifications/{id:[0-9]+}/read", requireUserMw.ApplyFn(notificationsC.Read)).Methods("POST")
+	r.HandleFunc("/profile/notifications", requireUserMw.ApplyFn(notificationsC.UpdateChannels)).Methods("POST")
+
+	// Operator console
+	r.HandleFunc("/admin", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Index))).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.ShowUser))).Methods("GET")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/impersonate", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Impersonate))).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/reset", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.ForcePasswordReset))).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/disable", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Disable))).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/enable", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Enable))).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/verify/resend", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.ResendVerification))).Methods("POST")
+	r.HandleFunc("/admin/outbox", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Outbox))).Methods("GET")
+	r.HandleFunc("/admin/outbox/{id:[0-9]+}/retry", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.RetryEmail))).Methods("POST")
+	r.HandleFunc("/admin/suppressions/{id:[0-9]+}/delete", requireUserMw.ApplyFn(requireAdminMw.ApplyFn(adminC.Unsuppress))).Methods("POST")
+	r.HandleFunc("/admin/impersonation/stop", requireUserMw.ApplyFn(adminC.StopImpersonating)).Methods("POST")
+
+	// Webhooks router, see webhooksMw
+	r.HandleFunc("/webhooks/mailgun/inbound", inboundC.Mailgun).Methods("POST")
+	r.HandleFunc("/webhooks/mailgun/events", deliveriesC.Mailgun).Methods("POST")
+
+	// Development only
+	if !config.IsProd() {
+		r.HandleFunc("/webhooks/inbound/raw", inboundC.Raw).Methods("POST")
+		devC := controllers.NewDev(emailer)
+		r.HandleFunc("/dev/emails", devC.Emails).Methods("GET")
+		r.HandleFunc("/dev/emails/{locale}/{name}", devC.PreviewEmail).Methods("GET")
+	}
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), realIPMw.Apply(apiTokenMw.Apply(webhooksMw.Apply(csrfMw(userMw.Apply(orgMw.Apply(notificationsMw.Apply(r)))))))))
 }
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+
+	// maxIdempotentBody is the largest request body that can be
+	// sent with an idempotency key, it is read whole to tell
+	// retries from other requests
+	maxIdempotentBody = 32 << 20
+)
+
+// Idempotency lets API clients retry requests that create or
+// change something without doing it twice. A request sent with
+// an Idempotency-Key header has its response kept, see
+// models.IdempotentRequest, and retries with the key get that
+// response back. It runs after RequireAPIToken, keys are per
+// user.
+type Idempotency struct {
+	models.IdempotencyService
+}
+
+func (i *Idempotency) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		user := context.User(r.Context())
+		if key == "" || user == nil {
+			next(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			views.RenderJSONError(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		req := models.IdempotentRequest{
+			UserID:      user.ID,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+		}
+		done, err := i.Begin(&req)
+		switch err {
+		case nil:
+		case models.ErrIdempotencyKeyTooLong, models.ErrIdempotencyKeyReused:
+			views.RenderJSONError(w, http.StatusUnprocessableEntity, err.(views.PublicError).Public())
+			return
+		case models.ErrIdempotencyKeyInFlight:
+			views.RenderJSONError(w, http.StatusConflict, err.(views.PublicError).Public())
+			return
+		default:
+			log.Println(err)
+			views.RenderJSONError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+
+		if done != nil {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(done.Status)
+			w.Write(done.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// Failures on our side are not kept, the client may retry
+		// them with the same key
+		if rec.status >= http.StatusInternalServerError {
+			err = i.Delete(req.ID)
+		} else {
+			err = i.Finish(&req, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("idempotent request %d: %v", req.ID, err)
+		}
+	})
+}
+
+func (i *Idempotency) Apply(next http.Handler) http.HandlerFunc {
+	return i.ApplyFn(next.ServeHTTP)
+}
+
+// requestHash identifies a request by its method, path and body
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response written through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
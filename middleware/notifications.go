@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"log"
+	"net/http"
+)
+
+// Notifications puts how many notifications the user hasn't
+// read in the request context, for the navbar. It runs after
+// User.
+type Notifications struct {
+	NotificationService models.NotificationService
+}
+
+func (n *Notifications) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			next(w, r)
+			return
+		}
+
+		// The badge is not worth failing the request over
+		count, err := n.NotificationService.UnreadCount(user.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		next(w, r.WithContext(context.WithUnread(r.Context(), count)))
+	})
+}
+
+func (n *Notifications) Apply(next http.Handler) http.HandlerFunc {
+	return n.ApplyFn(next.ServeHTTP)
+}
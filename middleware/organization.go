@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/context"
+	"log"
+	"net/http"
+)
+
+// Organization puts the organization the user works in, and the
+// ones they can switch to, in the request context. It runs after
+// User, the organization is remembered per session or API token.
+type Organization struct {
+	Authorizer *authz.Authorizer
+}
+
+func (o *Organization) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			next(w, r)
+			return
+		}
+
+		orgs, err := o.Authorizer.Organizations(user)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		var wanted uint
+		if session := context.Session(r.Context()); session != nil {
+			wanted = session.OrganizationID
+		} else if token := context.APIToken(r.Context()); token != nil {
+			wanted = token.OrganizationID
+		}
+
+		// Fall back to the first one, e.g. when the user was
+		// removed from the organization they worked in.
+		current := &orgs[0]
+		for i := range orgs {
+			if orgs[i].ID == wanted {
+				current = &orgs[i]
+				break
+			}
+		}
+
+		ctx := r.Context()
+		ctx = context.WithOrganization(ctx, current)
+		ctx = context.WithOrganizations(ctx, orgs)
+		next(w, r.WithContext(ctx))
+	})
+}
+
+func (o *Organization) Apply(next http.Handler) http.HandlerFunc {
+	return o.ApplyFn(next.ServeHTTP)
+}
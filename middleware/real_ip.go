@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIP sets the RemoteAddr of the requests relayed by
+// TrustedProxy to the client address the proxy puts in
+// X-Real-IP. The header is ignored on requests from anywhere
+// else, as any client can send it. It runs before everything
+// else, so handlers only have to look at RemoteAddr.
+type RealIP struct {
+	TrustedProxy string
+}
+
+func (ri *RealIP) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ri.trusted(r.RemoteAddr) {
+			if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+				r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+			}
+		}
+		next(w, r)
+	})
+}
+
+func (ri *RealIP) Apply(next http.Handler) http.HandlerFunc {
+	return ri.ApplyFn(next.ServeHTTP)
+}
+
+// trusted reports whether the request was made by the proxy
+func (ri *RealIP) trusted(remoteAddr string) bool {
+	proxy := net.ParseIP(ri.TrustedProxy)
+	if proxy == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	return proxy.Equal(net.ParseIP(host))
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"net/http"
+)
+
+// RequireAdmin guards the operator console. Other users get a
+// 404, the console doesn't exist as far as they know. It
+// assumes RequireUser ran first.
+type RequireAdmin struct{}
+
+func (ra *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if !user.Admin {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (ra *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return ra.ApplyFn(next.ServeHTTP)
+}
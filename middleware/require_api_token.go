@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+)
+
+// RequireAPIToken guards the routes of the JSON API. Unlike
+// RequireScope, browser sessions are turned away: the API is
+// for scripts, which authenticate with an API token granted
+// Scope.
+type RequireAPIToken struct {
+	Scope string
+}
+
+func (rt *RequireAPIToken) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := context.APIToken(r.Context())
+		if token == nil || context.User(r.Context()) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			views.RenderJSONError(w, http.StatusUnauthorized, "An API token is required")
+			return
+		}
+		if !token.HasScope(rt.Scope) {
+			views.RenderJSONError(w, http.StatusForbidden, "API token is missing the "+rt.Scope+" scope")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (rt *RequireAPIToken) Apply(next http.Handler) http.HandlerFunc {
+	return rt.ApplyFn(next.ServeHTTP)
+}
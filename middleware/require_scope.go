@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"net/http"
+)
+
+// RequireScope is RequireUser for routes that scripts may use
+// too. Requests made with an API token need to have been
+// granted Scope, browser sessions are not limited by scopes.
+type RequireScope struct {
+	Scope string
+}
+
+func (rs *RequireScope) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		token := context.APIToken(r.Context())
+		if token != nil && !token.HasScope(rs.Scope) {
+			http.Error(w, "API token is missing the "+rs.Scope+" scope", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (rs *RequireScope) Apply(next http.Handler) http.HandlerFunc {
+	return rs.ApplyFn(next.ServeHTTP)
+}
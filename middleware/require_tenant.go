@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"log"
+	"net/http"
+)
+
+// RequireTenant lets only users who rent a property into the
+// tenant portal, and puts their current lease in the request
+// context. Portal handlers look everything up through that
+// lease, so tenants never see more than their own. It assumes
+// RequireUser ran first.
+type RequireTenant struct {
+	models.LeaseService
+}
+
+func (rt *RequireTenant) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		lease, err := rt.Current(user.ID)
+		switch err {
+		case nil:
+		case models.ErrNotFound:
+			views.RedirectAlert(w, r, "/", http.StatusFound, views.Alert{
+				Level:   views.AlertLvlInfo,
+				Message: "You don't have a lease with us, the tenant portal is for tenants.",
+			})
+			return
+		default:
+			log.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		next(w, r.WithContext(context.WithLease(r.Context(), lease)))
+	})
+}
+
+func (rt *RequireTenant) Apply(next http.Handler) http.HandlerFunc {
+	return rt.ApplyFn(next.ServeHTTP)
+}
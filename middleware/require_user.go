@@ -14,6 +14,11 @@ func (ru *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
+		// API tokens only reach routes guarded by RequireScope
+		if context.APIToken(r.Context()) != nil {
+			http.Error(w, "API tokens can't be used here", http.StatusForbidden)
+			return
+		}
 		next(w, r)
 	})
 }
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"github.com/ruckuus/dojo1/context"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/views"
+	"net/http"
+)
+
+// RequireVerified guards actions that reach other people, such
+// as sending emails on the user's behalf, until the user proved
+// they own their email address. It assumes RequireUser ran first.
+type RequireVerified struct{}
+
+func (rv *RequireVerified) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if !user.Verified() {
+			views.RedirectAlert(w, r, "/profile", http.StatusFound, views.Alert{
+				Level:   views.AlertLvlWarning,
+				Message: models.ErrEmailNotVerified.Public(),
+			})
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (rv *RequireVerified) Apply(next http.Handler) http.HandlerFunc {
+	return rv.ApplyFn(next.ServeHTTP)
+}
@@ -7,8 +7,12 @@ import (
 	"strings"
 )
 
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "session_token"
+
 type User struct {
 	models.UserService
+	SessionService models.SessionService
 }
 
 func (u *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
@@ -23,21 +27,42 @@ func (u *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		cookie, err := r.Cookie("remember_token")
-		if err != nil {
+		// Already authenticated with an API token
+		if context.User(r.Context()) != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := u.ByRemember(cookie.Value)
+		cookie, err := r.Cookie(SessionCookie)
+		if err != nil {
+			next(w, r)
+			return
+		}
 
+		session, err := u.SessionService.Active(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
+		user, err := u.ByID(session.UserID)
+		if err != nil || user.Disabled() {
+			next(w, r)
+			return
+		}
+
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
+		// An impersonation ends with the admin rights of the operator
+		if session.Impersonated() {
+			admin, err := u.ByID(session.ImpersonatorID)
+			if err != nil || !admin.Admin {
+				next(w, r)
+				return
+			}
+			ctx = context.WithImpersonator(ctx, admin)
+		}
 		r = r.WithContext(ctx)
 
 		next(w, r)
@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"github.com/gorilla/csrf"
+	"net/http"
+	"strings"
+)
+
+// Webhooks lets the requests under Prefix past the CSRF check.
+// They are posted by other services rather than browsers, the
+// handlers check their signature instead. It runs before CSRF.
+type Webhooks struct {
+	Prefix string
+}
+
+func (wh *Webhooks) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, wh.Prefix) {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next(w, r)
+	})
+}
+
+func (wh *Webhooks) Apply(next http.Handler) http.HandlerFunc {
+	return wh.ApplyFn(next.ServeHTTP)
+}
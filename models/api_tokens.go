@@ -0,0 +1,350 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted. A token can only reach
+// the routes that require one of its scopes.
+const (
+	ScopePropertiesRead  = "properties:read"
+	ScopePropertiesWrite = "properties:write"
+	ScopeGalleriesRead   = "galleries:read"
+	ScopeGalleriesWrite  = "galleries:write"
+)
+
+// Scopes lists every scope, in the order they are offered
+var Scopes = []string{
+	ScopePropertiesRead,
+	ScopePropertiesWrite,
+	ScopeGalleriesRead,
+	ScopeGalleriesWrite,
+}
+
+const (
+	// apiTokenPrefix makes our tokens easy to recognise, e.g.
+	// for secret scanners when one ends up in a repository.
+	apiTokenPrefix = "tat_"
+
+	// apiTokenTouchInterval limits how often LastUsedAt is written back
+	apiTokenTouchInterval = time.Minute
+)
+
+const (
+	ErrTokenNameRequired modelError = "models: token name is required"
+	ErrScopeRequired     modelError = "models: select at least one scope"
+	ErrScopeInvalid      modelError = "models: scope is not valid"
+	ErrExpiryInvalid     modelError = "models: expiry must be in the future"
+)
+
+// APIToken is a personal access token used by scripts to act
+// as the user. Only the HMAC of the token is stored, the token
+// itself is shown to the user once when it is created. The
+// token acts in the organization it was created in.
+type APIToken struct {
+	gorm.Model
+	UserID         uint `gorm:"not null;index"`
+	OrganizationID uint
+	Name           string `gorm:"not null;size:100"`
+	Scopes         string `gorm:"not null"`
+	Token          string `gorm:"-"`
+	TokenHash      string `gorm:"not null;unique_index"`
+	ExpiresAt      *time.Time
+	LastUsedAt     *time.Time
+}
+
+// ScopeList returns the scopes the token was granted
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token can no longer be used.
+// Tokens without an expiry are valid until revoked.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenService is the set of methods used to
+// manage API tokens from outside the models package
+type APITokenService interface {
+	// Authenticate looks up the token sent by a client and
+	// records that it was used. ErrTokenExpired is returned
+	// for expired tokens.
+	Authenticate(token string) (*APIToken, error)
+	APITokenDB
+}
+
+// APITokenDB is used to interact with the api_tokens database.
+type APITokenDB interface {
+	ByID(id uint) (*APIToken, error)
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+
+	Create(t *APIToken) error
+	Update(t *APIToken) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+var _ APITokenService = &apiTokenService{}
+var _ APITokenDB = &apiTokenValidator{}
+var _ APITokenDB = &apiTokenGorm{}
+
+// NewAPITokenService returns an APITokenService backed by gorm
+func NewAPITokenService(db *gorm.DB, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			APITokenDB: &apiTokenGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+func (ats *apiTokenService) Authenticate(token string) (*APIToken, error) {
+	apiToken, err := ats.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if apiToken.Expired() {
+		return nil, ErrTokenExpired
+	}
+
+	now := time.Now()
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > apiTokenTouchInterval {
+		apiToken.LastUsedAt = &now
+		if err := ats.Update(apiToken); err != nil {
+			return nil, err
+		}
+	}
+
+	return apiToken, nil
+}
+
+// DB Implementation
+func (atg *apiTokenGorm) ByID(id uint) (*APIToken, error) {
+	var apiToken APIToken
+	err := first(atg.db.Where("id = ?", id), &apiToken)
+	if err != nil {
+		return nil, err
+	}
+	return &apiToken, nil
+}
+
+func (atg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var apiToken APIToken
+	err := first(atg.db.Where("token_hash = ?", tokenHash), &apiToken)
+	if err != nil {
+		return nil, err
+	}
+	return &apiToken, nil
+}
+
+// ByUserID returns the tokens of a user, newest first
+func (atg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var apiTokens []APIToken
+	db := atg.db.Where("user_id = ?", userID).Order("created_at desc")
+	err := db.Find(&apiTokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return apiTokens, nil
+}
+
+func (atg *apiTokenGorm) Create(t *APIToken) error {
+	return atg.db.Create(t).Error
+}
+
+func (atg *apiTokenGorm) Update(t *APIToken) error {
+	return atg.db.Save(t).Error
+}
+
+// Delete removes the token for good, a revoked token
+// has no reason to be kept around.
+func (atg *apiTokenGorm) Delete(id uint) error {
+	apiToken := APIToken{Model: gorm.Model{ID: id}}
+	return atg.db.Unscoped().Delete(&apiToken).Error
+}
+
+func (atg *apiTokenGorm) DeleteByUserID(userID uint) error {
+	return atg.db.Unscoped().Where("user_id = ?", userID).Delete(&APIToken{}).Error
+}
+
+// Validator implementation
+func (atv *apiTokenValidator) ByToken(token string) (*APIToken, error) {
+	apiToken := APIToken{
+		Token: token,
+	}
+
+	err := runAPITokenValFns(&apiToken,
+		atv.prefixRequired,
+		atv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return atv.APITokenDB.ByToken(apiToken.TokenHash)
+}
+
+func (atv *apiTokenValidator) Create(t *APIToken) error {
+	err := runAPITokenValFns(t,
+		atv.requireUserID,
+		atv.normalizeName,
+		atv.nameRequired,
+		atv.normalizeScopes,
+		atv.scopesValid,
+		atv.expiryInFuture,
+		atv.setToken,
+		atv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return atv.APITokenDB.Create(t)
+}
+
+func (atv *apiTokenValidator) Update(t *APIToken) error {
+	if err := runAPITokenValFns(t, atv.requireUserID, atv.nonZeroID); err != nil {
+		return err
+	}
+	return atv.APITokenDB.Update(t)
+}
+
+func (atv *apiTokenValidator) Delete(id uint) error {
+	var apiToken APIToken
+	apiToken.ID = id
+	if err := runAPITokenValFns(&apiToken, atv.nonZeroID); err != nil {
+		return err
+	}
+	return atv.APITokenDB.Delete(id)
+}
+
+// Validation functions
+func (atv *apiTokenValidator) requireUserID(t *APIToken) error {
+	if t.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) nonZeroID(t *APIToken) error {
+	if t.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) normalizeName(t *APIToken) error {
+	t.Name = strings.TrimSpace(t.Name)
+	return nil
+}
+
+func (atv *apiTokenValidator) nameRequired(t *APIToken) error {
+	if t.Name == "" {
+		return ErrTokenNameRequired
+	}
+	return nil
+}
+
+// normalizeScopes drops duplicates and stores the scopes in
+// the order of Scopes, so equal grants look the same.
+func (atv *apiTokenValidator) normalizeScopes(t *APIToken) error {
+	requested := map[string]bool{}
+	for _, s := range t.ScopeList() {
+		requested[s] = true
+	}
+
+	var scopes []string
+	for _, s := range Scopes {
+		if requested[s] {
+			scopes = append(scopes, s)
+			delete(requested, s)
+		}
+	}
+	if len(requested) > 0 {
+		return ErrScopeInvalid
+	}
+
+	t.Scopes = strings.Join(scopes, " ")
+	return nil
+}
+
+func (atv *apiTokenValidator) scopesValid(t *APIToken) error {
+	if t.Scopes == "" {
+		return ErrScopeRequired
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) expiryInFuture(t *APIToken) error {
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()) {
+		return ErrExpiryInvalid
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) setToken(t *APIToken) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	t.Token = apiTokenPrefix + token
+	return nil
+}
+
+// prefixRequired rejects anything that can't be one of our
+// tokens before we bother the database.
+func (atv *apiTokenValidator) prefixRequired(t *APIToken) error {
+	if !strings.HasPrefix(t.Token, apiTokenPrefix) {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+func (atv *apiTokenValidator) hmacToken(t *APIToken) error {
+	if t.Token == "" {
+		return ErrTokenInvalid
+	}
+
+	t.TokenHash = atv.hmac.Hash(t.Token)
+	return nil
+}
+
+// Validator functions
+type apiTokenValFn func(t *APIToken) error
+
+func runAPITokenValFns(t *APIToken, fns ...apiTokenValFn) error {
+	for _, fn := range fns {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	"reflect"
+	"time"
+)
+
+// Audited targets
+const (
+	AuditUser     = "user"
+	AuditProperty = "property"
+	AuditGallery  = "gallery"
+	AuditImage    = "image"
+)
+
+// Audited actions
+const (
+	AuditCreated        = "created"
+	AuditUpdated        = "updated"
+	AuditDeleted        = "deleted"
+	AuditLoginSucceeded = "login.succeeded"
+	AuditLoginFailed    = "login.failed"
+	AuditPasswordReset  = "password.reset"
+
+	// Operator actions, see the admin console
+	AuditPasswordResetForced   = "password.reset_forced"
+	AuditAccountDisabled       = "account.disabled"
+	AuditAccountEnabled        = "account.enabled"
+	AuditImpersonationStarted  = "impersonation.started"
+	AuditImpersonationFinished = "impersonation.finished"
+)
+
+// auditIgnored are the fields left out of diffs, they change
+// on every save or hold secrets.
+var auditIgnored = map[string]bool{
+	"CreatedAt":    true,
+	"UpdatedAt":    true,
+	"DeletedAt":    true,
+	"Images":       true,
+	"Password":     true,
+	"PasswordHash": true,
+	"TOTPSecret":   true,
+	"TOTPLastStep": true,
+}
+
+// Actor is who makes a change, UserID is zero for changes made
+// by the application itself, e.g. when purging accounts.
+type Actor struct {
+	UserID uint
+	IP     string
+}
+
+// AuditEvent records a security or data-changing event. Events
+// are only ever added, see AuditDB. Before and After hold the
+// JSON of the fields that changed.
+type AuditEvent struct {
+	ID         uint      `gorm:"primary_key"`
+	CreatedAt  time.Time `gorm:"index"`
+	ActorID    uint      `gorm:"index"`
+	IP         string
+	Action     string `gorm:"not null"`
+	TargetType string `gorm:"not null;index:idx_audit_events_target"`
+	TargetID   uint   `gorm:"index:idx_audit_events_target"`
+	Before     string `gorm:"type:text"`
+	After      string `gorm:"type:text"`
+}
+
+// AuditService is the set of methods used to
+// read the audit log from outside the models package
+type AuditService interface {
+	// Record adds an event that isn't a change made through
+	// another service, e.g. an operator impersonating a user.
+	Record(actor Actor, action, targetType string, targetID uint) error
+	AuditDB
+}
+
+// AuditDB is used to interact with the audit_events table. It
+// has no way to change or remove events on purpose.
+type AuditDB interface {
+	// ByTarget returns the events of a target, newest first
+	ByTarget(targetType string, targetID uint) ([]AuditEvent, error)
+	Create(e *AuditEvent) error
+}
+
+type auditService struct {
+	AuditDB
+}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+var _ AuditService = &auditService{}
+var _ AuditDB = &auditGorm{}
+
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditService{
+		AuditDB: &auditGorm{
+			db: db,
+		},
+	}
+}
+
+func (as *auditService) Record(actor Actor, action, targetType string, targetID uint) error {
+	ar := auditRecorder{db: as.AuditDB, actor: actor}
+	return ar.record(action, targetType, targetID, nil, nil)
+}
+
+// DB Implementation
+func (ag *auditGorm) ByTarget(targetType string, targetID uint) ([]AuditEvent, error) {
+	var events []AuditEvent
+	db := ag.db.Where("target_type = ? AND target_id = ?", targetType, targetID).
+		Order("created_at desc")
+	err := db.Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (ag *auditGorm) Create(e *AuditEvent) error {
+	return ag.db.Create(e).Error
+}
+
+// auditRecorder is used by the services to record the changes
+// they make on behalf of actor.
+type auditRecorder struct {
+	db    AuditDB
+	actor Actor
+}
+
+func newAuditRecorder(db *gorm.DB) auditRecorder {
+	return auditRecorder{db: &auditGorm{db: db}}
+}
+
+// record adds an event for target. before is nil for created
+// targets and after is nil for deleted ones.
+func (ar auditRecorder) record(action, targetType string, targetID uint, before, after interface{}) error {
+	b, a, err := auditDiff(before, after)
+	if err != nil {
+		return err
+	}
+	return ar.db.Create(&AuditEvent{
+		ActorID:    ar.actor.UserID,
+		IP:         ar.actor.IP,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Before:     b,
+		After:      a,
+	})
+}
+
+// auditDiff returns the JSON of the fields that differ between
+// before and after.
+func auditDiff(before, after interface{}) (string, string, error) {
+	bm, err := auditFields(before)
+	if err != nil {
+		return "", "", err
+	}
+	am, err := auditFields(after)
+	if err != nil {
+		return "", "", err
+	}
+
+	for k, v := range bm {
+		if av, ok := am[k]; ok && reflect.DeepEqual(v, av) {
+			delete(bm, k)
+			delete(am, k)
+		}
+	}
+	b, err := auditJSON(bm)
+	if err != nil {
+		return "", "", err
+	}
+	a, err := auditJSON(am)
+	return b, a, err
+}
+
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil {
+		return fields, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return fields, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	for k := range fields {
+		if auditIgnored[k] {
+			delete(fields, k)
+		}
+	}
+	return fields, nil
+}
+
+func auditJSON(fields map[string]interface{}) (string, error) {
+	if len(fields) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(fields)
+	return string(b), err
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// breachedPrefixLen is the length of the hash prefixes the list
+// is searched by, as with the Pwned Passwords range API.
+const breachedPrefixLen = 5
+
+const (
+	ErrPasswordBreached modelError = "models: this password appeared in a data breach, please choose another one"
+)
+
+// BreachedList checks passwords against a local copy of a
+// breached password list, so sign ups work offline. The file
+// holds one "SHA1:COUNT" line per password, sorted by hash, as
+// in the "ordered by hash" Pwned Passwords download.
+//
+// Like the range API, lookups only search the lines sharing the
+// first characters of the hash and compare the rest in memory.
+type BreachedList struct {
+	path string
+}
+
+var _ PasswordRule = &BreachedList{}
+
+// OpenBreachedList checks the list at path can be read
+func OpenBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &BreachedList{path: path}, nil
+}
+
+func (bl *BreachedList) CheckPassword(user *User, password string) error {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := bl.Range(hash[:breachedPrefixLen])
+	if err != nil {
+		return err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[breachedPrefixLen:] {
+			return ErrPasswordBreached
+		}
+	}
+	return nil
+}
+
+// Range returns the rest of the hashes starting with prefix
+func (bl *BreachedList) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+
+	f, err := os.Open(bl.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	// Find the first line not sorting before prefix, the lines
+	// starting at or after an offset only grow with it.
+	lo, hi := int64(0), size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAt(f, mid, size)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) > len(prefix) {
+			line = line[:len(prefix)]
+		}
+		if start >= size || line >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	start, _, err := lineAt(f, lo, size)
+	if err != nil {
+		return nil, err
+	}
+	var suffixes []string
+	scanner := bufio.NewScanner(io.NewSectionReader(f, start, size-start))
+	for scanner.Scan() {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if !strings.HasPrefix(line, prefix) {
+			break
+		}
+		hash := line
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			hash = line[:colon]
+		}
+		suffixes = append(suffixes, hash[len(prefix):])
+	}
+	return suffixes, scanner.Err()
+}
+
+// lineAt returns the first line starting at or after off, and
+// where it starts. start is size past the last line.
+func lineAt(f *os.File, off, size int64) (int64, string, error) {
+	start := off
+	if off > 0 {
+		r := bufio.NewReader(io.NewSectionReader(f, off-1, size-off+1))
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start = off - 1 + int64(len(skipped))
+	}
+	if start >= size {
+		return size, "", nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, strings.ToUpper(strings.TrimSpace(line)), nil
+}
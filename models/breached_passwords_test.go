@@ -0,0 +1,139 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeBreachedList writes lines to a temporary file, which is
+// removed by the returned function
+func writeBreachedList(t *testing.T, content string) (*BreachedList, func()) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	bl, err := OpenBreachedList(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bl, func() { os.Remove(f.Name()) }
+}
+
+func TestBreachedListRange(t *testing.T) {
+	// Enough lines that the search takes many steps, with
+	// several hashes sharing the shorter prefixes
+	var hashes []string
+	for i := 0; i < 3000; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("password%d", i)))
+		hashes = append(hashes, strings.ToUpper(hex.EncodeToString(sum[:])))
+	}
+	sort.Strings(hashes)
+
+	var lines []string
+	for i, h := range hashes {
+		lines = append(lines, fmt.Sprintf("%s:%d", h, i+1))
+	}
+
+	// want returns the suffixes after prefix, found the slow way
+	want := func(prefix string) []string {
+		var suffixes []string
+		for _, h := range hashes {
+			if strings.HasPrefix(h, strings.ToUpper(prefix)) {
+				suffixes = append(suffixes, h[len(prefix):])
+			}
+		}
+		return suffixes
+	}
+
+	prefixes := []string{
+		hashes[0][:5],
+		hashes[len(hashes)-1][:5],
+		hashes[1500][:5],
+		strings.ToLower(hashes[42][:5]),
+		hashes[7][:2],
+		hashes[2999][:1],
+		hashes[100],
+		"00000",
+		"FFFFF",
+	}
+	// A prefix missing from the middle of the list
+	for _, c := range "0123456789ABCDEF" {
+		if prefix := hashes[1500][:5] + string(c); want(prefix) == nil {
+			prefixes = append(prefixes, prefix)
+			break
+		}
+	}
+
+	files := map[string]string{
+		"newline at the end":    strings.Join(lines, "\n") + "\n",
+		"no newline at the end": strings.Join(lines, "\n"),
+		"crlf":                  strings.Join(lines, "\r\n") + "\r\n",
+		"lower case":            strings.ToLower(strings.Join(lines, "\n")),
+	}
+	for name, content := range files {
+		bl, remove := writeBreachedList(t, content)
+		for _, prefix := range prefixes {
+			got, err := bl.Range(prefix)
+			if err != nil {
+				t.Fatalf("%s: Range(%q): %v", name, prefix, err)
+			}
+			if w := want(prefix); !reflect.DeepEqual(got, w) {
+				t.Errorf("%s: Range(%q) = %d suffixes %v, want %d %v", name, prefix, len(got), got, len(w), w)
+			}
+		}
+		remove()
+	}
+}
+
+func TestBreachedListSmallFiles(t *testing.T) {
+	tests := []struct {
+		content string
+		prefix  string
+		want    []string
+	}{
+		{"", "ABCDE", nil},
+		{"ABCDE1:1\n", "ABCDE", []string{"1"}},
+		{"ABCDE1:1\n", "ABCDF", nil},
+		{"ABCDD1:1\nABCDE1:1\nABCDE2:5\nABCDF1:1\n", "ABCDE", []string{"1", "2"}},
+		// Lines without a count are allowed too
+		{"ABCDE1\nABCDE2", "ABCDE", []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		bl, remove := writeBreachedList(t, tt.content)
+		got, err := bl.Range(tt.prefix)
+		remove()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Range(%q) in %q = %v, want %v", tt.prefix, tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestBreachedListCheckPassword(t *testing.T) {
+	sum := sha1.Sum([]byte("hunter22"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	bl, remove := writeBreachedList(t, hash+":1000\n")
+	defer remove()
+
+	if err := bl.CheckPassword(&User{}, "hunter22"); err != ErrPasswordBreached {
+		t.Errorf("breached password: err = %v, want %v", err, ErrPasswordBreached)
+	}
+	if err := bl.CheckPassword(&User{}, "hunter23"); err != nil {
+		t.Errorf("other password: err = %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+)
+
+// calendarTokenBytes is how many random bytes feed tokens have
+const calendarTokenBytes = 32
+
+// CalendarFeed lets calendar apps, which have no session, read
+// the dates of the leases of a user. The feed covers every
+// property the user can see, or only PropertyID when it is set.
+// Only the HMAC of the token is stored, the feed URL is shown
+// to the user once when it is created.
+type CalendarFeed struct {
+	gorm.Model
+	UserID     uint `gorm:"not null;index"`
+	PropertyID uint
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+}
+
+// CalendarFeedService is the set of methods used to
+// manage calendar feeds from outside the models package
+type CalendarFeedService interface {
+	CalendarFeedDB
+}
+
+// CalendarFeedDB is used to interact with the calendar feeds database
+type CalendarFeedDB interface {
+	ByID(id uint) (*CalendarFeed, error)
+	ByToken(token string) (*CalendarFeed, error)
+	// ByUserID returns the feeds of a user, newest first
+	ByUserID(userID uint) ([]CalendarFeed, error)
+	Create(feed *CalendarFeed) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type calendarFeedService struct {
+	CalendarFeedDB
+}
+
+type calendarFeedValidator struct {
+	CalendarFeedDB
+	hmac hash.HMAC
+}
+
+type calendarFeedGorm struct {
+	db *gorm.DB
+}
+
+var _ CalendarFeedService = &calendarFeedService{}
+var _ CalendarFeedDB = &calendarFeedValidator{}
+var _ CalendarFeedDB = &calendarFeedGorm{}
+
+func NewCalendarFeedService(db *gorm.DB, hmacKey string) CalendarFeedService {
+	return &calendarFeedService{
+		CalendarFeedDB: &calendarFeedValidator{
+			CalendarFeedDB: &calendarFeedGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+// DB Implementation
+func (cfg *calendarFeedGorm) ByID(id uint) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	err := first(cfg.db.Where("id = ?", id), &feed)
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (cfg *calendarFeedGorm) ByToken(tokenHash string) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	err := first(cfg.db.Where("token_hash = ?", tokenHash), &feed)
+	if err != nil {
+		return nil, err
+	}
+	return &feed, nil
+}
+
+func (cfg *calendarFeedGorm) ByUserID(userID uint) ([]CalendarFeed, error) {
+	var feeds []CalendarFeed
+	db := cfg.db.Where("user_id = ?", userID).Order("created_at desc")
+	err := db.Find(&feeds).Error
+	if err != nil {
+		return nil, err
+	}
+	return feeds, nil
+}
+
+func (cfg *calendarFeedGorm) Create(feed *CalendarFeed) error {
+	return cfg.db.Create(feed).Error
+}
+
+// Delete revokes a feed for good
+func (cfg *calendarFeedGorm) Delete(id uint) error {
+	feed := CalendarFeed{Model: gorm.Model{ID: id}}
+	return cfg.db.Unscoped().Delete(&feed).Error
+}
+
+func (cfg *calendarFeedGorm) DeleteByUserID(userID uint) error {
+	return cfg.db.Unscoped().Where("user_id = ?", userID).Delete(&CalendarFeed{}).Error
+}
+
+// Validator implementation
+func (cfv *calendarFeedValidator) ByID(id uint) (*CalendarFeed, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return cfv.CalendarFeedDB.ByID(id)
+}
+
+func (cfv *calendarFeedValidator) ByToken(token string) (*CalendarFeed, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return cfv.CalendarFeedDB.ByToken(cfv.hmac.Hash(token))
+}
+
+func (cfv *calendarFeedValidator) Create(feed *CalendarFeed) error {
+	err := runCalendarFeedValFns(feed,
+		cfv.requireUserID,
+		cfv.setToken,
+		cfv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return cfv.CalendarFeedDB.Create(feed)
+}
+
+func (cfv *calendarFeedValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return cfv.CalendarFeedDB.Delete(id)
+}
+
+// Validation functions
+func (cfv *calendarFeedValidator) requireUserID(feed *CalendarFeed) error {
+	if feed.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (cfv *calendarFeedValidator) setToken(feed *CalendarFeed) error {
+	token, err := rand.String(calendarTokenBytes)
+	if err != nil {
+		return err
+	}
+	feed.Token = token
+	return nil
+}
+
+func (cfv *calendarFeedValidator) hmacToken(feed *CalendarFeed) error {
+	feed.TokenHash = cfv.hmac.Hash(feed.Token)
+	return nil
+}
+
+// Validator functions
+type calendarFeedValFn func(feed *CalendarFeed) error
+
+func runCalendarFeedValFns(feed *CalendarFeed, fns ...calendarFeedValFn) error {
+	for _, fn := range fns {
+		if err := fn(feed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
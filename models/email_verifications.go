@@ -0,0 +1,141 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+)
+
+// emailVerification proves that a user owns Email. It follows
+// the same token scheme as pwReset: only the HMAC of the token
+// is stored, the token itself is sent by email.
+type emailVerification struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Email     string `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null; unique_index"`
+}
+
+type emailVerificationDB interface {
+	ByToken(token string) (*emailVerification, error)
+	Create(ev *emailVerification) error
+	DeleteByUserID(userID uint) error
+}
+
+type emailVerificationGorm struct {
+	db *gorm.DB
+}
+
+type emailVerificationValidator struct {
+	emailVerificationDB
+	hmac hash.HMAC
+}
+
+func newEmailVerificationValidator(db emailVerificationDB, hmac hash.HMAC) *emailVerificationValidator {
+	return &emailVerificationValidator{
+		emailVerificationDB: db,
+		hmac:                hmac,
+	}
+}
+
+var _ emailVerificationDB = &emailVerificationGorm{}
+var _ emailVerificationDB = &emailVerificationValidator{}
+
+func (evg *emailVerificationGorm) ByToken(tokenHash string) (*emailVerification, error) {
+	var ev emailVerification
+	err := first(evg.db.Where("token_hash = ?", tokenHash), &ev)
+	if err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+func (evg *emailVerificationGorm) Create(ev *emailVerification) error {
+	return evg.db.Create(ev).Error
+}
+
+func (evg *emailVerificationGorm) DeleteByUserID(userID uint) error {
+	return evg.db.Unscoped().Where("user_id = ?", userID).Delete(&emailVerification{}).Error
+}
+
+// Validator
+func (evv *emailVerificationValidator) ByToken(token string) (*emailVerification, error) {
+	ev := emailVerification{
+		Token: token,
+	}
+
+	err := runEmailVerificationValFns(&ev, evv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+	return evv.emailVerificationDB.ByToken(ev.TokenHash)
+}
+
+func (evv *emailVerificationValidator) Create(ev *emailVerification) error {
+	err := runEmailVerificationValFns(ev,
+		evv.requireUserID,
+		evv.requireEmail,
+		evv.setTokenIfUnset,
+		evv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return evv.emailVerificationDB.Create(ev)
+}
+
+func (evv *emailVerificationValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return evv.emailVerificationDB.DeleteByUserID(userID)
+}
+
+// validation funcs
+type emailVerificationValFn func(*emailVerification) error
+
+func (evv *emailVerificationValidator) requireUserID(ev *emailVerification) error {
+	if ev.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) requireEmail(ev *emailVerification) error {
+	if ev.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (evv *emailVerificationValidator) setTokenIfUnset(ev *emailVerification) error {
+	if ev.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	ev.Token = token
+	return nil
+}
+
+func (evv *emailVerificationValidator) hmacToken(ev *emailVerification) error {
+	if ev.Token == "" {
+		return ErrTokenInvalid
+	}
+
+	ev.TokenHash = evv.hmac.Hash(ev.Token)
+	return nil
+}
+
+// validation runner
+func runEmailVerificationValFns(ev *emailVerification, fns ...emailVerificationValFn) error {
+	for _, f := range fns {
+		if err := f(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
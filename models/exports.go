@@ -0,0 +1,286 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+	"time"
+)
+
+// Export statuses, in the order an export goes through them
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// ExportDuration is how long an export can be downloaded
+const ExportDuration = 7 * 24 * time.Hour
+
+const (
+	ErrExportPending modelError = "models: an export is already being prepared, we will email you when it is ready"
+)
+
+// Export is a ZIP of everything a user stored with us. It is
+// requested from the profile page and built in the background,
+// see package export. Only the HMAC of the download token is
+// stored, the token itself is emailed once the ZIP is ready.
+type Export struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null"`
+	Path      string
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"index"`
+	ExpiresAt *time.Time
+}
+
+// Expired reports whether the export can no longer be downloaded
+func (e *Export) Expired() bool {
+	return e.ExpiresAt != nil && time.Now().After(*e.ExpiresAt)
+}
+
+// ExportService is the set of methods used to
+// manage exports from outside the models package
+type ExportService interface {
+	// Request queues a new export for the user, unless one
+	// is already pending.
+	Request(userID uint) (*Export, error)
+
+	// Ready marks the export as built and stored at path, and
+	// sets a download token valid for ExportDuration.
+	Ready(e *Export, path string) error
+
+	// Download returns the ready export for token.
+	// ErrTokenExpired is returned once it expired.
+	Download(token string) (*Export, error)
+	ExportDB
+}
+
+// ExportDB is used to interact with the exports database
+type ExportDB interface {
+	ByToken(token string) (*Export, error)
+	ByUserID(userID uint) ([]Export, error)
+	// Pending returns the exports waiting to be built, oldest first
+	Pending() ([]Export, error)
+	// ExpiredBefore returns the ready exports that expired before t
+	ExpiredBefore(t time.Time) ([]Export, error)
+	Create(e *Export) error
+	Update(e *Export) error
+	Delete(id uint) error
+}
+
+type exportService struct {
+	ExportDB
+}
+
+type exportValidator struct {
+	ExportDB
+	hmac hash.HMAC
+}
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+var _ ExportService = &exportService{}
+var _ ExportDB = &exportValidator{}
+var _ ExportDB = &exportGorm{}
+
+func NewExportService(db *gorm.DB, hmacKey string) ExportService {
+	return &exportService{
+		ExportDB: &exportValidator{
+			ExportDB: &exportGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+func (es *exportService) Request(userID uint) (*Export, error) {
+	exports, err := es.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exports {
+		if e.Status == ExportPending {
+			return nil, ErrExportPending
+		}
+	}
+
+	e := Export{
+		UserID: userID,
+		Status: ExportPending,
+	}
+	if err := es.Create(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (es *exportService) Ready(e *Export, path string) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(ExportDuration)
+	e.Status = ExportReady
+	e.Path = path
+	e.Token = token
+	e.ExpiresAt = &expiresAt
+	return es.Update(e)
+}
+
+func (es *exportService) Download(token string) (*Export, error) {
+	e, err := es.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if e.Status != ExportReady {
+		return nil, ErrTokenInvalid
+	}
+	if e.Expired() {
+		return nil, ErrTokenExpired
+	}
+	return e, nil
+}
+
+// DB Implementation
+func (eg *exportGorm) ByToken(tokenHash string) (*Export, error) {
+	var e Export
+	err := first(eg.db.Where("token_hash = ?", tokenHash), &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ByUserID returns the exports of a user, newest first
+func (eg *exportGorm) ByUserID(userID uint) ([]Export, error) {
+	var exports []Export
+	db := eg.db.Where("user_id = ?", userID).Order("created_at desc")
+	err := db.Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) Pending() ([]Export, error) {
+	var exports []Export
+	db := eg.db.Where("status = ?", ExportPending).Order("created_at")
+	err := db.Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) ExpiredBefore(t time.Time) ([]Export, error) {
+	var exports []Export
+	db := eg.db.Where("status = ? AND expires_at < ?", ExportReady, t)
+	err := db.Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (eg *exportGorm) Create(e *Export) error {
+	return eg.db.Create(e).Error
+}
+
+func (eg *exportGorm) Update(e *Export) error {
+	return eg.db.Save(e).Error
+}
+
+// Delete removes the export for good, its file is gone by then
+func (eg *exportGorm) Delete(id uint) error {
+	e := Export{Model: gorm.Model{ID: id}}
+	return eg.db.Unscoped().Delete(&e).Error
+}
+
+// Validator implementation
+func (ev *exportValidator) ByToken(token string) (*Export, error) {
+	e := Export{
+		Token: token,
+	}
+
+	if err := runExportValFns(&e, ev.hmacToken); err != nil {
+		return nil, err
+	}
+	return ev.ExportDB.ByToken(e.TokenHash)
+}
+
+func (ev *exportValidator) Create(e *Export) error {
+	if err := runExportValFns(e, ev.requireUserID); err != nil {
+		return err
+	}
+	return ev.ExportDB.Create(e)
+}
+
+func (ev *exportValidator) Update(e *Export) error {
+	err := runExportValFns(e,
+		ev.nonZeroID,
+		ev.requireUserID,
+		ev.hmacTokenIfSet)
+	if err != nil {
+		return err
+	}
+	return ev.ExportDB.Update(e)
+}
+
+func (ev *exportValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return ev.ExportDB.Delete(id)
+}
+
+// Validation functions
+func (ev *exportValidator) nonZeroID(e *Export) error {
+	if e.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (ev *exportValidator) requireUserID(e *Export) error {
+	if e.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (ev *exportValidator) hmacToken(e *Export) error {
+	if e.Token == "" {
+		return ErrTokenInvalid
+	}
+
+	e.TokenHash = ev.hmac.Hash(e.Token)
+	return nil
+}
+
+func (ev *exportValidator) hmacTokenIfSet(e *Export) error {
+	if e.Token == "" {
+		return nil
+	}
+	return ev.hmacToken(e)
+}
+
+// Validator functions
+type exportValFn func(e *Export) error
+
+func runExportValFns(e *Export, fns ...exportValFn) error {
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -11,17 +11,23 @@ const (
 
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	// OrganizationID owns the gallery, UserID is who created it
+	OrganizationID uint    `gorm:"index"`
+	UserID         uint    `gorm:"not_null;index"`
+	Title          string  `gorm:"not_null"`
+	Images         []Image `gorm:"-"`
 }
 
+// GalleryService records changes in the audit log
 type GalleryService interface {
+	// As returns the service acting on behalf of actor
+	As(actor Actor) GalleryService
 	GalleryDB
 }
 
 type galleryService struct {
 	GalleryDB
+	audit auditRecorder
 }
 
 type galleryValidator struct {
@@ -30,10 +36,17 @@ type galleryValidator struct {
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
-	ByUserID(id uint) ([]Gallery, error)
+	ByOrganizationID(id uint) ([]Gallery, error)
+	// Page returns up to limit galleries of the organization,
+	// with an ID above after, in the order of IDs
+	Page(orgID uint, after uint, limit int) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Update(gallery *Gallery) error
 	Delete(id uint) error
+
+	// Purge removes the gallery for good, its images have to
+	// be deleted beforehand
+	Purge(id uint) error
 }
 
 type galleryGorm struct {
@@ -41,7 +54,7 @@ type galleryGorm struct {
 }
 
 var _ GalleryService = &galleryService{}
-var _ GalleryService = &galleryValidator{}
+var _ GalleryDB = &galleryValidator{}
 
 func NewGalleryService(db *gorm.DB) GalleryService {
 	return &galleryService{
@@ -50,7 +63,43 @@ func NewGalleryService(db *gorm.DB) GalleryService {
 				db: db,
 			},
 		},
+		audit: newAuditRecorder(db),
+	}
+}
+
+func (gs *galleryService) As(actor Actor) GalleryService {
+	scoped := *gs
+	scoped.audit.actor = actor
+	return &scoped
+}
+
+func (gs *galleryService) Create(gallery *Gallery) error {
+	if err := gs.GalleryDB.Create(gallery); err != nil {
+		return err
+	}
+	return gs.audit.record(AuditCreated, AuditGallery, gallery.ID, nil, gallery)
+}
+
+func (gs *galleryService) Update(gallery *Gallery) error {
+	before, err := gs.ByID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	if err := gs.GalleryDB.Update(gallery); err != nil {
+		return err
+	}
+	return gs.audit.record(AuditUpdated, AuditGallery, gallery.ID, before, gallery)
+}
+
+func (gs *galleryService) Delete(id uint) error {
+	before, err := gs.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := gs.GalleryDB.Delete(id); err != nil {
+		return err
 	}
+	return gs.audit.record(AuditDeleted, AuditGallery, id, before, nil)
 }
 
 func (g *Gallery) ImagesSplitN(n int) [][]Image {
@@ -89,9 +138,9 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &foundGallery, nil
 }
 
-func (gg *galleryGorm) ByUserID(id uint) ([]Gallery, error) {
+func (gg *galleryGorm) ByOrganizationID(id uint) ([]Gallery, error) {
 	var galleries []Gallery
-	db := gg.db.Where("user_id = ?", id)
+	db := gg.db.Where("organization_id = ?", id)
 	err := db.Find(&galleries).Error
 	if err != nil {
 		return nil, err
@@ -99,6 +148,16 @@ func (gg *galleryGorm) ByUserID(id uint) ([]Gallery, error) {
 	return galleries, nil
 }
 
+func (gg *galleryGorm) Page(orgID uint, after uint, limit int) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Where("organization_id = ? AND id > ?", orgID, after)
+	err := db.Order("id").Limit(limit).Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 func (gg *galleryGorm) Delete(id uint) error {
 	//var gallery Gallery
 	//gallery.ID = id
@@ -107,9 +166,14 @@ func (gg *galleryGorm) Delete(id uint) error {
 	return gg.db.Delete(&gallery).Error
 }
 
+func (gg *galleryGorm) Purge(id uint) error {
+	gallery := Gallery{Model: gorm.Model{ID: id}}
+	return gg.db.Unscoped().Delete(&gallery).Error
+}
+
 // Validations
 func (gv *galleryValidator) Create(gallery *Gallery) error {
-	err := runGalleryValFns(gallery, gv.userIDRequired, gv.titleRequired)
+	err := runGalleryValFns(gallery, gv.organizationIDRequired, gv.userIDRequired, gv.titleRequired)
 	if err != nil {
 		return err
 	}
@@ -142,6 +206,13 @@ func (gv *galleryValidator) userIDRequired(gallery *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) organizationIDRequired(gallery *Gallery) error {
+	if gallery.OrganizationID <= 0 {
+		return ErrOrganizationIDRequired
+	}
+	return nil
+}
+
 func (gv *galleryValidator) titleRequired(gallery *Gallery) error {
 	if gallery.Title == "" {
 		return ErrTitleRequired
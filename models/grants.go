@@ -0,0 +1,192 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+const (
+	ErrResourceRequired modelError = "models: resource is required"
+	ErrRoleRequired     modelError = "models: role is required"
+	ErrGrantExists      modelError = "models: this user already has access, revoke it first to change the role"
+)
+
+// Grant gives a user a role on a resource they don't own, such
+// as a property manager on someone else's property. Owners are
+// never stored here, ownership comes from the resource itself.
+// The roles and what they allow live in package authz.
+type Grant struct {
+	gorm.Model
+	UserID       uint   `gorm:"not null;unique_index:idx_grants_user_resource"`
+	ResourceType string `gorm:"not null;unique_index:idx_grants_user_resource;index:idx_grants_resource"`
+	ResourceID   uint   `gorm:"not null;unique_index:idx_grants_user_resource;index:idx_grants_resource"`
+	Role         string `gorm:"not null"`
+}
+
+// GrantDB is used to interact with the grants database
+type GrantDB interface {
+	ByID(id uint) (*Grant, error)
+	ByUserResource(userID uint, resourceType string, resourceID uint) (*Grant, error)
+	ByResource(resourceType string, resourceID uint) ([]Grant, error)
+	ByUserType(userID uint, resourceType string) ([]Grant, error)
+	Create(grant *Grant) error
+	Delete(id uint) error
+	DeleteByResource(resourceType string, resourceID uint) error
+	DeleteByUserID(userID uint) error
+}
+
+// GrantService has the same method as GrantDB
+type GrantService interface {
+	GrantDB
+}
+
+type grantService struct {
+	GrantDB
+}
+
+type grantValidator struct {
+	GrantDB
+}
+
+type grantGorm struct {
+	db *gorm.DB
+}
+
+var _ GrantService = &grantService{}
+var _ GrantDB = &grantValidator{}
+var _ GrantDB = &grantGorm{}
+
+func NewGrantService(db *gorm.DB) GrantService {
+	return &grantService{
+		GrantDB: &grantValidator{
+			GrantDB: &grantGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// DB Implementation
+func (gg *grantGorm) ByID(id uint) (*Grant, error) {
+	var grant Grant
+	err := first(gg.db.Where("id = ?", id), &grant)
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (gg *grantGorm) ByUserResource(userID uint, resourceType string, resourceID uint) (*Grant, error) {
+	var grant Grant
+	db := gg.db.Where("user_id = ? AND resource_type = ? AND resource_id = ?",
+		userID, resourceType, resourceID)
+	err := first(db, &grant)
+	if err != nil {
+		return nil, err
+	}
+	return &grant, nil
+}
+
+func (gg *grantGorm) ByResource(resourceType string, resourceID uint) ([]Grant, error) {
+	var grants []Grant
+	db := gg.db.Where("resource_type = ? AND resource_id = ?", resourceType, resourceID)
+	err := db.Order("created_at").Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// ByUserType returns the grants a user has on resources of one type
+func (gg *grantGorm) ByUserType(userID uint, resourceType string) ([]Grant, error) {
+	var grants []Grant
+	db := gg.db.Where("user_id = ? AND resource_type = ?", userID, resourceType)
+	err := db.Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+func (gg *grantGorm) Create(grant *Grant) error {
+	return gg.db.Create(grant).Error
+}
+
+// Delete removes the grant for good, revoked access
+// has no reason to be kept around.
+func (gg *grantGorm) Delete(id uint) error {
+	grant := Grant{Model: gorm.Model{ID: id}}
+	return gg.db.Unscoped().Delete(&grant).Error
+}
+
+func (gg *grantGorm) DeleteByResource(resourceType string, resourceID uint) error {
+	db := gg.db.Unscoped().Where("resource_type = ? AND resource_id = ?", resourceType, resourceID)
+	return db.Delete(&Grant{}).Error
+}
+
+func (gg *grantGorm) DeleteByUserID(userID uint) error {
+	return gg.db.Unscoped().Where("user_id = ?", userID).Delete(&Grant{}).Error
+}
+
+// Validator implementation
+func (gv *grantValidator) Create(grant *Grant) error {
+	err := runGrantValFns(grant,
+		gv.userIDRequired,
+		gv.resourceRequired,
+		gv.roleRequired,
+		gv.notGranted)
+	if err != nil {
+		return err
+	}
+	return gv.GrantDB.Create(grant)
+}
+
+func (gv *grantValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return gv.GrantDB.Delete(id)
+}
+
+// Validation functions
+func (gv *grantValidator) userIDRequired(g *Grant) error {
+	if g.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (gv *grantValidator) resourceRequired(g *Grant) error {
+	if g.ResourceType == "" || g.ResourceID <= 0 {
+		return ErrResourceRequired
+	}
+	return nil
+}
+
+func (gv *grantValidator) roleRequired(g *Grant) error {
+	if g.Role == "" {
+		return ErrRoleRequired
+	}
+	return nil
+}
+
+func (gv *grantValidator) notGranted(g *Grant) error {
+	_, err := gv.ByUserResource(g.UserID, g.ResourceType, g.ResourceID)
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return ErrGrantExists
+	default:
+		return err
+	}
+}
+
+// Validator functions
+type grantValidationFn func(g *Grant) error
+
+func runGrantValFns(g *Grant, fns ...grantValidationFn) error {
+	for _, fn := range fns {
+		if err := fn(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
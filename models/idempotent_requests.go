@@ -0,0 +1,205 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	// IdempotencyKeyTTL is how long the response to a request is
+	// kept for its retries, the key can be used again after that
+	IdempotencyKeyTTL = 24 * time.Hour
+
+	// maxIdempotencyKeyLen is the longest key accepted
+	maxIdempotencyKeyLen = 255
+)
+
+const (
+	ErrIdempotencyKeyTooLong  modelError = "models: idempotency key must be at most 255 characters"
+	ErrIdempotencyKeyReused   modelError = "models: idempotency key was already used for another request"
+	ErrIdempotencyKeyInFlight modelError = "models: a request with this idempotency key is still in progress"
+)
+
+// IdempotentRequest is an API request sent with an
+// Idempotency-Key header. Its response is kept so a retry of the
+// request gets it back instead of e.g. creating a second
+// property. Keys are per user, RequestHash tells whether a retry
+// is the same request. Status is 0 while the request runs.
+type IdempotentRequest struct {
+	gorm.Model
+	UserID      uint   `gorm:"not null;unique_index:idx_idempotent_request_key"`
+	Key         string `gorm:"not null;size:255;unique_index:idx_idempotent_request_key"`
+	RequestHash string `gorm:"not null"`
+	Status      int    `gorm:"not null;default:0"`
+	Body        []byte
+}
+
+// Done reports whether the response of the request is known
+func (ir *IdempotentRequest) Done() bool {
+	return ir.Status != 0
+}
+
+// IdempotencyService is the set of methods used to manage
+// idempotent requests from outside the models package
+type IdempotencyService interface {
+	// Begin claims the key of req for it. It returns nil when
+	// the request should run, and the earlier request with the
+	// key when its response should be sent again instead.
+	// ErrIdempotencyKeyReused and ErrIdempotencyKeyInFlight are
+	// returned when the key can't be used for req.
+	Begin(req *IdempotentRequest) (*IdempotentRequest, error)
+	// Finish records the response of a request claimed by Begin
+	Finish(req *IdempotentRequest, status int, body []byte) error
+	IdempotencyDB
+}
+
+// IdempotencyDB is used to interact with the idempotent requests
+// database
+type IdempotencyDB interface {
+	ByKey(userID uint, key string) (*IdempotentRequest, error)
+	// Create leaves the table alone when the user used the key
+	// before, req is then not given an ID.
+	Create(req *IdempotentRequest) error
+	Update(req *IdempotentRequest) error
+	// Delete forgets a request, e.g. one that failed, so it can
+	// be tried again with its key
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type idempotencyService struct {
+	IdempotencyDB
+}
+
+type idempotencyValidator struct {
+	IdempotencyDB
+}
+
+type idempotencyGorm struct {
+	db *gorm.DB
+}
+
+var _ IdempotencyService = &idempotencyService{}
+var _ IdempotencyDB = &idempotencyValidator{}
+var _ IdempotencyDB = &idempotencyGorm{}
+
+func NewIdempotencyService(db *gorm.DB) IdempotencyService {
+	return &idempotencyService{
+		IdempotencyDB: &idempotencyValidator{
+			IdempotencyDB: &idempotencyGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (is *idempotencyService) Begin(req *IdempotentRequest) (*IdempotentRequest, error) {
+	if err := is.Create(req); err != nil {
+		return nil, err
+	}
+	if req.ID != 0 {
+		return nil, nil
+	}
+
+	found, err := is.ByKey(req.UserID, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(found.CreatedAt) > IdempotencyKeyTTL {
+		// The key expired, it is free to use again
+		if err := is.Delete(found.ID); err != nil {
+			return nil, err
+		}
+		return is.Begin(req)
+	}
+	if found.RequestHash != req.RequestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !found.Done() {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+	return found, nil
+}
+
+func (is *idempotencyService) Finish(req *IdempotentRequest, status int, body []byte) error {
+	req.Status = status
+	req.Body = body
+	return is.Update(req)
+}
+
+// DB Implementation
+func (ig *idempotencyGorm) ByKey(userID uint, key string) (*IdempotentRequest, error) {
+	var req IdempotentRequest
+	db := ig.db.Where("user_id = ? AND key = ?", userID, key)
+	err := first(db, &req)
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (ig *idempotencyGorm) Create(req *IdempotentRequest) error {
+	db := ig.db.Set("gorm:insert_option", "ON CONFLICT (user_id, key) DO NOTHING")
+	return insertedOrSkipped(db.Create(req).Error)
+}
+
+func (ig *idempotencyGorm) Update(req *IdempotentRequest) error {
+	return ig.db.Save(req).Error
+}
+
+func (ig *idempotencyGorm) Delete(id uint) error {
+	req := IdempotentRequest{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&req).Error
+}
+
+func (ig *idempotencyGorm) DeleteByUserID(userID uint) error {
+	return ig.db.Unscoped().Where("user_id = ?", userID).Delete(&IdempotentRequest{}).Error
+}
+
+// Validator implementation
+func (iv *idempotencyValidator) Create(req *IdempotentRequest) error {
+	err := runIdempotencyValFns(req,
+		iv.requireUserID,
+		iv.requireKey)
+	if err != nil {
+		return err
+	}
+	return iv.IdempotencyDB.Create(req)
+}
+
+func (iv *idempotencyValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.IdempotencyDB.Delete(id)
+}
+
+// Validation functions
+func (iv *idempotencyValidator) requireUserID(req *IdempotentRequest) error {
+	if req.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *idempotencyValidator) requireKey(req *IdempotentRequest) error {
+	if req.Key == "" {
+		return ErrIdempotencyKeyRequired
+	}
+	if len(req.Key) > maxIdempotencyKeyLen {
+		return ErrIdempotencyKeyTooLong
+	}
+	return nil
+}
+
+// Validator functions
+type idempotencyValFn func(req *IdempotentRequest) error
+
+func runIdempotencyValFns(req *IdempotentRequest, fns ...idempotencyValFn) error {
+	for _, fn := range fns {
+		if err := fn(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
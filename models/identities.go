@@ -0,0 +1,174 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+const (
+	ErrProviderRequired modelError = "models: identity provider is required"
+	ErrSubjectRequired  modelError = "models: identity subject is required"
+	ErrIdentityTaken    modelError = "models: this account is already linked to another user"
+	ErrIdentityLinked   modelError = "models: this account is already linked to your profile"
+)
+
+// Identity links an account at an external OpenID Connect
+// provider to a User. A provider account can only be linked
+// to a single user.
+type Identity struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	Provider string `gorm:"not null;unique_index:idx_identities_provider_subject"`
+	Subject  string `gorm:"not null;unique_index:idx_identities_provider_subject"`
+	Email    string
+}
+
+// IdentityDB is used to interact with the identities database
+type IdentityDB interface {
+	ByID(id uint) (*Identity, error)
+	ByProviderSubject(provider, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+	Create(identity *Identity) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+// IdentityService has the same method as IdentityDB
+type IdentityService interface {
+	IdentityDB
+}
+
+type identityService struct {
+	IdentityDB
+}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+var _ IdentityService = &identityService{}
+var _ IdentityDB = &identityValidator{}
+var _ IdentityDB = &identityGorm{}
+
+func NewIdentityService(db *gorm.DB) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// DB Implementation
+func (ig *identityGorm) ByID(id uint) (*Identity, error) {
+	var identity Identity
+	err := first(ig.db.Where("id = ?", id), &identity)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByProviderSubject(provider, subject string) (*Identity, error) {
+	var identity Identity
+	db := ig.db.Where("provider = ? AND subject = ?", provider, subject)
+	err := first(db, &identity)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	err := ig.db.Where("user_id = ?", userID).Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return ig.db.Create(identity).Error
+}
+
+// Delete removes the link for good, so the provider account
+// can be linked again later.
+func (ig *identityGorm) Delete(id uint) error {
+	identity := Identity{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&identity).Error
+}
+
+func (ig *identityGorm) DeleteByUserID(userID uint) error {
+	return ig.db.Unscoped().Where("user_id = ?", userID).Delete(&Identity{}).Error
+}
+
+// Validator implementation
+func (iv *identityValidator) Create(identity *Identity) error {
+	err := runIdentityValFns(identity,
+		iv.userIDRequired,
+		iv.providerRequired,
+		iv.subjectRequired,
+		iv.subjectIsAvail)
+	if err != nil {
+		return err
+	}
+	return iv.IdentityDB.Create(identity)
+}
+
+func (iv *identityValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.IdentityDB.Delete(id)
+}
+
+// Validation functions
+func (iv *identityValidator) userIDRequired(i *Identity) error {
+	if i.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) providerRequired(i *Identity) error {
+	if i.Provider == "" {
+		return ErrProviderRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) subjectRequired(i *Identity) error {
+	if i.Subject == "" {
+		return ErrSubjectRequired
+	}
+	return nil
+}
+
+func (iv *identityValidator) subjectIsAvail(i *Identity) error {
+	existing, err := iv.ByProviderSubject(i.Provider, i.Subject)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if existing.UserID != i.UserID {
+		return ErrIdentityTaken
+	}
+	return ErrIdentityLinked
+}
+
+// Validator functions
+type identityValidationFn func(i *Identity) error
+
+func runIdentityValFns(i *Identity, fns ...identityValidationFn) error {
+	for _, fn := range fns {
+		if err := fn(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
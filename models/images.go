@@ -13,6 +13,14 @@ const (
 	ErrImageInvalidPath modelError = "Error"
 )
 
+// ExternalType of the images, telling what they are attached to
+const (
+	GalleryImageKey  = "galleries"
+	LeaseDocumentKey = "leases"
+	TicketPhotoKey   = "tickets"
+	TicketCommentKey = "ticket_comments"
+)
+
 // Image is used to represent images stored in a Gallery
 // It is not stored in DB, the referenced data is stored
 // on disk.
@@ -22,6 +30,9 @@ type Image struct {
 	ExternalID   uint   `gorm:"external_id, not_null"`
 	Filename     string `gorm:"filename, not_null"`
 	Location     string `gorm:"location, not_null"`
+	// UserID uploaded the image, Size is its length in bytes
+	UserID uint  `gorm:"index"`
+	Size   int64 `gorm:"not null;default:0"`
 }
 
 func (i *Image) Path() string {
@@ -36,14 +47,23 @@ func (i *Image) RelativePath() string {
 	return filepath.ToSlash(filepath.Join("images", i.ExternalType, externalID, i.Filename))
 }
 
-// ImageService is the definition of image service operation
+// ImageService is the definition of image service operation,
+// changes are recorded in the audit log
 type ImageService interface {
+	// As returns the service acting on behalf of actor
+	As(actor Actor) ImageService
 	ImageDB
 }
 
 type ImageDB interface {
 	Create(image *Image, r io.Reader) error
 	ByExternalTypeAndID(ExternalType string, ExternalID uint) ([]Image, error)
+	// Page returns up to limit images of the external type and
+	// ID, with an ID above after, in the order of IDs
+	Page(externalType string, externalID uint, after uint, limit int) ([]Image, error)
+	// UsageByUserID returns how many images a user uploaded and
+	// how many bytes they take.
+	UsageByUserID(userID uint) (int, int64, error)
 	Delete(i *Image) error
 }
 
@@ -51,6 +71,7 @@ type imageService struct {
 	ImageDomainName string
 	Storage         store.StoreProvider
 	ImageDB
+	audit auditRecorder
 }
 
 type imageValidator struct {
@@ -70,9 +91,16 @@ func NewImageService(storage store.StoreProvider, db *gorm.DB, imageDomainName s
 		},
 		Storage:         storage,
 		ImageDomainName: imageDomainName,
+		audit:           newAuditRecorder(db),
 	}
 }
 
+func (im *imageService) As(actor Actor) ImageService {
+	scoped := *im
+	scoped.audit.actor = actor
+	return &scoped
+}
+
 func (im *imageService) imagePath(externalType string, externalID uint) string {
 	return filepath.Join("images", externalType, fmt.Sprintf("%v", externalID))
 }
@@ -80,17 +108,21 @@ func (im *imageService) imagePath(externalType string, externalID uint) string {
 func (im *imageService) Create(image *Image, r io.Reader) error {
 	imagePath := im.imagePath(image.ExternalType, image.ExternalID)
 
-	resultPath, err := im.Storage.Store(imagePath, image.Filename, r)
+	counter := &countingReader{r: r}
+	resultPath, err := im.Storage.Store(imagePath, image.Filename, counter)
 
 	if err != nil {
 		return err
 	}
+	image.Size = counter.n
 
 	image.Location = filepath.Join(im.ImageDomainName, resultPath)
 
-	err = im.ImageDB.Create(image, r)
+	if err := im.ImageDB.Create(image, r); err != nil {
+		return err
+	}
 
-	return nil
+	return im.audit.record(AuditCreated, AuditImage, image.ID, nil, image)
 }
 
 func (im *imageService) Delete(i *Image) error {
@@ -102,7 +134,11 @@ func (im *imageService) Delete(i *Image) error {
 
 	i.Location = i.RelativePath()
 
-	return im.ImageDB.Delete(i)
+	if err := im.ImageDB.Delete(i); err != nil {
+		return err
+	}
+
+	return im.audit.record(AuditDeleted, AuditImage, i.ID, i, nil)
 }
 
 func (im *imageService) ByExternalTypeAndID(externalType string, externalID uint) ([]Image, error) {
@@ -130,6 +166,27 @@ func (ig *imageGorm) ByExternalTypeAndID(externalType string, externalID uint) (
 	return images, nil
 }
 
+func (ig *imageGorm) Page(externalType string, externalID uint, after uint, limit int) ([]Image, error) {
+	var images []Image
+	db := ig.db.Where("external_type = ? AND external_id = ? AND id > ?", externalType, externalID, after)
+	err := db.Order("id").Limit(limit).Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) UsageByUserID(userID uint) (int, int64, error) {
+	var count int
+	var size int64
+	row := ig.db.Model(&Image{}).Where("user_id = ?", userID).
+		Select("count(*), coalesce(sum(size), 0)").Row()
+	if err := row.Scan(&count, &size); err != nil {
+		return 0, 0, err
+	}
+	return count, size, nil
+}
+
 func (ig *imageGorm) Delete(i *Image) error {
 	var image Image
 	db := ig.db.Where(i)
@@ -137,6 +194,20 @@ func (ig *imageGorm) Delete(i *Image) error {
 	if err != nil {
 		return err
 	}
+	// Let the caller know which image went
+	i.ID = image.ID
 
 	return db.Delete(image).Error
 }
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,306 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// InvitationDuration is how long an invitation can be accepted
+const InvitationDuration = 7 * 24 * time.Hour
+
+const (
+	ErrInvitationPending modelError = "models: this email address has already been invited"
+)
+
+// Invitation asks someone, by email, to take a role on a
+// resource. Accepting it turns it into a grant, see package authz.
+type Invitation struct {
+	gorm.Model
+	ResourceType string `gorm:"not null;index:idx_invitations_resource"`
+	ResourceID   uint   `gorm:"not null;index:idx_invitations_resource"`
+	Email        string `gorm:"not null"`
+	Role         string `gorm:"not null"`
+	InvitedByID  uint   `gorm:"not null"`
+	Token        string `gorm:"-"`
+	TokenHash    string `gorm:"not null;unique_index"`
+	ExpiresAt    time.Time
+}
+
+// Expired reports whether the invitation can no longer be accepted
+func (i *Invitation) Expired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// InvitationService is the set of methods used to
+// manage invitations from outside the models package
+type InvitationService interface {
+	// Pending returns the invitation for token, if it can
+	// still be accepted.
+	Pending(token string) (*Invitation, error)
+
+	// Renew replaces the token of the invitation and restarts
+	// its expiry, for sending it again.
+	Renew(inv *Invitation) error
+	InvitationDB
+}
+
+// InvitationDB is used to interact with the invitations database
+type InvitationDB interface {
+	ByID(id uint) (*Invitation, error)
+	ByToken(token string) (*Invitation, error)
+	ByResource(resourceType string, resourceID uint) ([]Invitation, error)
+	Create(inv *Invitation) error
+	Update(inv *Invitation) error
+	Delete(id uint) error
+}
+
+type invitationService struct {
+	InvitationDB
+}
+
+type invitationValidator struct {
+	InvitationDB
+	hmac       hash.HMAC
+	emailRegex *regexp.Regexp
+}
+
+type invitationGorm struct {
+	db *gorm.DB
+}
+
+var _ InvitationService = &invitationService{}
+var _ InvitationDB = &invitationValidator{}
+var _ InvitationDB = &invitationGorm{}
+
+func NewInvitationService(db *gorm.DB, hmacKey string) InvitationService {
+	return &invitationService{
+		InvitationDB: &invitationValidator{
+			InvitationDB: &invitationGorm{
+				db: db,
+			},
+			hmac:       hash.NewHMAC(hmacKey),
+			emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
+		},
+	}
+}
+
+func (is *invitationService) Pending(token string) (*Invitation, error) {
+	inv, err := is.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if inv.Expired() {
+		return nil, ErrTokenExpired
+	}
+	return inv, nil
+}
+
+func (is *invitationService) Renew(inv *Invitation) error {
+	inv.Token = ""
+	inv.ExpiresAt = time.Time{}
+	return is.Update(inv)
+}
+
+// DB Implementation
+func (ig *invitationGorm) ByID(id uint) (*Invitation, error) {
+	var inv Invitation
+	err := first(ig.db.Where("id = ?", id), &inv)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (ig *invitationGorm) ByToken(tokenHash string) (*Invitation, error) {
+	var inv Invitation
+	err := first(ig.db.Where("token_hash = ?", tokenHash), &inv)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (ig *invitationGorm) ByResource(resourceType string, resourceID uint) ([]Invitation, error) {
+	var invs []Invitation
+	db := ig.db.Where("resource_type = ? AND resource_id = ?", resourceType, resourceID)
+	err := db.Order("created_at").Find(&invs).Error
+	if err != nil {
+		return nil, err
+	}
+	return invs, nil
+}
+
+func (ig *invitationGorm) Create(inv *Invitation) error {
+	return ig.db.Create(inv).Error
+}
+
+func (ig *invitationGorm) Update(inv *Invitation) error {
+	return ig.db.Save(inv).Error
+}
+
+// Delete removes the invitation for good, once accepted or
+// revoked it has no reason to be kept around.
+func (ig *invitationGorm) Delete(id uint) error {
+	inv := Invitation{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&inv).Error
+}
+
+// Validator implementation
+func (iv *invitationValidator) ByToken(token string) (*Invitation, error) {
+	inv := Invitation{
+		Token: token,
+	}
+
+	if err := runInvitationValFns(&inv, iv.hmacToken); err != nil {
+		return nil, err
+	}
+	return iv.InvitationDB.ByToken(inv.TokenHash)
+}
+
+func (iv *invitationValidator) Create(inv *Invitation) error {
+	err := runInvitationValFns(inv,
+		iv.resourceRequired,
+		iv.invitedByRequired,
+		iv.roleRequired,
+		iv.normalizeEmail,
+		iv.emailRequired,
+		iv.emailFormat,
+		iv.notPending,
+		iv.setTokenIfUnset,
+		iv.hmacToken,
+		iv.setExpiryIfUnset)
+	if err != nil {
+		return err
+	}
+	return iv.InvitationDB.Create(inv)
+}
+
+func (iv *invitationValidator) Update(inv *Invitation) error {
+	err := runInvitationValFns(inv,
+		iv.nonZeroID,
+		iv.setTokenIfUnset,
+		iv.hmacToken,
+		iv.setExpiryIfUnset)
+	if err != nil {
+		return err
+	}
+	return iv.InvitationDB.Update(inv)
+}
+
+func (iv *invitationValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return iv.InvitationDB.Delete(id)
+}
+
+// Validation functions
+func (iv *invitationValidator) nonZeroID(inv *Invitation) error {
+	if inv.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (iv *invitationValidator) resourceRequired(inv *Invitation) error {
+	if inv.ResourceType == "" || inv.ResourceID <= 0 {
+		return ErrResourceRequired
+	}
+	return nil
+}
+
+func (iv *invitationValidator) invitedByRequired(inv *Invitation) error {
+	if inv.InvitedByID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (iv *invitationValidator) roleRequired(inv *Invitation) error {
+	if inv.Role == "" {
+		return ErrRoleRequired
+	}
+	return nil
+}
+
+func (iv *invitationValidator) normalizeEmail(inv *Invitation) error {
+	inv.Email = strings.ToLower(strings.TrimSpace(inv.Email))
+	return nil
+}
+
+func (iv *invitationValidator) emailRequired(inv *Invitation) error {
+	if inv.Email == "" {
+		return ErrEmailRequired
+	}
+	return nil
+}
+
+func (iv *invitationValidator) emailFormat(inv *Invitation) error {
+	if !iv.emailRegex.MatchString(inv.Email) {
+		return ErrEmailInvalid
+	}
+	return nil
+}
+
+// notPending rejects a second invitation for the same address,
+// the first one can be sent again instead.
+func (iv *invitationValidator) notPending(inv *Invitation) error {
+	invs, err := iv.ByResource(inv.ResourceType, inv.ResourceID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range invs {
+		if existing.Email == inv.Email && !existing.Expired() {
+			return ErrInvitationPending
+		}
+	}
+	return nil
+}
+
+func (iv *invitationValidator) setTokenIfUnset(inv *Invitation) error {
+	if inv.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	inv.Token = token
+	return nil
+}
+
+func (iv *invitationValidator) hmacToken(inv *Invitation) error {
+	if inv.Token == "" {
+		return ErrTokenInvalid
+	}
+
+	inv.TokenHash = iv.hmac.Hash(inv.Token)
+	return nil
+}
+
+func (iv *invitationValidator) setExpiryIfUnset(inv *Invitation) error {
+	if inv.ExpiresAt.IsZero() {
+		inv.ExpiresAt = time.Now().Add(InvitationDuration)
+	}
+	return nil
+}
+
+// Validator functions
+type invitationValFn func(inv *Invitation) error
+
+func runInvitationValFns(inv *Invitation, fns ...invitationValFn) error {
+	for _, fn := range fns {
+		if err := fn(inv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
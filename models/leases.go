@@ -0,0 +1,268 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	ErrPropertyIDRequired modelError = "models: property ID is required"
+	ErrTenantRequired     modelError = "models: tenant is required"
+	ErrLeaseStartRequired modelError = "models: lease start date is required"
+	ErrLeaseEndInvalid    modelError = "models: lease must end after it starts"
+	ErrRentInvalid        modelError = "models: rent can't be negative"
+)
+
+// Lease is a tenant renting a property. Tenants only ever see
+// what belongs to their lease, see middleware.RequireTenant.
+type Lease struct {
+	gorm.Model
+	PropertyID uint `gorm:"not null;index"`
+	TenantID   uint `gorm:"not null;index"`
+	StartsOn   time.Time
+	EndsOn     *time.Time
+	Rent       Money
+}
+
+// Active reports whether the lease runs at t
+func (l *Lease) Active(t time.Time) bool {
+	if t.Before(l.StartsOn) {
+		return false
+	}
+	return l.EndsOn == nil || t.Before(l.EndsOn.AddDate(0, 0, 1))
+}
+
+// RentDueOn returns the next day rent is due on, from t. Rent
+// is due monthly on the day of the month the lease started, or
+// on the last day of shorter months.
+func (l *Lease) RentDueOn(t time.Time) time.Time {
+	today := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	dueOn := func(year int, month time.Month) time.Time {
+		day := l.StartsOn.Day()
+		if last := time.Date(year, month+1, 0, 0, 0, 0, 0, t.Location()).Day(); day > last {
+			day = last
+		}
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+
+	due := dueOn(today.Year(), today.Month())
+	if due.Before(today) {
+		due = dueOn(today.Year(), today.Month()+1)
+	}
+	return due
+}
+
+// LeaseService is the set of methods used to
+// manage leases from outside the models package
+type LeaseService interface {
+	// Current returns the lease the tenant lives under today, or
+	// the one they move in next. ErrNotFound is returned for
+	// users who don't rent anything.
+	Current(tenantID uint) (*Lease, error)
+	LeaseDB
+}
+
+// LeaseDB is used to interact with the leases database
+type LeaseDB interface {
+	ByID(id uint) (*Lease, error)
+	ByTenantID(tenantID uint) ([]Lease, error)
+	ByPropertyID(propertyID uint) ([]Lease, error)
+	// Running returns the leases running on the day of t
+	Running(t time.Time) ([]Lease, error)
+	Create(lease *Lease) error
+	Update(lease *Lease) error
+	Delete(id uint) error
+}
+
+type leaseService struct {
+	LeaseDB
+}
+
+type leaseValidator struct {
+	LeaseDB
+}
+
+type leaseGorm struct {
+	db *gorm.DB
+}
+
+var _ LeaseService = &leaseService{}
+var _ LeaseDB = &leaseValidator{}
+var _ LeaseDB = &leaseGorm{}
+
+func NewLeaseService(db *gorm.DB) LeaseService {
+	return &leaseService{
+		LeaseDB: &leaseValidator{
+			LeaseDB: &leaseGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (ls *leaseService) Current(tenantID uint) (*Lease, error) {
+	leases, err := ls.ByTenantID(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leases are ordered by start, latest first
+	now := time.Now()
+	var next *Lease
+	for i := range leases {
+		if leases[i].Active(now) {
+			return &leases[i], nil
+		}
+		if leases[i].StartsOn.After(now) {
+			next = &leases[i]
+		}
+	}
+	if next == nil {
+		return nil, ErrNotFound
+	}
+	return next, nil
+}
+
+// DB Implementation
+func (lg *leaseGorm) ByID(id uint) (*Lease, error) {
+	var lease Lease
+	err := first(lg.db.Where("id = ?", id), &lease)
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (lg *leaseGorm) ByTenantID(tenantID uint) ([]Lease, error) {
+	var leases []Lease
+	db := lg.db.Where("tenant_id = ?", tenantID).Order("starts_on desc")
+	err := db.Find(&leases).Error
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (lg *leaseGorm) ByPropertyID(propertyID uint) ([]Lease, error) {
+	var leases []Lease
+	db := lg.db.Where("property_id = ?", propertyID).Order("starts_on desc")
+	err := db.Find(&leases).Error
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (lg *leaseGorm) Running(t time.Time) ([]Lease, error) {
+	var leases []Lease
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	db := lg.db.Where("starts_on < ? AND (ends_on IS NULL OR ends_on >= ?)", day.AddDate(0, 0, 1), day)
+	err := db.Find(&leases).Error
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+func (lg *leaseGorm) Create(lease *Lease) error {
+	return lg.db.Create(lease).Error
+}
+
+func (lg *leaseGorm) Update(lease *Lease) error {
+	return lg.db.Save(lease).Error
+}
+
+func (lg *leaseGorm) Delete(id uint) error {
+	lease := Lease{Model: gorm.Model{ID: id}}
+	return lg.db.Delete(&lease).Error
+}
+
+// Validator implementation
+func (lv *leaseValidator) Create(lease *Lease) error {
+	err := runLeaseValFns(lease,
+		lv.propertyIDRequired,
+		lv.tenantRequired,
+		lv.startRequired,
+		lv.endAfterStart,
+		lv.rentNotNegative)
+	if err != nil {
+		return err
+	}
+	return lv.LeaseDB.Create(lease)
+}
+
+func (lv *leaseValidator) Update(lease *Lease) error {
+	err := runLeaseValFns(lease,
+		lv.nonZeroID,
+		lv.propertyIDRequired,
+		lv.tenantRequired,
+		lv.startRequired,
+		lv.endAfterStart,
+		lv.rentNotNegative)
+	if err != nil {
+		return err
+	}
+	return lv.LeaseDB.Update(lease)
+}
+
+func (lv *leaseValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return lv.LeaseDB.Delete(id)
+}
+
+// Validation functions
+func (lv *leaseValidator) nonZeroID(lease *Lease) error {
+	if lease.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (lv *leaseValidator) propertyIDRequired(lease *Lease) error {
+	if lease.PropertyID <= 0 {
+		return ErrPropertyIDRequired
+	}
+	return nil
+}
+
+func (lv *leaseValidator) tenantRequired(lease *Lease) error {
+	if lease.TenantID <= 0 {
+		return ErrTenantRequired
+	}
+	return nil
+}
+
+func (lv *leaseValidator) startRequired(lease *Lease) error {
+	if lease.StartsOn.IsZero() {
+		return ErrLeaseStartRequired
+	}
+	return nil
+}
+
+func (lv *leaseValidator) endAfterStart(lease *Lease) error {
+	if lease.EndsOn != nil && lease.EndsOn.Before(lease.StartsOn) {
+		return ErrLeaseEndInvalid
+	}
+	return nil
+}
+
+func (lv *leaseValidator) rentNotNegative(lease *Lease) error {
+	if lease.Rent < 0 {
+		return ErrRentInvalid
+	}
+	return nil
+}
+
+// Validator functions
+type leaseValFn func(lease *Lease) error
+
+func runLeaseValFns(lease *Lease, fns ...leaseValFn) error {
+	for _, fn := range fns {
+		if err := fn(lease); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ErrAmountInvalid       modelError = "models: amount is not valid"
+	ErrAmountRequired      modelError = "models: amount is required"
+	ErrLeaseIDRequired     modelError = "models: lease ID is required"
+	ErrDescriptionRequired modelError = "models: description is required"
+)
+
+// Money is an amount in cents, so sums are exact
+type Money int64
+
+// ParseMoney reads an amount such as "1250" or "-12.50"
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || s == "" {
+		return 0, ErrAmountInvalid
+	}
+	if f < 0 {
+		return Money(f*100 - 0.5), nil
+	}
+	return Money(f*100 + 0.5), nil
+}
+
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign = "-"
+		m = -m
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, m/100, m%100)
+}
+
+// LedgerEntry is a line on the account of a lease. Charges,
+// such as rent, are positive, payments are negative, so the
+// balance is what the tenant owes.
+type LedgerEntry struct {
+	gorm.Model
+	LeaseID     uint `gorm:"not null;index"`
+	PostedOn    time.Time
+	Description string `gorm:"not null"`
+	Amount      Money  `gorm:"not null"`
+}
+
+// LedgerService is the set of methods used to
+// manage ledger entries from outside the models package
+type LedgerService interface {
+	// Balance returns what is owed on the lease
+	Balance(leaseID uint) (Money, error)
+	LedgerDB
+}
+
+// LedgerDB is used to interact with the ledger_entries database
+type LedgerDB interface {
+	ByID(id uint) (*LedgerEntry, error)
+	ByLeaseID(leaseID uint) ([]LedgerEntry, error)
+	Create(entry *LedgerEntry) error
+	Delete(id uint) error
+}
+
+type ledgerService struct {
+	LedgerDB
+}
+
+type ledgerValidator struct {
+	LedgerDB
+}
+
+type ledgerGorm struct {
+	db *gorm.DB
+}
+
+var _ LedgerService = &ledgerService{}
+var _ LedgerDB = &ledgerValidator{}
+var _ LedgerDB = &ledgerGorm{}
+
+func NewLedgerService(db *gorm.DB) LedgerService {
+	return &ledgerService{
+		LedgerDB: &ledgerValidator{
+			LedgerDB: &ledgerGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (ls *ledgerService) Balance(leaseID uint) (Money, error) {
+	entries, err := ls.ByLeaseID(leaseID)
+	if err != nil {
+		return 0, err
+	}
+	var balance Money
+	for _, e := range entries {
+		balance += e.Amount
+	}
+	return balance, nil
+}
+
+// DB Implementation
+func (lg *ledgerGorm) ByID(id uint) (*LedgerEntry, error) {
+	var entry LedgerEntry
+	err := first(lg.db.Where("id = ?", id), &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ByLeaseID returns the entries of a lease, latest first
+func (lg *ledgerGorm) ByLeaseID(leaseID uint) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+	db := lg.db.Where("lease_id = ?", leaseID).Order("posted_on desc, id desc")
+	err := db.Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (lg *ledgerGorm) Create(entry *LedgerEntry) error {
+	return lg.db.Create(entry).Error
+}
+
+func (lg *ledgerGorm) Delete(id uint) error {
+	entry := LedgerEntry{Model: gorm.Model{ID: id}}
+	return lg.db.Delete(&entry).Error
+}
+
+// Validator implementation
+func (lv *ledgerValidator) Create(entry *LedgerEntry) error {
+	err := runLedgerValFns(entry,
+		lv.leaseIDRequired,
+		lv.normalizeDescription,
+		lv.descriptionRequired,
+		lv.amountRequired,
+		lv.setPostedOnIfUnset)
+	if err != nil {
+		return err
+	}
+	return lv.LedgerDB.Create(entry)
+}
+
+func (lv *ledgerValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return lv.LedgerDB.Delete(id)
+}
+
+// Validation functions
+func (lv *ledgerValidator) leaseIDRequired(entry *LedgerEntry) error {
+	if entry.LeaseID <= 0 {
+		return ErrLeaseIDRequired
+	}
+	return nil
+}
+
+func (lv *ledgerValidator) normalizeDescription(entry *LedgerEntry) error {
+	entry.Description = strings.TrimSpace(entry.Description)
+	return nil
+}
+
+func (lv *ledgerValidator) descriptionRequired(entry *LedgerEntry) error {
+	if entry.Description == "" {
+		return ErrDescriptionRequired
+	}
+	return nil
+}
+
+func (lv *ledgerValidator) amountRequired(entry *LedgerEntry) error {
+	if entry.Amount == 0 {
+		return ErrAmountRequired
+	}
+	return nil
+}
+
+func (lv *ledgerValidator) setPostedOnIfUnset(entry *LedgerEntry) error {
+	if entry.PostedOn.IsZero() {
+		entry.PostedOn = time.Now()
+	}
+	return nil
+}
+
+// Validator functions
+type ledgerValFn func(entry *LedgerEntry) error
+
+func runLedgerValFns(entry *LedgerEntry, fns ...ledgerValFn) error {
+	for _, fn := range fns {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
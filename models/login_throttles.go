@@ -0,0 +1,223 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	// ErrLoginThrottled is returned while a client has to wait before the next attempt
+	ErrLoginThrottled modelError = "models: too many failed attempts, please wait a moment and try again"
+
+	// ErrAccountLocked is returned while an account is locked out
+	ErrAccountLocked modelError = "models: too many failed attempts, signing in is temporarily disabled"
+
+	// failureWindow is how long failures are remembered. A key
+	// without failures for that long starts from zero again.
+	failureWindow = time.Hour
+
+	// maxBackoff caps the exponential delay between attempts
+	maxBackoff = 15 * time.Minute
+)
+
+// throttlePolicy describes how failures of a kind of key are punished
+type throttlePolicy struct {
+	// free is the number of failures allowed without any delay
+	free int
+
+	// lockAfter is the number of failures that locks the key
+	// completely for lockFor. Zero means the key is never locked.
+	lockAfter int
+	lockFor   time.Duration
+}
+
+var (
+	accountPolicy = throttlePolicy{free: 3, lockAfter: 10, lockFor: 30 * time.Minute}
+	ipPolicy      = throttlePolicy{free: 10}
+)
+
+// loginThrottle counts failed logins for a single key, either
+// an email address or a client IP.
+type loginThrottle struct {
+	gorm.Model
+	Key           string `gorm:"not null;unique_index"`
+	Failures      int    `gorm:"not null"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// backoff returns how long the key has to wait after its last failure
+func (lt *loginThrottle) backoff(p throttlePolicy) time.Duration {
+	n := lt.Failures - p.free
+	if n < 0 {
+		return 0
+	}
+	if n > 10 {
+		return maxBackoff
+	}
+
+	d := time.Second << uint(n)
+	if d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
+
+func (lt *loginThrottle) locked(now time.Time) bool {
+	return lt.LockedUntil != nil && now.Before(*lt.LockedUntil)
+}
+
+// LoginThrottleService slows down password guessing, both
+// against a single account and from a single client. Keys are
+// tracked whether or not an account exists for the email, so
+// the responses do not tell registered addresses apart.
+type LoginThrottleService interface {
+	// Check returns ErrLoginThrottled or ErrAccountLocked if a
+	// login for email from ip must not be attempted right now.
+	Check(email, ip string) error
+
+	// Failure records a failed login. If it caused the account
+	// to be locked, the end of the lockout is returned, otherwise
+	// the returned time is zero.
+	Failure(email, ip string) (time.Time, error)
+
+	// Success clears the failures recorded for email
+	Success(email string) error
+}
+
+// LoginThrottleDB stores the failure counters of the throttle keys
+type LoginThrottleDB interface {
+	// ByKey returns the throttle for key, or ErrNotFound
+	ByKey(key string) (*loginThrottle, error)
+	Save(lt *loginThrottle) error
+	Delete(key string) error
+}
+
+type loginThrottleService struct {
+	LoginThrottleDB
+
+	// now returns the current time, tests replace it
+	now func() time.Time
+}
+
+type loginThrottleGorm struct {
+	db *gorm.DB
+}
+
+var _ LoginThrottleService = &loginThrottleService{}
+var _ LoginThrottleDB = &loginThrottleGorm{}
+
+func NewLoginThrottleService(db *gorm.DB) LoginThrottleService {
+	return &loginThrottleService{
+		LoginThrottleDB: &loginThrottleGorm{db},
+		now:             time.Now,
+	}
+}
+
+func (lts *loginThrottleService) Check(email, ip string) error {
+	now := lts.now()
+
+	account, err := lts.byKey(accountKey(email))
+	if err != nil {
+		return err
+	}
+	if account.locked(now) {
+		return ErrAccountLocked
+	}
+
+	if now.Before(account.LastFailureAt.Add(account.backoff(accountPolicy))) {
+		return ErrLoginThrottled
+	}
+
+	client, err := lts.byKey(ipKey(ip))
+	if err != nil {
+		return err
+	}
+	if now.Before(client.LastFailureAt.Add(client.backoff(ipPolicy))) {
+		return ErrLoginThrottled
+	}
+
+	return nil
+}
+
+func (lts *loginThrottleService) Failure(email, ip string) (time.Time, error) {
+	if _, err := lts.fail(ipKey(ip), ipPolicy); err != nil {
+		return time.Time{}, err
+	}
+	return lts.fail(accountKey(email), accountPolicy)
+}
+
+func (lts *loginThrottleService) Success(email string) error {
+	return lts.Delete(accountKey(email))
+}
+
+// fail records one failure for key and locks it if the policy
+// says so. It returns the end of a lock set by this failure.
+func (lts *loginThrottleService) fail(key string, p throttlePolicy) (time.Time, error) {
+	now := lts.now()
+
+	lt, err := lts.byKey(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	lockExpired := lt.LockedUntil != nil && !lt.locked(now)
+	if lockExpired || (!lt.locked(now) && now.Sub(lt.LastFailureAt) > failureWindow) {
+		lt.Failures = 0
+		lt.LockedUntil = nil
+	}
+
+	lt.Failures++
+	lt.LastFailureAt = now
+
+	var lockedUntil time.Time
+	if p.lockAfter > 0 && lt.Failures >= p.lockAfter && !lt.locked(now) {
+		lockedUntil = now.Add(p.lockFor)
+		lt.LockedUntil = &lockedUntil
+	}
+
+	if err := lts.Save(lt); err != nil {
+		return time.Time{}, err
+	}
+	return lockedUntil, nil
+}
+
+// byKey returns the throttle for key, or a new unsaved one
+func (lts *loginThrottleService) byKey(key string) (*loginThrottle, error) {
+	lt, err := lts.ByKey(key)
+	switch err {
+	case nil:
+		return lt, nil
+	case ErrNotFound:
+		return &loginThrottle{Key: key}, nil
+	default:
+		return nil, err
+	}
+}
+
+func accountKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// DB Implementation
+func (ltg *loginThrottleGorm) ByKey(key string) (*loginThrottle, error) {
+	var lt loginThrottle
+	err := first(ltg.db.Where("key = ?", key), &lt)
+	if err != nil {
+		return nil, err
+	}
+	return &lt, nil
+}
+
+func (ltg *loginThrottleGorm) Save(lt *loginThrottle) error {
+	return ltg.db.Save(lt).Error
+}
+
+func (ltg *loginThrottleGorm) Delete(key string) error {
+	return ltg.db.Unscoped().Where("key = ?", key).Delete(&loginThrottle{}).Error
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type memThrottleDB struct {
+	throttles map[string]loginThrottle
+}
+
+func (db *memThrottleDB) ByKey(key string) (*loginThrottle, error) {
+	lt, ok := db.throttles[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &lt, nil
+}
+
+func (db *memThrottleDB) Save(lt *loginThrottle) error {
+	db.throttles[lt.Key] = *lt
+	return nil
+}
+
+func (db *memThrottleDB) Delete(key string) error {
+	delete(db.throttles, key)
+	return nil
+}
+
+// newTestThrottle returns a throttle whose clock only moves when
+// the returned function is called
+func newTestThrottle() (*loginThrottleService, func(time.Duration)) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	lts := &loginThrottleService{
+		LoginThrottleDB: &memThrottleDB{throttles: map[string]loginThrottle{}},
+		now:             func() time.Time { return now },
+	}
+	return lts, func(d time.Duration) { now = now.Add(d) }
+}
+
+// waitFor returns how long Check keeps refusing email from ip,
+// probing in steps of 100ms
+func waitFor(t *testing.T, lts *loginThrottleService, advance func(time.Duration), email, ip string) time.Duration {
+	t.Helper()
+	var waited time.Duration
+	for {
+		err := lts.Check(email, ip)
+		switch err {
+		case nil:
+			return waited
+		case ErrLoginThrottled:
+		default:
+			t.Fatalf("Check(%q, %q) = %v", email, ip, err)
+		}
+		advance(100 * time.Millisecond)
+		waited += 100 * time.Millisecond
+	}
+}
+
+func TestLoginThrottleAccountBackoff(t *testing.T) {
+	lts, advance := newTestThrottle()
+
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		// Every attempt comes from another client so only the
+		// account is throttled
+		if _, err := lts.Failure("Jon@Example.com ", fmt.Sprintf("192.0.2.%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if got := waitFor(t, lts, advance, "jon@example.com", "198.51.100.1"); got != w {
+			t.Errorf("after %d failures: waited %v, want %v", i+1, got, w)
+		}
+	}
+
+	// Other accounts are not affected
+	if err := lts.Check("ann@example.com", "198.51.100.1"); err != nil {
+		t.Errorf("another account: Check() = %v", err)
+	}
+}
+
+func TestLoginThrottleIPBackoff(t *testing.T) {
+	lts, advance := newTestThrottle()
+	const ip = "203.0.113.7"
+
+	for i := 1; i <= 12; i++ {
+		// Every attempt guesses another account so only the
+		// client is throttled
+		if _, err := lts.Failure(fmt.Sprintf("user%d@example.com", i), ip); err != nil {
+			t.Fatal(err)
+		}
+
+		var want time.Duration
+		if i >= ipPolicy.free {
+			want = time.Second << uint(i-ipPolicy.free)
+		}
+		if got := waitFor(t, lts, advance, "someone@example.com", ip); got != want {
+			t.Errorf("after %d failures: waited %v, want %v", i, got, want)
+		}
+	}
+
+	// Other clients are not affected
+	if err := lts.Check("someone@example.com", "203.0.113.8"); err != nil {
+		t.Errorf("another client: Check() = %v", err)
+	}
+}
+
+func TestLoginThrottleBackoffIsCapped(t *testing.T) {
+	lt := loginThrottle{}
+	for lt.Failures = 0; lt.Failures < 40; lt.Failures++ {
+		if d := lt.backoff(accountPolicy); d > maxBackoff {
+			t.Fatalf("backoff after %d failures = %v, more than %v", lt.Failures, d, maxBackoff)
+		}
+	}
+	if d := lt.backoff(accountPolicy); d != maxBackoff {
+		t.Errorf("backoff after %d failures = %v, want %v", lt.Failures, d, maxBackoff)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	lts, advance := newTestThrottle()
+	const email = "jon@example.com"
+
+	for i := 1; i < accountPolicy.lockAfter; i++ {
+		until, err := lts.Failure(email, fmt.Sprintf("192.0.2.%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !until.IsZero() {
+			t.Fatalf("locked after %d failures", i)
+		}
+		advance(maxBackoff)
+	}
+
+	until, err := lts.Failure(email, "192.0.2.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := lts.now().Add(accountPolicy.lockFor); !until.Equal(want) {
+		t.Fatalf("locked until %v, want %v", until, want)
+	}
+
+	advance(accountPolicy.lockFor - time.Second)
+	if err := lts.Check(email, "198.51.100.1"); err != ErrAccountLocked {
+		t.Errorf("during the lockout: Check() = %v, want %v", err, ErrAccountLocked)
+	}
+
+	// Failing again while locked neither extends the lock nor
+	// reports a new one
+	if until, err := lts.Failure(email, "192.0.2.101"); err != nil || !until.IsZero() {
+		t.Errorf("failure while locked = %v, %v", until, err)
+	}
+
+	advance(time.Second)
+	if err := lts.Check(email, "198.51.100.1"); err == ErrAccountLocked {
+		t.Error("still locked after the lockout ended")
+	}
+
+	// The count starts over once the lock has expired
+	advance(maxBackoff)
+	if _, err := lts.Failure(email, "192.0.2.102"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lts.Check(email, "198.51.100.1"); err != nil {
+		t.Errorf("first failure after the lockout: Check() = %v", err)
+	}
+}
+
+func TestLoginThrottleSuccessResets(t *testing.T) {
+	lts, advance := newTestThrottle()
+	const email = "jon@example.com"
+
+	for i := 0; i < 6; i++ {
+		lts.Failure(email, "192.0.2.1")
+	}
+	if err := lts.Check(email, "198.51.100.1"); err != ErrLoginThrottled {
+		t.Fatalf("after 6 failures: Check() = %v, want %v", err, ErrLoginThrottled)
+	}
+
+	if err := lts.Success(email); err != nil {
+		t.Fatal(err)
+	}
+	if err := lts.Check(email, "198.51.100.1"); err != nil {
+		t.Errorf("after a success: Check() = %v", err)
+	}
+
+	// Earlier failures no longer count towards the lockout
+	for i := 1; i < accountPolicy.lockAfter; i++ {
+		until, _ := lts.Failure(email, fmt.Sprintf("192.0.2.%d", i+1))
+		if !until.IsZero() {
+			t.Fatalf("locked after %d failures since the success", i)
+		}
+		advance(maxBackoff)
+	}
+}
+
+func TestLoginThrottleForgetsOldFailures(t *testing.T) {
+	lts, advance := newTestThrottle()
+	const email = "jon@example.com"
+
+	for i := 0; i < 6; i++ {
+		lts.Failure(email, "192.0.2.1")
+	}
+	advance(failureWindow + time.Second)
+
+	lts.Failure(email, "192.0.2.2")
+	if err := lts.Check(email, "198.51.100.1"); err != nil {
+		t.Errorf("first failure in a new window: Check() = %v", err)
+	}
+}
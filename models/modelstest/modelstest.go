@@ -0,0 +1,151 @@
+// Package modelstest provides in-memory versions of the model
+// services, for tests of the packages using them. Each embeds
+// its service interface and implements only the methods tests
+// have needed so far, the others panic.
+package modelstest
+
+import (
+	"github.com/ruckuus/dojo1/models"
+)
+
+// Organizations keeps the memberships of organizations. Err,
+// when set, is returned by every method.
+type Organizations struct {
+	models.OrganizationService
+	Memberships []models.Membership
+	Err         error
+}
+
+var _ models.OrganizationService = &Organizations{}
+
+func (o *Organizations) Membership(organizationID, userID uint) (*models.Membership, error) {
+	if o.Err != nil {
+		return nil, o.Err
+	}
+	for i, m := range o.Memberships {
+		if m.OrganizationID == organizationID && m.UserID == userID {
+			return &o.Memberships[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (o *Organizations) Members(organizationID uint) ([]models.Membership, error) {
+	if o.Err != nil {
+		return nil, o.Err
+	}
+	var members []models.Membership
+	for _, m := range o.Memberships {
+		if m.OrganizationID == organizationID {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// Grants keeps grants. Err, when set, is returned by every
+// method.
+type Grants struct {
+	models.GrantService
+	Grants []models.Grant
+	Err    error
+}
+
+var _ models.GrantService = &Grants{}
+
+func (g *Grants) ByUserResource(userID uint, resourceType string, resourceID uint) (*models.Grant, error) {
+	if g.Err != nil {
+		return nil, g.Err
+	}
+	for i, grant := range g.Grants {
+		if grant.UserID == userID && grant.ResourceType == resourceType && grant.ResourceID == resourceID {
+			return &g.Grants[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func (g *Grants) ByResource(resourceType string, resourceID uint) ([]models.Grant, error) {
+	if g.Err != nil {
+		return nil, g.Err
+	}
+	var grants []models.Grant
+	for _, grant := range g.Grants {
+		if grant.ResourceType == resourceType && grant.ResourceID == resourceID {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (g *Grants) ByUserType(userID uint, resourceType string) ([]models.Grant, error) {
+	if g.Err != nil {
+		return nil, g.Err
+	}
+	var grants []models.Grant
+	for _, grant := range g.Grants {
+		if grant.UserID == userID && grant.ResourceType == resourceType {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (g *Grants) Create(grant *models.Grant) error {
+	if g.Err != nil {
+		return g.Err
+	}
+	grant.ID = uint(len(g.Grants) + 1)
+	g.Grants = append(g.Grants, *grant)
+	return nil
+}
+
+func (g *Grants) DeleteByResource(resourceType string, resourceID uint) error {
+	if g.Err != nil {
+		return g.Err
+	}
+	kept := g.Grants[:0]
+	for _, grant := range g.Grants {
+		if grant.ResourceType != resourceType || grant.ResourceID != resourceID {
+			kept = append(kept, grant)
+		}
+	}
+	g.Grants = kept
+	return nil
+}
+
+// Outbox keeps the messages queued. Err, when set, is returned
+// by every method.
+type Outbox struct {
+	models.OutboxService
+	Messages []models.OutboxMessage
+	Err      error
+}
+
+var _ models.OutboxService = &Outbox{}
+
+func (o *Outbox) Enqueue(m *models.OutboxMessage) error {
+	if o.Err != nil {
+		return o.Err
+	}
+	m.ID = uint(len(o.Messages) + 1)
+	o.Messages = append(o.Messages, *m)
+	return nil
+}
+
+func (o *Outbox) RecordDelivery(key, status, detail string) (*models.OutboxMessage, error) {
+	if o.Err != nil {
+		return nil, o.Err
+	}
+	if key == "" {
+		return nil, models.ErrIdempotencyKeyRequired
+	}
+	for i, m := range o.Messages {
+		if m.IdempotencyKey == key {
+			o.Messages[i].DeliveryStatus = status
+			o.Messages[i].DeliveryDetail = detail
+			return &o.Messages[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
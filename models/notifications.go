@@ -0,0 +1,418 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Events users are notified of
+const (
+	NotifyTicketUpdated = "ticket_updated"
+	NotifyRentDue       = "rent_due"
+	NotifyLeaseExpiring = "lease_expiring"
+)
+
+// Channels a notification is delivered through. Every channel
+// but ChannelOff lists the notification in the in-app inbox.
+const (
+	ChannelInbox  = "inbox"
+	ChannelEmail  = "email"
+	ChannelDigest = "digest"
+	ChannelOff    = "off"
+)
+
+// NotificationChannels lists the channels users pick from
+var NotificationChannels = []string{
+	ChannelInbox,
+	ChannelEmail,
+	ChannelDigest,
+	ChannelOff,
+}
+
+// NotificationEvent is an event users choose a channel for,
+// Channel is the one used until they do.
+type NotificationEvent struct {
+	Name    string
+	Label   string
+	Channel string
+}
+
+// NotificationEvents lists the events users are notified of
+var NotificationEvents = []NotificationEvent{
+	{NotifyTicketUpdated, "Ticket updates", ChannelEmail},
+	{NotifyRentDue, "Rent due", ChannelEmail},
+	{NotifyLeaseExpiring, "Lease expiring", ChannelEmail},
+}
+
+const (
+	ErrNotificationEventInvalid   modelError = "models: notification event is not valid"
+	ErrNotificationChannelInvalid modelError = "models: notification channel is not valid"
+	ErrNotificationKeyRequired    modelError = "models: notification key is required"
+)
+
+// Notification is something a user is told about, listed in
+// their inbox and emailed according to their preferences, see
+// package notify. Key tells notifications apart per user, the
+// same one is only ever created once. DigestPending is set
+// while the notification waits for the daily digest.
+type Notification struct {
+	gorm.Model
+	UserID        uint   `gorm:"not null;unique_index:idx_notifications_user_key"`
+	Key           string `gorm:"not null;unique_index:idx_notifications_user_key"`
+	Event         string `gorm:"not null"`
+	Title         string `gorm:"not null"`
+	Body          string `gorm:"type:text"`
+	URL           string
+	ReadAt        *time.Time
+	DigestPending bool `gorm:"not null;default:false;index"`
+
+	// ReplyTo is where replies to the email of the notification
+	// go, it is not saved and so not used by digests.
+	ReplyTo string `gorm:"-"`
+}
+
+// Read reports whether the user has seen the notification
+func (n *Notification) Read() bool {
+	return n.ReadAt != nil
+}
+
+// NotificationPreference is the channel a user picked for an
+// event
+type NotificationPreference struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;unique_index:idx_notification_preferences_user_event"`
+	Event   string `gorm:"not null;unique_index:idx_notification_preferences_user_event"`
+	Channel string `gorm:"not null"`
+}
+
+// NotificationService is the set of methods used to
+// manage notifications from outside the models package
+type NotificationService interface {
+	// Channel returns the channel the user picked for event,
+	// or its default one.
+	Channel(userID uint, event string) (string, error)
+
+	// Channels returns the channel of every event for the user
+	Channels(userID uint) (map[string]string, error)
+
+	// SetChannels saves the channels the user picked, by event
+	SetChannels(userID uint, channels map[string]string) error
+
+	// MarkRead marks a notification of the user as read.
+	// ErrNotFound is returned for notifications of others.
+	MarkRead(userID, id uint) (*Notification, error)
+	NotificationDB
+}
+
+// NotificationDB is used to interact with the notifications database
+type NotificationDB interface {
+	ByID(id uint) (*Notification, error)
+	// ByUserID returns up to limit notifications of the user,
+	// newest first
+	ByUserID(userID uint, limit int) ([]Notification, error)
+	UnreadCount(userID uint) (int, error)
+	MarkAllRead(userID uint) error
+	// DigestPending returns the notifications created before t
+	// waiting for the digest, by user then oldest first
+	DigestPending(t time.Time) ([]Notification, error)
+	// DigestSent clears DigestPending of the notifications
+	DigestSent(ids []uint) error
+	// Create leaves n without an ID when the user already has
+	// a notification with its key.
+	Create(n *Notification) error
+	Update(n *Notification) error
+	DeleteByUserID(userID uint) error
+
+	PreferencesByUserID(userID uint) ([]NotificationPreference, error)
+	SavePreference(p *NotificationPreference) error
+}
+
+type notificationService struct {
+	NotificationDB
+}
+
+type notificationValidator struct {
+	NotificationDB
+}
+
+type notificationGorm struct {
+	db *gorm.DB
+}
+
+var _ NotificationService = &notificationService{}
+var _ NotificationDB = &notificationValidator{}
+var _ NotificationDB = &notificationGorm{}
+
+func NewNotificationService(db *gorm.DB) NotificationService {
+	return &notificationService{
+		NotificationDB: &notificationValidator{
+			NotificationDB: &notificationGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (ns *notificationService) Channel(userID uint, event string) (string, error) {
+	channels, err := ns.Channels(userID)
+	if err != nil {
+		return "", err
+	}
+	channel, ok := channels[event]
+	if !ok {
+		return "", ErrNotificationEventInvalid
+	}
+	return channel, nil
+}
+
+func (ns *notificationService) Channels(userID uint) (map[string]string, error) {
+	channels := map[string]string{}
+	for _, e := range NotificationEvents {
+		channels[e.Name] = e.Channel
+	}
+
+	prefs, err := ns.PreferencesByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range prefs {
+		if _, ok := channels[p.Event]; ok {
+			channels[p.Event] = p.Channel
+		}
+	}
+	return channels, nil
+}
+
+func (ns *notificationService) SetChannels(userID uint, channels map[string]string) error {
+	prefs, err := ns.PreferencesByUserID(userID)
+	if err != nil {
+		return err
+	}
+	byEvent := map[string]*NotificationPreference{}
+	for i := range prefs {
+		byEvent[prefs[i].Event] = &prefs[i]
+	}
+
+	for event, channel := range channels {
+		p, ok := byEvent[event]
+		if !ok {
+			p = &NotificationPreference{UserID: userID, Event: event}
+		}
+		p.Channel = channel
+		if err := ns.SavePreference(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ns *notificationService) MarkRead(userID, id uint) (*Notification, error) {
+	n, err := ns.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if n.UserID != userID {
+		return nil, ErrNotFound
+	}
+	if n.Read() {
+		return n, nil
+	}
+
+	now := time.Now()
+	n.ReadAt = &now
+	return n, ns.Update(n)
+}
+
+// DB Implementation
+func (ng *notificationGorm) ByID(id uint) (*Notification, error) {
+	var n Notification
+	err := first(ng.db.Where("id = ?", id), &n)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func (ng *notificationGorm) ByUserID(userID uint, limit int) ([]Notification, error) {
+	var notifications []Notification
+	db := ng.db.Where("user_id = ?", userID).Order("created_at desc").Limit(limit)
+	err := db.Find(&notifications).Error
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (ng *notificationGorm) UnreadCount(userID uint) (int, error) {
+	var count int
+	db := ng.db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	err := db.Count(&count).Error
+	return count, err
+}
+
+func (ng *notificationGorm) MarkAllRead(userID uint) error {
+	db := ng.db.Model(&Notification{}).Where("user_id = ? AND read_at IS NULL", userID)
+	return db.Update("read_at", time.Now()).Error
+}
+
+func (ng *notificationGorm) DigestPending(t time.Time) ([]Notification, error) {
+	var notifications []Notification
+	db := ng.db.Where("digest_pending = ? AND created_at < ?", true, t).Order("user_id, created_at")
+	err := db.Find(&notifications).Error
+	if err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (ng *notificationGorm) DigestSent(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	db := ng.db.Model(&Notification{}).Where("id IN (?)", ids)
+	return db.Update("digest_pending", false).Error
+}
+
+func (ng *notificationGorm) Create(n *Notification) error {
+	db := ng.db.Set("gorm:insert_option", "ON CONFLICT (user_id, key) DO NOTHING")
+	return insertedOrSkipped(db.Create(n).Error)
+}
+
+func (ng *notificationGorm) Update(n *Notification) error {
+	return ng.db.Save(n).Error
+}
+
+// DeleteByUserID removes the notifications and preferences of
+// the user for good
+func (ng *notificationGorm) DeleteByUserID(userID uint) error {
+	err := ng.db.Unscoped().Where("user_id = ?", userID).Delete(&Notification{}).Error
+	if err != nil {
+		return err
+	}
+	return ng.db.Unscoped().Where("user_id = ?", userID).Delete(&NotificationPreference{}).Error
+}
+
+func (ng *notificationGorm) PreferencesByUserID(userID uint) ([]NotificationPreference, error) {
+	var prefs []NotificationPreference
+	err := ng.db.Where("user_id = ?", userID).Find(&prefs).Error
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (ng *notificationGorm) SavePreference(p *NotificationPreference) error {
+	return ng.db.Save(p).Error
+}
+
+// Validator implementation
+func (nv *notificationValidator) ByID(id uint) (*Notification, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return nv.NotificationDB.ByID(id)
+}
+
+func (nv *notificationValidator) Create(n *Notification) error {
+	err := runNotificationValFns(n,
+		nv.requireUserID,
+		nv.eventValid,
+		nv.requireKey,
+		nv.requireTitle)
+	if err != nil {
+		return err
+	}
+	return nv.NotificationDB.Create(n)
+}
+
+func (nv *notificationValidator) Update(n *Notification) error {
+	err := runNotificationValFns(n,
+		nv.nonZeroID,
+		nv.requireUserID,
+		nv.eventValid,
+		nv.requireKey,
+		nv.requireTitle)
+	if err != nil {
+		return err
+	}
+	return nv.NotificationDB.Update(n)
+}
+
+func (nv *notificationValidator) SavePreference(p *NotificationPreference) error {
+	if p.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if !validEvent(p.Event) {
+		return ErrNotificationEventInvalid
+	}
+	if !validChannel(p.Channel) {
+		return ErrNotificationChannelInvalid
+	}
+	return nv.NotificationDB.SavePreference(p)
+}
+
+// Validation functions
+func (nv *notificationValidator) nonZeroID(n *Notification) error {
+	if n.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (nv *notificationValidator) requireUserID(n *Notification) error {
+	if n.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (nv *notificationValidator) eventValid(n *Notification) error {
+	if !validEvent(n.Event) {
+		return ErrNotificationEventInvalid
+	}
+	return nil
+}
+
+func (nv *notificationValidator) requireKey(n *Notification) error {
+	if n.Key == "" {
+		return ErrNotificationKeyRequired
+	}
+	return nil
+}
+
+func (nv *notificationValidator) requireTitle(n *Notification) error {
+	if n.Title == "" {
+		return ErrTitleRequired
+	}
+	return nil
+}
+
+func validEvent(event string) bool {
+	for _, e := range NotificationEvents {
+		if e.Name == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validChannel(channel string) bool {
+	for _, c := range NotificationChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Validator functions
+type notificationValFn func(n *Notification) error
+
+func runNotificationValFns(n *Notification, fns ...notificationValFn) error {
+	for _, fn := range fns {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+const (
+	ErrOrganizationNameRequired modelError = "models: organization name is required"
+	ErrOrganizationIDRequired   modelError = "models: organization ID is required"
+	ErrMemberExists             modelError = "models: this user is already a member"
+)
+
+// Organization owns properties and galleries on behalf of its
+// members, e.g. an agency managing the portfolios of many owners.
+// Every user gets a personal organization when they sign up,
+// OwnerID is who it belongs to, it is 0 for the others. A user
+// has only one, see migratePersonalOrganizations.
+type Organization struct {
+	gorm.Model
+	Name     string `gorm:"not null"`
+	Personal bool   `gorm:"not null"`
+	OwnerID  uint   `gorm:"not null;default:0"`
+}
+
+// Membership makes a user part of an organization. Role is one
+// of the roles of package authz, which decides what it allows.
+type Membership struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"not null;unique_index:idx_memberships_organization_user"`
+	UserID         uint   `gorm:"not null;unique_index:idx_memberships_organization_user;index"`
+	Role           string `gorm:"not null"`
+}
+
+// OrganizationService is the set of methods used to manage
+// organizations and their members from outside the models package
+type OrganizationService interface {
+	OrganizationDB
+
+	Membership(organizationID, userID uint) (*Membership, error)
+	MembershipByID(id uint) (*Membership, error)
+	Members(organizationID uint) ([]Membership, error)
+	AddMember(m *Membership) error
+	RemoveMember(id uint) error
+
+	// RemoveUser removes every membership of userID
+	RemoveUser(userID uint) error
+}
+
+// OrganizationDB is used to interact with the organizations database
+type OrganizationDB interface {
+	ByID(id uint) (*Organization, error)
+	// ByUserID returns the organizations user is a member of,
+	// oldest first, so the personal one comes first.
+	ByUserID(userID uint) ([]Organization, error)
+	Create(org *Organization) error
+	Update(org *Organization) error
+
+	// Purge removes the organization for good along with its
+	// memberships. What it owns has to be removed beforehand.
+	Purge(id uint) error
+}
+
+type organizationService struct {
+	OrganizationDB
+	membershipDB membershipDB
+}
+
+type membershipDB interface {
+	ByOrganizationUser(organizationID, userID uint) (*Membership, error)
+	ByID(id uint) (*Membership, error)
+	ByOrganizationID(organizationID uint) ([]Membership, error)
+	Create(m *Membership) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type organizationValidator struct {
+	OrganizationDB
+}
+
+type organizationGorm struct {
+	db *gorm.DB
+}
+
+type membershipGorm struct {
+	db *gorm.DB
+}
+
+var _ OrganizationService = &organizationService{}
+var _ OrganizationDB = &organizationValidator{}
+var _ OrganizationDB = &organizationGorm{}
+var _ membershipDB = &membershipGorm{}
+
+func NewOrganizationService(db *gorm.DB) OrganizationService {
+	return &organizationService{
+		OrganizationDB: &organizationValidator{
+			OrganizationDB: &organizationGorm{
+				db: db,
+			},
+		},
+		membershipDB: &membershipGorm{db},
+	}
+}
+
+func (ors *organizationService) Membership(organizationID, userID uint) (*Membership, error) {
+	return ors.membershipDB.ByOrganizationUser(organizationID, userID)
+}
+
+func (ors *organizationService) MembershipByID(id uint) (*Membership, error) {
+	return ors.membershipDB.ByID(id)
+}
+
+func (ors *organizationService) Members(organizationID uint) ([]Membership, error) {
+	return ors.membershipDB.ByOrganizationID(organizationID)
+}
+
+func (ors *organizationService) AddMember(m *Membership) error {
+	if m.OrganizationID <= 0 {
+		return ErrOrganizationIDRequired
+	}
+	if m.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	if m.Role == "" {
+		return ErrRoleRequired
+	}
+
+	_, err := ors.membershipDB.ByOrganizationUser(m.OrganizationID, m.UserID)
+	switch err {
+	case ErrNotFound:
+	case nil:
+		return ErrMemberExists
+	default:
+		return err
+	}
+	return ors.membershipDB.Create(m)
+}
+
+func (ors *organizationService) RemoveMember(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return ors.membershipDB.Delete(id)
+}
+
+func (ors *organizationService) RemoveUser(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	return ors.membershipDB.DeleteByUserID(userID)
+}
+
+// DB Implementation
+func (og *organizationGorm) ByID(id uint) (*Organization, error) {
+	var org Organization
+	err := first(og.db.Where("id = ?", id), &org)
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func (og *organizationGorm) ByUserID(userID uint) ([]Organization, error) {
+	var orgs []Organization
+	db := og.db.
+		Joins("JOIN memberships ON memberships.organization_id = organizations.id").
+		Where("memberships.user_id = ? AND memberships.deleted_at IS NULL", userID).
+		Order("organizations.created_at")
+	err := db.Find(&orgs).Error
+	if err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+func (og *organizationGorm) Create(org *Organization) error {
+	return og.db.Create(org).Error
+}
+
+func (og *organizationGorm) Update(org *Organization) error {
+	return og.db.Save(org).Error
+}
+
+func (og *organizationGorm) Purge(id uint) error {
+	db := og.db.Unscoped()
+	if err := db.Where("organization_id = ?", id).Delete(&Membership{}).Error; err != nil {
+		return err
+	}
+	org := Organization{Model: gorm.Model{ID: id}}
+	return db.Delete(&org).Error
+}
+
+func (mg *membershipGorm) ByOrganizationUser(organizationID, userID uint) (*Membership, error) {
+	var m Membership
+	db := mg.db.Where("organization_id = ? AND user_id = ?", organizationID, userID)
+	err := first(db, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (mg *membershipGorm) ByID(id uint) (*Membership, error) {
+	var m Membership
+	err := first(mg.db.Where("id = ?", id), &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (mg *membershipGorm) ByOrganizationID(organizationID uint) ([]Membership, error) {
+	var members []Membership
+	db := mg.db.Where("organization_id = ?", organizationID).Order("created_at")
+	err := db.Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (mg *membershipGorm) Create(m *Membership) error {
+	return mg.db.Create(m).Error
+}
+
+// Delete removes the membership for good, so the user can be
+// added again later.
+func (mg *membershipGorm) Delete(id uint) error {
+	m := Membership{Model: gorm.Model{ID: id}}
+	return mg.db.Unscoped().Delete(&m).Error
+}
+
+func (mg *membershipGorm) DeleteByUserID(userID uint) error {
+	return mg.db.Unscoped().Where("user_id = ?", userID).Delete(&Membership{}).Error
+}
+
+// Validator implementation
+func (ov *organizationValidator) Create(org *Organization) error {
+	if err := runOrganizationValFns(org, ov.nameRequired); err != nil {
+		return err
+	}
+	return ov.OrganizationDB.Create(org)
+}
+
+func (ov *organizationValidator) Update(org *Organization) error {
+	if err := runOrganizationValFns(org, ov.nonZeroID, ov.nameRequired); err != nil {
+		return err
+	}
+	return ov.OrganizationDB.Update(org)
+}
+
+// Validation functions
+func (ov *organizationValidator) nameRequired(org *Organization) error {
+	if org.Name == "" {
+		return ErrOrganizationNameRequired
+	}
+	return nil
+}
+
+func (ov *organizationValidator) nonZeroID(org *Organization) error {
+	if org.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+// Validator functions
+type organizationValidationFn func(org *Organization) error
+
+func runOrganizationValFns(org *Organization, fns ...organizationValidationFn) error {
+	for _, fn := range fns {
+		if err := fn(org); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownerRole is the role of package authz the owner of a personal
+// organization has, as stored in memberships
+const ownerRole = "owner"
+
+// migratePersonalOrganizations makes sure every user has exactly
+// one personal organization. They used to be created on the
+// first request of a user, and two concurrent requests could
+// create two of them; the extra ones are kept as regular
+// organizations. Users without one get it here, along with what
+// they created before organizations existed. From then on they
+// are created when users sign up, and a unique index keeps it
+// at one per user.
+func migratePersonalOrganizations(db *gorm.DB) error {
+	steps := []struct {
+		sql  string
+		args []interface{}
+	}{
+		{`UPDATE organizations SET owner_id = m.user_id
+		FROM memberships m
+		WHERE m.organization_id = organizations.id AND m.role = ? AND m.deleted_at IS NULL
+			AND organizations.personal AND organizations.owner_id = 0
+			AND organizations.id = (
+				SELECT MIN(o.id) FROM organizations o
+				JOIN memberships om ON om.organization_id = o.id
+				WHERE o.personal AND om.user_id = m.user_id AND om.role = ? AND om.deleted_at IS NULL)
+			AND NOT EXISTS (
+				SELECT 1 FROM organizations o WHERE o.personal AND o.owner_id = m.user_id)`, []interface{}{ownerRole, ownerRole}},
+		{`UPDATE organizations SET personal = false WHERE personal AND owner_id = 0`, nil},
+		{`CREATE UNIQUE INDEX IF NOT EXISTS idx_organizations_personal_owner
+		ON organizations (owner_id) WHERE personal`, nil},
+		{`INSERT INTO organizations (created_at, updated_at, name, personal, owner_id)
+		SELECT NOW(), NOW(), CASE WHEN u.name = '' THEN u.email ELSE u.name END, true, u.id
+		FROM users u
+		WHERE NOT EXISTS (
+			SELECT 1 FROM organizations o WHERE o.personal AND o.owner_id = u.id)`, nil},
+		{`INSERT INTO memberships (created_at, updated_at, organization_id, user_id, role)
+		SELECT NOW(), NOW(), o.id, o.owner_id, ?
+		FROM organizations o
+		WHERE o.personal AND NOT EXISTS (
+			SELECT 1 FROM memberships m WHERE m.organization_id = o.id AND m.user_id = o.owner_id)`, []interface{}{ownerRole}},
+		{`UPDATE properties SET organization_id = o.id
+		FROM organizations o
+		WHERE o.personal AND o.owner_id = properties.user_id
+			AND (properties.organization_id IS NULL OR properties.organization_id = 0)`, nil},
+		{`UPDATE galleries SET organization_id = o.id
+		FROM organizations o
+		WHERE o.personal AND o.owner_id = galleries.user_id
+			AND (galleries.organization_id IS NULL OR galleries.organization_id = 0)`, nil},
+	}
+	for _, step := range steps {
+		if err := db.Exec(step.sql, step.args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package models
+
+import (
+	"database/sql"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Outbox message statuses. Queued messages are retried until
+// they are sent or OutboxMaxAttempts is reached, then they are
+// dead and wait for an operator. Messages to suppressed
+// addresses are not sent at all, see Suppression.
+const (
+	OutboxQueued     = "queued"
+	OutboxSent       = "sent"
+	OutboxDead       = "dead"
+	OutboxSuppressed = "suppressed"
+)
+
+// Delivery statuses of sent messages, as reported by the mail
+// provider
+const (
+	DeliveryDelivered  = "delivered"
+	DeliveryBounced    = "bounced"
+	DeliveryComplained = "complained"
+)
+
+const (
+	// OutboxMaxAttempts is how many times a message is tried
+	// before giving up on it
+	OutboxMaxAttempts = 10
+
+	// The delay before retrying doubles with every attempt,
+	// from outboxBaseDelay up to outboxMaxDelay.
+	outboxBaseDelay = time.Minute
+	outboxMaxDelay  = 6 * time.Hour
+)
+
+const (
+	ErrIdempotencyKeyRequired modelError = "models: idempotency key is required"
+	ErrRecipientRequired      modelError = "models: recipient is required"
+	ErrOutboxNotDead          modelError = "models: only dead messages can be retried"
+	ErrDeliveryStatusInvalid  modelError = "models: delivery status is not valid"
+)
+
+// OutboxMessage is an email waiting to be sent, or sent. Emails
+// are queued in the same transaction as the change they are
+// about, see Services.Transaction, and sent by package
+// mailqueue. Queueing twice with the same IdempotencyKey queues
+// the message once. DeliveryStatus is what became of the message
+// once sent, it stays empty with mailers reporting nothing.
+type OutboxMessage struct {
+	gorm.Model
+	IdempotencyKey string `gorm:"not null;unique_index"`
+	From           string `gorm:"not null"`
+	To             string `gorm:"not null"`
+	ReplyTo        string
+	Subject        string    `gorm:"not null"`
+	Text           string    `gorm:"type:text"`
+	HTML           string    `gorm:"type:text"`
+	Status         string    `gorm:"not null;index"`
+	Attempts       int       `gorm:"not null;default:0"`
+	NextAttemptAt  time.Time `gorm:"index"`
+	LastError      string    `gorm:"type:text"`
+	SentAt         *time.Time
+	DeliveryStatus string
+	DeliveryDetail string `gorm:"type:text"`
+}
+
+// OutboxService is the set of methods used to
+// manage outbox messages from outside the models package
+type OutboxService interface {
+	// Enqueue queues m to be sent right away. Nothing is queued
+	// if a message with the same key already was.
+	Enqueue(m *OutboxMessage) error
+
+	// Sent marks m as delivered to the mailer
+	Sent(m *OutboxMessage) error
+
+	// Failed records a failed attempt at sending m, and either
+	// schedules the next one or gives up on it.
+	Failed(m *OutboxMessage, err error) error
+
+	// Retry queues a dead message again, from scratch
+	Retry(id uint) error
+
+	// Suppressed gives up on m, its recipient is suppressed
+	Suppressed(m *OutboxMessage) error
+
+	// RecordDelivery saves the delivery status reported for the
+	// message with the idempotency key. A message already known
+	// to have bounced or been complained about stays so.
+	RecordDelivery(key, status, detail string) (*OutboxMessage, error)
+	OutboxDB
+}
+
+// OutboxDB is used to interact with the outbox database
+type OutboxDB interface {
+	ByID(id uint) (*OutboxMessage, error)
+	ByIdempotencyKey(key string) (*OutboxMessage, error)
+	// Due returns up to limit queued messages whose next attempt
+	// is due at t, oldest first
+	Due(t time.Time, limit int) ([]OutboxMessage, error)
+	// Recent returns up to limit messages, newest first, of the
+	// given status or of any status if it is empty
+	Recent(status string, limit int) ([]OutboxMessage, error)
+	Create(m *OutboxMessage) error
+	Update(m *OutboxMessage) error
+	// DeleteDoneBefore removes the messages sent before t, and
+	// those given up on before t
+	DeleteDoneBefore(t time.Time) error
+}
+
+type outboxService struct {
+	OutboxDB
+}
+
+type outboxValidator struct {
+	OutboxDB
+}
+
+type outboxGorm struct {
+	db *gorm.DB
+}
+
+var _ OutboxService = &outboxService{}
+var _ OutboxDB = &outboxValidator{}
+var _ OutboxDB = &outboxGorm{}
+
+func NewOutboxService(db *gorm.DB) OutboxService {
+	return &outboxService{
+		OutboxDB: &outboxValidator{
+			OutboxDB: &outboxGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (obs *outboxService) Enqueue(m *OutboxMessage) error {
+	m.Status = OutboxQueued
+	m.Attempts = 0
+	m.NextAttemptAt = time.Now()
+	return obs.Create(m)
+}
+
+func (obs *outboxService) Sent(m *OutboxMessage) error {
+	now := time.Now()
+	m.Attempts++
+	m.Status = OutboxSent
+	m.SentAt = &now
+	m.LastError = ""
+	return obs.Update(m)
+}
+
+func (obs *outboxService) Failed(m *OutboxMessage, err error) error {
+	m.Attempts++
+	m.LastError = err.Error()
+	if m.Attempts >= OutboxMaxAttempts {
+		m.Status = OutboxDead
+		return obs.Update(m)
+	}
+
+	delay := outboxBaseDelay << uint(m.Attempts-1)
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+	m.NextAttemptAt = time.Now().Add(delay)
+	return obs.Update(m)
+}
+
+func (obs *outboxService) Retry(id uint) error {
+	m, err := obs.ByID(id)
+	if err != nil {
+		return err
+	}
+	if m.Status != OutboxDead {
+		return ErrOutboxNotDead
+	}
+
+	m.Status = OutboxQueued
+	m.Attempts = 0
+	m.NextAttemptAt = time.Now()
+	return obs.Update(m)
+}
+
+func (obs *outboxService) Suppressed(m *OutboxMessage) error {
+	m.Status = OutboxSuppressed
+	return obs.Update(m)
+}
+
+func (obs *outboxService) RecordDelivery(key, status, detail string) (*OutboxMessage, error) {
+	switch status {
+	case DeliveryDelivered, DeliveryBounced, DeliveryComplained:
+	default:
+		return nil, ErrDeliveryStatusInvalid
+	}
+
+	m, err := obs.ByIdempotencyKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// Events may come in any order, and a complaint follows
+	// the delivery of the message
+	if status == DeliveryDelivered && m.DeliveryStatus != "" {
+		return m, nil
+	}
+
+	m.DeliveryStatus = status
+	m.DeliveryDetail = detail
+	return m, obs.Update(m)
+}
+
+// DB Implementation
+func (og *outboxGorm) ByID(id uint) (*OutboxMessage, error) {
+	var m OutboxMessage
+	err := first(og.db.Where("id = ?", id), &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (og *outboxGorm) ByIdempotencyKey(key string) (*OutboxMessage, error) {
+	var m OutboxMessage
+	err := first(og.db.Where("idempotency_key = ?", key), &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (og *outboxGorm) Due(t time.Time, limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	db := og.db.Where("status = ? AND next_attempt_at <= ?", OutboxQueued, t).
+		Order("next_attempt_at").Limit(limit)
+	err := db.Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (og *outboxGorm) Recent(status string, limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	db := og.db.Order("created_at desc").Limit(limit)
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	err := db.Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Create leaves the message alone when its key was queued
+// before, m is then not given an ID.
+func (og *outboxGorm) Create(m *OutboxMessage) error {
+	db := og.db.Set("gorm:insert_option", "ON CONFLICT (idempotency_key) DO NOTHING")
+	return insertedOrSkipped(db.Create(m).Error)
+}
+
+func (og *outboxGorm) Update(m *OutboxMessage) error {
+	return og.db.Save(m).Error
+}
+
+func (og *outboxGorm) DeleteDoneBefore(t time.Time) error {
+	db := og.db.Unscoped().Where("(status = ? AND sent_at < ?) OR (status IN (?) AND updated_at < ?)",
+		OutboxSent, t, []string{OutboxDead, OutboxSuppressed}, t)
+	return db.Delete(&OutboxMessage{}).Error
+}
+
+// insertedOrSkipped ignores the error of an insert skipped by
+// ON CONFLICT DO NOTHING, no ID is returned for the row then.
+func insertedOrSkipped(err error) error {
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// Validator implementation
+func (ov *outboxValidator) ByID(id uint) (*OutboxMessage, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return ov.OutboxDB.ByID(id)
+}
+
+func (ov *outboxValidator) ByIdempotencyKey(key string) (*OutboxMessage, error) {
+	if key == "" {
+		return nil, ErrIdempotencyKeyRequired
+	}
+	return ov.OutboxDB.ByIdempotencyKey(key)
+}
+
+func (ov *outboxValidator) Create(m *OutboxMessage) error {
+	err := runOutboxValFns(m,
+		ov.requireIdempotencyKey,
+		ov.requireRecipient)
+	if err != nil {
+		return err
+	}
+	return ov.OutboxDB.Create(m)
+}
+
+func (ov *outboxValidator) Update(m *OutboxMessage) error {
+	err := runOutboxValFns(m,
+		ov.nonZeroID,
+		ov.requireIdempotencyKey,
+		ov.requireRecipient)
+	if err != nil {
+		return err
+	}
+	return ov.OutboxDB.Update(m)
+}
+
+// Validation functions
+func (ov *outboxValidator) nonZeroID(m *OutboxMessage) error {
+	if m.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (ov *outboxValidator) requireIdempotencyKey(m *OutboxMessage) error {
+	if m.IdempotencyKey == "" {
+		return ErrIdempotencyKeyRequired
+	}
+	return nil
+}
+
+func (ov *outboxValidator) requireRecipient(m *OutboxMessage) error {
+	if m.To == "" {
+		return ErrRecipientRequired
+	}
+	return nil
+}
+
+// Validator functions
+type outboxValFn func(m *OutboxMessage) error
+
+func runOutboxValFns(m *OutboxMessage, fns ...outboxValFn) error {
+	for _, fn := range fns {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+)
+
+// Password policy defaults, used for the settings left to zero
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 64
+)
+
+// bcryptMaxBytes is how much of a password bcrypt looks at, the
+// bytes after it are ignored
+const bcryptMaxBytes = 72
+
+const (
+	ErrPasswordPersonal modelError = "models: password must not contain your name or email address"
+	ErrPasswordTooLong  modelError = "models: password is too long, use fewer or plainer characters"
+)
+
+// PasswordRule rejects passwords a user may not choose. Rules
+// only see passwords that are being set, never stored ones.
+type PasswordRule interface {
+	CheckPassword(user *User, password string) error
+}
+
+// PasswordRuleFunc lets a plain function be used as a PasswordRule
+type PasswordRuleFunc func(user *User, password string) error
+
+func (fn PasswordRuleFunc) CheckPassword(user *User, password string) error {
+	return fn(user, password)
+}
+
+// PasswordPolicy decides which passwords users may choose and
+// how they are hashed. Hashes made with another bcrypt cost are
+// upgraded the next time the user signs in.
+type PasswordPolicy struct {
+	MinLength  int
+	MaxLength  int
+	BcryptCost int
+	Rules      []PasswordRule
+
+	timingOnce sync.Once
+	timing     []byte
+}
+
+// NewPasswordPolicy returns a policy checking the length of
+// passwords, then rules in order. Zero settings get defaults.
+func NewPasswordPolicy(minLength, maxLength, bcryptCost int, rules ...PasswordRule) *PasswordPolicy {
+	if minLength <= 0 {
+		minLength = DefaultPasswordMinLength
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultPasswordMaxLength
+	}
+	if bcryptCost == 0 {
+		bcryptCost = bcrypt.DefaultCost
+	}
+	return &PasswordPolicy{
+		MinLength:  minLength,
+		MaxLength:  maxLength,
+		BcryptCost: bcryptCost,
+		Rules:      rules,
+	}
+}
+
+// Check returns the first reason user may not choose password
+func (pp *PasswordPolicy) Check(user *User, password string) error {
+	if n := len([]rune(password)); n < pp.MinLength {
+		return modelError(fmt.Sprintf("models: password must be at least %d characters", pp.MinLength))
+	} else if n > pp.MaxLength {
+		return modelError(fmt.Sprintf("models: password must be at most %d characters", pp.MaxLength))
+	}
+
+	for _, rule := range pp.Rules {
+		if err := rule.CheckPassword(user, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hash returns the bcrypt hash of the peppered password
+func (pp *PasswordPolicy) hash(peppered string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(peppered), pp.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedBytes), nil
+}
+
+// timingHash returns a hash made with the policy's cost, which
+// is compared against when there is no user to check a password
+// of, so that it takes as long as for a real user. It is made
+// once, see WithUser.
+func (pp *PasswordPolicy) timingHash() []byte {
+	pp.timingOnce.Do(func() {
+		pp.timing, _ = bcrypt.GenerateFromPassword([]byte("timing"), pp.BcryptCost)
+	})
+	return pp.timing
+}
+
+// outdated reports whether passwordHash was made with another
+// bcrypt cost than the policy's.
+func (pp *PasswordPolicy) outdated(passwordHash string) bool {
+	cost, err := bcrypt.Cost([]byte(passwordHash))
+	return err == nil && cost != pp.BcryptCost
+}
+
+// NoPersonalInfo rejects passwords containing the email address
+// of the user, its local part or a word of their name.
+var NoPersonalInfo = PasswordRuleFunc(func(user *User, password string) error {
+	password = strings.ToLower(password)
+
+	email := strings.ToLower(strings.TrimSpace(user.Email))
+	candidates := strings.Fields(strings.ToLower(user.Name))
+	if email != "" {
+		candidates = append(candidates, email)
+		if at := strings.Index(email, "@"); at > 0 {
+			candidates = append(candidates, email[:at])
+		}
+	}
+
+	for _, c := range candidates {
+		// Initials and short words would reject too much
+		if len(c) < 3 {
+			continue
+		}
+		if strings.Contains(password, c) {
+			return ErrPasswordPersonal
+		}
+	}
+	return nil
+})
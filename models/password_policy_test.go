@@ -0,0 +1,41 @@
+package models
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestTimingHashUsesPolicyCost(t *testing.T) {
+	for _, cost := range []int{bcrypt.MinCost, bcrypt.MinCost + 1} {
+		pp := NewPasswordPolicy(0, 0, cost)
+		got, err := bcrypt.Cost(pp.timingHash())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != cost {
+			t.Errorf("timing hash cost = %d, want %d", got, cost)
+		}
+	}
+}
+
+func TestPasswordFitsBcryptWithPepper(t *testing.T) {
+	pepper := strings.Repeat("p", 16)
+	uv := newUserValidator(nil, pepper, NewPasswordPolicy(0, 0, bcrypt.MinCost))
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{strings.Repeat("a", bcryptMaxBytes-len(pepper)), nil},
+		{strings.Repeat("a", bcryptMaxBytes-len(pepper)+1), ErrPasswordTooLong},
+		// Few enough characters, but too many bytes
+		{strings.Repeat("ü", 30), ErrPasswordTooLong},
+	}
+	for _, tt := range tests {
+		user := User{Password: tt.password}
+		if err := uv.passwordPolicy(&user); err != tt.want {
+			t.Errorf("passwordPolicy(%d bytes) = %v, want %v", len(tt.password), err, tt.want)
+		}
+	}
+}
@@ -10,31 +10,45 @@ const (
 
 type Property struct {
 	gorm.Model
-	UserID     uint   `gorm:"not_null;index"`
-	Name       string `gorm:"not_null"`
-	Address    string `gorm:"not_null"`
-	PostalCode string `gorm:"not_null"`
+	// OrganizationID owns the property, UserID is who created it
+	OrganizationID uint   `gorm:"index"`
+	UserID         uint   `gorm:"not_null;index"`
+	Name           string `gorm:"not_null"`
+	Address        string `gorm:"not_null"`
+	PostalCode     string `gorm:"not_null"`
 }
 
 // PropertyDB is the main interface,
 // accessible from outside model package
 type PropertyDB interface {
 	ByID(id uint) (*Property, error)
-	ByUserID(id uint) ([]Property, error)
+	ByOrganizationID(id uint) ([]Property, error)
+	ByIDs(ids []uint) ([]Property, error)
+	// Page returns up to limit properties of the organization or
+	// among shared, with an ID above after, in the order of IDs
+	Page(orgID uint, shared []uint, after uint, limit int) ([]Property, error)
 	Create(property *Property) error
 	Update(property *Property) error
 	Delete(id uint) error
+
+	// Purge removes the property for good along with its leases,
+	// their ledgers, and its tickets with their comments. Their
+	// files have to be deleted beforehand.
+	Purge(id uint) error
 }
 
 // PropertyService has the same method as
-// PropertyDB interface
+// PropertyDB interface, changes are recorded in the audit log
 type PropertyService interface {
+	// As returns the service acting on behalf of actor
+	As(actor Actor) PropertyService
 	PropertyDB
 }
 
 // concrete type that is returned by New* method
 type propertyService struct {
 	PropertyDB
+	audit auditRecorder
 }
 
 // propertyValidator is the concrete type that implements
@@ -58,7 +72,43 @@ func NewPropertyService(db *gorm.DB) PropertyService {
 				db: db,
 			},
 		},
+		audit: newAuditRecorder(db),
+	}
+}
+
+func (ps *propertyService) As(actor Actor) PropertyService {
+	scoped := *ps
+	scoped.audit.actor = actor
+	return &scoped
+}
+
+func (ps *propertyService) Create(p *Property) error {
+	if err := ps.PropertyDB.Create(p); err != nil {
+		return err
+	}
+	return ps.audit.record(AuditCreated, AuditProperty, p.ID, nil, p)
+}
+
+func (ps *propertyService) Update(p *Property) error {
+	before, err := ps.ByID(p.ID)
+	if err != nil {
+		return err
+	}
+	if err := ps.PropertyDB.Update(p); err != nil {
+		return err
 	}
+	return ps.audit.record(AuditUpdated, AuditProperty, p.ID, before, p)
+}
+
+func (ps *propertyService) Delete(id uint) error {
+	before, err := ps.ByID(id)
+	if err != nil {
+		return err
+	}
+	if err := ps.PropertyDB.Delete(id); err != nil {
+		return err
+	}
+	return ps.audit.record(AuditDeleted, AuditProperty, id, before, nil)
 }
 
 // DB Implementation
@@ -72,9 +122,9 @@ func (pg *propertyGorm) ByID(id uint) (*Property, error) {
 	return &property, nil
 }
 
-func (pg *propertyGorm) ByUserID(id uint) ([]Property, error) {
+func (pg *propertyGorm) ByOrganizationID(id uint) ([]Property, error) {
 	var properties []Property
-	db := pg.db.Where("user_id = ?", id)
+	db := pg.db.Where("organization_id = ?", id)
 	err := db.Find(&properties).Error
 	if err != nil {
 		return nil, err
@@ -82,6 +132,31 @@ func (pg *propertyGorm) ByUserID(id uint) ([]Property, error) {
 	return properties, nil
 }
 
+func (pg *propertyGorm) ByIDs(ids []uint) ([]Property, error) {
+	var properties []Property
+	if len(ids) == 0 {
+		return properties, nil
+	}
+	err := pg.db.Where("id in (?)", ids).Find(&properties).Error
+	if err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+func (pg *propertyGorm) Page(orgID uint, shared []uint, after uint, limit int) ([]Property, error) {
+	var properties []Property
+	db := pg.db.Where("organization_id = ?", orgID)
+	if len(shared) > 0 {
+		db = pg.db.Where("organization_id = ? OR id in (?)", orgID, shared)
+	}
+	err := db.Where("id > ?", after).Order("id").Limit(limit).Find(&properties).Error
+	if err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
 func (pg *propertyGorm) Create(p *Property) error {
 	return pg.db.Create(p).Error
 }
@@ -95,9 +170,31 @@ func (pg *propertyGorm) Delete(id uint) error {
 	return pg.db.Delete(&property).Error
 }
 
+func (pg *propertyGorm) Purge(id uint) error {
+	db := pg.db.Unscoped()
+	leases := db.Model(&Lease{}).Select("id").Where("property_id = ?", id).QueryExpr()
+	err := db.Where("lease_id IN (?)", leases).Delete(&LedgerEntry{}).Error
+	if err != nil {
+		return err
+	}
+	tickets := db.Model(&Ticket{}).Select("id").Where("property_id = ?", id).QueryExpr()
+	err = db.Where("ticket_id IN (?)", tickets).Delete(&TicketComment{}).Error
+	if err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&Ticket{}, &Lease{}} {
+		if err := db.Where("property_id = ?", id).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	property := Property{Model: gorm.Model{ID: id}}
+	return db.Delete(&property).Error
+}
+
 // Validator implementation
 func (pv *propertyValidator) Create(p *Property) error {
 	if err := runPropertyValFns(p,
+		pv.organizationIDRequired,
 		pv.userIDRequired,
 		pv.propertyNameRequired,
 		pv.propertyAddressRequired,
@@ -109,6 +206,7 @@ func (pv *propertyValidator) Create(p *Property) error {
 
 func (pv *propertyValidator) Update(p *Property) error {
 	if err := runPropertyValFns(p,
+		pv.organizationIDRequired,
 		pv.userIDRequired,
 		pv.propertyNameRequired,
 		pv.propertyAddressRequired,
@@ -136,6 +234,13 @@ func (pv *propertyValidator) userIDRequired(p *Property) error {
 	return nil
 }
 
+func (pv *propertyValidator) organizationIDRequired(p *Property) error {
+	if p.OrganizationID <= 0 {
+		return ErrOrganizationIDRequired
+	}
+	return nil
+}
+
 func (pv *propertyValidator) propertyNameRequired(p *Property) error {
 	if p.Name == "" {
 		return ErrPropertyNameRequired
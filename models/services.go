@@ -7,22 +7,46 @@ import (
 )
 
 type Services struct {
-	User        UserService
-	Gallery     GalleryService
-	Image       ImageService
-	Property    PropertyService
-	db          *gorm.DB
-	AWSSession  *session.Session
-	S3Bucket    string
-	Store       store.StoreProvider
-	StorageType string
-	ImageDomain string
+	User          UserService
+	Session       SessionService
+	TwoFactor     TwoFactorService
+	Throttle      LoginThrottleService
+	Identity      IdentityService
+	APIToken      APITokenService
+	CalendarFeed  CalendarFeedService
+	Idempotency   IdempotencyService
+	Grant         GrantService
+	Organization  OrganizationService
+	Invitation    InvitationService
+	Gallery       GalleryService
+	Image         ImageService
+	Property      PropertyService
+	Lease         LeaseService
+	Ledger        LedgerService
+	Ticket        TicketService
+	TicketComment TicketCommentService
+	Export        ExportService
+	Audit         AuditService
+	Outbox        OutboxService
+	Suppression   SuppressionService
+	Notification  NotificationService
+	Webhook       WebhookEndpointService
+	Delivery      WebhookDeliveryService
+	db            *gorm.DB
+	AWSSession    *session.Session
+	S3Bucket      string
+	Store         store.StoreProvider
+	StorageType   string
+	ImageDomain   string
+
+	// cfgs are kept to build the services of a transaction
+	cfgs []ServicesConfig
 }
 
 type ServicesConfig func(*Services) error
 
 func NewServices(cfgs ...ServicesConfig) (*Services, error) {
-	var s Services
+	s := Services{cfgs: cfgs}
 	for _, cfg := range cfgs {
 		if err := cfg(&s); err != nil {
 			return nil, err
@@ -31,8 +55,43 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 	return &s, nil
 }
 
+// Transaction calls fn with services working in a database
+// transaction, which is committed if fn returns nil and rolled
+// back otherwise. Use it to change several things at once, e.g.
+// a user and the emails queued about it.
+func (s *Services) Transaction(fn func(tx *Services) error) (err error) {
+	db := s.db.Begin()
+	if err := db.Error; err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			db.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			db.Rollback()
+		}
+	}()
+
+	tx := Services{db: db, cfgs: s.cfgs}
+	for _, cfg := range s.cfgs {
+		if err := cfg(&tx); err != nil {
+			return err
+		}
+	}
+	if err := fn(&tx); err != nil {
+		return err
+	}
+	return db.Commit().Error
+}
+
 func WithGorm(dialect, connectionInfo string) ServicesConfig {
 	return func(s *Services) error {
+		// Services of a transaction come with their database
+		if s.db != nil {
+			return nil
+		}
 		db, err := gorm.Open(dialect, connectionInfo)
 		if err != nil {
 			return err
@@ -49,9 +108,83 @@ func WithLogMode(mode bool) ServicesConfig {
 	}
 }
 
-func WithUser(pepper, hmacKey string) ServicesConfig {
+func WithUser(pepper, hmacKey string, policy *PasswordPolicy) ServicesConfig {
+	// Made now rather than on the first login attempt, which
+	// would take longer than the following ones
+	policy.timingHash()
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, pepper, hmacKey, policy)
+		return nil
+	}
+}
+
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithTwoFactor requires WithUser to be applied first
+func WithTwoFactor(issuer, hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, issuer, hmacKey)
+		return nil
+	}
+}
+
+func WithLoginThrottle() ServicesConfig {
+	return func(s *Services) error {
+		s.Throttle = NewLoginThrottleService(s.db)
+		return nil
+	}
+}
+
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		s.Identity = NewIdentityService(s.db)
+		return nil
+	}
+}
+
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithCalendarFeed(hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, pepper, hmacKey)
+		s.CalendarFeed = NewCalendarFeedService(s.db, hmacKey)
+		return nil
+	}
+}
+
+func WithIdempotency() ServicesConfig {
+	return func(s *Services) error {
+		s.Idempotency = NewIdempotencyService(s.db)
+		return nil
+	}
+}
+
+func WithGrant() ServicesConfig {
+	return func(s *Services) error {
+		s.Grant = NewGrantService(s.db)
+		return nil
+	}
+}
+
+func WithOrganization() ServicesConfig {
+	return func(s *Services) error {
+		s.Organization = NewOrganizationService(s.db)
+		return nil
+	}
+}
+
+func WithInvitation(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Invitation = NewInvitationService(s.db, hmacKey)
 		return nil
 	}
 }
@@ -106,6 +239,83 @@ func WithProperty() ServicesConfig {
 	}
 }
 
+func WithLease() ServicesConfig {
+	return func(s *Services) error {
+		s.Lease = NewLeaseService(s.db)
+		return nil
+	}
+}
+
+func WithLedger() ServicesConfig {
+	return func(s *Services) error {
+		s.Ledger = NewLedgerService(s.db)
+		return nil
+	}
+}
+
+func WithTicket() ServicesConfig {
+	return func(s *Services) error {
+		s.Ticket = NewTicketService(s.db)
+		return nil
+	}
+}
+
+func WithTicketComment() ServicesConfig {
+	return func(s *Services) error {
+		s.TicketComment = NewTicketCommentService(s.db)
+		return nil
+	}
+}
+
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+func WithOutbox() ServicesConfig {
+	return func(s *Services) error {
+		s.Outbox = NewOutboxService(s.db)
+		return nil
+	}
+}
+
+func WithSuppression() ServicesConfig {
+	return func(s *Services) error {
+		s.Suppression = NewSuppressionService(s.db)
+		return nil
+	}
+}
+
+func WithNotification() ServicesConfig {
+	return func(s *Services) error {
+		s.Notification = NewNotificationService(s.db)
+		return nil
+	}
+}
+
+func WithWebhookEndpoint() ServicesConfig {
+	return func(s *Services) error {
+		s.Webhook = NewWebhookEndpointService(s.db)
+		return nil
+	}
+}
+
+func WithWebhookDelivery() ServicesConfig {
+	return func(s *Services) error {
+		s.Delivery = NewWebhookDeliveryService(s.db)
+		return nil
+	}
+}
+
+func WithExport(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Export = NewExportService(s.db, hmacKey)
+		return nil
+	}
+}
+
 // I will keep this commented, for future reference
 //func NewServices(dialect, connectionInfo string) (*Services, error) {
 //
@@ -129,11 +339,17 @@ func (s *Services) Close() error {
 }
 
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}, &Property{}, &Image{}).Error
+	err := s.db.AutoMigrate(&User{}, &Session{}, &recoveryCode{}, &loginChallenge{}, &loginThrottle{}, &Identity{}, &APIToken{}, &CalendarFeed{}, &IdempotentRequest{}, &Grant{}, &Organization{}, &Membership{}, &Invitation{}, &Gallery{}, &pwReset{}, &emailVerification{}, &Property{}, &Lease{}, &LedgerEntry{}, &Ticket{}, &TicketComment{}, &Export{}, &AuditEvent{}, &OutboxMessage{}, &Suppression{}, &Notification{}, &NotificationPreference{}, &WebhookEndpoint{}, &WebhookDelivery{}, &Image{}).Error
+	if err != nil {
+		return err
+	}
+	return s.Transaction(func(tx *Services) error {
+		return migratePersonalOrganizations(tx.db)
+	})
 }
 
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}, &Property{}, &Image{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Session{}, &recoveryCode{}, &loginChallenge{}, &loginThrottle{}, &Identity{}, &APIToken{}, &CalendarFeed{}, &IdempotentRequest{}, &Grant{}, &Organization{}, &Membership{}, &Invitation{}, &Gallery{}, &pwReset{}, &emailVerification{}, &Property{}, &Lease{}, &LedgerEntry{}, &Ticket{}, &TicketComment{}, &Export{}, &AuditEvent{}, &OutboxMessage{}, &Suppression{}, &Notification{}, &NotificationPreference{}, &WebhookEndpoint{}, &WebhookDelivery{}, &Image{}).Error
 	if err != nil {
 		return err
 	}
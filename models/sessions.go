@@ -0,0 +1,277 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+	"time"
+)
+
+const (
+	// SessionDuration is how long a session stays valid after it was created
+	SessionDuration = 30 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often LastSeenAt is written back,
+	// so we don't update the sessions table on every single request.
+	sessionTouchInterval = 5 * time.Minute
+
+	// ImpersonationDuration is how long an operator can act as
+	// another user before having to start over
+	ImpersonationDuration = time.Hour
+)
+
+// Session represents a single signed in device. A user can have
+// as many sessions as devices, each one can be revoked separately.
+// OrganizationID is the organization the user works in on the device.
+// ImpersonatorID is set when an operator acts as the user.
+type Session struct {
+	gorm.Model
+	UserID         uint `gorm:"not null;index"`
+	OrganizationID uint
+	ImpersonatorID uint
+	Token          string    `gorm:"-"`
+	TokenHash      string    `gorm:"not null;unique_index"`
+	UserAgent      string    `gorm:"size:512"`
+	IP             string    `gorm:"size:64"`
+	LastSeenAt     time.Time `gorm:"not null"`
+	ExpiresAt      time.Time `gorm:"not null;index"`
+}
+
+// Expired reports whether the session can no longer be used
+func (s *Session) Expired() bool {
+	return time.Now().After(s.ExpiresAt)
+}
+
+// Impersonated reports whether an operator is acting as the user
+func (s *Session) Impersonated() bool {
+	return s.ImpersonatorID != 0
+}
+
+// SessionService is the set of methods used to
+// manage user sessions from outside the models package
+type SessionService interface {
+	// Active looks up the session for the provided token. Expired
+	// sessions are removed and ErrTokenExpired is returned.
+	Active(token string) (*Session, error)
+	SessionDB
+}
+
+// SessionDB is used to interact with the sessions database.
+type SessionDB interface {
+	ByID(id uint) (*Session, error)
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+
+	Create(s *Session) error
+	Update(s *Session) error
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+var _ SessionService = &sessionService{}
+var _ SessionDB = &sessionValidator{}
+var _ SessionDB = &sessionGorm{}
+
+// NewSessionService returns a SessionService backed by gorm
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{
+				db: db,
+			},
+			hmac: hash.NewHMAC(hmacKey),
+		},
+	}
+}
+
+func (ss *sessionService) Active(token string) (*Session, error) {
+	session, err := ss.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Expired() {
+		ss.Delete(session.ID)
+		return nil, ErrTokenExpired
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		session.LastSeenAt = time.Now()
+		if err := ss.Update(session); err != nil {
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// DB Implementation
+func (sg *sessionGorm) ByID(id uint) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("id = ?", id), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ByUserID returns the sessions of a user, most recently used first
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	db := sg.db.Where("user_id = ?", userID).Order("last_seen_at desc")
+	err := db.Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(s *Session) error {
+	return sg.db.Create(s).Error
+}
+
+func (sg *sessionGorm) Update(s *Session) error {
+	return sg.db.Save(s).Error
+}
+
+// Delete removes the session for good, a revoked session
+// has no reason to be kept around.
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Unscoped().Where("user_id = ?", userID).Delete(&Session{}).Error
+}
+
+// Validator implementation
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{
+		Token: token,
+	}
+
+	if err := runSessionValFns(&session, sv.hmacToken); err != nil {
+		return nil, err
+	}
+	return sv.SessionDB.ByToken(session.TokenHash)
+}
+
+func (sv *sessionValidator) Create(s *Session) error {
+	err := runSessionValFns(s,
+		sv.requireUserID,
+		sv.setTokenIfUnset,
+		sv.hmacToken,
+		sv.setTimestampsIfUnset)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(s)
+}
+
+func (sv *sessionValidator) Update(s *Session) error {
+	if err := runSessionValFns(s, sv.requireUserID, sv.nonZeroID); err != nil {
+		return err
+	}
+	return sv.SessionDB.Update(s)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	var session Session
+	session.ID = id
+	if err := runSessionValFns(&session, sv.nonZeroID); err != nil {
+		return err
+	}
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	var session Session
+	session.UserID = userID
+	if err := runSessionValFns(&session, sv.requireUserID); err != nil {
+		return err
+	}
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+// Validation functions
+func (sv *sessionValidator) requireUserID(s *Session) error {
+	if s.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) nonZeroID(s *Session) error {
+	if s.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(s *Session) error {
+	if s.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	s.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(s *Session) error {
+	if s.Token == "" {
+		return ErrTokenInvalid
+	}
+
+	s.TokenHash = sv.hmac.Hash(s.Token)
+	return nil
+}
+
+func (sv *sessionValidator) setTimestampsIfUnset(s *Session) error {
+	now := time.Now()
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = now
+	}
+	if s.ExpiresAt.IsZero() {
+		s.ExpiresAt = now.Add(SessionDuration)
+	}
+	return nil
+}
+
+// Validator functions
+type sessionValFn func(s *Session) error
+
+func runSessionValFns(s *Session, fns ...sessionValFn) error {
+	for _, fn := range fns {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
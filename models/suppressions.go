@@ -0,0 +1,142 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Reasons addresses are suppressed for
+const (
+	SuppressBounced    = "bounced"
+	SuppressComplained = "complained"
+)
+
+const (
+	ErrSuppressionReasonInvalid modelError = "models: suppression reason is not valid"
+)
+
+// Suppression is an address we no longer email, because mail to
+// it bounced for good or its owner marked our mail as spam.
+// Sending more would hurt the reputation of our sender domain.
+type Suppression struct {
+	gorm.Model
+	Email  string `gorm:"not null;unique_index"`
+	Reason string `gorm:"not null"`
+	Detail string `gorm:"type:text"`
+}
+
+// SuppressionService is the set of methods used to
+// manage suppressed addresses from outside the models package
+type SuppressionService interface {
+	// Suppressed reports whether email must not be sent to
+	Suppressed(email string) (bool, error)
+	SuppressionDB
+}
+
+// SuppressionDB is used to interact with the suppressions database
+type SuppressionDB interface {
+	ByEmail(email string) (*Suppression, error)
+	// Recent returns up to limit suppressions, newest first
+	Recent(limit int) ([]Suppression, error)
+	// Create keeps the existing suppression of the address, if
+	// any, s is then not given an ID.
+	Create(s *Suppression) error
+	Delete(id uint) error
+}
+
+type suppressionService struct {
+	SuppressionDB
+}
+
+type suppressionValidator struct {
+	SuppressionDB
+}
+
+type suppressionGorm struct {
+	db *gorm.DB
+}
+
+var _ SuppressionService = &suppressionService{}
+var _ SuppressionDB = &suppressionValidator{}
+var _ SuppressionDB = &suppressionGorm{}
+
+func NewSuppressionService(db *gorm.DB) SuppressionService {
+	return &suppressionService{
+		SuppressionDB: &suppressionValidator{
+			SuppressionDB: &suppressionGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (ss *suppressionService) Suppressed(email string) (bool, error) {
+	_, err := ss.ByEmail(email)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// DB Implementation
+func (sg *suppressionGorm) ByEmail(email string) (*Suppression, error) {
+	var s Suppression
+	err := first(sg.db.Where("email = ?", email), &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (sg *suppressionGorm) Recent(limit int) ([]Suppression, error) {
+	var suppressions []Suppression
+	err := sg.db.Order("created_at desc").Limit(limit).Find(&suppressions).Error
+	if err != nil {
+		return nil, err
+	}
+	return suppressions, nil
+}
+
+func (sg *suppressionGorm) Create(s *Suppression) error {
+	db := sg.db.Set("gorm:insert_option", "ON CONFLICT (email) DO NOTHING")
+	return insertedOrSkipped(db.Create(s).Error)
+}
+
+// Delete lifts a suppression, for good so the address can be
+// suppressed again
+func (sg *suppressionGorm) Delete(id uint) error {
+	return sg.db.Unscoped().Where("id = ?", id).Delete(&Suppression{}).Error
+}
+
+// Validator implementation
+func (sv *suppressionValidator) ByEmail(email string) (*Suppression, error) {
+	return sv.SuppressionDB.ByEmail(normalizeAddress(email))
+}
+
+func (sv *suppressionValidator) Create(s *Suppression) error {
+	s.Email = normalizeAddress(s.Email)
+	if s.Email == "" {
+		return ErrEmailRequired
+	}
+	switch s.Reason {
+	case SuppressBounced, SuppressComplained:
+	default:
+		return ErrSuppressionReasonInvalid
+	}
+	return sv.SuppressionDB.Create(s)
+}
+
+func (sv *suppressionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SuppressionDB.Delete(id)
+}
+
+func normalizeAddress(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
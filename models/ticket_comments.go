@@ -0,0 +1,155 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Where ticket comments come from
+const (
+	CommentSourceWeb   = "web"
+	CommentSourceEmail = "email"
+)
+
+const (
+	ErrTicketIDRequired     modelError = "models: ticket ID is required"
+	ErrCommentSourceInvalid modelError = "models: comment source is not valid"
+	ErrCommentBodyRequired  modelError = "models: comment is empty"
+)
+
+// TicketComment is a message on a ticket, by its tenant or by
+// someone looking after the property. Attachments are Images
+// with the comment as their external reference.
+type TicketComment struct {
+	gorm.Model
+	TicketID uint   `gorm:"not null;index"`
+	AuthorID uint   `gorm:"not null;index"`
+	Body     string `gorm:"type:text"`
+	Source   string `gorm:"not null"`
+}
+
+// TicketCommentService is the set of methods used to
+// manage ticket comments from outside the models package
+type TicketCommentService interface {
+	TicketCommentDB
+}
+
+// TicketCommentDB is used to interact with the ticket comments
+// database
+type TicketCommentDB interface {
+	// ByTicketID returns the comments of a ticket, oldest first
+	ByTicketID(ticketID uint) ([]TicketComment, error)
+	ByAuthorID(authorID uint) ([]TicketComment, error)
+	// Create saves a comment, which may have an empty body
+	// when it is sent for its attachments.
+	Create(comment *TicketComment) error
+	DeleteByAuthorID(authorID uint) error
+}
+
+type ticketCommentService struct {
+	TicketCommentDB
+}
+
+type ticketCommentValidator struct {
+	TicketCommentDB
+}
+
+type ticketCommentGorm struct {
+	db *gorm.DB
+}
+
+var _ TicketCommentService = &ticketCommentService{}
+var _ TicketCommentDB = &ticketCommentValidator{}
+var _ TicketCommentDB = &ticketCommentGorm{}
+
+func NewTicketCommentService(db *gorm.DB) TicketCommentService {
+	return &ticketCommentService{
+		TicketCommentDB: &ticketCommentValidator{
+			TicketCommentDB: &ticketCommentGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// DB Implementation
+func (tcg *ticketCommentGorm) ByTicketID(ticketID uint) ([]TicketComment, error) {
+	var comments []TicketComment
+	db := tcg.db.Where("ticket_id = ?", ticketID).Order("created_at")
+	err := db.Find(&comments).Error
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (tcg *ticketCommentGorm) ByAuthorID(authorID uint) ([]TicketComment, error) {
+	var comments []TicketComment
+	err := tcg.db.Where("author_id = ?", authorID).Find(&comments).Error
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+func (tcg *ticketCommentGorm) Create(comment *TicketComment) error {
+	return tcg.db.Create(comment).Error
+}
+
+// DeleteByAuthorID removes the comments of the user for good
+func (tcg *ticketCommentGorm) DeleteByAuthorID(authorID uint) error {
+	return tcg.db.Unscoped().Where("author_id = ?", authorID).Delete(&TicketComment{}).Error
+}
+
+// Validator implementation
+func (tcv *ticketCommentValidator) Create(comment *TicketComment) error {
+	err := runTicketCommentValFns(comment,
+		tcv.ticketIDRequired,
+		tcv.authorIDRequired,
+		tcv.normalizeBody,
+		tcv.sourceValid)
+	if err != nil {
+		return err
+	}
+	return tcv.TicketCommentDB.Create(comment)
+}
+
+// Validation functions
+func (tcv *ticketCommentValidator) ticketIDRequired(comment *TicketComment) error {
+	if comment.TicketID <= 0 {
+		return ErrTicketIDRequired
+	}
+	return nil
+}
+
+func (tcv *ticketCommentValidator) authorIDRequired(comment *TicketComment) error {
+	if comment.AuthorID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (tcv *ticketCommentValidator) normalizeBody(comment *TicketComment) error {
+	comment.Body = strings.TrimSpace(comment.Body)
+	return nil
+}
+
+func (tcv *ticketCommentValidator) sourceValid(comment *TicketComment) error {
+	switch comment.Source {
+	case CommentSourceWeb, CommentSourceEmail:
+		return nil
+	}
+	return ErrCommentSourceInvalid
+}
+
+// Validator functions
+type ticketCommentValFn func(comment *TicketComment) error
+
+func runTicketCommentValFns(comment *TicketComment, fns ...ticketCommentValFn) error {
+	for _, fn := range fns {
+		if err := fn(comment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
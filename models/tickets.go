@@ -0,0 +1,215 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Ticket statuses, in the order a ticket goes through them
+const (
+	TicketOpen       = "open"
+	TicketInProgress = "in progress"
+	TicketClosed     = "closed"
+)
+
+// TicketStatuses lists every status a ticket can have
+var TicketStatuses = []string{
+	TicketOpen,
+	TicketInProgress,
+	TicketClosed,
+}
+
+const (
+	ErrTicketStatusInvalid modelError = "models: ticket status is not valid"
+)
+
+// Ticket is a maintenance request for a property, opened by a
+// tenant under their lease. Photos are Images with the ticket
+// as their external reference.
+type Ticket struct {
+	gorm.Model
+	PropertyID  uint   `gorm:"not null;index"`
+	LeaseID     uint   `gorm:"not null;index"`
+	OpenedByID  uint   `gorm:"not null"`
+	Title       string `gorm:"not null"`
+	Description string `gorm:"type:text"`
+	Status      string `gorm:"not null"`
+}
+
+// TicketService is the set of methods used to
+// manage tickets from outside the models package
+type TicketService interface {
+	TicketDB
+}
+
+// TicketDB is used to interact with the tickets database
+type TicketDB interface {
+	ByID(id uint) (*Ticket, error)
+	ByLeaseID(leaseID uint) ([]Ticket, error)
+	ByPropertyID(propertyID uint) ([]Ticket, error)
+	Create(ticket *Ticket) error
+	Update(ticket *Ticket) error
+}
+
+type ticketService struct {
+	TicketDB
+}
+
+type ticketValidator struct {
+	TicketDB
+}
+
+type ticketGorm struct {
+	db *gorm.DB
+}
+
+var _ TicketService = &ticketService{}
+var _ TicketDB = &ticketValidator{}
+var _ TicketDB = &ticketGorm{}
+
+func NewTicketService(db *gorm.DB) TicketService {
+	return &ticketService{
+		TicketDB: &ticketValidator{
+			TicketDB: &ticketGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+// DB Implementation
+func (tg *ticketGorm) ByID(id uint) (*Ticket, error) {
+	var ticket Ticket
+	err := first(tg.db.Where("id = ?", id), &ticket)
+	if err != nil {
+		return nil, err
+	}
+	return &ticket, nil
+}
+
+// ByLeaseID returns the tickets opened under a lease, newest first
+func (tg *ticketGorm) ByLeaseID(leaseID uint) ([]Ticket, error) {
+	var tickets []Ticket
+	db := tg.db.Where("lease_id = ?", leaseID).Order("created_at desc")
+	err := db.Find(&tickets).Error
+	if err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+// ByPropertyID returns the tickets of a property, newest first
+func (tg *ticketGorm) ByPropertyID(propertyID uint) ([]Ticket, error) {
+	var tickets []Ticket
+	db := tg.db.Where("property_id = ?", propertyID).Order("created_at desc")
+	err := db.Find(&tickets).Error
+	if err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+func (tg *ticketGorm) Create(ticket *Ticket) error {
+	return tg.db.Create(ticket).Error
+}
+
+func (tg *ticketGorm) Update(ticket *Ticket) error {
+	return tg.db.Save(ticket).Error
+}
+
+// Validator implementation
+func (tv *ticketValidator) Create(ticket *Ticket) error {
+	err := runTicketValFns(ticket,
+		tv.propertyIDRequired,
+		tv.leaseIDRequired,
+		tv.openedByRequired,
+		tv.normalizeTitle,
+		tv.titleRequired,
+		tv.setStatusIfUnset,
+		tv.statusValid)
+	if err != nil {
+		return err
+	}
+	return tv.TicketDB.Create(ticket)
+}
+
+func (tv *ticketValidator) Update(ticket *Ticket) error {
+	err := runTicketValFns(ticket,
+		tv.nonZeroID,
+		tv.normalizeTitle,
+		tv.titleRequired,
+		tv.statusValid)
+	if err != nil {
+		return err
+	}
+	return tv.TicketDB.Update(ticket)
+}
+
+// Validation functions
+func (tv *ticketValidator) nonZeroID(ticket *Ticket) error {
+	if ticket.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (tv *ticketValidator) propertyIDRequired(ticket *Ticket) error {
+	if ticket.PropertyID <= 0 {
+		return ErrPropertyIDRequired
+	}
+	return nil
+}
+
+func (tv *ticketValidator) leaseIDRequired(ticket *Ticket) error {
+	if ticket.LeaseID <= 0 {
+		return ErrLeaseIDRequired
+	}
+	return nil
+}
+
+func (tv *ticketValidator) openedByRequired(ticket *Ticket) error {
+	if ticket.OpenedByID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (tv *ticketValidator) normalizeTitle(ticket *Ticket) error {
+	ticket.Title = strings.TrimSpace(ticket.Title)
+	return nil
+}
+
+func (tv *ticketValidator) titleRequired(ticket *Ticket) error {
+	if ticket.Title == "" {
+		return ErrTitleRequired
+	}
+	return nil
+}
+
+func (tv *ticketValidator) setStatusIfUnset(ticket *Ticket) error {
+	if ticket.Status == "" {
+		ticket.Status = TicketOpen
+	}
+	return nil
+}
+
+func (tv *ticketValidator) statusValid(ticket *Ticket) error {
+	for _, s := range TicketStatuses {
+		if ticket.Status == s {
+			return nil
+		}
+	}
+	return ErrTicketStatusInvalid
+}
+
+// Validator functions
+type ticketValFn func(ticket *Ticket) error
+
+func runTicketValFns(ticket *Ticket, fns ...ticketValFn) error {
+	for _, fn := range fns {
+		if err := fn(ticket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+package models
+
+import (
+	"encoding/base32"
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/rand"
+	"github.com/ruckuus/dojo1/totp"
+	"strings"
+	"time"
+)
+
+const (
+	// RecoveryCodeCount is how many recovery codes a user gets
+	RecoveryCodeCount = 10
+
+	recoveryCodeBytes = 5
+
+	// loginChallengeDuration is the time a user has to type the
+	// second factor after the password was accepted.
+	loginChallengeDuration = 5 * time.Minute
+
+	// loginChallengeMaxAttempts limits code guessing per challenge
+	loginChallengeMaxAttempts = 5
+)
+
+const (
+	// ErrTwoFactorCodeInvalid is returned when a TOTP or recovery code does not match
+	ErrTwoFactorCodeInvalid modelError = "models: two-factor code is not valid"
+
+	// ErrTwoFactorEnabled is returned when enrolling a user that already has 2FA
+	ErrTwoFactorEnabled modelError = "models: two-factor authentication is already enabled"
+
+	// ErrTwoFactorDisabled is returned when 2FA is required but not set up
+	ErrTwoFactorDisabled modelError = "models: two-factor authentication is not enabled"
+
+	// ErrTooManyAttempts is returned when a login challenge was guessed too often
+	ErrTooManyAttempts modelError = "models: too many attempts, please sign in again"
+)
+
+// recoveryCode is a single use code that replaces a TOTP code
+// when the user lost access to their authenticator app.
+type recoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null;index"`
+	UsedAt   *time.Time
+}
+
+// loginChallenge is created once the password has been verified
+// for a user with 2FA, and consumed by the second login step.
+type loginChallenge struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Attempts  int    `gorm:"not null"`
+}
+
+// TwoFactorService manages TOTP enrollment, recovery codes and
+// the second step of the login.
+type TwoFactorService interface {
+	// NewSecret generates a secret for enrollment
+	NewSecret(user *User) (string, error)
+
+	// ProvisioningURI returns the otpauth:// URI for secret,
+	// to be shown to the user as a QR code.
+	ProvisioningURI(user *User, secret string) string
+
+	// Enable turns on 2FA once the user proved they can generate
+	// codes for secret. It returns the plain recovery codes, which
+	// are not stored anywhere and must be shown to the user once.
+	Enable(user *User, secret, code string) ([]string, error)
+	Disable(user *User, code string) error
+	RegenerateRecoveryCodes(user *User, code string) ([]string, error)
+
+	BeginChallenge(user *User) (string, error)
+
+	// ChallengeUser returns the user a pending challenge belongs to
+	ChallengeUser(token string) (*User, error)
+	CompleteChallenge(token, code string) (*User, error)
+}
+
+type twoFactorService struct {
+	UserDB
+	issuer         string
+	hmac           hash.HMAC
+	recoveryCodeDB recoveryCodeDB
+	challengeDB    loginChallengeDB
+}
+
+type recoveryCodeDB interface {
+	ByUserIDAndHash(userID uint, codeHash string) (*recoveryCode, error)
+	Create(rc *recoveryCode) error
+	Update(rc *recoveryCode) error
+	DeleteByUserID(userID uint) error
+}
+
+type loginChallengeDB interface {
+	ByToken(tokenHash string) (*loginChallenge, error)
+	Create(lc *loginChallenge) error
+	Update(lc *loginChallenge) error
+	Delete(id uint) error
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+type loginChallengeGorm struct {
+	db *gorm.DB
+}
+
+var _ TwoFactorService = &twoFactorService{}
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+var _ loginChallengeDB = &loginChallengeGorm{}
+
+// NewTwoFactorService returns a TwoFactorService. issuer is the
+// name authenticator apps display next to the codes.
+func NewTwoFactorService(db *gorm.DB, udb UserDB, issuer, hmacKey string) TwoFactorService {
+	return &twoFactorService{
+		UserDB:         udb,
+		issuer:         issuer,
+		hmac:           hash.NewHMAC(hmacKey),
+		recoveryCodeDB: &recoveryCodeGorm{db},
+		challengeDB:    &loginChallengeGorm{db},
+	}
+}
+
+func (tfs *twoFactorService) NewSecret(user *User) (string, error) {
+	if user.TwoFactorEnabled() {
+		return "", ErrTwoFactorEnabled
+	}
+	return totp.GenerateSecret()
+}
+
+func (tfs *twoFactorService) ProvisioningURI(user *User, secret string) string {
+	return totp.ProvisioningURI(tfs.issuer, user.Email, secret)
+}
+
+func (tfs *twoFactorService) Enable(user *User, secret, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPLastStep = step
+	if err := tfs.Update(user); err != nil {
+		return nil, err
+	}
+
+	return tfs.newRecoveryCodes(user.ID)
+}
+
+func (tfs *twoFactorService) Disable(user *User, code string) error {
+	if err := tfs.verify(user, code); err != nil {
+		return err
+	}
+
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	if err := tfs.Update(user); err != nil {
+		return err
+	}
+
+	return tfs.recoveryCodeDB.DeleteByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) RegenerateRecoveryCodes(user *User, code string) ([]string, error) {
+	if err := tfs.verify(user, code); err != nil {
+		return nil, err
+	}
+	return tfs.newRecoveryCodes(user.ID)
+}
+
+func (tfs *twoFactorService) BeginChallenge(user *User) (string, error) {
+	if !user.TwoFactorEnabled() {
+		return "", ErrTwoFactorDisabled
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return "", err
+	}
+
+	lc := loginChallenge{
+		UserID:    user.ID,
+		TokenHash: tfs.hmac.Hash(token),
+	}
+	if err := tfs.challengeDB.Create(&lc); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (tfs *twoFactorService) ChallengeUser(token string) (*User, error) {
+	lc, err := tfs.challenge(token)
+	if err != nil {
+		return nil, err
+	}
+	return tfs.ByID(lc.UserID)
+}
+
+func (tfs *twoFactorService) CompleteChallenge(token, code string) (*User, error) {
+	lc, err := tfs.challenge(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.Attempts >= loginChallengeMaxAttempts {
+		tfs.challengeDB.Delete(lc.ID)
+		return nil, ErrTooManyAttempts
+	}
+
+	user, err := tfs.ByID(lc.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tfs.verify(user, code); err != nil {
+		lc.Attempts++
+		if updateErr := tfs.challengeDB.Update(lc); updateErr != nil {
+			return nil, updateErr
+		}
+		return nil, err
+	}
+
+	if err := tfs.challengeDB.Delete(lc.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// challenge returns the unexpired challenge for token
+func (tfs *twoFactorService) challenge(token string) (*loginChallenge, error) {
+	if token == "" {
+		return nil, ErrTokenInvalid
+	}
+
+	lc, err := tfs.challengeDB.ByToken(tfs.hmac.Hash(token))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(lc.CreatedAt) > loginChallengeDuration {
+		tfs.challengeDB.Delete(lc.ID)
+		return nil, ErrTokenExpired
+	}
+	return lc, nil
+}
+
+// verify accepts either the current TOTP code or an unused
+// recovery code. TOTP codes can only be used once, recovery
+// codes are burnt on use.
+func (tfs *twoFactorService) verify(user *User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTwoFactorDisabled
+	}
+
+	code = strings.TrimSpace(code)
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		if step <= user.TOTPLastStep {
+			return ErrTwoFactorCodeInvalid
+		}
+		user.TOTPLastStep = step
+		return tfs.Update(user)
+	}
+
+	rc, err := tfs.recoveryCodeDB.ByUserIDAndHash(user.ID, tfs.hmac.Hash(normalizeRecoveryCode(code)))
+	if err != nil {
+		if err == ErrNotFound {
+			return ErrTwoFactorCodeInvalid
+		}
+		return err
+	}
+
+	now := time.Now()
+	rc.UsedAt = &now
+	return tfs.recoveryCodeDB.Update(rc)
+}
+
+// newRecoveryCodes replaces all recovery codes of the user
+func (tfs *twoFactorService) newRecoveryCodes(userID uint) ([]string, error) {
+	if err := tfs.recoveryCodeDB.DeleteByUserID(userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		rc := recoveryCode{
+			UserID:   userID,
+			CodeHash: tfs.hmac.Hash(normalizeRecoveryCode(code)),
+		}
+		if err := tfs.recoveryCodeDB.Create(&rc); err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a code like "k3j5d-9zq2m"
+func generateRecoveryCode() (string, error) {
+	b, err := rand.Bytes(recoveryCodeBytes * 2)
+	if err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	return s[:5] + "-" + s[5:10], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// DB Implementation
+func (rcg *recoveryCodeGorm) ByUserIDAndHash(userID uint, codeHash string) (*recoveryCode, error) {
+	var rc recoveryCode
+	db := rcg.db.Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash)
+	err := first(db, &rc)
+	if err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func (rcg *recoveryCodeGorm) Create(rc *recoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+func (rcg *recoveryCodeGorm) Update(rc *recoveryCode) error {
+	return rcg.db.Save(rc).Error
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
+
+func (lcg *loginChallengeGorm) ByToken(tokenHash string) (*loginChallenge, error) {
+	var lc loginChallenge
+	err := first(lcg.db.Where("token_hash = ?", tokenHash), &lc)
+	if err != nil {
+		return nil, err
+	}
+	return &lc, nil
+}
+
+func (lcg *loginChallengeGorm) Create(lc *loginChallenge) error {
+	return lcg.db.Create(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Update(lc *loginChallenge) error {
+	return lcg.db.Save(lc).Error
+}
+
+func (lcg *loginChallengeGorm) Delete(id uint) error {
+	lc := loginChallenge{Model: gorm.Model{ID: id}}
+	return lcg.db.Unscoped().Delete(&lc).Error
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/totp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memUserDB keeps the users of the tests in memory, only the
+// methods the two-factor service uses are implemented
+type memUserDB struct {
+	UserDB
+	users map[uint]*User
+}
+
+func (db *memUserDB) ByID(id uint) (*User, error) {
+	u, ok := db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *u
+	return &c, nil
+}
+
+func (db *memUserDB) Update(user *User) error {
+	c := *user
+	db.users[user.ID] = &c
+	return nil
+}
+
+type memRecoveryCodeDB struct {
+	codes []*recoveryCode
+}
+
+func (db *memRecoveryCodeDB) ByUserIDAndHash(userID uint, codeHash string) (*recoveryCode, error) {
+	for _, rc := range db.codes {
+		if rc.UserID == userID && rc.CodeHash == codeHash && rc.UsedAt == nil {
+			c := *rc
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memRecoveryCodeDB) Create(rc *recoveryCode) error {
+	rc.ID = uint(len(db.codes) + 1)
+	c := *rc
+	db.codes = append(db.codes, &c)
+	return nil
+}
+
+func (db *memRecoveryCodeDB) Update(rc *recoveryCode) error {
+	for i, c := range db.codes {
+		if c.ID == rc.ID {
+			c := *rc
+			db.codes[i] = &c
+		}
+	}
+	return nil
+}
+
+func (db *memRecoveryCodeDB) DeleteByUserID(userID uint) error {
+	var kept []*recoveryCode
+	for _, rc := range db.codes {
+		if rc.UserID != userID {
+			kept = append(kept, rc)
+		}
+	}
+	db.codes = kept
+	return nil
+}
+
+type memLoginChallengeDB struct {
+	challenges map[uint]*loginChallenge
+	nextID     uint
+}
+
+func (db *memLoginChallengeDB) ByToken(tokenHash string) (*loginChallenge, error) {
+	for _, lc := range db.challenges {
+		if lc.TokenHash == tokenHash {
+			c := *lc
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memLoginChallengeDB) Create(lc *loginChallenge) error {
+	db.nextID++
+	lc.ID = db.nextID
+	lc.CreatedAt = time.Now()
+	c := *lc
+	db.challenges[lc.ID] = &c
+	return nil
+}
+
+func (db *memLoginChallengeDB) Update(lc *loginChallenge) error {
+	c := *lc
+	db.challenges[lc.ID] = &c
+	return nil
+}
+
+func (db *memLoginChallengeDB) Delete(id uint) error {
+	delete(db.challenges, id)
+	return nil
+}
+
+// newTestTwoFactor returns a two-factor service in memory, and
+// a user who enabled 2FA along with their recovery codes
+func newTestTwoFactor(t *testing.T) (*twoFactorService, *User, []string) {
+	users := &memUserDB{users: map[uint]*User{}}
+	tfs := &twoFactorService{
+		UserDB:         users,
+		issuer:         "Tataruma",
+		hmac:           hash.NewHMAC("test-key"),
+		recoveryCodeDB: &memRecoveryCodeDB{},
+		challengeDB:    &memLoginChallengeDB{challenges: map[uint]*loginChallenge{}},
+	}
+
+	user := &User{Email: "jane@example.com"}
+	user.ID = 1
+	users.Update(user)
+
+	secret, err := tfs.NewSecret(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := tfs.Enable(user, secret, code)
+	if err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("Enable returned %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+	return tfs, user, codes
+}
+
+// signIn runs the second step of a login with code
+func signIn(tfs *twoFactorService, user *User, code string) error {
+	token, err := tfs.BeginChallenge(user)
+	if err != nil {
+		return err
+	}
+	_, err = tfs.CompleteChallenge(token, code)
+	return err
+}
+
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	tfs, user, codes := newTestTwoFactor(t)
+
+	if err := signIn(tfs, user, codes[0]); err != nil {
+		t.Fatalf("first use of a recovery code: %v", err)
+	}
+	if err := signIn(tfs, user, codes[0]); err != ErrTwoFactorCodeInvalid {
+		t.Fatalf("second use of a recovery code: got %v, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+	if err := signIn(tfs, user, codes[1]); err != nil {
+		t.Fatalf("another recovery code: %v", err)
+	}
+}
+
+func TestRecoveryCodeFormatting(t *testing.T) {
+	tfs, user, codes := newTestTwoFactor(t)
+
+	typed := strings.ToUpper(strings.Replace(codes[0], "-", " ", 1))
+	if err := signIn(tfs, user, typed); err != nil {
+		t.Fatalf("recovery code typed as %q: %v", typed, err)
+	}
+	if err := signIn(tfs, user, codes[0]); err != ErrTwoFactorCodeInvalid {
+		t.Fatalf("recovery code used again in another format: got %v", err)
+	}
+}
+
+func TestRegeneratedRecoveryCodesReplaceOldOnes(t *testing.T) {
+	tfs, user, codes := newTestTwoFactor(t)
+
+	fresh, err := tfs.RegenerateRecoveryCodes(user, codes[0])
+	if err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+	if err := signIn(tfs, user, codes[1]); err != ErrTwoFactorCodeInvalid {
+		t.Fatalf("old recovery code after regenerating: got %v", err)
+	}
+	if err := signIn(tfs, user, fresh[0]); err != nil {
+		t.Fatalf("new recovery code: %v", err)
+	}
+}
+
+func TestTOTPCodeSingleUse(t *testing.T) {
+	tfs, user, _ := newTestTwoFactor(t)
+
+	// The code used to enable 2FA can't sign in again
+	user, _ = tfs.ByID(user.ID)
+	code, err := totp.Code(user.TOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signIn(tfs, user, code); err != ErrTwoFactorCodeInvalid {
+		t.Fatalf("TOTP code used twice: got %v, want %v", err, ErrTwoFactorCodeInvalid)
+	}
+}
+
+func TestChallengeAttemptsLimited(t *testing.T) {
+	tfs, user, codes := newTestTwoFactor(t)
+
+	token, err := tfs.BeginChallenge(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < loginChallengeMaxAttempts; i++ {
+		if _, err := tfs.CompleteChallenge(token, "zzzzzz"); err != ErrTwoFactorCodeInvalid {
+			t.Fatalf("attempt %d: got %v", i+1, err)
+		}
+	}
+	if _, err := tfs.CompleteChallenge(token, codes[0]); err != ErrTooManyAttempts {
+		t.Fatalf("after too many attempts: got %v, want %v", err, ErrTooManyAttempts)
+	}
+}
@@ -17,14 +17,69 @@ type User struct {
 	Email        string `gorm:"not null; unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null, unique_index"`
+	TOTPSecret   string `gorm:"size:64"`
+	TOTPLastStep int64
+	VerifiedAt   *time.Time
+	// Locale is the language emails are written in, picked
+	// from the browser at sign up. Empty means the default.
+	Locale string `gorm:"size:8"`
+
+	// Admin users can reach the operator console, the flag is
+	// only ever set by hand in the database. DisabledAt is set
+	// when an operator disabled the account.
+	Admin      bool `gorm:"not null;default:false"`
+	DisabledAt *time.Time
+}
+
+// Disabled reports whether an operator disabled the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// Verified reports whether the user confirmed their email address
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
+}
+
+// TwoFactorEnabled reports whether the user signs in with a TOTP code
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
 }
 
 type UserService interface {
+	// As returns the service acting on behalf of actor, sign ins
+	// and password resets are recorded in the audit log.
+	As(actor Actor) UserService
+
 	Authenticate(email, password string) (*User, error)
 	InitiateReset(email string) (string, error)
 	CompleteReset(token, newPassword string) (*User, error)
+
+	// InitiateVerification creates a verification token for
+	// the current email address of user.
+	InitiateVerification(user *User) (string, error)
+	CompleteVerification(token string) (*User, error)
+
+	// ChangePassword sets a new password for user, once the
+	// current one was confirmed.
+	ChangePassword(user *User, current, password string) error
+
+	// InitiateEmailChange creates a verification token for
+	// email. The address of user only changes once the token is
+	// used, see CompleteVerification.
+	InitiateEmailChange(user *User, email string) (string, error)
+
+	// Restore brings back an account deleted less than
+	// AccountCoolingOff ago, given its credentials.
+	Restore(email, password string) (*User, error)
+
+	// Disable keeps user from signing in until Enable is called
+	Disable(user *User) error
+	Enable(user *User) error
+
+	// ForcePasswordReset replaces the password of user with a
+	// random one and returns a reset token to choose a new one.
+	ForcePasswordReset(user *User) (string, error)
 	UserDB
 }
 
@@ -44,19 +99,37 @@ type UserDB interface {
 	// Find user by parameter
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
 
 	// Method for altering user
 	Create(user *User) error
 	Update(user *User) error
 	Delete(id uint) error
+
+	// Deleted users are kept for AccountCoolingOff before they
+	// are purged for good.
+	DeletedByEmail(email string) (*User, error)
+	DeletedByID(id uint) (*User, error)
+	DeletedBefore(t time.Time) ([]User, error)
+	Undelete(id uint) error
+	Purge(id uint) error
+
+	// Search returns up to limit users whose name or email
+	// contains query.
+	Search(query string, limit int) ([]User, error)
 }
 
+// AccountCoolingOff is how long a deleted account can be
+// restored before it is purged.
+const AccountCoolingOff = 14 * 24 * time.Hour
+
 // userService
 type userService struct {
 	UserDB
+	uv        *userValidator
 	pepper    string
 	pwResetDB pwResetDB
+	evDB      emailVerificationDB
+	audit     auditRecorder
 }
 
 // userGorm represents the database interaction layer
@@ -70,9 +143,9 @@ type userGorm struct {
 // UserDB in our interface chain.
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
+	policy     *PasswordPolicy
 }
 
 type modelError string
@@ -115,45 +188,65 @@ var (
 	//ErrEmailNotFound
 	ErrEmailNotFound modelError = "models: email not found"
 
-	// ErrPasswordTooShort
-	ErrPasswordTooShort modelError = "models: password must be at least 8 characters"
-
 	// ErrPasswordRequired
 	ErrPasswordRequired modelError = "models: password is required"
 
-	//ErrRememberRequired
-	ErrRememberRequired modelError = "models: remember token is required"
-
-	// ErrRememberTooShort
-	ErrRememberTooShort modelError = "models: remember token must be at least 32 bytes"
-
 	// ErrTokenInvalid
 	ErrTokenInvalid modelError = "models: token provided is not valid"
 
 	// ErrTokenExpired
 	ErrTokenExpired modelError = "models: token provided is no longer valid"
+
+	// ErrCredentialsInvalid is returned by Authenticate for both an
+	// unknown email and a wrong password, so callers can't tell
+	// registered addresses apart.
+	ErrCredentialsInvalid modelError = "models: email address or password is incorrect"
+
+	// ErrEmailNotVerified
+	ErrEmailNotVerified modelError = "models: please verify your email address first"
+
+	// ErrEmailUnchanged is returned when changing the email
+	// address to the one the user already has
+	ErrEmailUnchanged modelError = "models: this is already your email address"
+
+	// ErrRestoreExpired is returned when the account was deleted
+	// too long ago to be restored
+	ErrRestoreExpired modelError = "models: this account was deleted too long ago to be restored"
+
+	// ErrAccountDisabled is returned when signing in to an account
+	// an operator disabled
+	ErrAccountDisabled modelError = "models: this account has been disabled, please contact support"
 )
 
 // NewUserService Create new UserService instance
-func NewUserService(db *gorm.DB, pepper, hmacKey string) UserService {
+func NewUserService(db *gorm.DB, pepper, hmacKey string, policy *PasswordPolicy) UserService {
 	ug := &userGorm{db}
 
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	uv := newUserValidator(ug, pepper, policy)
 
 	return &userService{
 		UserDB:    uv,
+		uv:        uv,
 		pepper:    pepper,
 		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		evDB:      newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
+		audit:     newAuditRecorder(db),
 	}
 }
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+func (us *userService) As(actor Actor) UserService {
+	scoped := *us
+	scoped.audit.actor = actor
+	return &scoped
+}
+
+func newUserValidator(udb UserDB, pepper string, policy *PasswordPolicy) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
-		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
+		policy:     policy,
 	}
 }
 
@@ -196,12 +289,22 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// ByRemember find users record from database by remember token
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
+// Update will update the provided user with all the data in the provided user object
+func (ug *userGorm) Update(user *User) error {
+	return ug.db.Save(&user).Error
+}
 
-	db := ug.db.Where("remember_hash = ?", rememberHash)
+// Delete will delete the record for the user. The record is
+// only marked as deleted, see Purge.
+func (ug *userGorm) Delete(id uint) error {
+	user := User{Model: gorm.Model{ID: id}}
+	return ug.db.Delete(&user).Error
+}
 
+// DeletedByEmail finds a deleted user by email
+func (ug *userGorm) DeletedByEmail(email string) (*User, error) {
+	var user User
+	db := ug.db.Unscoped().Where("email = ? AND deleted_at IS NOT NULL", email)
 	err := first(db, &user)
 	if err != nil {
 		return nil, err
@@ -209,21 +312,107 @@ func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
 	return &user, nil
 }
 
-// Update will update the provided user with all the data in the provided user object
-func (ug *userGorm) Update(user *User) error {
-	return ug.db.Save(&user).Error
+// DeletedByID finds a deleted user by ID
+func (ug *userGorm) DeletedByID(id uint) (*User, error) {
+	var user User
+	db := ug.db.Unscoped().Where("id = ? AND deleted_at IS NOT NULL", id)
+	err := first(db, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-// Delete will delete the record for the user
-func (ug *userGorm) Delete(id uint) error {
+// DeletedBefore returns the users deleted before t
+func (ug *userGorm) DeletedBefore(t time.Time) ([]User, error) {
+	var users []User
+	db := ug.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", t)
+	err := db.Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (ug *userGorm) Search(query string, limit int) ([]User, error) {
+	var users []User
+	like := "%" + strings.ToLower(query) + "%"
+	db := ug.db.Where("lower(name) LIKE ? OR lower(email) LIKE ?", like, like).
+		Order("id").Limit(limit)
+	err := db.Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Undelete clears the deletion mark of a user
+func (ug *userGorm) Undelete(id uint) error {
+	db := ug.db.Unscoped().Model(&User{}).Where("id = ?", id)
+	return db.Update("deleted_at", gorm.Expr("NULL")).Error
+}
+
+// Purge removes the record of the user for good
+func (ug *userGorm) Purge(id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
-	return ug.db.Delete(&user).Error
+	return ug.db.Unscoped().Delete(&user).Error
 }
 
-// Authenticate will return error when password provided mismatch
+// Authenticate will return ErrCredentialsInvalid when there is no user
+// with the email or the password provided mismatch
 func (us *userService) Authenticate(email, password string) (*User, error) {
-	foundUser, err := us.ByEmail(email)
+	foundUser, err := us.authenticate(email, password)
+	if err == nil && foundUser.Disabled() {
+		err = ErrAccountDisabled
+	}
+	if err == nil {
+		err = us.upgradeHash(foundUser, password)
+	}
+	switch err {
+	case nil:
+		err = us.audit.record(AuditLoginSucceeded, AuditUser, foundUser.ID, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		return foundUser, nil
+	case ErrCredentialsInvalid, ErrAccountDisabled:
+		var userID uint
+		if user, err := us.ByEmail(email); err == nil {
+			userID = user.ID
+		}
+		attempt := map[string]string{"Email": email}
+		if err := us.audit.record(AuditLoginFailed, AuditUser, userID, nil, attempt); err != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// upgradeHash hashes password again when the stored hash was
+// made with another bcrypt cost than the policy's. The policy
+// rules are skipped, they only apply to new passwords.
+func (us *userService) upgradeHash(user *User, password string) error {
+	if !us.uv.policy.outdated(user.PasswordHash) {
+		return nil
+	}
+
+	hashed, err := us.uv.policy.hash(password + us.pepper)
 	if err != nil {
+		return err
+	}
+	user.PasswordHash = hashed
+	return us.uv.UserDB.Update(user)
+}
+
+// authenticate checks the credentials without recording the attempt
+func (us *userService) authenticate(email, password string) (*User, error) {
+	foundUser, err := us.ByEmail(email)
+	switch err {
+	case nil:
+	case ErrNotFound, ErrEmailRequired:
+		bcrypt.CompareHashAndPassword(us.uv.policy.timingHash(), []byte(password+us.pepper))
+		return nil, ErrCredentialsInvalid
+	default:
 		return nil, err
 	}
 
@@ -233,7 +422,7 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	case nil:
 		return foundUser, nil
 	case bcrypt.ErrMismatchedHashAndPassword:
-		return nil, ErrPasswordInvalid
+		return nil, ErrCredentialsInvalid
 	default:
 		return nil, err
 	}
@@ -276,7 +465,177 @@ func (us *userService) CompleteReset(token, newPassword string) (*User, error) {
 	}
 	user.Password = newPassword
 
-	err = us.Update(user)
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	if err := us.audit.record(AuditPasswordReset, AuditUser, user.ID, nil, nil); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	// only the latest link sent out is valid
+	if err := us.evDB.DeleteByUserID(user.ID); err != nil {
+		return "", err
+	}
+
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  user.Email,
+	}
+
+	if err := us.evDB.Create(&ev); err != nil {
+		return "", err
+	}
+
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.evDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(ev.CreatedAt) > (48 * time.Hour) {
+		return nil, ErrTokenExpired
+	}
+
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The link was sent to a new address, see InitiateEmailChange.
+	// Update makes sure nobody took the address in the meantime.
+	user.Email = ev.Email
+
+	now := time.Now()
+	user.VerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	if err := us.evDB.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (us *userService) ChangePassword(user *User, current, password string) error {
+	_, err := us.authenticate(user.Email, current)
+	if err == ErrCredentialsInvalid {
+		return ErrPasswordInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	user.Password = password
+	return us.Update(user)
+}
+
+func (us *userService) Disable(user *User) error {
+	now := time.Now()
+	user.DisabledAt = &now
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.audit.record(AuditAccountDisabled, AuditUser, user.ID, nil, nil)
+}
+
+func (us *userService) Enable(user *User) error {
+	user.DisabledAt = nil
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	return us.audit.record(AuditAccountEnabled, AuditUser, user.ID, nil, nil)
+}
+
+func (us *userService) ForcePasswordReset(user *User) (string, error) {
+	password, err := rand.String(32)
+	if err != nil {
+		return "", err
+	}
+	user.Password = password
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+
+	token, err := us.InitiateReset(user.Email)
+	if err != nil {
+		return "", err
+	}
+	err = us.audit.record(AuditPasswordResetForced, AuditUser, user.ID, nil, nil)
+	return token, err
+}
+
+func (us *userService) InitiateEmailChange(user *User, email string) (string, error) {
+	candidate := User{
+		Model: gorm.Model{ID: user.ID},
+		Email: email,
+	}
+	err := runUserValidationFunctions(&candidate,
+		us.uv.normalizeEmail,
+		us.uv.requireEmail,
+		us.uv.emailFormat,
+		us.uv.emailIsAvail)
+	if err != nil {
+		return "", err
+	}
+	if candidate.Email == user.Email {
+		return "", ErrEmailUnchanged
+	}
+
+	// only the latest link sent out is valid
+	if err := us.evDB.DeleteByUserID(user.ID); err != nil {
+		return "", err
+	}
+
+	ev := emailVerification{
+		UserID: user.ID,
+		Email:  candidate.Email,
+	}
+	if err := us.evDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) Restore(email, password string) (*User, error) {
+	user, err := us.DeletedByEmail(email)
+	switch err {
+	case nil:
+	case ErrNotFound, ErrEmailRequired:
+		bcrypt.CompareHashAndPassword(us.uv.policy.timingHash(), []byte(password+us.pepper))
+		return nil, ErrCredentialsInvalid
+	default:
+		return nil, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper))
+	switch err {
+	case nil:
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return nil, ErrCredentialsInvalid
+	default:
+		return nil, err
+	}
+
+	if time.Since(*user.DeletedAt) > AccountCoolingOff {
+		return nil, ErrRestoreExpired
+	}
+	if err := us.Undelete(user.ID); err != nil {
+		return nil, err
+	}
+	user.DeletedAt = nil
 	return user, nil
 }
 
@@ -284,16 +643,13 @@ func (us *userService) CompleteReset(token, newPassword string) (*User, error) {
 func (uv *userValidator) Create(user *User) error {
 
 	err := runUserValidationFunctions(user,
-		uv.passwordMinLength,
 		uv.passwordIsRequired,
+		uv.passwordPolicy,
 		uv.requireEmail,
 		uv.emailFormat,
 		uv.normalizeEmail,
 		uv.emailIsAvail,
-		uv.bcryptPassword,
-		uv.setRememberIfUnset,
-		uv.rememberMinBytes,
-		uv.hmacRemember)
+		uv.bcryptPassword)
 	if err != nil {
 		return err
 	}
@@ -304,14 +660,13 @@ func (uv *userValidator) Create(user *User) error {
 // Update will update the provided user with all the data in the provided user object
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValidationFunctions(user,
-		uv.passwordMinLength,
+		uv.passwordPolicy,
 		uv.passwordHashIsRequired,
 		uv.requireEmail,
 		uv.emailFormat,
 		uv.normalizeEmail,
-		uv.bcryptPassword,
-		uv.hmacRemember,
-		uv.rememberHashIsRequired)
+		uv.emailIsAvail,
+		uv.bcryptPassword)
 
 	if err != nil {
 		return err
@@ -336,16 +691,20 @@ func (uv *userValidator) ByEmail(email string) (*User, error) {
 	return uv.UserDB.ByEmail(user.Email)
 }
 
-// ByRemember find users record from database by remember token
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
-	}
+// DeletedByEmail normalizes the email address like ByEmail
+func (uv *userValidator) DeletedByEmail(email string) (*User, error) {
+	var user User
+	user.Email = email
 
-	if err := runUserValidationFunctions(&user, uv.hmacRemember); err != nil {
+	err := runUserValidationFunctions(&user,
+		uv.requireEmail,
+		uv.normalizeEmail)
+
+	if err != nil {
 		return nil, err
 	}
-	return uv.UserDB.ByRemember(user.RememberHash)
+
+	return uv.UserDB.DeletedByEmail(user.Email)
 }
 
 func (uv *userValidator) Delete(id uint) error {
@@ -368,41 +727,16 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 		return nil
 	}
 
-	passwordBytes := user.Password + uv.pepper
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(passwordBytes), bcrypt.DefaultCost)
+	hashed, err := uv.policy.hash(user.Password + uv.pepper)
 	if err != nil {
 		return err
 	}
 
-	user.PasswordHash = string(hashedBytes)
+	user.PasswordHash = hashed
 	user.Password = ""
 	return nil
 }
 
-// hmacRemember hmac remember token
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-
-	user.Remember = token
-	return nil
-}
-
 func (uv *userValidator) idGreaterThan(n uint) userValidationFn {
 	return userValidationFn(func(user *User) error {
 		if user.ID <= n {
@@ -454,15 +788,18 @@ func (uv *userValidator) emailIsAvail(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) passwordMinLength(user *User) error {
+// passwordPolicy checks a password being set against the
+// policy, and that bcrypt sees all of it once peppered
+func (uv *userValidator) passwordPolicy(user *User) error {
 	if user.Password == "" {
 		return nil
 	}
-
-	if len(user.Password) < 8 {
-		return ErrPasswordTooShort
+	if err := uv.policy.Check(user, user.Password); err != nil {
+		return err
+	}
+	if len(user.Password)+len(uv.pepper) > bcryptMaxBytes {
+		return ErrPasswordTooLong
 	}
-
 	return nil
 }
 
@@ -480,29 +817,6 @@ func (uv *userValidator) passwordHashIsRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-
-	if n < 32 {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashIsRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberRequired
-	}
-	return nil
-}
-
 // userValidationFn accepts pointer to user, it returns error
 type userValidationFn func(user *User) error
 
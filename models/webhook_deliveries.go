@@ -0,0 +1,288 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Webhook delivery statuses. Queued deliveries are retried until
+// they go through or WebhookMaxAttempts is reached, then they
+// failed and may only be replayed by hand.
+const (
+	WebhookQueued    = "queued"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+const (
+	// WebhookMaxAttempts is how many times a delivery is tried
+	// before giving up on it
+	WebhookMaxAttempts = 8
+
+	// The delay before retrying doubles with every attempt,
+	// from webhookBaseDelay up to webhookMaxDelay.
+	webhookBaseDelay = time.Minute
+	webhookMaxDelay  = 6 * time.Hour
+)
+
+const (
+	ErrEndpointIDRequired     modelError = "models: webhook endpoint ID is required"
+	ErrWebhookEventIDRequired modelError = "models: webhook event ID is required"
+)
+
+// WebhookDelivery is an event posted, or to be posted, to a
+// webhook endpoint. Replaying a delivery queues a copy of it
+// with the same EventID, so receivers can tell they already
+// handled the event. The deliveries of an endpoint are its
+// delivery log.
+type WebhookDelivery struct {
+	gorm.Model
+	EndpointID     uint      `gorm:"not null;index"`
+	EventID        string    `gorm:"not null"`
+	Event          string    `gorm:"not null"`
+	Payload        string    `gorm:"type:text"`
+	Status         string    `gorm:"not null;index"`
+	Attempts       int       `gorm:"not null;default:0"`
+	NextAttemptAt  time.Time `gorm:"index"`
+	ResponseStatus int
+	LastError      string `gorm:"type:text"`
+	DeliveredAt    *time.Time
+}
+
+// WebhookDeliveryService is the set of methods used to
+// manage webhook deliveries from outside the models package
+type WebhookDeliveryService interface {
+	// Enqueue queues d to be posted right away
+	Enqueue(d *WebhookDelivery) error
+
+	// Delivered marks d as accepted by the endpoint, which
+	// answered with status
+	Delivered(d *WebhookDelivery, status int) error
+
+	// Failed records a failed attempt at posting d, status is
+	// the one the endpoint answered with or 0 when it could not
+	// be reached. The next attempt is scheduled, or d is given
+	// up on.
+	Failed(d *WebhookDelivery, status int, err error) error
+
+	// Redeliver queues a copy of the delivery with the ID, and
+	// returns it
+	Redeliver(id uint) (*WebhookDelivery, error)
+	WebhookDeliveryDB
+}
+
+// WebhookDeliveryDB is used to interact with the webhook deliveries database
+type WebhookDeliveryDB interface {
+	ByID(id uint) (*WebhookDelivery, error)
+	// ByEndpointID returns up to limit deliveries to an
+	// endpoint, newest first
+	ByEndpointID(endpointID uint, limit int) ([]WebhookDelivery, error)
+	// Due returns up to limit queued deliveries to enabled
+	// endpoints whose next attempt is due at t, oldest first
+	Due(t time.Time, limit int) ([]WebhookDelivery, error)
+	Create(d *WebhookDelivery) error
+	Update(d *WebhookDelivery) error
+	DeleteByEndpointID(endpointID uint) error
+	// DeleteBefore removes the deliveries made before t that
+	// are no longer queued
+	DeleteBefore(t time.Time) error
+}
+
+type webhookDeliveryService struct {
+	WebhookDeliveryDB
+}
+
+type webhookDeliveryValidator struct {
+	WebhookDeliveryDB
+}
+
+type webhookDeliveryGorm struct {
+	db *gorm.DB
+}
+
+var _ WebhookDeliveryService = &webhookDeliveryService{}
+var _ WebhookDeliveryDB = &webhookDeliveryValidator{}
+var _ WebhookDeliveryDB = &webhookDeliveryGorm{}
+
+func NewWebhookDeliveryService(db *gorm.DB) WebhookDeliveryService {
+	return &webhookDeliveryService{
+		WebhookDeliveryDB: &webhookDeliveryValidator{
+			WebhookDeliveryDB: &webhookDeliveryGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (wds *webhookDeliveryService) Enqueue(d *WebhookDelivery) error {
+	d.Status = WebhookQueued
+	d.Attempts = 0
+	d.NextAttemptAt = time.Now()
+	return wds.Create(d)
+}
+
+func (wds *webhookDeliveryService) Delivered(d *WebhookDelivery, status int) error {
+	now := time.Now()
+	d.Attempts++
+	d.Status = WebhookDelivered
+	d.ResponseStatus = status
+	d.DeliveredAt = &now
+	d.LastError = ""
+	return wds.Update(d)
+}
+
+func (wds *webhookDeliveryService) Failed(d *WebhookDelivery, status int, err error) error {
+	d.Attempts++
+	d.ResponseStatus = status
+	d.LastError = err.Error()
+	if d.Attempts >= WebhookMaxAttempts {
+		d.Status = WebhookFailed
+		return wds.Update(d)
+	}
+
+	delay := webhookBaseDelay << uint(d.Attempts-1)
+	if delay > webhookMaxDelay {
+		delay = webhookMaxDelay
+	}
+	d.NextAttemptAt = time.Now().Add(delay)
+	return wds.Update(d)
+}
+
+func (wds *webhookDeliveryService) Redeliver(id uint) (*WebhookDelivery, error) {
+	d, err := wds.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := WebhookDelivery{
+		EndpointID: d.EndpointID,
+		EventID:    d.EventID,
+		Event:      d.Event,
+		Payload:    d.Payload,
+	}
+	if err := wds.Enqueue(&replay); err != nil {
+		return nil, err
+	}
+	return &replay, nil
+}
+
+// DB Implementation
+func (wdg *webhookDeliveryGorm) ByID(id uint) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := first(wdg.db.Where("id = ?", id), &d)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (wdg *webhookDeliveryGorm) ByEndpointID(endpointID uint, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	db := wdg.db.Where("endpoint_id = ?", endpointID).Order("id desc").Limit(limit)
+	err := db.Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (wdg *webhookDeliveryGorm) Due(t time.Time, limit int) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	db := wdg.db.
+		Joins("JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id").
+		Where("webhook_endpoints.disabled_at IS NULL AND webhook_endpoints.deleted_at IS NULL").
+		Where("webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ?", WebhookQueued, t).
+		Order("webhook_deliveries.next_attempt_at").Limit(limit)
+	err := db.Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (wdg *webhookDeliveryGorm) Create(d *WebhookDelivery) error {
+	return wdg.db.Create(d).Error
+}
+
+func (wdg *webhookDeliveryGorm) Update(d *WebhookDelivery) error {
+	return wdg.db.Save(d).Error
+}
+
+func (wdg *webhookDeliveryGorm) DeleteByEndpointID(endpointID uint) error {
+	return wdg.db.Unscoped().Where("endpoint_id = ?", endpointID).Delete(&WebhookDelivery{}).Error
+}
+
+func (wdg *webhookDeliveryGorm) DeleteBefore(t time.Time) error {
+	db := wdg.db.Unscoped().Where("status <> ? AND created_at < ?", WebhookQueued, t)
+	return db.Delete(&WebhookDelivery{}).Error
+}
+
+// Validator implementation
+func (wdv *webhookDeliveryValidator) ByID(id uint) (*WebhookDelivery, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return wdv.WebhookDeliveryDB.ByID(id)
+}
+
+func (wdv *webhookDeliveryValidator) Create(d *WebhookDelivery) error {
+	err := runWebhookDeliveryValFns(d,
+		wdv.requireEndpointID,
+		wdv.requireEventID)
+	if err != nil {
+		return err
+	}
+	return wdv.WebhookDeliveryDB.Create(d)
+}
+
+func (wdv *webhookDeliveryValidator) Update(d *WebhookDelivery) error {
+	err := runWebhookDeliveryValFns(d,
+		wdv.nonZeroID,
+		wdv.requireEndpointID,
+		wdv.requireEventID)
+	if err != nil {
+		return err
+	}
+	return wdv.WebhookDeliveryDB.Update(d)
+}
+
+func (wdv *webhookDeliveryValidator) DeleteByEndpointID(endpointID uint) error {
+	if endpointID <= 0 {
+		return ErrEndpointIDRequired
+	}
+	return wdv.WebhookDeliveryDB.DeleteByEndpointID(endpointID)
+}
+
+// Validation functions
+func (wdv *webhookDeliveryValidator) nonZeroID(d *WebhookDelivery) error {
+	if d.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (wdv *webhookDeliveryValidator) requireEndpointID(d *WebhookDelivery) error {
+	if d.EndpointID <= 0 {
+		return ErrEndpointIDRequired
+	}
+	return nil
+}
+
+func (wdv *webhookDeliveryValidator) requireEventID(d *WebhookDelivery) error {
+	if d.EventID == "" {
+		return ErrWebhookEventIDRequired
+	}
+	return nil
+}
+
+// Validator functions
+type webhookDeliveryValFn func(d *WebhookDelivery) error
+
+func runWebhookDeliveryValFns(d *WebhookDelivery, fns ...webhookDeliveryValFn) error {
+	for _, fn := range fns {
+		if err := fn(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
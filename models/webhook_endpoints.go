@@ -0,0 +1,399 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/ruckuus/dojo1/rand"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Events webhook endpoints can subscribe to
+const (
+	EventPropertyCreated = "property.created"
+	EventPropertyUpdated = "property.updated"
+	EventPropertyDeleted = "property.deleted"
+	EventLeaseCreated    = "lease.created"
+	EventLeaseDeleted    = "lease.deleted"
+	EventPaymentCreated  = "payment.created"
+	EventTicketOpened    = "ticket.opened"
+	EventTicketUpdated   = "ticket.updated"
+)
+
+// WebhookEvents lists every event, in the order they are offered
+var WebhookEvents = []string{
+	EventPropertyCreated,
+	EventPropertyUpdated,
+	EventPropertyDeleted,
+	EventLeaseCreated,
+	EventLeaseDeleted,
+	EventPaymentCreated,
+	EventTicketOpened,
+	EventTicketUpdated,
+}
+
+const (
+	// WebhookMaxFailures is how many deliveries in a row may
+	// fail before the endpoint is disabled
+	WebhookMaxFailures = 15
+
+	// webhookSecretPrefix makes our signing secrets easy to
+	// recognise
+	webhookSecretPrefix = "whsec_"
+	webhookSecretBytes  = 24
+)
+
+const (
+	ErrWebhookURLRequired   modelError = "models: webhook URL is required"
+	ErrWebhookURLInvalid    modelError = "models: webhook URL must be an absolute http or https URL"
+	ErrWebhookHostUnknown   modelError = "models: webhook host could not be found"
+	ErrWebhookHostPrivate   modelError = "models: webhook URL must point to a public address"
+	ErrWebhookEventRequired modelError = "models: select at least one event"
+	ErrWebhookEventInvalid  modelError = "models: webhook event is not valid"
+)
+
+// WebhookEndpoint is a URL of an organization the events it
+// subscribed to are posted to, signed with Secret, see package
+// webhook. Failures counts the deliveries that failed since the
+// last one that went through, the endpoint is disabled when it
+// reaches WebhookMaxFailures and stays so until it is enabled
+// again by hand.
+type WebhookEndpoint struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"not null;index"`
+	UserID         uint   `gorm:"not null"`
+	URL            string `gorm:"not null"`
+	Events         string `gorm:"not null"`
+	Secret         string `gorm:"not null"`
+	Failures       int    `gorm:"not null;default:0"`
+	DisabledAt     *time.Time
+}
+
+// EventList returns the events the endpoint subscribed to
+func (e *WebhookEndpoint) EventList() []string {
+	return strings.Fields(e.Events)
+}
+
+// Subscribed reports whether the endpoint subscribed to event
+func (e *WebhookEndpoint) Subscribed(event string) bool {
+	for _, s := range e.EventList() {
+		if s == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Disabled reports whether events are no longer posted to the
+// endpoint
+func (e *WebhookEndpoint) Disabled() bool {
+	return e.DisabledAt != nil
+}
+
+// WebhookEndpointService is the set of methods used to
+// manage webhook endpoints from outside the models package
+type WebhookEndpointService interface {
+	// Subscribed returns the enabled endpoints of an
+	// organization subscribed to event
+	Subscribed(orgID uint, event string) ([]WebhookEndpoint, error)
+
+	// Succeeded records a delivery to e that went through
+	Succeeded(e *WebhookEndpoint) error
+
+	// Failed records a failed delivery to e, and disables it
+	// after WebhookMaxFailures of them in a row
+	Failed(e *WebhookEndpoint) error
+
+	// Enable posts events to a disabled endpoint again
+	Enable(e *WebhookEndpoint) error
+	WebhookEndpointDB
+}
+
+// WebhookEndpointDB is used to interact with the webhook endpoints database
+type WebhookEndpointDB interface {
+	ByID(id uint) (*WebhookEndpoint, error)
+	// ByOrganizationID returns the endpoints of an organization,
+	// oldest first
+	ByOrganizationID(orgID uint) ([]WebhookEndpoint, error)
+	Create(e *WebhookEndpoint) error
+	Update(e *WebhookEndpoint) error
+	Delete(id uint) error
+}
+
+type webhookEndpointService struct {
+	WebhookEndpointDB
+}
+
+type webhookEndpointValidator struct {
+	WebhookEndpointDB
+}
+
+type webhookEndpointGorm struct {
+	db *gorm.DB
+}
+
+var _ WebhookEndpointService = &webhookEndpointService{}
+var _ WebhookEndpointDB = &webhookEndpointValidator{}
+var _ WebhookEndpointDB = &webhookEndpointGorm{}
+
+func NewWebhookEndpointService(db *gorm.DB) WebhookEndpointService {
+	return &webhookEndpointService{
+		WebhookEndpointDB: &webhookEndpointValidator{
+			WebhookEndpointDB: &webhookEndpointGorm{
+				db: db,
+			},
+		},
+	}
+}
+
+func (wes *webhookEndpointService) Subscribed(orgID uint, event string) ([]WebhookEndpoint, error) {
+	endpoints, err := wes.ByOrganizationID(orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscribed []WebhookEndpoint
+	for _, e := range endpoints {
+		if !e.Disabled() && e.Subscribed(event) {
+			subscribed = append(subscribed, e)
+		}
+	}
+	return subscribed, nil
+}
+
+func (wes *webhookEndpointService) Succeeded(e *WebhookEndpoint) error {
+	if e.Failures == 0 {
+		return nil
+	}
+	e.Failures = 0
+	return wes.Update(e)
+}
+
+func (wes *webhookEndpointService) Failed(e *WebhookEndpoint) error {
+	e.Failures++
+	if e.Failures >= WebhookMaxFailures && e.DisabledAt == nil {
+		now := time.Now()
+		e.DisabledAt = &now
+	}
+	return wes.Update(e)
+}
+
+func (wes *webhookEndpointService) Enable(e *WebhookEndpoint) error {
+	e.Failures = 0
+	e.DisabledAt = nil
+	return wes.Update(e)
+}
+
+// DB Implementation
+func (weg *webhookEndpointGorm) ByID(id uint) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	err := first(weg.db.Where("id = ?", id), &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (weg *webhookEndpointGorm) ByOrganizationID(orgID uint) ([]WebhookEndpoint, error) {
+	var endpoints []WebhookEndpoint
+	db := weg.db.Where("organization_id = ?", orgID).Order("id")
+	err := db.Find(&endpoints).Error
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (weg *webhookEndpointGorm) Create(e *WebhookEndpoint) error {
+	return weg.db.Create(e).Error
+}
+
+func (weg *webhookEndpointGorm) Update(e *WebhookEndpoint) error {
+	return weg.db.Save(e).Error
+}
+
+// Delete removes the endpoint for good, its deliveries are
+// removed by the caller
+func (weg *webhookEndpointGorm) Delete(id uint) error {
+	e := WebhookEndpoint{Model: gorm.Model{ID: id}}
+	return weg.db.Unscoped().Delete(&e).Error
+}
+
+// Validator implementation
+func (wev *webhookEndpointValidator) ByID(id uint) (*WebhookEndpoint, error) {
+	if id <= 0 {
+		return nil, ErrIDInvalid
+	}
+	return wev.WebhookEndpointDB.ByID(id)
+}
+
+func (wev *webhookEndpointValidator) Create(e *WebhookEndpoint) error {
+	err := runWebhookEndpointValFns(e,
+		wev.requireOrganizationID,
+		wev.requireUserID,
+		wev.normalizeURL,
+		wev.urlValid,
+		wev.normalizeEvents,
+		wev.eventsRequired,
+		wev.setSecret)
+	if err != nil {
+		return err
+	}
+	return wev.WebhookEndpointDB.Create(e)
+}
+
+func (wev *webhookEndpointValidator) Update(e *WebhookEndpoint) error {
+	err := runWebhookEndpointValFns(e,
+		wev.nonZeroID,
+		wev.requireOrganizationID,
+		wev.normalizeURL,
+		wev.urlValid,
+		wev.normalizeEvents,
+		wev.eventsRequired)
+	if err != nil {
+		return err
+	}
+	return wev.WebhookEndpointDB.Update(e)
+}
+
+func (wev *webhookEndpointValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrIDInvalid
+	}
+	return wev.WebhookEndpointDB.Delete(id)
+}
+
+// Validation functions
+func (wev *webhookEndpointValidator) nonZeroID(e *WebhookEndpoint) error {
+	if e.ID <= 0 {
+		return ErrIDInvalid
+	}
+	return nil
+}
+
+func (wev *webhookEndpointValidator) requireOrganizationID(e *WebhookEndpoint) error {
+	if e.OrganizationID <= 0 {
+		return ErrOrganizationIDRequired
+	}
+	return nil
+}
+
+func (wev *webhookEndpointValidator) requireUserID(e *WebhookEndpoint) error {
+	if e.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (wev *webhookEndpointValidator) normalizeURL(e *WebhookEndpoint) error {
+	e.URL = strings.TrimSpace(e.URL)
+	return nil
+}
+
+// urlValid also makes sure the host is public, the endpoint
+// would let organizations reach into our network otherwise. The
+// worker checks again when it connects, see WebhookIPAllowed,
+// hosts may resolve elsewhere later on.
+func (wev *webhookEndpointValidator) urlValid(e *WebhookEndpoint) error {
+	if e.URL == "" {
+		return ErrWebhookURLRequired
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrWebhookURLInvalid
+	}
+
+	ips := []net.IP{net.ParseIP(u.Hostname())}
+	if ips[0] == nil {
+		ips, err = lookupIP(u.Hostname())
+		if err != nil || len(ips) == 0 {
+			return ErrWebhookHostUnknown
+		}
+	}
+	for _, ip := range ips {
+		if !WebhookIPAllowed(ip) {
+			return ErrWebhookHostPrivate
+		}
+	}
+	return nil
+}
+
+// lookupIP resolves the hosts of endpoints
+var lookupIP = net.LookupIP
+
+// webhookBlockedNets are the ranges that reach us or our network
+// the methods of net.IP don't tell apart: "this network", which
+// Linux connects to locally, and carrier-grade NAT.
+var webhookBlockedNets = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// WebhookIPAllowed reports whether events may be posted to ip.
+// Loopback, private, link-local, multicast and unspecified
+// addresses are refused.
+func WebhookIPAllowed(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range webhookBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEvents drops duplicates and stores the events in
+// the order of WebhookEvents
+func (wev *webhookEndpointValidator) normalizeEvents(e *WebhookEndpoint) error {
+	requested := map[string]bool{}
+	for _, s := range e.EventList() {
+		requested[s] = true
+	}
+
+	var events []string
+	for _, s := range WebhookEvents {
+		if requested[s] {
+			events = append(events, s)
+			delete(requested, s)
+		}
+	}
+	if len(requested) > 0 {
+		return ErrWebhookEventInvalid
+	}
+
+	e.Events = strings.Join(events, " ")
+	return nil
+}
+
+func (wev *webhookEndpointValidator) eventsRequired(e *WebhookEndpoint) error {
+	if e.Events == "" {
+		return ErrWebhookEventRequired
+	}
+	return nil
+}
+
+func (wev *webhookEndpointValidator) setSecret(e *WebhookEndpoint) error {
+	secret, err := rand.String(webhookSecretBytes)
+	if err != nil {
+		return err
+	}
+	e.Secret = webhookSecretPrefix + secret
+	return nil
+}
+
+// Validator functions
+type webhookEndpointValFn func(e *WebhookEndpoint) error
+
+func runWebhookEndpointValFns(e *WebhookEndpoint, fns ...webhookEndpointValFn) error {
+	for _, fn := range fns {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type memDeliveryDB struct {
+	WebhookDeliveryDB
+}
+
+func (memDeliveryDB) Update(d *WebhookDelivery) error { return nil }
+
+type memEndpointDB struct {
+	WebhookEndpointDB
+}
+
+func (memEndpointDB) Update(e *WebhookEndpoint) error { return nil }
+
+func TestWebhookDeliveryBackoff(t *testing.T) {
+	wds := &webhookDeliveryService{WebhookDeliveryDB: memDeliveryDB{}}
+	d := &WebhookDelivery{Status: WebhookQueued}
+
+	want := webhookBaseDelay
+	for attempt := 1; attempt < WebhookMaxAttempts; attempt++ {
+		before := time.Now()
+		if err := wds.Failed(d, 500, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+		if d.Status != WebhookQueued {
+			t.Fatalf("attempt %d: status = %q, want %q", attempt, d.Status, WebhookQueued)
+		}
+		if delay := d.NextAttemptAt.Sub(before); delay < want || delay > want+time.Second {
+			t.Errorf("attempt %d: retried after %v, want %v", attempt, delay, want)
+		}
+		if want *= 2; want > webhookMaxDelay {
+			want = webhookMaxDelay
+		}
+	}
+
+	if err := wds.Failed(d, 0, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != WebhookFailed || d.Attempts != WebhookMaxAttempts {
+		t.Errorf("after %d attempts: status = %q, attempts = %d", WebhookMaxAttempts, d.Status, d.Attempts)
+	}
+	if d.ResponseStatus != 0 || d.LastError != "boom" {
+		t.Errorf("last attempt recorded as %d %q", d.ResponseStatus, d.LastError)
+	}
+}
+
+func TestWebhookEndpointDisabledAfterFailures(t *testing.T) {
+	wes := &webhookEndpointService{WebhookEndpointDB: memEndpointDB{}}
+	e := &WebhookEndpoint{}
+
+	for i := 1; i < WebhookMaxFailures; i++ {
+		if err := wes.Failed(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e.Disabled() {
+		t.Fatalf("disabled after %d failures", WebhookMaxFailures-1)
+	}
+
+	// A delivery that goes through starts the count over
+	if err := wes.Succeeded(e); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < WebhookMaxFailures; i++ {
+		wes.Failed(e)
+	}
+	if e.Disabled() {
+		t.Fatal("failures before a success were counted")
+	}
+
+	if err := wes.Failed(e); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Disabled() {
+		t.Errorf("not disabled after %d failures in a row", WebhookMaxFailures)
+	}
+}
+
+func TestWebhookIPAllowed(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := WebhookIPAllowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("WebhookIPAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookURLValid(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupIP = lookup }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "hooks.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "rebind.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.1")}, nil
+		case "localhost":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"https://hooks.example.com/tataruma", nil},
+		{"http://93.184.216.34:8080/hooks", nil},
+		{"", ErrWebhookURLRequired},
+		{"ftp://hooks.example.com/", ErrWebhookURLInvalid},
+		{"/hooks", ErrWebhookURLInvalid},
+		{"https://unknown.example.com/", ErrWebhookHostUnknown},
+		{"http://localhost:8080/", ErrWebhookHostPrivate},
+		{"http://127.0.0.1/", ErrWebhookHostPrivate},
+		{"http://[::1]/", ErrWebhookHostPrivate},
+		{"http://169.254.169.254/latest/meta-data/", ErrWebhookHostPrivate},
+		{"https://rebind.example.com/", ErrWebhookHostPrivate},
+	}
+	wev := &webhookEndpointValidator{}
+	for _, tt := range tests {
+		if err := wev.urlValid(&WebhookEndpoint{URL: tt.url}); err != tt.want {
+			t.Errorf("urlValid(%q) = %v, want %v", tt.url, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package notify tells users about what happens on their
+// properties and leases. Notifications are listed in the in-app
+// inbox and emailed right away or in a daily digest, as each
+// user chose per event on their profile page.
+package notify
+
+import (
+	"fmt"
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/email"
+	"github.com/ruckuus/dojo1/mailqueue"
+	"github.com/ruckuus/dojo1/models"
+	"log"
+	"time"
+)
+
+const (
+	// pollInterval is how often the daily jobs are looked at
+	pollInterval = 10 * time.Minute
+
+	// digestHour is when digests go out and the leases are
+	// checked, in server time
+	digestHour = 7
+
+	// rentNotice is how long before it is due rent is notified
+	rentNotice = 3 * 24 * time.Hour
+
+	// leaseNotice is how long before it ends a lease is notified
+	leaseNotice = 30 * 24 * time.Hour
+)
+
+// Notifier delivers notifications and runs the daily jobs
+type Notifier struct {
+	services *models.Services
+	emailer  *email.Client
+}
+
+func NewNotifier(services *models.Services, emailer *email.Client) *Notifier {
+	return &Notifier{
+		services: services,
+		emailer:  emailer,
+	}
+}
+
+// Notify delivers n through the channel its user picked for its
+// event. Nothing happens when they turned the event off, or
+// were already notified with the same key.
+func (nt *Notifier) Notify(n *models.Notification) error {
+	channel, err := nt.services.Notification.Channel(n.UserID, n.Event)
+	if err != nil {
+		return err
+	}
+	if channel == models.ChannelOff {
+		return nil
+	}
+	n.DigestPending = channel == models.ChannelDigest
+
+	return nt.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Notification.Create(n); err != nil {
+			return err
+		}
+		if n.ID == 0 || channel != models.ChannelEmail {
+			return nil
+		}
+
+		user, err := tx.User.ByID(n.UserID)
+		if err != nil {
+			return err
+		}
+		emailer := nt.emailer.Via(mailqueue.NewMailer(tx.Outbox))
+		return emailer.In(user.Locale).Notification(user.Name, user.Email, emailData(n))
+	})
+}
+
+// Run works through the daily jobs forever, it is meant to be
+// started in its own goroutine. Running them again the same day,
+// e.g. after a restart, sends nothing twice: lease notices are
+// created once per key, and the digest only takes what came in
+// before digestHour of the day. Notices created by the run wait
+// for the next digest.
+func (nt *Notifier) Run() {
+	var lastRun time.Time
+	for {
+		now := time.Now()
+		due := now.Hour() >= digestHour && now.YearDay() != lastRun.YearDay()
+		if due {
+			nt.checkLeases(now)
+			y, m, d := now.Date()
+			nt.sendDigests(time.Date(y, m, d, digestHour, 0, 0, 0, now.Location()))
+			lastRun = now
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// checkLeases notifies tenants of rent coming due, and tenants
+// and managers of leases coming to an end.
+func (nt *Notifier) checkLeases(now time.Time) {
+	leases, err := nt.services.Lease.Running(now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range leases {
+		l := &leases[i]
+		property, err := nt.services.Property.ByID(l.PropertyID)
+		if err != nil {
+			log.Printf("lease %d: %v", l.ID, err)
+			continue
+		}
+
+		if dueOn := l.RentDueOn(now); l.Rent > 0 && dueOn.Sub(now) <= rentNotice {
+			nt.notify(&models.Notification{
+				UserID: l.TenantID,
+				Event:  models.NotifyRentDue,
+				Key:    fmt.Sprintf("rent:%d:%s", l.ID, dueOn.Format("2006-01-02")),
+				Title:  fmt.Sprintf("Rent of %s is due on %s", l.Rent, dueOn.Format("02 Jan 2006")),
+				Body:   property.Name,
+				URL:    "/portal",
+			})
+		}
+
+		if l.EndsOn != nil && l.EndsOn.Sub(now) <= leaseNotice {
+			key := fmt.Sprintf("lease:%d:%s", l.ID, l.EndsOn.Format("2006-01-02"))
+			title := fmt.Sprintf("The lease of %s ends on %s", property.Name, l.EndsOn.Format("02 Jan 2006"))
+			nt.notify(&models.Notification{
+				UserID: l.TenantID,
+				Event:  models.NotifyLeaseExpiring,
+				Key:    key,
+				Title:  title,
+				URL:    "/portal",
+			})
+			managers, err := nt.managers(property)
+			if err != nil {
+				log.Printf("lease %d: %v", l.ID, err)
+				continue
+			}
+			for _, id := range managers {
+				nt.notify(&models.Notification{
+					UserID: id,
+					Event:  models.NotifyLeaseExpiring,
+					Key:    key,
+					Title:  title,
+					URL:    fmt.Sprintf("/properties/%d", property.ID),
+				})
+			}
+		}
+	}
+}
+
+// managers returns the users who may edit property: the owners
+// and managers of its organization, and those it was shared
+// with as such
+func (nt *Notifier) managers(property *models.Property) ([]uint, error) {
+	if property.OrganizationID == 0 {
+		return []uint{property.UserID}, nil
+	}
+
+	var ids []uint
+	seen := map[uint]bool{}
+	add := func(userID uint, role string) {
+		if !seen[userID] && authz.Allows(authz.TypeProperty, authz.Role(role), authz.ActionEdit) {
+			seen[userID] = true
+			ids = append(ids, userID)
+		}
+	}
+
+	members, err := nt.services.Organization.Members(property.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		add(m.UserID, m.Role)
+	}
+	grants, err := nt.services.Grant.ByResource(authz.TypeProperty, property.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range grants {
+		add(g.UserID, g.Role)
+	}
+	return ids, nil
+}
+
+// sendDigests emails each user the notifications created before
+// t waiting for their digest
+func (nt *Notifier) sendDigests(t time.Time) {
+	pending, err := nt.services.Notification.DigestPending(t)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Notifications come by user
+	for start := 0; start < len(pending); {
+		end := start
+		for end < len(pending) && pending[end].UserID == pending[start].UserID {
+			end++
+		}
+		if err := nt.sendDigest(pending[start:end]); err != nil {
+			log.Printf("digest of user %d: %v", pending[start].UserID, err)
+		}
+		start = end
+	}
+}
+
+func (nt *Notifier) sendDigest(notifications []models.Notification) error {
+	var ids []uint
+	var data []email.NotificationData
+	for i := range notifications {
+		ids = append(ids, notifications[i].ID)
+		data = append(data, emailData(&notifications[i]))
+	}
+
+	return nt.services.Transaction(func(tx *models.Services) error {
+		if err := tx.Notification.DigestSent(ids); err != nil {
+			return err
+		}
+		user, err := tx.User.ByID(notifications[0].UserID)
+		if err == models.ErrNotFound {
+			// Deleted users get no email
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		emailer := nt.emailer.Via(mailqueue.NewMailer(tx.Outbox))
+		return emailer.In(user.Locale).Digest(user.Name, user.Email, data)
+	})
+}
+
+// notify is Notify for the daily jobs, which carry on past errors
+func (nt *Notifier) notify(n *models.Notification) {
+	if err := nt.Notify(n); err != nil {
+		log.Printf("notifying user %d of %s: %v", n.UserID, n.Key, err)
+	}
+}
+
+func emailData(n *models.Notification) email.NotificationData {
+	return email.NotificationData{
+		Title:   n.Title,
+		Body:    n.Body,
+		URL:     n.URL,
+		ReplyTo: n.ReplyTo,
+	}
+}
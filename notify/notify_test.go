@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/models/modelstest"
+	"reflect"
+	"testing"
+)
+
+func TestManagers(t *testing.T) {
+	nt := NewNotifier(&models.Services{
+		Organization: &modelstest.Organizations{Memberships: []models.Membership{
+			{OrganizationID: 1, UserID: 1, Role: string(authz.RoleOwner)},
+			{OrganizationID: 1, UserID: 2, Role: string(authz.RoleCoOwner)},
+			{OrganizationID: 1, UserID: 3, Role: string(authz.RoleViewer)},
+			{OrganizationID: 1, UserID: 4, Role: string(authz.RolePropertyManager)},
+			{OrganizationID: 2, UserID: 7, Role: string(authz.RoleOwner)},
+		}},
+		Grant: &modelstest.Grants{Grants: []models.Grant{
+			{UserID: 5, ResourceType: authz.TypeProperty, ResourceID: 3, Role: string(authz.RolePropertyManager)},
+			{UserID: 6, ResourceType: authz.TypeProperty, ResourceID: 3, Role: string(authz.RoleTenant)},
+			{UserID: 4, ResourceType: authz.TypeProperty, ResourceID: 3, Role: string(authz.RolePropertyManager)},
+			{UserID: 8, ResourceType: authz.TypeProperty, ResourceID: 4, Role: string(authz.RolePropertyManager)},
+		}},
+	}, nil)
+
+	property := &models.Property{OrganizationID: 1, UserID: 9}
+	property.ID = 3
+	got, err := nt.managers(property)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{1, 2, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("managers = %v, want %v", got, want)
+	}
+}
+
+func TestManagersOfPropertyWithoutOrganization(t *testing.T) {
+	nt := NewNotifier(&models.Services{}, nil)
+
+	got, err := nt.managers(&models.Property{UserID: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("managers = %v, want %v", got, want)
+	}
+}
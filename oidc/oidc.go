@@ -0,0 +1,283 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ruckuus/dojo1/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDiscovery     = errors.New("oidc: provider discovery failed")
+	ErrTokenExchange = errors.New("oidc: code exchange failed")
+)
+
+// Config describes a relying party registration at a provider
+type Config struct {
+	// Name identifies the provider in our URLs, e.g. "google"
+	Name string `json:"name"`
+
+	// DisplayName is shown on the login button
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+}
+
+// Claims are the ID token claims we care about
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// audience can either be a single string or a list in a JWT
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// discovery is the subset of the provider metadata we use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect provider. Discovery happens on
+// first use so a provider being down does not stop us from
+// starting.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu   sync.Mutex
+	meta *discovery
+	keys *keySet
+}
+
+// NewProvider returns a Provider for cfg. A nil client means
+// http.DefaultClient.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = cfg.Name
+	}
+	return &Provider{
+		Config: cfg,
+		client: client,
+	}
+}
+
+func (p *Provider) discover() (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	resp, err := p.client.Get(wellKnown)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrDiscovery
+	}
+
+	var meta discovery
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, err
+	}
+
+	// the issuer in the document must be the one we configured,
+	// see OpenID Connect Discovery 1.0 section 4.3
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(p.Issuer, "/") {
+		return nil, ErrDiscovery
+	}
+
+	p.meta = &meta
+	p.keys = newKeySet(meta.JWKSURI, p.client)
+	return p.meta, nil
+}
+
+// Flow holds the values generated when a login starts, which
+// have to be kept by the caller until the provider redirects
+// back.
+type Flow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// NewFlow generates the state, nonce and PKCE verifier of a login
+func NewFlow() (*Flow, error) {
+	var f Flow
+	for _, dst := range []*string{&f.State, &f.Nonce, &f.Verifier} {
+		s, err := rand.String(32)
+		if err != nil {
+			return nil, err
+		}
+		*dst = strings.TrimRight(s, "=")
+	}
+	return &f, nil
+}
+
+// challenge returns the S256 PKCE code challenge (RFC 7636)
+func (f *Flow) challenge() string {
+	sum := sha256.Sum256([]byte(f.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL to send the user to
+func (p *Provider) AuthCodeURL(f *Flow) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(p.Scopes, " "))
+	v.Set("state", f.State)
+	v.Set("nonce", f.Nonce)
+	v.Set("code_challenge", f.challenge())
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code for tokens and returns
+// the verified claims of the ID token.
+func (p *Provider) Exchange(f *Flow, code string) (*Claims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("client_id", p.ClientID)
+	v.Set("code_verifier", f.Verifier)
+
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ErrTokenExchange
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, ErrTokenExchange
+	}
+
+	return p.Verify(tokens.IDToken, f.Nonce)
+}
+
+// Verify checks the signature and the claims of an ID token
+// as described in OpenID Connect Core 1.0 section 3.1.3.7.
+func (p *Provider) Verify(idToken, nonce string) (*Claims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := verifyJWS(idToken, p.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return nil, fmt.Errorf("oidc: unexpected issuer %q", claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, errors.New("oidc: token was not issued for this client")
+	case claims.Subject == "":
+		return nil, errors.New("oidc: token has no subject")
+	case now.After(time.Unix(claims.Expiry, 0).Add(time.Minute)):
+		return nil, errors.New("oidc: token is expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(time.Minute)):
+		return nil, errors.New("oidc: token is issued in the future")
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,180 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/ruckuus/dojo1/oidc/oidctest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testRedirectURL = "https://tataruma.test/auth/mock/callback"
+
+// newTestProvider serves a MockIdP and returns a Provider
+// registered with it
+func newTestProvider(t *testing.T) (*oidctest.MockIdP, *Provider) {
+	t.Helper()
+	idp, err := oidctest.NewMockIdP("test-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+
+	p := NewProvider(Config{
+		Name:        "mock",
+		Issuer:      srv.URL,
+		ClientID:    "test-client",
+		RedirectURL: testRedirectURL,
+	}, srv.Client())
+	return idp, p
+}
+
+// authorize sends the user agent to the provider for f, and
+// returns the code it is redirected back with
+func authorize(t *testing.T, p *Provider, f *Flow) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize answered %d", resp.StatusCode)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != testRedirectURL {
+		t.Fatalf("redirected to %s, want %s", got, testRedirectURL)
+	}
+	if got := callback.Query().Get("state"); got != f.State {
+		t.Fatalf("state = %q, want %q", got, f.State)
+	}
+	return callback.Query().Get("code")
+}
+
+func TestLoginFlow(t *testing.T) {
+	idp, p := newTestProvider(t)
+	f, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := p.Exchange(f, authorize(t, p, f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != idp.Subject || claims.Email != idp.Email || !claims.EmailVerified {
+		t.Errorf("claims = %+v", claims)
+	}
+	if claims.Nonce != f.Nonce {
+		t.Errorf("nonce = %q, want %q", claims.Nonce, f.Nonce)
+	}
+}
+
+func TestAuthCodeURLSendsPKCEChallenge(t *testing.T) {
+	_, p := newTestProvider(t)
+	f, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := p.AuthCodeURL(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	sum := sha256.Sum256([]byte(f.Verifier))
+	if got, want := q.Get("code_challenge"), base64.RawURLEncoding.EncodeToString(sum[:]); got != want {
+		t.Errorf("code_challenge = %q, want %q", got, want)
+	}
+	if got := q.Get("code_challenge_method"); got != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", got)
+	}
+	if q.Get("code_verifier") != "" {
+		t.Error("the verifier must not leave us before the code exchange")
+	}
+	if q.Get("nonce") != f.Nonce || q.Get("state") != f.State {
+		t.Errorf("nonce or state missing in %s", authURL)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	_, p := newTestProvider(t)
+	f, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, f)
+
+	// Somebody who intercepted the code doesn't have our verifier
+	other, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Verifier = other.Verifier
+	if _, err := p.Exchange(f, code); err != ErrTokenExchange {
+		t.Errorf("Exchange() error = %v, want %v", err, ErrTokenExchange)
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	_, p := newTestProvider(t)
+	f, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, f)
+
+	// An ID token minted for another login must not be accepted
+	f.Nonce = "another-login"
+	if _, err := p.Exchange(f, code); err == nil {
+		t.Error("Exchange() accepted an ID token with another nonce")
+	}
+}
+
+func TestCodeIsSingleUse(t *testing.T) {
+	_, p := newTestProvider(t)
+	f, err := NewFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, p, f)
+
+	if _, err := p.Exchange(f, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(f, code); err != ErrTokenExchange {
+		t.Errorf("second Exchange() error = %v, want %v", err, ErrTokenExchange)
+	}
+}
+
+func TestDiscoveryRejectsOtherIssuer(t *testing.T) {
+	idp, p := newTestProvider(t)
+	idp.Issuer = "https://elsewhere.test"
+
+	if _, err := p.AuthCodeURL(&Flow{}); err != ErrDiscovery {
+		t.Errorf("AuthCodeURL() error = %v, want %v", err, ErrDiscovery)
+	}
+}
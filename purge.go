@@ -0,0 +1,249 @@
+package main
+
+import (
+	"github.com/ruckuus/dojo1/authz"
+	"github.com/ruckuus/dojo1/models"
+	"log"
+	"time"
+)
+
+// purgeInterval is how often deleted accounts are looked for
+const purgeInterval = time.Hour
+
+// purgeDeletedUsers runs forever, removing for good the accounts
+// deleted more than models.AccountCoolingOff ago.
+func purgeDeletedUsers(services *models.Services) {
+	for {
+		users, err := services.User.DeletedBefore(time.Now().Add(-models.AccountCoolingOff))
+		if err != nil {
+			log.Println(err)
+		}
+		for _, user := range users {
+			if err := purgeUser(services, &user); err != nil {
+				log.Printf("purging user %d: %v", user.ID, err)
+			}
+		}
+		time.Sleep(purgeInterval)
+	}
+}
+
+// purgeUser removes the files a deleted user stored, then
+// everything else of theirs along with the user itself, in one
+// transaction. The personal organization of the user goes with
+// what it owns, organizations the user shared with others stay,
+// they belong to the remaining members as well.
+func purgeUser(services *models.Services, user *models.User) error {
+	// Images may be found twice, e.g. comments the user left on
+	// tickets of their own properties
+	var images []models.Image
+	seen := map[uint]bool{}
+	add := func(externalType string, externalID uint) error {
+		found, err := services.Image.ByExternalTypeAndID(externalType, externalID)
+		for _, image := range found {
+			if !seen[image.ID] {
+				seen[image.ID] = true
+				images = append(images, image)
+			}
+		}
+		return err
+	}
+	addComments := func(comments []models.TicketComment, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, c := range comments {
+			if err := add(models.TicketCommentKey, c.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var personal []models.Organization
+	var galleries []models.Gallery
+	var properties []models.Property
+	orgs, err := services.Organization.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		if !org.Personal || org.OwnerID != user.ID {
+			continue
+		}
+		personal = append(personal, org)
+
+		orgGalleries, err := services.Gallery.ByOrganizationID(org.ID)
+		if err != nil {
+			return err
+		}
+		galleries = append(galleries, orgGalleries...)
+		for _, g := range orgGalleries {
+			if err := add(models.GalleryImageKey, g.ID); err != nil {
+				return err
+			}
+		}
+
+		orgProperties, err := services.Property.ByOrganizationID(org.ID)
+		if err != nil {
+			return err
+		}
+		properties = append(properties, orgProperties...)
+		for _, p := range orgProperties {
+			leases, err := services.Lease.ByPropertyID(p.ID)
+			if err != nil {
+				return err
+			}
+			for _, l := range leases {
+				if err := add(models.LeaseDocumentKey, l.ID); err != nil {
+					return err
+				}
+			}
+
+			tickets, err := services.Ticket.ByPropertyID(p.ID)
+			if err != nil {
+				return err
+			}
+			for _, t := range tickets {
+				if err := add(models.TicketPhotoKey, t.ID); err != nil {
+					return err
+				}
+				if err := addComments(services.TicketComment.ByTicketID(t.ID)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Photos the user took as a tenant
+	leases, err := services.Lease.ByTenantID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		tickets, err := services.Ticket.ByLeaseID(l.ID)
+		if err != nil {
+			return err
+		}
+		for _, t := range tickets {
+			if t.OpenedByID != user.ID {
+				continue
+			}
+			if err := add(models.TicketPhotoKey, t.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Files the user sent in ticket comments, which go along
+	// with the comments
+	if err := addComments(services.TicketComment.ByAuthorID(user.ID)); err != nil {
+		return err
+	}
+
+	// Files can't be rolled back, they go first along with
+	// their records, a purge failing later on is retried without
+	// them.
+	for i := range images {
+		if err := services.Image.Delete(&images[i]); err != nil {
+			return err
+		}
+	}
+
+	// Exports are copies of all of the above
+	exports, err := services.Export.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, e := range exports {
+		if e.Path != "" {
+			if err := services.Store.Delete(e.Path); err != nil {
+				return err
+			}
+		}
+		if err := services.Export.Delete(e.ID); err != nil {
+			return err
+		}
+	}
+
+	return services.Transaction(func(tx *models.Services) error {
+		for _, g := range galleries {
+			if err := forgetResource(tx, authz.Gallery(&g)); err != nil {
+				return err
+			}
+			if err := tx.Gallery.Purge(g.ID); err != nil {
+				return err
+			}
+		}
+		for _, p := range properties {
+			if err := forgetResource(tx, authz.Property(&p)); err != nil {
+				return err
+			}
+			if err := tx.Property.Purge(p.ID); err != nil {
+				return err
+			}
+		}
+		for _, org := range personal {
+			if err := purgeWebhooks(tx, org.ID); err != nil {
+				return err
+			}
+			if err := forgetResource(tx, authz.Organization(&org)); err != nil {
+				return err
+			}
+			if err := tx.Organization.Purge(org.ID); err != nil {
+				return err
+			}
+		}
+
+		for _, purge := range []func(userID uint) error{
+			tx.Notification.DeleteByUserID,
+			tx.TicketComment.DeleteByAuthorID,
+			tx.CalendarFeed.DeleteByUserID,
+			tx.Idempotency.DeleteByUserID,
+			tx.Identity.DeleteByUserID,
+			tx.APIToken.DeleteByUserID,
+			tx.Grant.DeleteByUserID,
+			tx.Organization.RemoveUser,
+			tx.Session.DeleteByUserID,
+		} {
+			if err := purge(user.ID); err != nil {
+				return err
+			}
+		}
+		return tx.User.Purge(user.ID)
+	})
+}
+
+// forgetResource removes the grants and invitations of res
+func forgetResource(tx *models.Services, res authz.Resource) error {
+	if err := authz.NewAuthorizer(tx.Grant, tx.Organization).Forget(res); err != nil {
+		return err
+	}
+	invitations, err := tx.Invitation.ByResource(res.Type, res.ID)
+	if err != nil {
+		return err
+	}
+	for _, inv := range invitations {
+		if err := tx.Invitation.Delete(inv.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeWebhooks removes the webhook endpoints of an organization
+// along with their deliveries
+func purgeWebhooks(tx *models.Services, orgID uint) error {
+	endpoints, err := tx.Webhook.ByOrganizationID(orgID)
+	if err != nil {
+		return err
+	}
+	for _, e := range endpoints {
+		if err := tx.Delivery.DeleteByEndpointID(e.ID); err != nil {
+			return err
+		}
+		if err := tx.Webhook.Delete(e.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
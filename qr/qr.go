@@ -0,0 +1,537 @@
+// Package qr draws QR codes (ISO/IEC 18004), so the two-factor
+// setup page can show its otpauth URI as an image we make
+// ourselves instead of loading a script from elsewhere. Only the
+// byte mode at error correction level M is supported, which is
+// all URIs need.
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+var ErrTooLong = errors.New("qr: text is too long for a QR code")
+
+const (
+	minVersion = 1
+	maxVersion = 40
+
+	// quietZone is the light border around the code, in modules
+	quietZone = 4
+
+	// formatLevelM are the bits of error correction level M in
+	// the format information
+	formatLevelM = 0
+)
+
+// blocks describes the error correction blocks of a version at
+// level M: blocks1 blocks of data1 data codewords, followed by
+// blocks2 of one more, each with ec error correction codewords.
+type blocks struct {
+	ec      int
+	blocks1 int
+	data1   int
+	blocks2 int
+}
+
+// levelM has the blocks of each version at level M, table 9 of
+// the standard
+var levelM = [maxVersion + 1]blocks{
+	1: {10, 1, 16, 0}, 2: {16, 1, 28, 0}, 3: {26, 1, 44, 0}, 4: {18, 2, 32, 0},
+	5: {24, 2, 43, 0}, 6: {16, 4, 27, 0}, 7: {18, 4, 31, 0}, 8: {22, 2, 38, 2},
+	9: {22, 3, 36, 2}, 10: {26, 4, 43, 1}, 11: {30, 1, 50, 4}, 12: {22, 6, 36, 2},
+	13: {22, 8, 37, 1}, 14: {24, 4, 40, 5}, 15: {24, 5, 41, 5}, 16: {28, 7, 45, 3},
+	17: {28, 10, 46, 1}, 18: {26, 9, 43, 4}, 19: {26, 3, 44, 11}, 20: {26, 3, 41, 13},
+	21: {26, 17, 42, 0}, 22: {28, 17, 46, 0}, 23: {28, 4, 47, 14}, 24: {28, 6, 45, 14},
+	25: {28, 8, 47, 13}, 26: {28, 19, 46, 4}, 27: {28, 22, 45, 3}, 28: {28, 3, 45, 23},
+	29: {28, 21, 45, 7}, 30: {28, 19, 47, 10}, 31: {28, 2, 46, 29}, 32: {28, 10, 46, 23},
+	33: {28, 14, 46, 21}, 34: {28, 14, 46, 23}, 35: {28, 12, 47, 26}, 36: {28, 6, 47, 34},
+	37: {28, 29, 46, 14}, 38: {28, 13, 46, 32}, 39: {28, 40, 47, 7}, 40: {28, 18, 47, 31},
+}
+
+func (b blocks) dataCodewords() int {
+	return b.blocks1*b.data1 + b.blocks2*(b.data1+1)
+}
+
+// Code is a QR code, a square of Size modules each way, the
+// quiet zone around it left out
+type Code struct {
+	Size    int
+	modules []bool
+
+	// function marks the modules of the patterns, which data
+	// and masks leave alone
+	function []bool
+}
+
+// Black reports whether the module at column x and row y is
+// dark. Modules outside of the code are light.
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+// PNG returns the code as a PNG image with scale pixels per
+// module, quiet zone included
+func (c *Code) PNG(scale int) ([]byte, error) {
+	size := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			v := color.Gray{Y: 0xff}
+			if c.Black(px/scale-quietZone, py/scale-quietZone) {
+				v.Y = 0
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encode returns the QR code of text, at the smallest version it
+// fits in and with the mask that suits it best
+func Encode(text string) (*Code, error) {
+	for v := minVersion; v <= maxVersion; v++ {
+		if bitsNeeded(v, len(text)) <= 8*levelM[v].dataCodewords() {
+			return encode([]byte(text), v, -1), nil
+		}
+	}
+	return nil, ErrTooLong
+}
+
+// bitsNeeded returns the length of n bytes in byte mode
+func bitsNeeded(version, n int) int {
+	return 4 + countBits(version) + 8*n
+}
+
+// countBits is the length of the character count of byte mode
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// encode draws data, which must fit in version, with mask, or
+// with the best one when mask is -1
+func encode(data []byte, version, mask int) *Code {
+	size := 4*version + 17
+	c := &Code{
+		Size:     size,
+		modules:  make([]bool, size*size),
+		function: make([]bool, size*size),
+	}
+	c.drawFunctionPatterns(version)
+	c.drawCodewords(codewords(data, version))
+
+	if mask < 0 {
+		best := -1
+		for m := 0; m < 8; m++ {
+			c.applyMask(m)
+			c.drawFormat(m)
+			if p := c.penalty(); best < 0 || p < best {
+				best, mask = p, m
+			}
+			// Masks are XOR, applying one again takes it off
+			c.applyMask(m)
+		}
+	}
+	c.applyMask(mask)
+	c.drawFormat(mask)
+	return c
+}
+
+// codewords returns the data and error correction codewords of
+// data, interleaved in the order they are drawn
+func codewords(data []byte, version int) []byte {
+	b := levelM[version]
+	capacity := b.dataCodewords()
+
+	var w bitWriter
+	w.write(0x4, 4)
+	w.write(uint(len(data)), countBits(version))
+	for _, d := range data {
+		w.write(uint(d), 8)
+	}
+	// The terminator, as much of it as fits, then padding
+	for i := 0; i < 4 && w.n < 8*capacity; i++ {
+		w.write(0, 1)
+	}
+	for w.n%8 != 0 {
+		w.write(0, 1)
+	}
+	for pad := byte(0xec); len(w.bytes) < capacity; pad ^= 0xec ^ 0x11 {
+		w.bytes = append(w.bytes, pad)
+		w.n += 8
+	}
+
+	divisor := rsDivisor(b.ec)
+	var dataBlocks, ecBlocks [][]byte
+	rest := w.bytes
+	for i := 0; i < b.blocks1+b.blocks2; i++ {
+		n := b.data1
+		if i >= b.blocks1 {
+			n++
+		}
+		dataBlocks = append(dataBlocks, rest[:n])
+		ecBlocks = append(ecBlocks, rsRemainder(rest[:n], divisor))
+		rest = rest[n:]
+	}
+
+	var out []byte
+	for i := 0; i <= b.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+type bitWriter struct {
+	bytes []byte
+	n     int
+}
+
+// write appends the low count bits of v, most significant first
+func (w *bitWriter) write(v uint, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.bytes = append(w.bytes, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.bytes[w.n/8] |= 0x80 >> uint(w.n%8)
+		}
+		w.n++
+	}
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8+x^4+x^3+x^2+1
+func gfMul(a, b byte) byte {
+	var p byte
+	for ; b != 0; b >>= 1 {
+		if b&1 == 1 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+	}
+	return p
+}
+
+// rsDivisor returns the generator polynomial of degree n, its
+// leading coefficient of 1 left out, highest power first
+func rsDivisor(n int) []byte {
+	divisor := make([]byte, n)
+	divisor[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			divisor[j] = gfMul(divisor[j], root)
+			if j+1 < n {
+				divisor[j] ^= divisor[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return divisor
+}
+
+// rsRemainder returns the error correction codewords of data
+func rsRemainder(data, divisor []byte) []byte {
+	rem := make([]byte, len(divisor))
+	for _, d := range data {
+		factor := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i, coef := range divisor {
+			rem[i] ^= gfMul(coef, factor)
+		}
+	}
+	return rem
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.function[y*c.Size+x] = true
+}
+
+func (c *Code) drawFunctionPatterns(version int) {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	positions := alignmentPositions(version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// The corners of the finders have none
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserved until the mask is known
+	c.drawFormat(0)
+	c.drawVersion(version)
+}
+
+// drawFinder draws the finder pattern centered on x, y and the
+// light separator around it
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the rows and columns alignment
+// patterns are centered on
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	}
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, 4*version+10; i > 0; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormat draws both copies of the format information, the
+// error correction level and mask
+func (c *Code) drawFormat(mask int) {
+	data := formatLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	// The dark module
+	c.set(8, c.Size-8, true)
+}
+
+// drawVersion draws both copies of the version information,
+// which versions from 7 on have
+func (c *Code) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1f25
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 == 1
+		a, b := c.Size-11+i%3, i/3
+		c.set(a, b, dark)
+		c.set(b, a, dark)
+	}
+}
+
+// drawCodewords fills the modules left, two columns at a time
+// from the right, going up and down in turn
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// The vertical timing pattern is skipped
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.function[y*c.Size+x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = data[i/8]>>uint(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules the mask selects
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.function[y*c.Size+x] {
+				c.modules[y*c.Size+x] = !c.modules[y*c.Size+x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read, following the
+// rules of the standard for choosing a mask
+func (c *Code) penalty() int {
+	p := 0
+	for i := 0; i < c.Size; i++ {
+		row := func(j int) bool { return c.Black(j, i) }
+		col := func(j int) bool { return c.Black(i, j) }
+		p += c.linePenalty(row) + c.linePenalty(col)
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			b := c.Black(x, y)
+			if b {
+				dark++
+			}
+			if x+1 < c.Size && y+1 < c.Size &&
+				b == c.Black(x+1, y) && b == c.Black(x, y+1) && b == c.Black(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+
+	total := c.Size * c.Size
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+// finderLike is the 1:1:3:1:1 pattern of the finders
+var finderLike = []bool{true, false, true, true, true, false, true}
+
+// linePenalty scores the runs of a row or column, and the
+// patterns looking like finders in it
+func (c *Code) linePenalty(at func(int) bool) int {
+	p := 0
+	run := 1
+	for j := 1; j <= c.Size; j++ {
+		if j < c.Size && at(j) == at(j-1) {
+			run++
+			continue
+		}
+		if run >= 5 {
+			p += 3 + run - 5
+		}
+		run = 1
+	}
+
+	for j := 0; j+len(finderLike) <= c.Size; j++ {
+		match := true
+		for k, dark := range finderLike {
+			if at(j+k) != dark {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for k := 1; k <= 4; k++ {
+			// Outside of the code is the light quiet zone
+			before = before && (j-k < 0 || !at(j-k))
+			after = after && (j+6+k >= c.Size || !at(j+6+k))
+		}
+		if before || after {
+			p += 40
+		}
+	}
+	return p
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package qr
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestBlocksFillTheVersion(t *testing.T) {
+	for v := minVersion; v <= maxVersion; v++ {
+		b := levelM[v]
+		total := b.dataCodewords() + (b.blocks1+b.blocks2)*b.ec
+
+		// The modules left for codewords once the patterns and
+		// the format and version information are drawn
+		size := 4*v + 17
+		c := &Code{Size: size, modules: make([]bool, size*size), function: make([]bool, size*size)}
+		c.drawFunctionPatterns(v)
+		free := 0
+		for _, f := range c.function {
+			if !f {
+				free++
+			}
+		}
+		if total != free/8 {
+			t.Errorf("version %d: %d codewords, %d fit", v, total, free/8)
+		}
+	}
+}
+
+func TestErrorCorrection(t *testing.T) {
+	// "01234567" at version 1-M, annex I of the standard
+	data := []byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11, 0xec, 0x11}
+	want := []byte{0xa5, 0x24, 0xd4, 0xc1, 0xed, 0x36, 0xc7, 0x87, 0x2c, 0x55}
+	if got := rsRemainder(data, rsDivisor(len(want))); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder() = % x, want % x", got, want)
+	}
+}
+
+func TestFormatAndVersionInformation(t *testing.T) {
+	c := encode([]byte("x"), 7, 5)
+
+	// Level M with mask 5, read from under the top left finder
+	var format int
+	for i := 14; i >= 9; i-- {
+		format = format<<1 | bit(c.Black(14-i, 8))
+	}
+	format = format<<1 | bit(c.Black(7, 8))
+	format = format<<1 | bit(c.Black(8, 8))
+	format = format<<1 | bit(c.Black(8, 7))
+	for i := 5; i >= 0; i-- {
+		format = format<<1 | bit(c.Black(8, i))
+	}
+	if want := 0x40ce; format != want {
+		t.Errorf("format information = %015b, want %015b", format, want)
+	}
+
+	// Version 7, left of the top right finder
+	var version int
+	for i := 17; i >= 0; i-- {
+		version = version<<1 | bit(c.Black(c.Size-11+i%3, i/3))
+	}
+	if want := 0x07c94; version != want {
+		t.Errorf("version information = %018b, want %018b", version, want)
+	}
+}
+
+func bit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodePicksTheSmallestVersion(t *testing.T) {
+	tests := []struct {
+		n    int
+		size int
+	}{
+		{1, 21},
+		{14, 21},
+		{15, 25},
+		{180, 53},
+		{181, 57}, // version 10 has a longer count
+		{2331, 177},
+	}
+	for _, tt := range tests {
+		c, err := Encode(strings.Repeat("a", tt.n))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tt.n, err)
+		}
+		if c.Size != tt.size {
+			t.Errorf("%d bytes: size = %d, want %d", tt.n, c.Size, tt.size)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("a", 2332)); err != ErrTooLong {
+		t.Errorf("Encode() of 2332 bytes error = %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := Encode("otpauth://totp/Tataruma:jon@example.com?secret=JBSWY3DPEHPK3PXP&issuer=Tataruma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.PNG(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size := (c.Size + 2*quietZone) * 4; img.Bounds().Dx() != size || img.Bounds().Dy() != size {
+		t.Fatalf("image is %v, want %d pixels wide", img.Bounds(), size)
+	}
+	dark := func(x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r == 0
+	}
+	for y := 0; y < c.Size+2*quietZone; y++ {
+		for x := 0; x < c.Size+2*quietZone; x++ {
+			if dark(x*4+1, y*4+2) != c.Black(x-quietZone, y-quietZone) {
+				t.Fatalf("module %d,%d of the image is wrong", x, y)
+			}
+		}
+	}
+}
@@ -10,5 +10,7 @@ cd /root/go/src/github.com/ruckuus/dojo1/ && \
     sudo service lenslocked.com stop && \
     cp dojo1 /root/app/dojo1 && \
     cp -r views /root/app/ && \
+    mkdir -p /root/app/email && \
+    cp -r email/templates /root/app/email/ && \
     cp -r public /root/app/ && \
     service lenslocked.com restart
\ No newline at end of file
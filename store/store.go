@@ -13,6 +13,9 @@ import (
 
 type StoreProvider interface {
 	Store(path, filename string, body io.Reader) (string, error)
+	// Open reads back what was stored at fullPath, the path
+	// returned by Store. The caller closes the reader.
+	Open(fullPath string) (io.ReadCloser, error)
 	Delete(fullPath string) error
 }
 
@@ -54,6 +57,10 @@ func (fss *fsStore) Store(path, filename string, body io.Reader) (string, error)
 	return fullPath, nil
 }
 
+func (fss *fsStore) Open(fullPath string) (io.ReadCloser, error) {
+	return os.Open(fullPath)
+}
+
 func (fss *fsStore) Delete(fullPath string) error {
 	return os.Remove(fullPath)
 }
@@ -81,6 +88,17 @@ func (s3s *s3Store) Store(path, filename string, body io.Reader) (string, error)
 	return fullPath, nil
 }
 
+func (s3s *s3Store) Open(fullPath string) (io.ReadCloser, error) {
+	out, err := s3.New(s3s.AWSSession).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3s.S3Bucket),
+		Key:    aws.String(fullPath),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
 func (s3s *s3Store) Delete(fullPath string) error {
 	batcher := s3manager.NewBatchDelete(s3s.AWSSession)
 	objects := []s3manager.BatchDeleteObject{
@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 Appendix B, the ASCII
+// string "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// The test vectors of RFC 6238 Appendix B for SHA1. The RFC
+// lists 8 digit codes, ours are their last Digits digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		got, err := Code(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", v.unix, err)
+		}
+		if want := v.code[len(v.code)-Digits:]; got != want {
+			t.Errorf("Code(%d) = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestValidateRFC6238(t *testing.T) {
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		step, ok := Validate(rfcSecret, v.code[len(v.code)-Digits:], at)
+		if !ok {
+			t.Errorf("Validate(%d) rejected the code", v.unix)
+			continue
+		}
+		if step != Step(at) {
+			t.Errorf("Validate(%d) step = %d, want %d", v.unix, step, Step(at))
+		}
+	}
+}
+
+func TestValidateWindow(t *testing.T) {
+	at := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		shift int64
+		ok    bool
+	}{
+		{"same step", 0, true},
+		{"one step later", 1, true},
+		{"one step earlier", -1, true},
+		{"two steps later", 2, false},
+		{"two steps earlier", -2, false},
+	}
+	for _, c := range cases {
+		now := at.Add(time.Duration(c.shift*Period) * time.Second)
+		step, ok := Validate(rfcSecret, code, now)
+		if ok != c.ok {
+			t.Errorf("%s: ok = %v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if ok && step != Step(at) {
+			t.Errorf("%s: step = %d, want the step of the code, %d", c.name, step, Step(at))
+		}
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := Validate(rfcSecret, code, at); ok {
+			t.Errorf("Validate accepted %q", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "287082", at); ok {
+		t.Error("Validate accepted a code for a malformed secret")
+	}
+	if _, ok := Validate(rfcSecret, "287 082", at); !ok {
+		t.Error("Validate rejected a code with a space")
+	}
+}
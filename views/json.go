@@ -0,0 +1,35 @@
+package views
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// ErrorBody is the body of the error responses of the API
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail says what went wrong, Message is written for the
+// user like the alerts of the HTML pages
+type ErrorDetail struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// RenderJSON writes v as the JSON body of a response with status
+func RenderJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// RenderJSONError writes an error response of the API
+func RenderJSONError(w http.ResponseWriter, status int, message string) {
+	RenderJSON(w, status, &ErrorBody{
+		Error: ErrorDetail{Status: status, Message: message},
+	})
+}
@@ -33,6 +33,17 @@ type Data struct {
 	Alert *Alert
 	Yield interface{}
 	User  *models.User
+
+	// Organization is the one the user works in, Organizations
+	// the ones they can switch to.
+	Organization  *models.Organization
+	Organizations []models.Organization
+
+	// Impersonator is the operator acting as User, if any
+	Impersonator *models.User
+
+	// Unread is how many notifications User hasn't read
+	Unread int
 }
 
 type Alert struct {
@@ -130,6 +141,10 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	}
 
 	vd.User = context.User(r.Context())
+	vd.Organization = context.Organization(r.Context())
+	vd.Organizations = context.Organizations(r.Context())
+	vd.Impersonator = context.Impersonator(r.Context())
+	vd.Unread = context.Unread(r.Context())
 	var buf bytes.Buffer
 
 	// actual implementation of csrfField
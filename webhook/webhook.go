@@ -0,0 +1,142 @@
+// Package webhook posts the events of an organization, such as
+// a property being created or a payment being recorded, to the
+// webhook endpoints it set up. Events are queued as deliveries
+// by a Dispatcher and posted in the background by a Worker,
+// which retries them with backoff. Every request is signed with
+// the secret of its endpoint, see Sign.
+package webhook
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"github.com/ruckuus/dojo1/hash"
+	"github.com/ruckuus/dojo1/models"
+	"github.com/ruckuus/dojo1/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of the requests posting events
+const (
+	HeaderEvent     = "Tataruma-Event"
+	HeaderEventID   = "Tataruma-Event-Id"
+	HeaderDelivery  = "Tataruma-Delivery"
+	HeaderSignature = "Tataruma-Signature"
+)
+
+// eventIDBytes is how many random bytes event IDs have
+const eventIDBytes = 18
+
+var (
+	ErrSignatureMalformed = errors.New("webhook: signature header is malformed")
+	ErrSignatureInvalid   = errors.New("webhook: signature does not match the body")
+	ErrSignatureExpired   = errors.New("webhook: signature is too old")
+)
+
+// Event is the body of the requests posting events. Data is the
+// thing the event is about, as the JSON API shows it.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt string      `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Dispatcher queues events for the endpoints subscribed to them
+type Dispatcher struct {
+	services *models.Services
+}
+
+func NewDispatcher(services *models.Services) *Dispatcher {
+	return &Dispatcher{services: services}
+}
+
+// Emit queues event, about data, for every enabled endpoint of
+// the organization subscribed to it. Nothing is queued when
+// there is none.
+func (d *Dispatcher) Emit(orgID uint, event string, data interface{}) error {
+	endpoints, err := d.services.Webhook.Subscribed(orgID, event)
+	if err != nil || len(endpoints) == 0 {
+		return err
+	}
+
+	id, err := rand.String(eventIDBytes)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&Event{
+		ID:        "evt_" + id,
+		Type:      event,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.services.Transaction(func(tx *models.Services) error {
+		for _, e := range endpoints {
+			err := tx.Delivery.Enqueue(&models.WebhookDelivery{
+				EndpointID: e.ID,
+				EventID:    "evt_" + id,
+				Event:      event,
+				Payload:    string(payload),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sign returns the signature header of body posted at t with
+// secret, e.g. "t=1700000000,v1=<mac>". The MAC is the
+// HMAC-SHA256 of the timestamp, a dot and the body, base64url
+// encoded, so a request can't be replayed later on with a new
+// timestamp.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, body)
+}
+
+// Verify checks the signature header of body, as receivers do.
+// Signatures older than tolerance are rejected, unless it is 0.
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var macs []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrSignatureMalformed
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			macs = append(macs, kv[1])
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(macs) == 0 {
+		return ErrSignatureMalformed
+	}
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return ErrSignatureExpired
+	}
+
+	// Any of the v1 signatures of the header will do
+	expected := signature(secret, ts, body)
+	for _, mac := range macs {
+		if hmac.Equal([]byte(mac), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrSignatureInvalid
+}
+
+func signature(secret, ts string, body []byte) string {
+	return hash.NewHMAC(secret).Hash(ts + "." + string(body))
+}
@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ruckuus/dojo1/models"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// pollInterval is how often due deliveries are looked for
+	pollInterval = 10 * time.Second
+
+	// batchSize is how many deliveries are posted per poll
+	batchSize = 50
+
+	// timeout is how long an endpoint has to answer
+	timeout = 10 * time.Second
+
+	// keepDeliveries is how long deliveries are listed in the
+	// delivery log before they are removed
+	keepDeliveries = 30 * 24 * time.Hour
+
+	// maxResponseBody is how much of the response is read, so
+	// the connection can be reused
+	maxResponseBody = 64 << 10
+
+	userAgent = "Tataruma-Webhooks/1"
+)
+
+// ErrAddressNotAllowed is the error of the deliveries to hosts
+// resolving to addresses of ours, see models.WebhookIPAllowed
+var ErrAddressNotAllowed = errors.New("webhook: the endpoint resolves to an address that is not public")
+
+// Worker posts the queued deliveries. Only one worker may run
+// at a time.
+type Worker struct {
+	endpoints  models.WebhookEndpointService
+	deliveries models.WebhookDeliveryService
+	client     *http.Client
+
+	// allowIP tells which addresses may be connected to
+	allowIP func(net.IP) bool
+}
+
+func NewWorker(endpoints models.WebhookEndpointService, deliveries models.WebhookDeliveryService) *Worker {
+	w := &Worker{
+		endpoints:  endpoints,
+		deliveries: deliveries,
+		allowIP:    models.WebhookIPAllowed,
+	}
+
+	// The address is checked once resolved, as the host of an
+	// endpoint may resolve to another one than when it was saved.
+	// Proxies would connect on our behalf, they are not used.
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !w.allowIP(ip) {
+				return ErrAddressNotAllowed
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	w.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		// An endpoint redirecting us is misconfigured, and
+		// following it would turn the POST into a GET
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return w
+}
+
+// Run posts deliveries forever, it is meant to be started in
+// its own goroutine.
+func (w *Worker) Run() {
+	for {
+		w.PostDue()
+		if err := w.deliveries.DeleteBefore(time.Now().Add(-keepDeliveries)); err != nil {
+			log.Println(err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// PostDue posts the deliveries that are due now
+func (w *Worker) PostDue() {
+	deliveries, err := w.deliveries.Due(time.Now(), batchSize)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for i := range deliveries {
+		if err := w.post(&deliveries[i]); err != nil {
+			log.Printf("webhook delivery %d: %v", deliveries[i].ID, err)
+		}
+	}
+}
+
+// post posts d to its endpoint, and records how it went on both.
+// The error of a failed delivery is returned once recorded.
+func (w *Worker) post(d *models.WebhookDelivery) error {
+	endpoint, err := w.endpoints.ByID(d.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	status, err := w.send(endpoint, d)
+	if err != nil {
+		if err := w.deliveries.Failed(d, status, err); err != nil {
+			return err
+		}
+		if err := w.endpoints.Failed(endpoint); err != nil {
+			return err
+		}
+		return err
+	}
+	if err := w.deliveries.Delivered(d, status); err != nil {
+		return err
+	}
+	return w.endpoints.Succeeded(endpoint)
+}
+
+// send makes the request posting d to e, and returns the status
+// it was answered with. Only 2xx statuses are a success.
+func (w *Worker) send(e *models.WebhookEndpoint, d *models.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderEventID, d.EventID)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set(HeaderSignature, Sign(e.Secret, time.Now(), body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxResponseBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook: endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,248 @@
+package webhook
+
+import (
+	"errors"
+	"github.com/ruckuus/dojo1/models"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_test"
+
+type memEndpoints struct {
+	models.WebhookEndpointService
+	endpoint  models.WebhookEndpoint
+	failed    int
+	succeeded int
+}
+
+func (me *memEndpoints) ByID(id uint) (*models.WebhookEndpoint, error) {
+	if id != me.endpoint.ID {
+		return nil, models.ErrNotFound
+	}
+	e := me.endpoint
+	return &e, nil
+}
+
+func (me *memEndpoints) Failed(e *models.WebhookEndpoint) error {
+	me.failed++
+	return nil
+}
+
+func (me *memEndpoints) Succeeded(e *models.WebhookEndpoint) error {
+	me.succeeded++
+	return nil
+}
+
+// memDeliveries keeps one delivery, due until it went through
+type memDeliveries struct {
+	models.WebhookDeliveryService
+	delivery models.WebhookDelivery
+	errs     []error
+	statuses []int
+}
+
+func (md *memDeliveries) Due(t time.Time, limit int) ([]models.WebhookDelivery, error) {
+	if md.delivery.Status != models.WebhookQueued {
+		return nil, nil
+	}
+	return []models.WebhookDelivery{md.delivery}, nil
+}
+
+func (md *memDeliveries) Delivered(d *models.WebhookDelivery, status int) error {
+	d.Attempts++
+	d.Status = models.WebhookDelivered
+	md.delivery = *d
+	md.statuses = append(md.statuses, status)
+	return nil
+}
+
+func (md *memDeliveries) Failed(d *models.WebhookDelivery, status int, err error) error {
+	d.Attempts++
+	md.delivery = *d
+	md.statuses = append(md.statuses, status)
+	md.errs = append(md.errs, err)
+	return nil
+}
+
+// newTestWorker returns a worker posting a delivery to a
+// receiver answering with handler
+func newTestWorker(t *testing.T, handler http.HandlerFunc) (*Worker, *memEndpoints, *memDeliveries) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	endpoints := &memEndpoints{endpoint: models.WebhookEndpoint{
+		URL:    srv.URL + "/hooks",
+		Events: models.EventPropertyCreated,
+		Secret: testSecret,
+	}}
+	endpoints.endpoint.ID = 1
+	deliveries := &memDeliveries{delivery: models.WebhookDelivery{
+		EndpointID: 1,
+		EventID:    "evt_1",
+		Event:      models.EventPropertyCreated,
+		Payload:    `{"id":"evt_1","type":"property.created","data":{"id":1}}`,
+		Status:     models.WebhookQueued,
+	}}
+	deliveries.delivery.ID = 7
+
+	w := NewWorker(endpoints, deliveries)
+	// The receiver listens on the loopback interface
+	w.allowIP = func(net.IP) bool { return true }
+	return w, endpoints, deliveries
+}
+
+func TestWorkerSignsDeliveries(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	w, endpoints, deliveries := newTestWorker(t, func(rw http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusNoContent)
+	})
+
+	w.PostDue()
+
+	if got == nil {
+		t.Fatal("the receiver got nothing")
+	}
+	if got.Method != http.MethodPost || got.URL.Path != "/hooks" {
+		t.Errorf("got %s %s", got.Method, got.URL.Path)
+	}
+	if string(body) != deliveries.delivery.Payload {
+		t.Errorf("body = %s", body)
+	}
+	if err := Verify(testSecret, got.Header.Get(HeaderSignature), body, time.Minute); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	if err := Verify("whsec_other", got.Header.Get(HeaderSignature), body, time.Minute); err != ErrSignatureInvalid {
+		t.Errorf("Verify() with another secret error = %v, want %v", err, ErrSignatureInvalid)
+	}
+	headers := map[string]string{
+		HeaderEvent:    models.EventPropertyCreated,
+		HeaderEventID:  "evt_1",
+		HeaderDelivery: "7",
+		"Content-Type": "application/json",
+	}
+	for name, want := range headers {
+		if got := got.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	if deliveries.delivery.Status != models.WebhookDelivered || len(deliveries.statuses) != 1 || deliveries.statuses[0] != http.StatusNoContent {
+		t.Errorf("delivery = %+v, statuses %v", deliveries.delivery, deliveries.statuses)
+	}
+	if endpoints.succeeded != 1 || endpoints.failed != 0 {
+		t.Errorf("endpoint succeeded %d and failed %d times", endpoints.succeeded, endpoints.failed)
+	}
+}
+
+func TestWorkerRetriesFailedDeliveries(t *testing.T) {
+	var eventIDs []string
+	w, endpoints, deliveries := newTestWorker(t, func(rw http.ResponseWriter, r *http.Request) {
+		eventIDs = append(eventIDs, r.Header.Get(HeaderEventID))
+		if len(eventIDs) == 1 {
+			http.Error(rw, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	deliveries.delivery.NextAttemptAt = time.Now()
+	if err := w.post(&deliveries.delivery); err == nil {
+		t.Error("post() of a rejected delivery returned no error")
+	}
+	if deliveries.delivery.Status != models.WebhookQueued || endpoints.failed != 1 {
+		t.Fatalf("after a 503: delivery = %+v, endpoint failed %d times", deliveries.delivery, endpoints.failed)
+	}
+	if len(deliveries.errs) != 1 || deliveries.statuses[0] != http.StatusServiceUnavailable {
+		t.Errorf("recorded %v with %v", deliveries.statuses, deliveries.errs)
+	}
+
+	w.PostDue()
+
+	if deliveries.delivery.Status != models.WebhookDelivered || deliveries.delivery.Attempts != 2 {
+		t.Errorf("after the retry: delivery = %+v", deliveries.delivery)
+	}
+	if len(eventIDs) != 2 || eventIDs[0] != eventIDs[1] {
+		t.Errorf("event IDs = %v, the retry must carry the same", eventIDs)
+	}
+	if endpoints.succeeded != 1 {
+		t.Errorf("endpoint succeeded %d times, want 1", endpoints.succeeded)
+	}
+}
+
+func TestWorkerDoesNotFollowRedirects(t *testing.T) {
+	redirected := false
+	w, _, deliveries := newTestWorker(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/elsewhere" {
+			redirected = true
+			return
+		}
+		http.Redirect(rw, r, "/elsewhere", http.StatusFound)
+	})
+
+	w.PostDue()
+
+	if redirected {
+		t.Error("the redirect was followed")
+	}
+	if len(deliveries.statuses) != 1 || deliveries.statuses[0] != http.StatusFound {
+		t.Errorf("statuses = %v, want the redirect recorded as a failure", deliveries.statuses)
+	}
+}
+
+func TestWorkerRefusesPrivateAddresses(t *testing.T) {
+	received := false
+	w, endpoints, deliveries := newTestWorker(t, func(rw http.ResponseWriter, r *http.Request) {
+		received = true
+	})
+	w.allowIP = models.WebhookIPAllowed
+
+	w.PostDue()
+
+	if received {
+		t.Fatal("posted to a loopback address")
+	}
+	if len(deliveries.errs) != 1 || !errors.Is(deliveries.errs[0], ErrAddressNotAllowed) {
+		t.Errorf("errors = %v, want %v", deliveries.errs, ErrAddressNotAllowed)
+	}
+	if deliveries.statuses[0] != 0 || endpoints.failed != 1 {
+		t.Errorf("status = %d, endpoint failed %d times", deliveries.statuses[0], endpoints.failed)
+	}
+}
+
+func TestVerifyRefusesReplays(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	old := Sign(testSecret, time.Now().Add(-10*time.Minute), body)
+
+	if err := Verify(testSecret, old, body, 5*time.Minute); err != ErrSignatureExpired {
+		t.Errorf("Verify() of an old signature error = %v, want %v", err, ErrSignatureExpired)
+	}
+	if err := Verify(testSecret, old, body, 0); err != nil {
+		t.Errorf("Verify() without tolerance error = %v", err)
+	}
+
+	// The timestamp is signed, a fresh one with the old MAC fails
+	mac := old[strings.Index(old, ",v1="):]
+	fresh := "t=" + strconv.FormatInt(time.Now().Unix(), 10) + mac
+	if err := Verify(testSecret, fresh, body, 5*time.Minute); err != ErrSignatureInvalid {
+		t.Errorf("Verify() with a new timestamp error = %v, want %v", err, ErrSignatureInvalid)
+	}
+
+	current := Sign(testSecret, time.Now(), body)
+	if err := Verify(testSecret, current, []byte(`{"id":"evt_2"}`), 5*time.Minute); err != ErrSignatureInvalid {
+		t.Errorf("Verify() of another body error = %v, want %v", err, ErrSignatureInvalid)
+	}
+	if err := Verify(testSecret, "v1=abc", body, 5*time.Minute); err != ErrSignatureMalformed {
+		t.Errorf("Verify() without timestamp error = %v, want %v", err, ErrSignatureMalformed)
+	}
+}